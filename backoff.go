@@ -0,0 +1,62 @@
+package mesh
+
+import (
+	"fmt"
+	"time"
+)
+
+// ConnectionBackoffs returns, for each address we are waiting to retry
+// after failing to connect, when we next will. The zero time means
+// never, e.g. after connecting to ourself.
+func (router *Router) ConnectionBackoffs() map[string]time.Time {
+	return router.ConnectionMaker.backoffs()
+}
+
+// ResetBackoff retries connecting to the named peer straight away, at
+// each address we are backing off from at which we know it, e.g. once
+// something outside the mesh tells us it has recovered. We know a peer
+// at an address if we last connected to it there, or if others reach it
+// there. It is an error if there is no such address.
+func (router *Router) ResetBackoff(peer PeerName) error {
+	if !router.ConnectionMaker.resetBackoff(peer) {
+		return fmt.Errorf("not backing off from %s", peer)
+	}
+	return nil
+}
+
+func (cm *connectionMaker) backoffs() map[string]time.Time {
+	resultChan := make(chan map[string]time.Time)
+	cm.actionChan <- func() bool {
+		backoffs := make(map[string]time.Time)
+		for address, target := range cm.targets {
+			if target.state == targetWaiting {
+				backoffs[address] = target.tryAfter
+			}
+		}
+		resultChan <- backoffs
+		return false
+	}
+	return <-resultChan
+}
+
+// resetBackoff retries the waiting targets at which we know peer now,
+// reporting whether there were any.
+func (cm *connectionMaker) resetBackoff(peer PeerName) bool {
+	resultChan := make(chan bool)
+	cm.actionChan <- func() bool {
+		found := false
+		for address, target := range cm.targets {
+			if target.state != targetWaiting {
+				continue
+			}
+			if target.remote == peer || cm.peerAt(address) == peer {
+				target.nextTryNow(cm.now())
+				found = true
+			}
+		}
+		cm.urgent = found
+		resultChan <- found
+		return found
+	}
+	return <-resultChan
+}
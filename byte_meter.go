@@ -0,0 +1,64 @@
+package mesh
+
+import (
+	"sync"
+	"time"
+)
+
+// byteRateWindow is the number of seconds over which byteMeter reports
+// throughput.
+const byteRateWindow = 10
+
+// byteMeter counts the bytes passing over a connection, cumulatively and
+// per second in a ring of buckets: one for each second of the window,
+// plus one for the second in progress. It is safe for concurrent use.
+type byteMeter struct {
+	sync.Mutex
+	total   uint64
+	buckets [byteRateWindow + 1]uint64
+	second  int64 // unix second counted in the latest bucket
+}
+
+// add counts n bytes at time t.
+func (m *byteMeter) add(n int, t time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	m.advance(t.Unix())
+	m.total += uint64(n)
+	m.buckets[m.bucket(m.second)] += uint64(n)
+}
+
+func (m *byteMeter) bucket(second int64) int {
+	return int(second % int64(len(m.buckets)))
+}
+
+// advance moves the latest bucket on to second, emptying those it passes.
+// Must hold m.Lock.
+func (m *byteMeter) advance(second int64) {
+	if second <= m.second {
+		return
+	}
+	if second-m.second >= int64(len(m.buckets)) {
+		m.buckets = [byteRateWindow + 1]uint64{}
+	} else {
+		for s := m.second + 1; s <= second; s++ {
+			m.buckets[m.bucket(s)] = 0
+		}
+	}
+	m.second = second
+}
+
+// read returns the total bytes counted, and the rate in bytes per second
+// over the byteRateWindow whole seconds before t.
+func (m *byteMeter) read(t time.Time) (total uint64, rate float64) {
+	m.Lock()
+	defer m.Unlock()
+	m.advance(t.Unix())
+	var sum uint64
+	for i, n := range m.buckets {
+		if i != m.bucket(m.second) {
+			sum += n
+		}
+	}
+	return m.total, float64(sum) / byteRateWindow
+}
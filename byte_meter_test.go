@@ -0,0 +1,30 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestByteMeterRate(t *testing.T) {
+	var m byteMeter
+	start := time.Unix(1000000, 0)
+	tm := start
+	// A steady 10000 bytes per second, in 1000 byte messages
+	for ; tm.Before(start.Add(30 * time.Second)); tm = tm.Add(100 * time.Millisecond) {
+		m.add(1000, tm)
+		total, rate := m.read(tm)
+		require.Equal(t, uint64(tm.Sub(start)/(100*time.Millisecond)+1)*1000, total)
+		if tm.Sub(start) > byteRateWindow*time.Second {
+			require.InEpsilon(t, 10000, rate, 0.05)
+		}
+	}
+
+	// Idle for half the window, then for longer than the window
+	_, rate := m.read(tm.Add(byteRateWindow * time.Second / 2))
+	require.InEpsilon(t, 5000, rate, 0.1)
+	total, rate := m.read(tm.Add(2 * byteRateWindow * time.Second))
+	require.Equal(t, uint64(300000), total)
+	require.Zero(t, rate)
+}
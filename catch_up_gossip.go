@@ -0,0 +1,53 @@
+package mesh
+
+import "time"
+
+// catchUpGossip schedules the extra rounds of gossip down a newly
+// established connection. See Config.CatchUpGossipPeriod.
+type catchUpGossip struct {
+	timer    *time.Timer
+	interval time.Duration
+	until    time.Time
+}
+
+// newCatchUpGossip starts the schedule of catch-up gossip for a new
+// connection, returning nil if there is to be none.
+func (router *Router) newCatchUpGossip() *catchUpGossip {
+	if router.CatchUpGossipPeriod <= 0 || router.CatchUpGossipInterval <= 0 {
+		return nil
+	}
+	return &catchUpGossip{
+		timer:    time.NewTimer(router.CatchUpGossipInterval),
+		interval: router.CatchUpGossipInterval,
+		until:    time.Now().Add(router.CatchUpGossipPeriod),
+	}
+}
+
+// C fires when the next round is due, and never once the period is
+// over.
+func (c *catchUpGossip) C() <-chan time.Time {
+	if c == nil {
+		return nil
+	}
+	return c.timer.C
+}
+
+// next schedules the round after the one just sent, doubling the
+// interval, up to steady, so that gossip tapers off towards the normal
+// rate. It reports false once the period is over.
+func (c *catchUpGossip) next(steady time.Duration) bool {
+	if c.interval *= 2; c.interval > steady {
+		c.interval = steady
+	}
+	if time.Now().Add(c.interval).After(c.until) {
+		return false
+	}
+	c.timer.Reset(c.interval)
+	return true
+}
+
+func (c *catchUpGossip) stop() {
+	if c != nil {
+		c.timer.Stop()
+	}
+}
@@ -0,0 +1,57 @@
+package mesh
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// roundCountingGossiper counts the rounds of periodic gossip it receives.
+type roundCountingGossiper struct {
+	*testGossiper
+	rounds int32
+}
+
+func (g *roundCountingGossiper) OnGossip(update []byte) (GossipData, error) {
+	atomic.AddInt32(&g.rounds, 1)
+	return g.testGossiper.OnGossip(update)
+}
+
+func TestCatchUpGossip(t *testing.T) {
+	steady := time.Hour
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{
+		GossipInterval:        &steady,
+		CatchUpGossipPeriod:   400 * time.Millisecond,
+		CatchUpGossipInterval: 25 * time.Millisecond,
+	})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{GossipInterval: &steady})
+	defer r1.Stop()
+	defer r2.Stop()
+	g1 := newTestGossiper()
+	_, err := r1.NewGossip("Test", g1)
+	require.NoError(t, err)
+	_, err = g1.OnGossip([]byte{1})
+	require.NoError(t, err)
+	g2 := &roundCountingGossiper{testGossiper: newTestGossiper()}
+	_, err = r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+
+	connectTCPTestRouters(r2, r1)
+	awaitEstablished(t, r1, r2)
+	joined := time.Now()
+
+	// Besides the gossip on connecting, rounds follow after 25ms, 75ms,
+	// 175ms and 375ms, tapering off within the period
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&g2.rounds) >= 5 }, 2*time.Second, 5*time.Millisecond)
+	require.True(t, time.Since(joined) < time.Second)
+	g2.checkHas(t, 1)
+
+	// after which it is back to the steady rate, of none in this test
+	time.Sleep(500 * time.Millisecond)
+	rounds := atomic.LoadInt32(&g2.rounds)
+	time.Sleep(500 * time.Millisecond)
+	require.Equal(t, rounds, atomic.LoadInt32(&g2.rounds))
+	require.True(t, rounds <= 5, "%d rounds", rounds)
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,6 +18,7 @@ type Connection interface {
 	remoteTCPAddress() string
 	isOutbound() bool
 	isEstablished() bool
+	routeCost() float64
 }
 
 type ourConnection interface {
@@ -34,6 +37,7 @@ type remoteConnection struct {
 	remoteTCPAddr string
 	outbound      bool
 	established   bool
+	cost          float64 // as advertised; zero means 1, see Router.SetConnectionCost
 }
 
 func newRemoteConnection(from, to *Peer, tcpAddr string, outbound bool, established bool) *remoteConnection {
@@ -56,17 +60,39 @@ func (conn *remoteConnection) isOutbound() bool { return conn.outbound }
 
 func (conn *remoteConnection) isEstablished() bool { return conn.established }
 
+func (conn *remoteConnection) routeCost() float64 {
+	if conn.cost > 0 {
+		return conn.cost
+	}
+	return 1
+}
+
 // LocalConnection is the local (our) side of a connection.
 // It implements ProtocolSender, and manages per-channel GossipSenders.
 type LocalConnection struct {
 	OverlayConn OverlayConnection
 
 	remoteConnection
-	tcpConn         *net.TCPConn
-	trustRemote     bool // is remote on a trusted subnet?
-	trustedByRemote bool // does remote trust us?
+	remoteLabel     string         // remote, as introduced, for logging; its nickname may change later
+	tcpConn         net.Conn       // over Config.Transport; TCP by default
+	peeked          []byte         // read from tcpConn before the intro; see acceptRelayable
+	handshake       handshakeTimer // see Handshake
+	catchUp         *catchUpGossip // nil outside the catch-up period; see Config.CatchUpGossipPeriod
+	trustRemote     bool           // is remote on a trusted subnet?
+	trustedByRemote bool           // does remote trust us?
 	version         byte
 	tcpSender       tcpSender
+	frameOverhead   int               // bytes added to each message by the protocol
+	compactGossip   bool              // does remote accept compact gossip frames?
+	dictionaries    map[string][]byte // gossip dictionaries shared with remote, by channel
+	gossipCodec     gossipCodec       // negotiated; see Config.GossipCodecs
+	remoteTenant    string            // see Config.Tenant
+	pings           bool              // does remote answer ProtocolPing?
+	rtt             int64             // atomic; smoothed round-trip time in nanoseconds
+	bytesSent       byteMeter
+	bytesReceived   byteMeter
+	quiesceLock     sync.Mutex    // guards resumed, and established, read by isEstablished from any goroutine
+	resumed         chan struct{} // non-nil while quiesced; closed on resume
 	sessionKey      *[32]byte
 	heartbeatTCP    *time.Ticker
 	router          *Router
@@ -78,8 +104,9 @@ type LocalConnection struct {
 }
 
 // If the connection is successful, it will end up in the local peer's
-// connections map.
-func startLocalConnection(connRemote *remoteConnection, tcpConn *net.TCPConn, router *Router, acceptNewPeer bool, logger Logger) {
+// connections map. Any bytes already read from tcpConn are in peeked. If
+// we made tcpConn, doing so took dialled.
+func startLocalConnection(connRemote *remoteConnection, tcpConn net.Conn, peeked []byte, dialled time.Duration, router *Router, acceptNewPeer bool, logger Logger) {
 	if connRemote.local != router.Ourself.Peer {
 		panic("attempt to create local connection from a peer which is not ourself")
 	}
@@ -89,6 +116,7 @@ func startLocalConnection(connRemote *remoteConnection, tcpConn *net.TCPConn, ro
 		remoteConnection: *connRemote, // NB, we're taking a copy of connRemote here.
 		router:           router,
 		tcpConn:          tcpConn,
+		peeked:           peeked,
 		trustRemote:      router.trusts(connRemote),
 		uid:              randUint64(),
 		errorChan:        errorChan,
@@ -96,11 +124,33 @@ func startLocalConnection(connRemote *remoteConnection, tcpConn *net.TCPConn, ro
 		logger:           logger,
 	}
 	conn.senders = newGossipSenders(conn, finished)
-	go conn.run(errorChan, finished, acceptNewPeer)
+	if router.MaxPendingGossip > 0 {
+		conn.senders.limit(router.MaxPendingGossip, router.GossipOverflow, router.ChannelGossipOverflow, conn.shutdown)
+	}
+	if router.ChannelWeights != nil {
+		conn.senders.schedule(router.ChannelWeights)
+	}
+	if router.DebugMergeValidation {
+		conn.senders.validateMerges(router.mergeValidator)
+	}
+	if router.MaxGossipBatch > 0 {
+		conn.senders.batch(router.MaxGossipBatch)
+	}
+	if router.BroadcastRetention != nil {
+		conn.senders.retain(router.BroadcastRetention)
+	}
+	if router.gossipBytes != nil {
+		conn.senders.throttle(router.gossipBytes)
+	}
+	if router.mergeSlots != nil {
+		conn.senders.limitMerges(router.mergeSlots)
+	}
+	conn.senders.reportDrops(router.noteGossipDrop)
+	router.goroutines.spawn(func() { conn.run(errorChan, finished, acceptNewPeer, dialled) })
 }
 
 func (conn *LocalConnection) logf(format string, args ...interface{}) {
-	format = "->[" + conn.remoteTCPAddr + "|" + conn.remote.String() + "]: " + format
+	format = "->[" + conn.remoteTCPAddr + "|" + conn.remoteLabel + "]: " + format
 	conn.logger.Printf(format, args...)
 }
 
@@ -116,14 +166,66 @@ func (conn *LocalConnection) breakTie(dupConn ourConnection) connectionTieBreak
 	return tieBreakTied
 }
 
-// Established returns true if the connection is established.
-// TODO(pb): data race?
+// Established returns true if the connection is established and not
+// quiesced.
 func (conn *LocalConnection) isEstablished() bool {
-	return conn.established
+	conn.quiesceLock.Lock()
+	defer conn.quiesceLock.Unlock()
+	return conn.established && conn.resumed == nil
+}
+
+// quiesce pauses reading from and sending gossip over the connection,
+// without closing it, returning false if it was already quiesced.
+func (conn *LocalConnection) quiesce() bool {
+	conn.quiesceLock.Lock()
+	defer conn.quiesceLock.Unlock()
+	if conn.resumed != nil {
+		return false
+	}
+	conn.resumed = make(chan struct{})
+	return true
+}
+
+// resume undoes quiesce, returning false if the connection was not
+// quiesced.
+func (conn *LocalConnection) resume() bool {
+	conn.quiesceLock.Lock()
+	defer conn.quiesceLock.Unlock()
+	if conn.resumed == nil {
+		return false
+	}
+	close(conn.resumed)
+	conn.resumed = nil
+	return true
+}
+
+func (conn *LocalConnection) isQuiesced() bool {
+	conn.quiesceLock.Lock()
+	defer conn.quiesceLock.Unlock()
+	return conn.resumed != nil
+}
+
+// awaitResume waits while the connection is quiesced, unless it finishes.
+func (conn *LocalConnection) awaitResume() {
+	conn.quiesceLock.Lock()
+	resumed := conn.resumed
+	conn.quiesceLock.Unlock()
+	if resumed != nil {
+		select {
+		case <-resumed:
+		case <-conn.finished:
+		}
+	}
 }
 
-// SendProtocolMsg implements ProtocolSender.
+// SendProtocolMsg implements ProtocolSender. It waits while the
+// connection is quiesced.
 func (conn *LocalConnection) SendProtocolMsg(m protocolMsg) error {
+	conn.awaitResume()
+	m, err := conn.gossipFraming(m)
+	if err != nil {
+		return err
+	}
 	if err := conn.sendProtocolMsg(m); err != nil {
 		conn.shutdown(err)
 		return err
@@ -131,6 +233,30 @@ func (conn *LocalConnection) SendProtocolMsg(m protocolMsg) error {
 	return nil
 }
 
+// gossipFraming converts gossip to the framing the remote accepts, which
+// may differ from that of the peer we are relaying it from.
+func (conn *LocalConnection) gossipFraming(m protocolMsg) (protocolMsg, error) {
+	if conn.gossipCodec == gossipCodecBinary {
+		return binaryGossipMsg(m)
+	}
+	if _, compact := expandedTag(m.tag); compact && !conn.compactGossip {
+		return expandGossipMsg(m)
+	} else if _, found := compactTags[m.tag]; found && conn.compactGossip {
+		return compactGossipMsg(m)
+	}
+	return m, nil
+}
+
+func (conn *LocalConnection) acceptsCompactGossip() bool {
+	return conn.compactGossip
+}
+
+// gossipDictionary returns the dictionary with which gossip on the named
+// channel is compressed over this connection, if any.
+func (conn *LocalConnection) gossipDictionary(channelName string) []byte {
+	return conn.dictionaries[channelName]
+}
+
 func (conn *LocalConnection) gossipSenders() *gossipSenders {
 	return conn.senders
 }
@@ -157,36 +283,78 @@ func (conn *LocalConnection) shutdown(err error) {
 
 // ACTOR server
 
-func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{}, acceptNewPeer bool) {
+func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{}, acceptNewPeer bool, dialled time.Duration) {
 	var err error // important to use this var and not create another one with 'err :='
 	defer func() { conn.teardown(err) }()
 	defer close(finished)
+	conn.startHandshake(dialled)
+
+	if tcpConn, ok := conn.tcpConn.(*net.TCPConn); ok {
+		if err = tcpConn.SetLinger(0); err != nil {
+			return
+		}
+		if conn.router.DSCP != 0 {
+			// QoS marking is best effort; carry on without it
+			if dscpErr := setDSCP(tcpConn, conn.router.DSCP); dscpErr != nil {
+				conn.logger.Printf("->[%s] unable to set DSCP: %v", conn.remoteTCPAddr, dscpErr)
+			}
+		}
+	}
 
-	if err = conn.tcpConn.SetLinger(0); err != nil {
+	password, err := conn.router.password()
+	if err != nil {
 		return
 	}
 
+	var introConn protocolIntroConn = conn.tcpConn
+	if conn.peeked != nil {
+		introConn = &peekedConn{conn.tcpConn, conn.peeked}
+	}
 	intro, err := protocolIntroParams{
-		MinVersion: conn.router.ProtocolMinVersion,
-		MaxVersion: ProtocolMaxVersion,
-		Features:   conn.makeFeatures(),
-		Conn:       conn.tcpConn,
-		Password:   conn.router.Password,
-		Outbound:   conn.outbound,
+		MinVersion:  conn.router.ProtocolMinVersion,
+		MaxVersion:  ProtocolMaxVersion,
+		Features:    conn.makeFeatures(),
+		Conn:        introConn,
+		Password:    password,
+		Outbound:    conn.outbound,
+		CipherSuite: conn.router.CipherSuite,
+		Framer:      conn.router.Framer,
+		OnHeader:    func() { conn.handshakePhaseDone(HandshakeVersion) },
 	}.doIntro()
+	if err == errExpectedCrypto || err == errExpectedNoCrypto {
+		conn.router.noteEncryptionMismatch(conn.remoteTCPAddr, err)
+	}
+	if _, nonMesh := err.(nonMeshError); nonMesh {
+		conn.router.noteNonMeshConnection(conn.remoteTCPAddr, err)
+	}
 	if err != nil {
 		return
 	}
+	conn.handshakePhaseDone(HandshakeCrypto)
 
 	conn.sessionKey = intro.SessionKey
 	conn.tcpSender = intro.Sender
 	conn.version = intro.Version
+	conn.frameOverhead = intro.Overhead
+	// Protocol V1 does not pass this feature, so only V2 peers use it
+	conn.compactGossip = intro.Features["CompactGossip"] == "1"
+	conn.dictionaries = sharedGossipDictionaries(conn.router.GossipDictionaries, intro.Features[gossipDictionariesFeature])
+	conn.gossipCodec = negotiateGossipCodec(conn.router.GossipCodecs, intro.Features[gossipCodecsFeature])
+	conn.remoteTenant = intro.Features[tenantFeature]
+	conn.pings = intro.Features[pingFeature] == "1"
 
 	remote, err := conn.parseFeatures(intro.Features)
 	if err != nil {
 		return
 	}
 
+	if onPeerConnecting := conn.router.OnPeerConnecting; onPeerConnecting != nil {
+		if err = onPeerConnecting(remote.Name, conn.remoteTCPAddr); err != nil {
+			err = fmt.Errorf("connection from %s refused: %v", remote.Name, err)
+			return
+		}
+	}
+
 	if err = conn.registerRemote(remote, acceptNewPeer); err != nil {
 		return
 	}
@@ -202,8 +370,8 @@ func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{
 
 	params := OverlayConnectionParams{
 		RemotePeer:         conn.remote,
-		LocalAddr:          conn.tcpConn.LocalAddr().(*net.TCPAddr),
-		RemoteAddr:         conn.tcpConn.RemoteAddr().(*net.TCPAddr),
+		LocalAddr:          tcpAddrOf(conn.tcpConn.LocalAddr()),
+		RemoteAddr:         tcpAddrOf(conn.tcpConn.RemoteAddr()),
 		Outbound:           conn.outbound,
 		ConnUID:            conn.uid,
 		SessionKey:         sessionKey,
@@ -243,8 +411,8 @@ func (conn *LocalConnection) run(errorChan <-chan error, finished chan<- struct{
 	// will have a positive ref count), leaving behind dangling
 	// references to peers. Hence we must invoke AddConnection,
 	// which is *synchronous*, first.
-	conn.heartbeatTCP = time.NewTicker(tcpHeartbeat)
-	go conn.receiveTCP(intro.Receiver)
+	conn.heartbeatTCP = time.NewTicker(conn.router.heartbeatInterval())
+	conn.router.goroutines.spawn(func() { conn.receiveTCP(intro.Receiver) })
 
 	// AddConnection must precede actorLoop. More precisely, it
 	// must precede shutdown, since that invokes DeleteConnection
@@ -265,6 +433,17 @@ func (conn *LocalConnection) makeFeatures() map[string]string {
 		"UID":             fmt.Sprint(conn.local.UID),
 		"ConnID":          fmt.Sprint(conn.uid),
 		"Trusted":         fmt.Sprint(conn.trustRemote),
+		"CompactGossip":   "1",
+		pingFeature:       "1",
+	}
+	if len(conn.router.GossipDictionaries) > 0 {
+		features[gossipDictionariesFeature] = encodeGossipDictionaries(conn.router.GossipDictionaries)
+	}
+	if len(conn.router.GossipCodecs) > 0 {
+		features[gossipCodecsFeature] = strings.Join(conn.router.GossipCodecs, ",")
+	}
+	if conn.router.Tenant != "" {
+		features[tenantFeature] = conn.router.Tenant
 	}
 	conn.router.Overlay.AddFeaturesTo(features)
 	return features
@@ -323,6 +502,7 @@ func (conn *LocalConnection) parseFeatures(features map[string]string) (*Peer, e
 }
 
 func (conn *LocalConnection) registerRemote(remote *Peer, acceptNewPeer bool) error {
+	conn.remoteLabel = remote.String()
 	if acceptNewPeer {
 		conn.remote = conn.router.Peers.fetchWithDefault(remote)
 	} else {
@@ -333,6 +513,7 @@ func (conn *LocalConnection) registerRemote(remote *Peer, acceptNewPeer bool) er
 	}
 
 	if remote.Name == conn.local.Name && remote.UID != conn.local.UID {
+		conn.router.noteNameCollision(remote.UID, "connection with "+conn.remoteTCPAddr)
 		return &peerNameCollisionError{conn.local, remote}
 	}
 	if conn.remote == conn.local {
@@ -353,11 +534,25 @@ func (conn *LocalConnection) actorLoop(errorChan <-chan error) (err error) {
 		default:
 			select {
 			case <-conn.heartbeatTCP.C:
-				err = conn.sendSimpleProtocolMsg(ProtocolHeartbeat)
+				if err = conn.sendSimpleProtocolMsg(ProtocolHeartbeat); err == nil {
+					err = conn.sendPing()
+				}
 			case <-fwdEstablishedChan:
+				conn.handshakePhaseDone(HandshakeSync)
+				conn.quiesceLock.Lock()
 				conn.established = true
+				conn.quiesceLock.Unlock()
 				fwdEstablishedChan = nil
 				conn.router.Ourself.doConnectionEstablished(conn)
+				conn.catchUp = conn.router.newCatchUpGossip()
+				// so that the round-trip time is known without waiting
+				// for the first heartbeat
+				err = conn.sendPing()
+			case <-conn.catchUp.C():
+				conn.router.sendAllGossipDown(conn)
+				if !conn.catchUp.next(conn.router.gossipInterval()) {
+					conn.catchUp = nil
+				}
 			case err = <-errorChan:
 			case err = <-fwdErrorChan:
 			}
@@ -368,7 +563,9 @@ func (conn *LocalConnection) actorLoop(errorChan <-chan error) (err error) {
 }
 
 func (conn *LocalConnection) teardown(err error) {
-	if conn.remote == nil {
+	if _, nonMesh := err.(nonMeshError); nonMesh {
+		// already logged, if not too often, by noteNonMeshConnection
+	} else if conn.remote == nil {
 		conn.logger.Printf("->[%s] connection shutting down due to error during handshake: %v", conn.remoteTCPAddr, err)
 	} else {
 		conn.logf("connection shutting down due to error: %v", err)
@@ -385,6 +582,8 @@ func (conn *LocalConnection) teardown(err error) {
 		conn.router.Ourself.doDeleteConnection(conn)
 	}
 
+	conn.catchUp.stop()
+
 	if conn.heartbeatTCP != nil {
 		conn.heartbeatTCP.Stop()
 	}
@@ -407,24 +606,50 @@ func (conn *LocalConnection) sendSimpleProtocolMsg(tag protocolTag) error {
 }
 
 func (conn *LocalConnection) sendProtocolMsg(m protocolMsg) error {
-	return conn.tcpSender.Send(append([]byte{byte(m.tag)}, m.msg...))
+	if err := conn.tcpSender.Send(conn.router.framer().EncodeTag(byte(m.tag), m.msg)); err != nil {
+		return err
+	}
+	conn.countBytes(conn.router.OnBytesSent, &conn.bytesSent, m.tag, 1+len(m.msg))
+	return nil
+}
+
+// countBytes counts a message of n bytes, excluding framing, in meter,
+// and reports it to the callback f, if set.
+func (conn *LocalConnection) countBytes(f func(PeerName, protocolTag, int), meter *byteMeter, tag protocolTag, n int) {
+	n += conn.frameOverhead
+	meter.add(n, now())
+	if f == nil || conn.remote == nil {
+		return
+	}
+	tag, _ = expandedTag(tag)
+	f(conn.remote.Name, tag, n)
 }
 
 func (conn *LocalConnection) receiveTCP(receiver tcpReceiver) {
 	var err error
+	extend := true
+	framer := conn.router.framer()
 	for {
-		if err = conn.extendReadDeadline(); err != nil {
-			break
+		conn.awaitResume()
+		if extend {
+			if err = conn.extendReadDeadline(); err != nil {
+				break
+			}
 		}
-		var msg []byte
-		if msg, err = receiver.Receive(); err != nil {
+		var frame []byte
+		if frame, err = receiver.Receive(); err != nil {
 			break
 		}
-		if len(msg) < 1 {
-			conn.logf("ignoring blank msg")
+		tag, msg, decodeErr := framer.DecodeTag(frame)
+		if decodeErr != nil {
+			conn.logf("ignoring msg: %v", decodeErr)
 			continue
 		}
-		if err = conn.handleProtocolMsg(protocolTag(msg[0]), msg[1:]); err != nil {
+		// Pongs are answered by the remote's receiving side, so they do
+		// not show that the rest of it is alive, as heartbeats do
+		extend = protocolTag(tag) != ProtocolPong
+		conn.countBytes(conn.router.OnBytesReceived, &conn.bytesReceived, protocolTag(tag), 1+len(msg))
+		if err = conn.handleProtocolMsg(protocolTag(tag), msg); err != nil {
 			break
 		}
 	}
@@ -434,18 +659,41 @@ func (conn *LocalConnection) receiveTCP(receiver tcpReceiver) {
 func (conn *LocalConnection) handleProtocolMsg(tag protocolTag, payload []byte) error {
 	switch tag {
 	case ProtocolHeartbeat:
+	case ProtocolPing:
+		return conn.sendProtocolMsg(protocolMsg{ProtocolPong, payload})
+	case ProtocolPong:
+		conn.handlePong(payload)
 	case ProtocolReserved1, ProtocolReserved2, ProtocolReserved3, ProtocolOverlayControlMsg:
 		conn.OverlayConn.ControlMessage(byte(tag), payload)
-	case ProtocolGossipUnicast, ProtocolGossipBroadcast, ProtocolGossip:
-		return conn.router.handleGossip(tag, payload)
+	case ProtocolGossipUnicast, ProtocolGossipBroadcast, ProtocolGossip,
+		ProtocolGossipUnicastCompact, ProtocolGossipBroadcastCompact, ProtocolGossipCompact:
+		return conn.handleGossip(tag, payload)
+	case ProtocolGossipUnicastBinary, ProtocolGossipBroadcastBinary, ProtocolGossipBinary:
+		m, err := unbinaryGossipMsg(protocolMsg{tag, payload})
+		if err != nil {
+			return err
+		}
+		return conn.handleGossip(m.tag, m.msg)
 	default:
 		conn.logf("ignoring unknown protocol tag: %v", tag)
 	}
 	return nil
 }
 
+// handleGossip passes gossip to the router. Gossip rejected because its
+// protocol is disabled does not end the connection, since our neighbour
+// may only be relaying it.
+func (conn *LocalConnection) handleGossip(tag protocolTag, payload []byte) error {
+	err := conn.router.handleGossip(conn.remote.Name, tag, payload)
+	if _, disabled := err.(disabledProtocolError); disabled {
+		conn.logf("%v", err)
+		return nil
+	}
+	return err
+}
+
 func (conn *LocalConnection) extendReadDeadline() error {
-	return conn.tcpConn.SetReadDeadline(time.Now().Add(tcpHeartbeat * 2))
+	return conn.tcpConn.SetReadDeadline(time.Now().Add(conn.router.heartbeatTimeout()))
 }
 
 // Untrusted returns true if either we don't trust our remote, or are not
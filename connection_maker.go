@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"sort"
 	"strconv"
 	"time"
 	"unicode"
@@ -27,6 +28,10 @@ type connectionMaker struct {
 	targets          map[string]*target
 	connections      map[Connection]struct{}
 	directPeers      peerAddrs
+	tags             map[string][]string // by target address; see TagConnections
+	restored         map[string]struct{} // see ImportTargets
+	paused           bool                // see Router.Stop
+	urgent           bool                // check targets without waiting; see resetBackoff
 	terminationCount int
 	actionChan       chan<- connectionMakerAction
 	logger           Logger
@@ -48,6 +53,9 @@ type target struct {
 	lastError   error         // reason for disconnection last time
 	tryAfter    time.Time     // next time to try this address
 	tryInterval time.Duration // retry delay on next failure
+	attempts    int           // number of connection attempts started
+	failures    int           // consecutive failed attempts; see relayFor
+	remote      PeerName      // peer we last connected to here, if any
 }
 
 // The actor closure used by ConnectionMaker. If an action returns true, the
@@ -59,8 +67,8 @@ type connectionMakerAction func() bool
 // peers, making outbound connections from localAddr, and listening on
 // port. If discovery is true, ConnectionMaker will attempt to
 // initiate new connections with peers it's not directly connected to.
-func newConnectionMaker(ourself *localPeer, peers *Peers, localAddr string, port int, discovery bool, logger Logger) *connectionMaker {
-	actionChan := make(chan connectionMakerAction, ChannelSize)
+func newConnectionMaker(ourself *localPeer, peers *Peers, localAddr string, port int, discovery bool, channelSize int, logger Logger) *connectionMaker {
+	actionChan := make(chan connectionMakerAction, channelSize)
 	cm := &connectionMaker{
 		ourself:     ourself,
 		peers:       peers,
@@ -68,15 +76,22 @@ func newConnectionMaker(ourself *localPeer, peers *Peers, localAddr string, port
 		port:        port,
 		discovery:   discovery,
 		directPeers: peerAddrs{},
+		tags:        make(map[string][]string),
+		restored:    make(map[string]struct{}),
 		targets:     make(map[string]*target),
 		connections: make(map[Connection]struct{}),
 		actionChan:  actionChan,
 		logger:      logger,
 	}
-	go cm.queryLoop(actionChan)
+	ourself.router.goroutineCount().spawn(func() { cm.queryLoop(actionChan) })
 	return cm
 }
 
+// now returns the time by the router's clock; see Config.Clock.
+func (cm *connectionMaker) now() time.Time {
+	return cm.ourself.router.now()
+}
+
 // InitiateConnections creates new connections to the provided peers,
 // specified in host:port format. If replace is true, any existing direct
 // peers are forgotten.
@@ -84,6 +99,69 @@ func newConnectionMaker(ourself *localPeer, peers *Peers, localAddr string, port
 // TODO(pb): Weave Net invokes router.ConnectionMaker.InitiateConnections;
 // it may be better to provide that on Router directly.
 func (cm *connectionMaker) InitiateConnections(peers []string, replace bool) []error {
+	addrs, errors := parsePeerAddrs(peers)
+	cm.actionChan <- func() bool {
+		if replace {
+			cm.directPeers = peerAddrs{}
+		}
+		for peer, addr := range addrs {
+			cm.directPeers[peer] = addr
+			// curtail any existing reconnect interval
+			if target, found := cm.targets[cm.completeAddr(*addr)]; found {
+				target.nextTryNow(cm.now())
+			}
+		}
+		return true
+	}
+	return errors
+}
+
+// Tags describing how a connection came about, which are given to every
+// connection in addition to those set by TagConnections.
+const (
+	TagConfigured = "configured" // outbound, to a peer given to InitiateConnections
+	TagDiscovered = "discovered" // outbound, to a peer learned of from others
+	TagInbound    = "inbound"
+)
+
+// TagConnections sets the tags of the connections to the provided peers,
+// specified in host:port format, replacing any they had. See
+// Router.ConnectionsByTag.
+func (cm *connectionMaker) TagConnections(peers []string, tags ...string) []error {
+	addrs, errors := parsePeerAddrs(peers)
+	cm.actionChan <- func() bool {
+		for _, addr := range addrs {
+			cm.tags[cm.completeAddr(*addr)] = tags
+		}
+		return false
+	}
+	return errors
+}
+
+// connectionTags returns the tags of the connection or target at
+// address, given the addresses of our direct peers.
+func (cm *connectionMaker) connectionTags(address string, outbound bool, direct map[string]struct{}) []string {
+	tags := append([]string{}, cm.tags[address]...)
+	if !outbound {
+		return append(tags, TagInbound)
+	}
+	if _, configured := direct[address]; configured {
+		return append(tags, TagConfigured)
+	}
+	return append(tags, TagDiscovered)
+}
+
+// directAddresses returns the addresses of our direct peers.
+func (cm *connectionMaker) directAddresses() map[string]struct{} {
+	direct := make(map[string]struct{})
+	for _, addr := range cm.directPeers {
+		direct[cm.completeAddr(*addr)] = struct{}{}
+	}
+	return direct
+}
+
+// parsePeerAddrs resolves peers specified in host[:port] format.
+func parsePeerAddrs(peers []string) (peerAddrs, []error) {
 	errors := []error{}
 	addrs := peerAddrs{}
 	for _, peer := range peers {
@@ -101,20 +179,7 @@ func (cm *connectionMaker) InitiateConnections(peers []string, replace bool) []e
 			addrs[peer] = addr
 		}
 	}
-	cm.actionChan <- func() bool {
-		if replace {
-			cm.directPeers = peerAddrs{}
-		}
-		for peer, addr := range addrs {
-			cm.directPeers[peer] = addr
-			// curtail any existing reconnect interval
-			if target, found := cm.targets[cm.completeAddr(*addr)]; found {
-				target.nextTryNow()
-			}
-		}
-		return true
-	}
-	return errors
+	return addrs, errors
 }
 
 func isAlnum(s string) bool {
@@ -140,6 +205,17 @@ func (cm *connectionMaker) ForgetConnections(peers []string) {
 	}
 }
 
+// terminations returns the number of connections terminated, other than
+// by our connecting to ourself.
+func (cm *connectionMaker) terminations() int {
+	resultChan := make(chan int)
+	cm.actionChan <- func() bool {
+		resultChan <- cm.terminationCount
+		return false
+	}
+	return <-resultChan
+}
+
 // Targets takes a snapshot of the targets (direct peers),
 // either just the ones we are still trying, or all of them.
 // Note these are the same things that InitiateConnections and ForgetConnections talks about,
@@ -162,6 +238,85 @@ func (cm *connectionMaker) Targets(activeOnly bool) []string {
 	return <-resultChan
 }
 
+// ConnectionTarget is an address to which we connect, as exported by
+// ConnectionMaker.ExportTargets.
+type ConnectionTarget struct {
+	Address string
+	Direct  bool // given to InitiateConnections, rather than discovered
+	Tags    []string
+}
+
+// ExportTargets takes a snapshot of our direct peers and of the
+// discovered peers we are connected or trying to connect to, along with
+// their tags, for ImportTargets to restore after a restart.
+func (cm *connectionMaker) ExportTargets() []ConnectionTarget {
+	resultChan := make(chan []ConnectionTarget)
+	cm.actionChan <- func() bool {
+		var slice []ConnectionTarget
+		direct := cm.directAddresses()
+		for peer, addr := range cm.directPeers {
+			slice = append(slice, ConnectionTarget{peer, true, cm.tags[cm.completeAddr(*addr)]})
+		}
+		for address := range cm.targets {
+			if _, found := direct[address]; !found {
+				slice = append(slice, ConnectionTarget{address, false, cm.tags[address]})
+			}
+		}
+		sort.Slice(slice, func(i, j int) bool { return slice[i].Address < slice[j].Address })
+		resultChan <- slice
+		return false
+	}
+	return <-resultChan
+}
+
+// ImportTargets restores targets exported by ExportTargets, so that we
+// redial them straight away. Direct peers are added as by
+// InitiateConnections. Discovered peers are dialled once, after which
+// we only reconnect to them if discovery would.
+func (cm *connectionMaker) ImportTargets(targets []ConnectionTarget) []error {
+	var errors []error
+	var direct []string
+	restored := peerAddrs{}
+	for _, target := range targets {
+		if target.Direct {
+			direct = append(direct, target.Address)
+		} else {
+			addrs, errs := parsePeerAddrs([]string{target.Address})
+			errors = append(errors, errs...)
+			for peer, addr := range addrs {
+				restored[peer] = addr
+			}
+		}
+		if len(target.Tags) > 0 {
+			cm.TagConnections([]string{target.Address}, target.Tags...)
+		}
+	}
+	cm.actionChan <- func() bool {
+		for _, addr := range restored {
+			cm.restored[cm.completeAddr(*addr)] = struct{}{}
+		}
+		return true
+	}
+	return append(errors, cm.InitiateConnections(direct, false)...)
+}
+
+// targetErrors returns the reasons for the most recent failures to
+// connect to any of the given addresses.
+func (cm *connectionMaker) targetErrors(addresses []string) []string {
+	resultChan := make(chan []string)
+	cm.actionChan <- func() bool {
+		var errs []string
+		for _, address := range addresses {
+			if target, found := cm.targets[address]; found && target.lastError != nil {
+				errs = append(errs, fmt.Sprintf("connecting to %s: %v", address, target.lastError))
+			}
+		}
+		resultChan <- errs
+		return false
+	}
+	return <-resultChan
+}
+
 // connectionAborted marks the target identified by address as broken, and
 // puts it in the TargetWaiting state.
 func (cm *connectionMaker) connectionAborted(address string, err error) {
@@ -169,7 +324,13 @@ func (cm *connectionMaker) connectionAborted(address string, err error) {
 		target := cm.targets[address]
 		target.state = targetWaiting
 		target.lastError = err
-		target.nextTryLater()
+		target.failures++
+		if _, _, relay := cm.relayFor(address, target); relay && target.failures == relayAfterFailures {
+			// fall back to the relay straight away
+			target.nextTryNow(cm.now())
+		} else {
+			target.nextTryLater(cm.now())
+		}
 		return true
 	}
 }
@@ -183,8 +344,11 @@ func (cm *connectionMaker) connectionCreated(conn Connection) {
 		if conn.isOutbound() {
 			target := cm.targets[conn.remoteTCPAddress()]
 			target.state = targetConnected
+			target.failures = 0
+			target.remote = conn.Remote().Name
 		}
-		return false
+		// Move on to the next seed, if they are dialled in turn.
+		return cm.sequential()
 	}
 }
 
@@ -198,7 +362,7 @@ func (cm *connectionMaker) connectionTerminated(conn Connection, err error) {
 		delete(cm.connections, conn)
 		if conn.isOutbound() {
 			if conn.Remote() != nil {
-				if _, ok := cm.ourself.Peer.connections[conn.Remote().Name]; ok {
+				if _, ok := cm.ourself.ConnectionTo(conn.Remote().Name); ok {
 					return true
 				}
 			}
@@ -209,10 +373,10 @@ func (cm *connectionMaker) connectionTerminated(conn Connection, err error) {
 			switch {
 			case peerNameCollision || err == errConnectToSelf:
 				target.nextTryNever()
-			case time.Now().After(target.tryAfter.Add(resetAfter)):
-				target.nextTryNow()
+			case cm.now().After(target.tryAfter.Add(resetAfter)):
+				target.nextTryNow(cm.now())
 			default:
-				target.nextTryLater()
+				target.nextTryLater(cm.now())
 			}
 		}
 		return true
@@ -226,6 +390,20 @@ func (cm *connectionMaker) refresh() {
 	cm.actionChan <- func() bool { return true }
 }
 
+// pause stops (or, with false, resumes) connection attempts. On resuming,
+// all targets are tried straight away.
+func (cm *connectionMaker) pause(paused bool) {
+	cm.actionChan <- func() bool {
+		if cm.paused && !paused {
+			for _, target := range cm.targets {
+				target.nextTryNow(cm.now())
+			}
+		}
+		cm.paused = paused
+		return !paused
+	}
+}
+
 func (cm *connectionMaker) queryLoop(actionChan <-chan connectionMakerAction) {
 	//timer := time.NewTimer(maxDuration)
 	//run := func() { timer.Reset(cm.checkStateAndAttemptConnections()) }
@@ -245,29 +423,31 @@ func (cm *connectionMaker) queryLoop(actionChan <-chan connectionMakerAction) {
 		timer.Reset(currentDuration)
 	}
 
-	run := func() {
-		now := time.Now()
+	run := func(fired bool) {
+		t := cm.now()
 
 		// If run() was called too recently, we want to ensure that the duration
-		// is no longer than initialInterval
-		if now.Sub(lastRun) < initialInterval {
-			if currentDuration > initialInterval {
+		// is no longer than initialInterval. If the timer has fired, it
+		// must be rearmed, or we would not check again until the next action.
+		if t.Sub(lastRun) < initialInterval && !cm.urgent {
+			if fired || currentDuration > initialInterval {
 				resetTimer(initialInterval)
 			}
 		} else {
 			// otherwise this means we hit the timer
 			resetTimer(cm.checkStateAndAttemptConnections())
-			lastRun = now
+			lastRun = t
+			cm.urgent = false
 		}
 	}
 	for {
 		select {
 		case action := <-actionChan:
 			if action() {
-				run()
+				run(false)
 			}
 		case <-timer.C:
-			run()
+			run(true)
 		}
 	}
 }
@@ -280,6 +460,9 @@ func (cm *connectionMaker) completeAddr(addr net.TCPAddr) string {
 }
 
 func (cm *connectionMaker) checkStateAndAttemptConnections() time.Duration {
+	if cm.paused || cm.seed() {
+		return maxDuration
+	}
 	var (
 		validTarget  = make(map[string]struct{})
 		directTarget = make(map[string]struct{})
@@ -295,7 +478,7 @@ func (cm *connectionMaker) checkStateAndAttemptConnections() time.Duration {
 			return
 		}
 		tgt := &target{state: targetWaiting}
-		tgt.nextTryNow()
+		tgt.nextTryNow(cm.now())
 		cm.targets[address] = tgt
 	}
 
@@ -317,9 +500,14 @@ func (cm *connectionMaker) checkStateAndAttemptConnections() time.Duration {
 		}
 	}
 
+	// Add restored targets which we have yet to try
+	for address := range cm.restored {
+		addTarget(address)
+	}
+
 	// Add targets for peers that someone else is connected to, but we
-	// aren't
-	if cm.discovery {
+	// aren't, unless we have no room for more connections
+	if cm.discovery && !cm.manual() && !cm.ourself.isMembershipFrozen() && cm.ourself.checkConnectionLimit() == nil {
 		cm.addPeerTargets(ourConnectedPeers, addTarget)
 	}
 
@@ -346,6 +534,10 @@ func (cm *connectionMaker) ourConnections() (peerNameSet, map[string]struct{}, m
 	return ourConnectedPeers, ourConnectedTargets, ourInboundIPs
 }
 
+// addPeerTargets adds targets for the peers we have learned of through
+// topology gossip, but are not connected to, at the addresses by which
+// others reach them. This is how, with discovery enabled, the mesh fills
+// in beyond the peers we were told to connect to.
 func (cm *connectionMaker) addPeerTargets(ourConnectedPeers peerNameSet, addTarget func(string)) {
 	cm.peers.forEach(func(peer *Peer) {
 		if peer == cm.ourself.Peer {
@@ -377,9 +569,20 @@ func (cm *connectionMaker) addPeerTargets(ourConnectedPeers peerNameSet, addTarg
 }
 
 func (cm *connectionMaker) connectToTargets(validTarget map[string]struct{}, directTarget map[string]struct{}) time.Duration {
-	now := time.Now() // make sure we catch items just added
+	t := cm.now() // make sure we catch items just added
 	after := maxDuration
-	for address, target := range cm.targets {
+	frozen := cm.ourself.isMembershipFrozen()
+	sequential := cm.sequential()
+	addresses := make([]string, 0, len(cm.targets))
+	for address := range cm.targets {
+		addresses = append(addresses, address)
+	}
+	if sequential {
+		sort.Strings(addresses)
+	}
+	dialling := sequential && cm.dialling(directTarget)
+	for _, address := range addresses {
+		target := cm.targets[address]
 		if target.state != targetWaiting && target.state != targetSuspended {
 			continue
 		}
@@ -397,11 +600,27 @@ func (cm *connectionMaker) connectToTargets(validTarget map[string]struct{}, dir
 			continue
 		}
 		target.state = targetWaiting
-		switch duration := target.tryAfter.Sub(now); {
+		switch duration := target.tryAfter.Sub(t); {
 		case duration <= 0:
-			target.state = targetAttempting
 			_, isCmdLineTarget := directTarget[address]
-			go cm.attemptConnection(address, isCmdLineTarget)
+			if first := isCmdLineTarget && target.attempts == 0; first && sequential {
+				if dialling {
+					// wait for the attempt in progress to finish
+					continue
+				}
+				dialling = true
+			}
+			// restored targets are peers we knew before
+			_, isRestored := cm.restored[address]
+			delete(cm.restored, address)
+			target.attempts++
+			target.state = targetAttempting
+			address, acceptNewPeer := address, (isCmdLineTarget || isRestored) && !frozen
+			if name, relay, ok := cm.relayFor(address, target); ok {
+				cm.ourself.router.goroutineCount().spawn(func() { cm.attemptRelayedConnection(address, name, relay, acceptNewPeer) })
+			} else {
+				cm.ourself.router.goroutineCount().spawn(func() { cm.attemptConnection(address, acceptNewPeer) })
+			}
 		case duration < after:
 			after = duration
 		}
@@ -409,6 +628,30 @@ func (cm *connectionMaker) connectToTargets(validTarget map[string]struct{}, dir
 	return after
 }
 
+// manual reports whether we only connect to direct peers. See
+// Config.ManualConnections.
+func (cm *connectionMaker) manual() bool {
+	return cm.ourself.router != nil && cm.ourself.router.ManualConnections
+}
+
+// sequential reports whether direct peers are dialled one at a time, in
+// order of address. See Config.SequentialBootstrap.
+func (cm *connectionMaker) sequential() bool {
+	return cm.ourself.router != nil && cm.ourself.router.SequentialBootstrap
+}
+
+// dialling reports whether a first connection attempt to any of
+// directTarget is in progress. Retries are not made in turn, so that an
+// unreachable peer does not hold up the rest.
+func (cm *connectionMaker) dialling(directTarget map[string]struct{}) bool {
+	for address := range directTarget {
+		if target, found := cm.targets[address]; found && target.state == targetAttempting && target.attempts == 1 {
+			return true
+		}
+	}
+	return false
+}
+
 func (cm *connectionMaker) attemptConnection(address string, acceptNewPeer bool) {
 	cm.logger.Printf("->[%s] attempting connection", address)
 	if err := cm.ourself.createConnection(cm.localAddr, address, acceptNewPeer, cm.logger); err != nil {
@@ -422,15 +665,15 @@ func (t *target) nextTryNever() {
 	t.tryInterval = maxInterval
 }
 
-func (t *target) nextTryNow() {
-	t.tryAfter = time.Now()
+func (t *target) nextTryNow(at time.Time) {
+	t.tryAfter = at
 	t.tryInterval = initialInterval
 }
 
 // The delay at the nth retry is a random value in the range
-// [i-i/2,i+i/2], where i = InitialInterval * 1.5^(n-1).
-func (t *target) nextTryLater() {
-	t.tryAfter = time.Now().Add(t.tryInterval/2 + time.Duration(rand.Int63n(int64(t.tryInterval))))
+// [i-i/2,i+i/2], where i = InitialInterval * 1.5^(n-1), from at.
+func (t *target) nextTryLater(at time.Time) {
+	t.tryAfter = at.Add(t.tryInterval/2 + time.Duration(rand.Int63n(int64(t.tryInterval))))
 	t.tryInterval = t.tryInterval * 3 / 2
 	if t.tryInterval > maxInterval {
 		t.tryInterval = maxInterval
@@ -0,0 +1,132 @@
+package mesh
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// redacted replaces secrets in Diagnostics.
+const redacted = "REDACTED"
+
+// secretConfigFields are the fields of Config which Diagnostics redacts.
+var secretConfigFields = map[string]struct{}{
+	"Password":     {},
+	"PasswordFunc": {},
+	"SigningKey":   {},
+}
+
+// Diagnostics is a snapshot of a router, for attaching to bug reports.
+// It is made of plain data, so serialises with e.g. encoding/json. See
+// Router.Diagnostics.
+type Diagnostics struct {
+	Time time.Time
+	// Config holds each field of the router's Config by name. Secrets
+	// are REDACTED, callbacks are "set" if present, and other
+	// interfaces are named by type.
+	Config   map[string]interface{}
+	Health   string
+	Status   *Status // peers, connections and routes
+	Channels []ChannelInfo
+	Counters DiagnosticCounters
+	// Events are the latest changes to the topology, oldest first.
+	Events []DiagnosticEvent
+}
+
+// DiagnosticCounters are the router's running totals in Diagnostics.
+type DiagnosticCounters struct {
+	RejectedMessages  uint64 // see Router.RejectedMessages
+	MergeViolations   uint64 // see Router.MergeViolations
+	DroppedGossip     uint64 // over current connections; see Config.MaxPendingGossip
+	RouteCalculations uint64
+}
+
+// DiagnosticEvent is a topology event in Diagnostics, with when it
+// happened.
+type DiagnosticEvent struct {
+	Time time.Time
+	TopologyEvent
+}
+
+// Diagnostics returns a snapshot of everything about the router likely to
+// be relevant to a bug report, with secrets such as Config.Password and
+// Config.SigningKey redacted. The parts are taken in turn, so may not be
+// entirely consistent with each other on a busy router.
+func (router *Router) Diagnostics() *Diagnostics {
+	d := &Diagnostics{
+		Time:   time.Now(),
+		Config: router.redactedConfig(),
+		Health: router.HealthCheck().String(),
+		Status: NewStatus(router),
+		Counters: DiagnosticCounters{
+			RejectedMessages: router.RejectedMessages(),
+			MergeViolations:  router.MergeViolations(),
+		},
+	}
+	for _, conn := range d.Status.Connections {
+		d.Counters.DroppedGossip += conn.DroppedGossip
+	}
+	router.Routes.RLock()
+	d.Counters.RouteCalculations = router.Routes.calculations
+	router.Routes.RUnlock()
+
+	router.gossipLock.RLock()
+	names := make([]string, 0, len(router.gossipChannels))
+	for name := range router.gossipChannels {
+		names = append(names, name)
+	}
+	router.gossipLock.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		if info, found := router.ChannelInfo(name); found {
+			d.Channels = append(d.Channels, info)
+		}
+	}
+
+	router.topologyLock.Lock()
+	d.Events = append([]DiagnosticEvent(nil), router.topologyRecent...)
+	router.topologyLock.Unlock()
+	return d
+}
+
+// redactedConfig returns the fields of our Config for Diagnostics.
+func (router *Router) redactedConfig() map[string]interface{} {
+	v := reflect.ValueOf(router.Config)
+	config := make(map[string]interface{}, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		name, field := v.Type().Field(i).Name, v.Field(i)
+		switch {
+		case field.Kind() == reflect.Func || field.Kind() == reflect.Slice:
+			if field.IsNil() {
+				config[name] = nil
+				continue
+			}
+			if _, secret := secretConfigFields[name]; secret {
+				config[name] = redacted
+			} else if field.Kind() == reflect.Func {
+				config[name] = "set"
+			} else {
+				config[name] = field.Interface()
+			}
+		case field.Kind() == reflect.Interface:
+			if field.IsNil() {
+				config[name] = nil
+			} else {
+				config[name] = fmt.Sprintf("%T", field.Interface())
+			}
+		default:
+			config[name] = field.Interface()
+		}
+	}
+	config["TrustedSubnets"] = makeTrustedSubnetsSlice(router.TrustedSubnets)
+	if router.httpProxy != nil {
+		proxy := *router.httpProxy
+		if _, found := proxy.User.Password(); found {
+			proxy.User = url.UserPassword(proxy.User.Username(), redacted)
+		}
+		config["HTTPProxy"] = proxy.String()
+	}
+	return config
+}
@@ -0,0 +1,28 @@
+// +build linux darwin freebsd
+
+package mesh
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDSCP marks the traffic on conn with the given differentiated
+// services code point, in the IPv4 ToS or IPv6 traffic class field.
+func setDSCP(conn *net.TCPConn, dscp int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, opt, dscp<<2)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
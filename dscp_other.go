@@ -0,0 +1,12 @@
+// +build !linux,!darwin,!freebsd
+
+package mesh
+
+import (
+	"errors"
+	"net"
+)
+
+func setDSCP(conn *net.TCPConn, dscp int) error {
+	return errors.New("DSCP marking is not supported on this platform")
+}
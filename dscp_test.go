@@ -0,0 +1,34 @@
+// +build linux
+
+package mesh
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDSCP(t *testing.T) {
+	const dscp = 46 // expedited forwarding
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{DSCP: dscp})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	defer r1.Stop()
+	defer r2.Stop()
+	connectTCPTestRouters(r1, r2)
+	conn := awaitEstablished(t, r1, r2)
+
+	raw, err := conn.tcpConn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var tos int
+	var sockErr error
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		tos, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	}))
+	require.NoError(t, sockErr)
+	require.Equal(t, dscp<<2, tos)
+
+	_, err = NewRouter(Config{DSCP: 64}, r1.Ourself.Name, "nick", nil, r1.logger)
+	require.Error(t, err)
+}
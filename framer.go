@@ -0,0 +1,94 @@
+package mesh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Framer delimits the messages sent over a connection, and encodes the
+// tag identifying the kind of each, one of the Protocol* constants. It
+// is used from the exchange of public keys and features in the protocol
+// intro onwards; the protocol header before it is fixed. Both ends of a
+// connection must use the same Framer. See Config.Framer.
+//
+// A frame is what EncodeTag returns. When the connection is encrypted,
+// it is the sealed frame which is written with WriteFrame, and read back
+// with ReadFrame before it is opened and passed to DecodeTag.
+type Framer interface {
+	// WriteFrame writes frame to w as a single message. It is called
+	// concurrently, so should make a single Write.
+	WriteFrame(w io.Writer, frame []byte) error
+	// ReadFrame reads the next message written by WriteFrame from r.
+	ReadFrame(r io.Reader) ([]byte, error)
+	// EncodeTag returns the frame carrying msg, tagged with tag.
+	EncodeTag(tag byte, msg []byte) []byte
+	// DecodeTag splits a frame returned by EncodeTag into its tag and
+	// msg.
+	DecodeTag(frame []byte) (tag byte, msg []byte, err error)
+}
+
+// LengthPrefixFramer is the Framer used unless Config.Framer is set, and
+// by all peers before it was introduced. Each message on the wire is its
+// length, as a big-endian uint32, followed by that many bytes, and no
+// more than 10MB. A frame is the tag byte followed by the message. For
+// gossip, the message is as described by binaryGossipMsg when the
+// binary codec is negotiated, and otherwise gob encoded.
+type LengthPrefixFramer struct{}
+
+var _ Framer = LengthPrefixFramer{}
+
+// WriteFrame implements Framer. Frames larger than 10MB are rejected.
+func (LengthPrefixFramer) WriteFrame(w io.Writer, frame []byte) error {
+	l := len(frame)
+	if l > maxTCPMsgSize {
+		return fmt.Errorf("outgoing message exceeds maximum size: %d > %d", l, maxTCPMsgSize)
+	}
+	// We copy the message so we can send it in a single Write
+	// operation, thus making this thread-safe without locking.
+	prefixedMsg := make([]byte, lengthPrefixSize+l)
+	binary.BigEndian.PutUint32(prefixedMsg, uint32(l))
+	copy(prefixedMsg[lengthPrefixSize:], frame)
+	_, err := w.Write(prefixedMsg)
+	return err
+}
+
+// ReadFrame implements Framer by making a length-limited read.
+func (LengthPrefixFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	lenPrefix := make([]byte, lengthPrefixSize)
+	if _, err := io.ReadFull(r, lenPrefix); err != nil {
+		return nil, err
+	}
+	l := binary.BigEndian.Uint32(lenPrefix)
+	if l > maxTCPMsgSize {
+		return nil, fmt.Errorf("incoming message exceeds maximum size: %d > %d", l, maxTCPMsgSize)
+	}
+	msg := make([]byte, l)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// EncodeTag implements Framer.
+func (LengthPrefixFramer) EncodeTag(tag byte, msg []byte) []byte {
+	return append([]byte{tag}, msg...)
+}
+
+// DecodeTag implements Framer.
+func (LengthPrefixFramer) DecodeTag(frame []byte) (byte, []byte, error) {
+	if len(frame) < 1 {
+		return 0, nil, errBlankFrame
+	}
+	return frame[0], frame[1:], nil
+}
+
+// errBlankFrame is returned by LengthPrefixFramer for a frame without a
+// tag, which connections ignore.
+var errBlankFrame = fmt.Errorf("blank msg")
+
+// framer returns the Framer of our connections.
+func (router *Router) framer() Framer {
+	if router.Framer == nil {
+		return LengthPrefixFramer{}
+	}
+	return router.Framer
+}
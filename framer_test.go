@@ -0,0 +1,110 @@
+package mesh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// trailerFramer is a Framer unlike LengthPrefixFramer, with uvarint
+// lengths and the tag after the message, counting the frames it reads.
+type trailerFramer struct {
+	read int64
+}
+
+func (f *trailerFramer) WriteFrame(w io.Writer, frame []byte) error {
+	_, err := w.Write(appendUvarintBytes(nil, frame))
+	return err
+}
+
+func (f *trailerFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		// Our connections are not ByteReaders, so read byte by byte
+		br = &byteReader{r}
+	}
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&f.read, 1)
+	return frame, nil
+}
+
+func (f *trailerFramer) EncodeTag(tag byte, msg []byte) []byte {
+	return append(append([]byte{}, msg...), tag)
+}
+
+func (f *trailerFramer) DecodeTag(frame []byte) (byte, []byte, error) {
+	if len(frame) < 1 {
+		return 0, nil, fmt.Errorf("blank frame")
+	}
+	return frame[len(frame)-1], frame[:len(frame)-1], nil
+}
+
+type byteReader struct {
+	io.Reader
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+func TestFramerRoundTrip(t *testing.T) {
+	for _, framer := range []Framer{LengthPrefixFramer{}, &trailerFramer{}} {
+		buf := new(bytes.Buffer)
+		sender := newFramedTCPSender(buf, framer)
+		receiver := newFramedTCPReceiver(bufio.NewReader(buf), framer)
+		for _, msg := range [][]byte{[]byte("hello"), {}} {
+			require.NoError(t, sender.Send(framer.EncodeTag(ProtocolGossipBroadcast, msg)))
+		}
+		for _, msg := range [][]byte{[]byte("hello"), {}} {
+			frame, err := receiver.Receive()
+			require.NoError(t, err)
+			tag, got, err := framer.DecodeTag(frame)
+			require.NoError(t, err)
+			require.Equal(t, byte(ProtocolGossipBroadcast), tag)
+			require.Equal(t, msg, got)
+		}
+		_, err := receiver.Receive()
+		require.Equal(t, io.EOF, err)
+	}
+
+	// The default framer is the format used before Framer was introduced
+	buf := new(bytes.Buffer)
+	require.NoError(t, LengthPrefixFramer{}.WriteFrame(buf, LengthPrefixFramer{}.EncodeTag(ProtocolGossip, []byte("hi"))))
+	require.Equal(t, []byte{0, 0, 0, 3, ProtocolGossip, 'h', 'i'}, buf.Bytes())
+}
+
+func TestCustomFramerConnection(t *testing.T) {
+	f1, f2 := &trailerFramer{}, &trailerFramer{}
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{Framer: f1, Password: []byte("sekr1t")})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{Framer: f2, Password: []byte("sekr1t")})
+	defer r1.Stop()
+	defer r2.Stop()
+	g1, g2 := newTestGossiper(), newTestGossiper()
+	s1, err := r1.NewGossip("test", g1)
+	require.NoError(t, err)
+	_, err = r2.NewGossip("test", g2)
+	require.NoError(t, err)
+
+	connectTCPTestRouters(r1, r2)
+	awaitEstablished(t, r1, r2)
+	broadcast(s1, 1)
+	require.Eventually(t, func() bool { return g2.has(1) }, 5*time.Second, 10*time.Millisecond)
+	require.True(t, atomic.LoadInt64(&f1.read) > 0)
+	require.True(t, atomic.LoadInt64(&f2.read) > 0)
+}
@@ -0,0 +1,42 @@
+package mesh
+
+import "sync/atomic"
+
+// goroutineCount counts the goroutines which the router owns: the actors
+// of the router itself, and of each connection and its gossip senders.
+// See Router.Goroutines.
+type goroutineCount struct {
+	n int64 // atomic
+}
+
+// spawn runs f in a goroutine, counted until f returns. A nil
+// goroutineCount counts nothing.
+func (g *goroutineCount) spawn(f func()) {
+	if g == nil {
+		go f()
+		return
+	}
+	atomic.AddInt64(&g.n, 1)
+	go func() {
+		defer atomic.AddInt64(&g.n, -1)
+		f()
+	}()
+}
+
+// goroutineCount returns the count of our goroutines, or nil, for
+// routerless peers in tests.
+func (router *Router) goroutineCount() *goroutineCount {
+	if router == nil {
+		return nil
+	}
+	return &router.goroutines
+}
+
+// Goroutines returns the number of goroutines the router is running:
+// those of the router itself, and, for each connection, its actor and
+// receiver and a gossip sender for each channel with gossip for it. It
+// is also in Status. Growth which does not follow that of the mesh
+// suggests a leak.
+func (router *Router) Goroutines() int {
+	return int(atomic.LoadInt64(&router.goroutines.n))
+}
@@ -1,6 +1,12 @@
 package mesh
 
-import "sync"
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // Gossip is the sending interface.
 //
@@ -19,6 +25,9 @@ type Gossip interface {
 	GossipUnicast(dst PeerName, msg []byte) error
 
 	// GossipBroadcast emits a message to all peers in the mesh.
+	// On channels made with Router.NewSequencedGossip, broadcasts carry
+	// a sequence number per origin, and receivers ignore any older than
+	// one they have already seen.
 	//
 	// TODO(pb): rename to Broadcast?
 	GossipBroadcast(update GossipData)
@@ -51,6 +60,102 @@ type Gossiper interface {
 	OnGossip(msg []byte) (delta GossipData, err error)
 }
 
+// GossiperWithProvenance is an optional extension of Gossiper. If a
+// Gossiper implements it, unicasts and broadcasts are delivered via these
+// methods instead, identifying both the peer that originated the message
+// and the neighbour that relayed it to us. The two are the same when the
+// originator is directly connected.
+//
+// Periodic gossip (OnGossip) carries merged state, and so has no single
+// originator.
+type GossiperWithProvenance interface {
+	Gossiper
+
+	// OnGossipUnicastFrom is OnGossipUnicast with provenance.
+	OnGossipUnicastFrom(origin, sender PeerName, msg []byte) error
+
+	// OnGossipBroadcastFrom is OnGossipBroadcast with provenance.
+	OnGossipBroadcastFrom(origin, sender PeerName, update []byte) (received GossipData, err error)
+}
+
+// GossiperWithSchemaVersion is an optional extension of Gossiper, for
+// applications migrating between encodings of their gossip payloads. If a
+// Gossiper implements it, all messages are delivered via these methods
+// instead, along with the schema version they were sent with, so the
+// receiver can decode both old and new formats. Messages from senders
+// which do not version their payloads arrive with version 0.
+//
+// It takes precedence over GossiperWithProvenance.
+type GossiperWithSchemaVersion interface {
+	Gossiper
+
+	// OnGossipUnicastVersion is OnGossipUnicast with a schema version.
+	OnGossipUnicastVersion(src PeerName, version byte, msg []byte) error
+
+	// OnGossipBroadcastVersion is OnGossipBroadcast with a schema version.
+	OnGossipBroadcastVersion(src PeerName, version byte, update []byte) (received GossipData, err error)
+
+	// OnGossipVersion is OnGossip with a schema version.
+	OnGossipVersion(version byte, msg []byte) (delta GossipData, err error)
+}
+
+// SchemaVersioned may be implemented by GossipData to have its encoding
+// sent with a schema version, which is passed to receivers implementing
+// GossiperWithSchemaVersion. Version 0 means unversioned.
+type SchemaVersioned interface {
+	SchemaVersion() byte
+}
+
+// Cloneable may be implemented by GossipData to have its merges checked
+// by Config.DebugMergeValidation. Merge may modify its receiver, so the
+// check merges copies made by Clone, which must be deep.
+type Cloneable interface {
+	Clone() GossipData
+}
+
+// VersionedGossip is implemented by the Gossip returned from
+// Router.NewGossip, to send unicasts with a schema version.
+type VersionedGossip interface {
+	Gossip
+
+	// GossipUnicastVersion is GossipUnicast with a schema version.
+	GossipUnicastVersion(dst PeerName, version byte, msg []byte) error
+}
+
+// ScheduledGossip is implemented by the Gossip returned from
+// Router.NewGossip, to originate broadcasts at a given time, e.g. so that
+// a coordinated change is gossiped by all peers at around the same
+// moment.
+type ScheduledGossip interface {
+	Gossip
+
+	// SendAt queues update to be broadcast, as by GossipBroadcast, at t,
+	// or straight away if t has passed, by Config.Clock if set. It
+	// returns without waiting. Broadcasts still pending when the router
+	// is stopped are cancelled.
+	SendAt(t time.Time, update GossipData)
+}
+
+// InspectableGossip is implemented by the Gossip returned from
+// Router.NewGossip, to look at the state of the channel, e.g. to dump it
+// from a live node for debugging.
+type InspectableGossip interface {
+	Gossip
+
+	// CurrentState returns the complete state of the channel, as the
+	// Gossiper would gossip it, or nil if it has none. It is a snapshot,
+	// provided the Gossiper returns a copy from Gossip, as it should,
+	// and must be treated as read-only.
+	CurrentState() GossipData
+}
+
+func schemaVersion(data GossipData) byte {
+	if v, ok := data.(SchemaVersioned); ok {
+		return v.SchemaVersion()
+	}
+	return 0
+}
+
 // GossipData is a merge-able dataset.
 // Think: log-structured data.
 type GossipData interface {
@@ -63,26 +168,181 @@ type GossipData interface {
 	Merge(GossipData) GossipData
 }
 
+// GossipStage is a point on a gossip message's path through the mesh.
+type GossipStage int
+
+const (
+	// GossipOriginate is the sending of a message by its origin.
+	GossipOriginate GossipStage = iota
+	// GossipRelay is the forwarding of a message received from a peer.
+	GossipRelay
+	// GossipDeliver is the handing of a received message to the Gossiper.
+	GossipDeliver
+)
+
+func (s GossipStage) String() string {
+	switch s {
+	case GossipOriginate:
+		return "originate"
+	case GossipRelay:
+		return "relay"
+	case GossipDeliver:
+		return "deliver"
+	}
+	return fmt.Sprintf("GossipStage(%d)", int(s))
+}
+
+// GossipTracer observes gossip messages at each stage of their path, for
+// example to record them as spans in a distributed tracing system. See
+// Config.GossipTracer.
+type GossipTracer interface {
+	// TraceGossip is called as a message on channel, originated by origin,
+	// enters stage. The returned func, if not nil, is called with the
+	// outcome once the stage is complete.
+	TraceGossip(stage GossipStage, channel string, origin PeerName) func(error)
+}
+
+// sequencedGossipData is broadcast GossipData along with the sequence
+// number its origin gave it. Merging keeps the latest sequence, since the
+// result includes the latest data.
+type sequencedGossipData struct {
+	GossipData
+	seq uint64
+}
+
+func (d *sequencedGossipData) Merge(other GossipData) GossipData {
+	seq := d.seq
+	if o, ok := other.(*sequencedGossipData); ok {
+		other = o.GossipData
+		seq = laterSequence(seq, o.seq)
+	}
+	return &sequencedGossipData{d.GossipData.Merge(other), seq}
+}
+
 // GossipSender accumulates GossipData that needs to be sent to one
 // destination, and sends it when possible. GossipSender is one-to-one with a
 // channel.
 type gossipSender struct {
 	sync.Mutex
-	makeMsg          func(msg []byte) protocolMsg
-	makeBroadcastMsg func(srcName PeerName, msg []byte) protocolMsg
-	sender           protocolSender
-	gossip           GossipData
-	broadcasts       map[PeerName]GossipData
-	more             chan<- struct{}
-	flush            chan<- chan<- bool // for testing
+	makeMsg            func(version byte, msg []byte) protocolMsg
+	makeBroadcastMsg   func(srcName PeerName, version byte, seq uint64, msg []byte) protocolMsg
+	sender             protocolSender
+	gossip             GossipData
+	broadcasts         map[PeerName]GossipData
+	more               chan<- struct{}
+	flush              chan<- chan<- bool // for testing
+	limits             *sendQueueLimits   // nil means unbounded
+	pending            int                // items merged into gossip and broadcasts
+	gossipCount        int
+	broadcastCounts    map[PeerName]int
+	scheduler          *fairScheduler  // nil means senders are not scheduled
+	weight             int             // messages per turn from scheduler
+	turnUsed           int             // -1 if not holding a turn; only used by run
+	validator          *mergeValidator // nil means merges are not validated
+	maxBatch           int             // messages sent per flush; zero means unbounded
+	carry              []protocolMsg   // held over to the next flush; only used by run
+	retention          BroadcastRetention
+	retained           map[PeerName][]retainedBroadcast // unmerged broadcasts, if retention is limited
+	bytes              *byteBucket                      // shared by all connections; nil means unlimited
+	quit               chan struct{}                    // closed by gossipSenders.drop
+	tenant             *tenantAccount                   // of the channel; nil means unaccounted
+	delivered          chan struct{}                    // closed when next emptied; see sendFirst
+	after              <-chan struct{}                  // sends wait until closed; see sendAfter
+	merges             mergeSlots                       // shared by all connections; nil means unbounded
+	gossipDeadline     time.Time                        // zero means none; see GossipWithDeadline
+	broadcastDeadlines map[PeerName]time.Time
+	dropped            func(reason GossipDropReason, n int) // nil means drops are not reported
+	overflow           GossipOverflowPolicy                 // of the channel, when limits are exceeded
+	arrivals           uint64                               // counts items queued, to order them
+	gossipSince        uint64                               // arrival of the oldest item in gossip
+	broadcastSince     map[PeerName]uint64                  // arrival of the oldest item from each origin
+	clock              func() time.Time                     // nil means now; see Config.Clock
+	shrank             func()                               // nil, or called holding the lock when pending shrinks
+}
+
+// BroadcastRetention limits how much broadcast data from each origin a
+// channel holds, merged, for a neighbour while it waits to be sent. The
+// zero value holds everything. See Config.BroadcastRetention.
+type BroadcastRetention struct {
+	// MaxItems, if set, holds only the latest MaxItems broadcasts from
+	// each origin; 1 holds only the latest value.
+	MaxItems int
+	// MaxAge, if set, discards broadcasts held for longer.
+	MaxAge time.Duration
+}
+
+func (r BroadcastRetention) limited() bool {
+	return r.MaxItems > 0 || r.MaxAge > 0
+}
+
+type retainedBroadcast struct {
+	data    GossipData
+	t       time.Time
+	arrival uint64 // see gossipSender.arrivals
+}
+
+// GossipOverflowPolicy determines what happens when more gossip is
+// pending for a connection than Config.MaxPendingGossip allows.
+type GossipOverflowPolicy int
+
+const (
+	// GossipOverflowDropOldest discards the oldest gossip pending, in
+	// favour of the new gossip: the periodic gossip, or the broadcasts
+	// from one origin, whichever has waited longest. Suitable for
+	// channels that tolerate loss, since periodic gossip will eventually
+	// repair the gap.
+	GossipOverflowDropOldest GossipOverflowPolicy = iota
+	// GossipOverflowClose shuts down the connection, so that it can be
+	// re-established from a clean state.
+	GossipOverflowClose
+)
+
+// BackpressurePolicy determines which neighbour's backlog throttles the
+// origination of gossip, when Config.BackpressureThreshold is set.
+type BackpressurePolicy int
+
+const (
+	// BackpressureNone never throttles origination.
+	BackpressureNone BackpressurePolicy = iota
+	// BackpressureSlowest throttles while any neighbour lags.
+	BackpressureSlowest
+	// BackpressureMedian throttles while the median neighbour lags, so
+	// that a single slow neighbour cannot hold back the rest.
+	BackpressureMedian
+)
+
+// sendQueueLimits bounds the gossip pending on a connection, and keeps
+// count of what was dropped as a result.
+type sendQueueLimits struct {
+	maxPending int
+	overflow   GossipOverflowPolicy            // unless the channel has its own
+	channels   map[string]GossipOverflowPolicy // by channel
+	shutdown   func(error)
+	dropped    uint64 // atomic
+}
+
+// policy returns the overflow policy of the named channel.
+func (l *sendQueueLimits) policy(channelName string) GossipOverflowPolicy {
+	if overflow, found := l.channels[channelName]; found {
+		return overflow
+	}
+	return l.overflow
+}
+
+func (l *sendQueueLimits) droppedCount() uint64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.dropped)
 }
 
 // NewGossipSender constructs a usable GossipSender.
 func newGossipSender(
-	makeMsg func(msg []byte) protocolMsg,
-	makeBroadcastMsg func(srcName PeerName, msg []byte) protocolMsg,
+	makeMsg func(version byte, msg []byte) protocolMsg,
+	makeBroadcastMsg func(srcName PeerName, version byte, seq uint64, msg []byte) protocolMsg,
 	sender protocolSender,
 	stop <-chan struct{},
+	goroutines *goroutineCount,
 ) *gossipSender {
 	more := make(chan struct{}, 1)
 	flush := make(chan chan<- bool)
@@ -93,17 +353,30 @@ func newGossipSender(
 		broadcasts:       make(map[PeerName]GossipData),
 		more:             more,
 		flush:            flush,
+		broadcastCounts:  make(map[PeerName]int),
+		turnUsed:         -1,
+		quit:             make(chan struct{}),
 	}
-	go s.run(stop, more, flush)
+	goroutines.spawn(func() { s.run(stop, more, flush) })
 	return s
 }
 
+// now returns the time by the clock of the sender.
+func (s *gossipSender) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return now()
+}
+
 func (s *gossipSender) run(stop <-chan struct{}, more <-chan struct{}, flush <-chan chan<- bool) {
 	sent := false
 	for {
 		select {
 		case <-stop:
 			return
+		case <-s.quit:
+			return
 		case <-more:
 			sentSomething, err := s.deliver(stop)
 			if err != nil {
@@ -130,6 +403,7 @@ func (s *gossipSender) run(stop <-chan struct{}, more <-chan struct{}, flush <-c
 
 func (s *gossipSender) deliver(stop <-chan struct{}) (bool, error) {
 	sent := false
+	count := 0
 	// We must not hold our lock when sending, since that would block
 	// the callers of Send/Broadcast while we are stuck waiting for
 	// network congestion to clear. So we pick and send one piece of
@@ -140,50 +414,264 @@ func (s *gossipSender) deliver(stop <-chan struct{}) (bool, error) {
 			return sent, nil
 		default:
 		}
-		data, makeProtocolMsg := s.pick()
-		if data == nil {
-			return sent, nil
+		if len(s.carry) == 0 {
+			data, makeProtocolMsg := s.pick()
+			if data == nil {
+				s.endTurn()
+				s.noteDelivered()
+				return sent, nil
+			}
+			version := schemaVersion(data)
+			for _, msg := range data.Encode() {
+				s.carry = append(s.carry, makeProtocolMsg(version, msg))
+			}
 		}
-		for _, msg := range data.Encode() {
-			if err := s.sender.SendProtocolMsg(makeProtocolMsg(msg)); err != nil {
+		for len(s.carry) > 0 {
+			if s.maxBatch > 0 && count >= s.maxBatch {
+				// leave the rest for the next flush
+				s.endTurn()
+				s.prod()
+				return sent, nil
+			}
+			pm := s.carry[0]
+			s.carry = s.carry[1:]
+			if err := s.send(stop, pm); err != nil {
 				return sent, err
 			}
+			count++
+			sent = true
 		}
 		sent = true
 	}
 }
 
-func (s *gossipSender) pick() (data GossipData, makeProtocolMsg func(msg []byte) protocolMsg) {
+// send sends a message, first waiting for our turn if scheduled, and
+// for the bytes to be available if throttled.
+func (s *gossipSender) send(stop <-chan struct{}, pm protocolMsg) error {
+	if !s.awaitAfter(stop) {
+		return nil
+	}
+	n := 1 + len(pm.msg)
+	if s.bytes != nil && !s.bytes.wait(stop, n) {
+		return nil
+	}
+	if !s.tenant.wait(stop, n) {
+		return nil
+	}
+	if s.scheduler == nil {
+		return s.sendCounted(pm, n)
+	}
+	if s.turnUsed < 0 {
+		if !s.scheduler.acquire(stop) {
+			return nil
+		}
+		s.turnUsed = 0
+	}
+	err := s.sendCounted(pm, n)
+	if s.turnUsed++; s.turnUsed >= s.weight {
+		s.endTurn()
+	}
+	return err
+}
+
+// sendCounted sends a message of n bytes, counting it for our tenant.
+func (s *gossipSender) sendCounted(pm protocolMsg, n int) error {
+	err := s.sender.SendProtocolMsg(pm)
+	if err == nil {
+		s.tenant.countSent(n)
+	}
+	return err
+}
+
+func (s *gossipSender) endTurn() {
+	if s.turnUsed >= 0 {
+		s.turnUsed = -1
+		s.scheduler.release()
+	}
+}
+
+// fairScheduler takes turns between the gossip senders of a connection,
+// so that a channel with a lot to send cannot starve the others. Each
+// sender sends up to its weight in messages per turn, and senders wait
+// for their turn in order of arrival, giving weighted round-robin.
+type fairScheduler struct {
+	sync.Mutex
+	busy    bool
+	waiters []chan struct{}
+}
+
+// acquire waits for a turn, returning false if stopped first.
+func (f *fairScheduler) acquire(stop <-chan struct{}) bool {
+	f.Lock()
+	if !f.busy {
+		f.busy = true
+		f.Unlock()
+		return true
+	}
+	turn := make(chan struct{})
+	f.waiters = append(f.waiters, turn)
+	f.Unlock()
+	select {
+	case <-turn:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// release ends a turn, handing it to the longest waiting sender.
+func (f *fairScheduler) release() {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.waiters) == 0 {
+		f.busy = false
+		return
+	}
+	close(f.waiters[0])
+	f.waiters = f.waiters[1:]
+}
+
+func (f *fairScheduler) waiting() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.waiters)
+}
+
+func (s *gossipSender) pick() (data GossipData, makeProtocolMsg func(version byte, msg []byte) protocolMsg) {
 	s.Lock()
 	defer s.Unlock()
+	defer func(pending int) {
+		if s.pending < pending && s.shrank != nil {
+			s.shrank()
+		}
+	}(s.pending)
+	t := s.now()
+	if s.retention.MaxAge > 0 {
+		for srcName := range s.retained {
+			s.trim(srcName, t)
+		}
+	}
+	s.expire(t)
 	switch {
 	case s.gossip != nil: // usually more important than broadcasts
 		data = s.gossip
 		makeProtocolMsg = s.makeMsg
 		s.gossip = nil
+		s.pending -= s.gossipCount
+		s.gossipCount = 0
+		s.gossipDeadline = time.Time{}
+		s.gossipSince = 0
 	case len(s.broadcasts) > 0:
 		for srcName, d := range s.broadcasts {
+			var seq uint64
+			if sd, ok := d.(*sequencedGossipData); ok {
+				d, seq = sd.GossipData, sd.seq
+			}
 			data = d
-			makeProtocolMsg = func(msg []byte) protocolMsg { return s.makeBroadcastMsg(srcName, msg) }
+			makeProtocolMsg = func(version byte, msg []byte) protocolMsg { return s.makeBroadcastMsg(srcName, version, seq, msg) }
 			delete(s.broadcasts, srcName)
+			delete(s.retained, srcName)
+			s.pending -= s.broadcastCounts[srcName]
+			delete(s.broadcastCounts, srcName)
+			delete(s.broadcastDeadlines, srcName)
+			delete(s.broadcastSince, srcName)
 			break
 		}
 	}
 	return
 }
 
+// admit applies the send queue limits before another item is accumulated,
+// returning false if the item must be dropped. Must hold s.Lock.
+func (s *gossipSender) admit() bool {
+	if s.limits == nil || s.limits.maxPending <= 0 || s.pending < s.limits.maxPending {
+		return true
+	}
+	switch s.overflow {
+	case GossipOverflowClose:
+		atomic.AddUint64(&s.limits.dropped, 1)
+		s.noteDrop(GossipDropQueueFull, 1)
+		if s.limits.shutdown != nil {
+			s.limits.shutdown(fmt.Errorf("pending gossip exceeds limit (%d)", s.limits.maxPending))
+		}
+		return false
+	default:
+		for s.pending >= s.limits.maxPending {
+			n := s.dropOldest(GossipDropQueueFull)
+			atomic.AddUint64(&s.limits.dropped, uint64(n))
+		}
+		return true
+	}
+}
+
+// dropOldest discards whichever of the gossip, or the broadcasts from one
+// origin, has the oldest item pending, returning the number of items
+// discarded. Must hold s.Lock, with something pending.
+func (s *gossipSender) dropOldest(reason GossipDropReason) int {
+	oldest, from, isBroadcast := s.gossipSince, UnknownPeerName, false
+	if s.gossip == nil {
+		oldest = ^uint64(0)
+	}
+	for srcName, since := range s.broadcastSince {
+		if since < oldest {
+			oldest, from, isBroadcast = since, srcName, true
+		}
+	}
+	if isBroadcast {
+		return s.dropBroadcasts(from, reason)
+	}
+	return s.dropGossip(reason)
+}
+
+// dropGossip discards the pending gossip, returning the number of items
+// discarded. Must hold s.Lock.
+func (s *gossipSender) dropGossip(reason GossipDropReason) int {
+	n := s.gossipCount
+	s.noteDrop(reason, n)
+	s.gossip = nil
+	s.pending -= n
+	s.gossipCount = 0
+	s.gossipDeadline = time.Time{}
+	s.gossipSince = 0
+	return n
+}
+
+// dropBroadcasts discards the broadcasts pending from srcName, returning
+// the number of items discarded. Must hold s.Lock.
+func (s *gossipSender) dropBroadcasts(srcName PeerName, reason GossipDropReason) int {
+	n := s.broadcastCounts[srcName]
+	s.noteDrop(reason, n)
+	delete(s.broadcasts, srcName)
+	delete(s.retained, srcName)
+	s.pending -= n
+	delete(s.broadcastCounts, srcName)
+	delete(s.broadcastDeadlines, srcName)
+	delete(s.broadcastSince, srcName)
+	return n
+}
+
 // Send accumulates the GossipData and will send it eventually.
 // Send and Broadcast accumulate into different buckets.
 func (s *gossipSender) Send(data GossipData) {
 	s.Lock()
 	defer s.Unlock()
+	if !s.admit() {
+		return
+	}
 	if s.empty() {
 		defer s.prod()
 	}
+	s.pending++
+	s.gossipCount++
+	s.arrivals++
+	data, deadline := splitDeadline(data)
 	if s.gossip == nil {
 		s.gossip = data
+		s.gossipDeadline = deadline
+		s.gossipSince = s.arrivals
 	} else {
-		s.gossip = s.gossip.Merge(data)
+		s.gossip = s.merge(s.gossip, data)
+		s.gossipDeadline = laterDeadline(s.gossipDeadline, deadline)
 	}
 }
 
@@ -192,15 +680,157 @@ func (s *gossipSender) Send(data GossipData) {
 func (s *gossipSender) Broadcast(srcName PeerName, data GossipData) {
 	s.Lock()
 	defer s.Unlock()
+	if !s.admit() {
+		return
+	}
 	if s.empty() {
 		defer s.prod()
 	}
+	s.pending++
+	s.broadcastCounts[srcName]++
+	s.arrivals++
+	if _, found := s.broadcastSince[srcName]; !found {
+		if s.broadcastSince == nil {
+			s.broadcastSince = make(map[PeerName]uint64)
+		}
+		s.broadcastSince[srcName] = s.arrivals
+	}
+	data, deadline := splitDeadline(data)
+	if _, found := s.broadcasts[srcName]; found {
+		deadline = laterDeadline(s.broadcastDeadlines[srcName], deadline)
+	}
+	s.setBroadcastDeadline(srcName, deadline)
+	if s.retention.limited() {
+		s.retain(srcName, data)
+		return
+	}
+	s.mergeBroadcast(srcName, data)
+}
+
+// mergeBroadcast merges data into what is held from srcName. Must hold
+// s.Lock.
+func (s *gossipSender) mergeBroadcast(srcName PeerName, data GossipData) {
 	d, found := s.broadcasts[srcName]
 	if !found {
 		s.broadcasts[srcName] = data
-	} else {
-		s.broadcasts[srcName] = d.Merge(data)
+		return
+	}
+	if _, sequenced := data.(*sequencedGossipData); sequenced {
+		if _, ok := d.(*sequencedGossipData); !ok {
+			d = &sequencedGossipData{d, 0}
+		}
+	}
+	s.broadcasts[srcName] = s.merge(d, data)
+}
+
+// retain holds data from srcName subject to the retention limits. Must
+// hold s.Lock.
+func (s *gossipSender) retain(srcName PeerName, data GossipData) {
+	if s.retained == nil {
+		s.retained = make(map[PeerName][]retainedBroadcast)
+	}
+	t := s.now()
+	s.retained[srcName] = append(s.retained[srcName], retainedBroadcast{data, t, s.arrivals})
+	if !s.trim(srcName, t) {
+		s.mergeBroadcast(srcName, data)
+	}
+}
+
+// trim discards what is held from srcName beyond the retention limits,
+// as of t, and if it discards anything, re-merges the rest. It reports
+// whether it did so. Must hold s.Lock.
+func (s *gossipSender) trim(srcName PeerName, t time.Time) bool {
+	items := s.retained[srcName]
+	drop := 0
+	if max := s.retention.MaxItems; max > 0 && len(items) > max {
+		drop = len(items) - max
+	}
+	if maxAge := s.retention.MaxAge; maxAge > 0 {
+		for drop < len(items) && t.Sub(items[drop].t) > maxAge {
+			drop++
+		}
+	}
+	if drop == 0 {
+		return false
+	}
+	s.noteDrop(GossipDropRetention, drop)
+	s.pending -= drop
+	s.broadcastCounts[srcName] -= drop
+	delete(s.broadcasts, srcName)
+	if drop == len(items) {
+		delete(s.retained, srcName)
+		delete(s.broadcastCounts, srcName)
+		delete(s.broadcastDeadlines, srcName)
+		delete(s.broadcastSince, srcName)
+		return true
+	}
+	s.retained[srcName] = items[drop:]
+	s.broadcastSince[srcName] = items[drop].arrival
+	for _, item := range items[drop:] {
+		s.mergeBroadcast(srcName, item.data)
+	}
+	return true
+}
+
+func (s *gossipSender) merge(a, b GossipData) GossipData {
+	s.merges.acquire()
+	defer s.merges.release()
+	if s.validator == nil {
+		return a.Merge(b)
+	}
+	return s.validator.merge(a, b)
+}
+
+// mergeSlots bounds how many merges run at once, holding a token for
+// each. See Config.MaxConcurrentMerges.
+type mergeSlots chan struct{}
+
+// acquire waits for a free slot. A nil mergeSlots is unbounded.
+func (m mergeSlots) acquire() {
+	if m != nil {
+		m <- struct{}{}
+	}
+}
+
+func (m mergeSlots) release() {
+	if m != nil {
+		<-m
+	}
+}
+
+// mergeValidator checks that merges are commutative, by merging copies
+// in both orders and comparing the results. See
+// Config.DebugMergeValidation.
+type mergeValidator struct {
+	logger     Logger
+	violations uint64 // atomic
+}
+
+// merge returns a merged with b, noting a violation if copies of them
+// merged the other way round differ. Data which is not Cloneable is
+// merged unchecked: b is the very data queued for our other
+// connections, and merging into it would change what they send.
+// Surrogate data, relayed verbatim, is never Cloneable.
+func (v *mergeValidator) merge(a, b GossipData) GossipData {
+	x, xok := unsequenced(a).(Cloneable)
+	y, yok := unsequenced(b).(Cloneable)
+	if xok && yok {
+		merged := x.Clone().Merge(y.Clone())
+		reversed := y.Clone().Merge(x.Clone())
+		if !reflect.DeepEqual(merged, reversed) {
+			atomic.AddUint64(&v.violations, 1)
+			v.logger.Printf("Merge of %T is not commutative", x)
+		}
 	}
+	return a.Merge(b)
+}
+
+// unsequenced returns data without any sequence number.
+func unsequenced(data GossipData) GossipData {
+	if sd, ok := data.(*sequencedGossipData); ok {
+		return sd.GossipData
+	}
+	return data
 }
 
 func (s *gossipSender) empty() bool { return s.gossip == nil && len(s.broadcasts) == 0 }
@@ -212,6 +842,66 @@ func (s *gossipSender) prod() {
 	}
 }
 
+// sendFirst is Send, returning a channel which is closed once everything
+// pending, including data, has been sent, so that the senders of other
+// channels can be made to wait for it with sendAfter.
+func (s *gossipSender) sendFirst(data GossipData) <-chan struct{} {
+	s.Lock()
+	if s.delivered == nil {
+		s.delivered = make(chan struct{})
+	}
+	delivered := s.delivered
+	s.Unlock()
+	s.Send(data)
+	return delivered
+}
+
+// sendAfter is Send, holding back everything pending until after is
+// closed. A nil after does not hold anything back.
+func (s *gossipSender) sendAfter(data GossipData, after <-chan struct{}) {
+	if after != nil {
+		s.Lock()
+		s.after = after
+		s.Unlock()
+	}
+	s.Send(data)
+}
+
+// noteDelivered closes the channel returned by sendFirst, now that
+// everything pending has been sent.
+func (s *gossipSender) noteDelivered() {
+	s.Lock()
+	defer s.Unlock()
+	if s.delivered != nil {
+		close(s.delivered)
+		s.delivered = nil
+	}
+}
+
+// awaitAfter waits until the channel given to sendAfter is closed,
+// returning false if stopped first.
+func (s *gossipSender) awaitAfter(stop <-chan struct{}) bool {
+	s.Lock()
+	after := s.after
+	s.Unlock()
+	if after == nil {
+		return true
+	}
+	select {
+	case <-after:
+	case <-stop:
+		return false
+	case <-s.quit:
+		return false
+	}
+	s.Lock()
+	if s.after == after {
+		s.after = nil
+	}
+	s.Unlock()
+	return true
+}
+
 // Flush sends all pending data, and returns true if anything was sent since
 // the previous flush. For testing.
 func (s *gossipSender) Flush() bool {
@@ -225,9 +915,18 @@ func (s *gossipSender) Flush() bool {
 // TODO(pb): may be able to remove this and use makeGossipSender directly
 type gossipSenders struct {
 	sync.Mutex
-	sender  protocolSender
-	stop    <-chan struct{}
-	senders map[string]*gossipSender
+	sender     protocolSender
+	stop       <-chan struct{}
+	senders    map[string]*gossipSender
+	limits     *sendQueueLimits
+	weights    map[string]int // see Config.ChannelWeights
+	sched      *fairScheduler // nil unless weights are set
+	validator  *mergeValidator
+	maxBatch   int                                                  // see Config.MaxGossipBatch
+	retention  map[string]BroadcastRetention                        // see Config.BroadcastRetention
+	bytes      *byteBucket                                          // see Config.TotalByteRate
+	merges     mergeSlots                                           // see Config.MaxConcurrentMerges
+	reportDrop func(channel string, reason GossipDropReason, n int) // see reportDrops
 }
 
 // NewGossipSenders returns a usable GossipSenders leveraging the ProtocolSender.
@@ -248,11 +947,132 @@ func (gs *gossipSenders) Sender(channelName string, makeGossipSender func(sender
 	s, found := gs.senders[channelName]
 	if !found {
 		s = makeGossipSender(gs.sender, gs.stop)
+		if gs.limits != nil && channelName != topologyChannel {
+			// Topology is exempt; it merges into one message anyway
+			s.limits = gs.limits
+			s.overflow = gs.limits.policy(channelName)
+		}
+		s.validator = gs.validator
+		s.maxBatch = gs.maxBatch
+		s.retention = gs.retention[channelName]
+		s.bytes = gs.bytes
+		s.merges = gs.merges
+		if report := gs.reportDrop; report != nil {
+			s.dropped = func(reason GossipDropReason, n int) { report(channelName, reason, n) }
+		}
+		if gs.sched != nil {
+			s.scheduler = gs.sched
+			s.weight = 1
+			if w := gs.weights[channelName]; w > 0 {
+				s.weight = w
+			}
+		}
 		gs.senders[channelName] = s
 	}
 	return s
 }
 
+// limit bounds the gossip pending in each managed sender, but that of the
+// topology, to maxPending items, applying the channel's policy from
+// channels, or else overflow, when exceeded. Must be called before any
+// senders are made.
+func (gs *gossipSenders) limit(maxPending int, overflow GossipOverflowPolicy, channels map[string]GossipOverflowPolicy, shutdown func(error)) {
+	gs.Lock()
+	defer gs.Unlock()
+	gs.limits = &sendQueueLimits{maxPending: maxPending, overflow: overflow, channels: channels, shutdown: shutdown}
+}
+
+// schedule has the managed senders take turns, sending up to their
+// channel's weight in messages per turn; channels without a weight get
+// one. Must be called before any senders are made.
+func (gs *gossipSenders) schedule(weights map[string]int) {
+	gs.Lock()
+	defer gs.Unlock()
+	gs.weights = weights
+	gs.sched = &fairScheduler{}
+}
+
+// batch bounds the number of messages each managed sender sends per
+// flush. Must be called before any senders are made.
+func (gs *gossipSenders) batch(maxBatch int) {
+	gs.Lock()
+	defer gs.Unlock()
+	gs.maxBatch = maxBatch
+}
+
+// retain limits the broadcast data held by the managed senders of each
+// channel listed in retention. Must be called before any senders are made.
+func (gs *gossipSenders) retain(retention map[string]BroadcastRetention) {
+	gs.Lock()
+	defer gs.Unlock()
+	gs.retention = retention
+}
+
+// throttle has the managed senders wait for each message's bytes to be
+// available from b, which may be shared with other connections. Must be
+// called before any senders are made.
+func (gs *gossipSenders) throttle(b *byteBucket) {
+	gs.Lock()
+	defer gs.Unlock()
+	gs.bytes = b
+}
+
+// reportDrops has the managed senders report the messages they drop to
+// f. Must be called before any senders are made.
+func (gs *gossipSenders) reportDrops(f func(channel string, reason GossipDropReason, n int)) {
+	gs.Lock()
+	defer gs.Unlock()
+	gs.reportDrop = f
+}
+
+// limitMerges has the managed senders take a slot from m for each merge
+// they make. Must be called before any senders are made.
+func (gs *gossipSenders) limitMerges(m mergeSlots) {
+	gs.Lock()
+	defer gs.Unlock()
+	gs.merges = m
+}
+
+// validateMerges has the managed senders check each merge they make with
+// v. Must be called before any senders are made.
+func (gs *gossipSenders) validateMerges(v *mergeValidator) {
+	gs.Lock()
+	defer gs.Unlock()
+	gs.validator = v
+}
+
+// pending returns the number of gossip items awaiting transmission by
+// the named channel's sender, if any.
+func (gs *gossipSenders) pending(channelName string) int {
+	gs.Lock()
+	s, found := gs.senders[channelName]
+	gs.Unlock()
+	if !found {
+		return 0
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.pending
+}
+
+// drop stops and forgets the sender for the named channel, if any,
+// discarding whatever it has pending.
+func (gs *gossipSenders) drop(channelName string) {
+	gs.Lock()
+	defer gs.Unlock()
+	if s, found := gs.senders[channelName]; found {
+		delete(gs.senders, channelName)
+		close(s.quit)
+	}
+}
+
+// dropped returns the number of gossip items dropped due to the limits.
+func (gs *gossipSenders) dropped() uint64 {
+	gs.Lock()
+	defer gs.Unlock()
+	return gs.limits.droppedCount()
+}
+
 // Flush flushes all managed senders. Used for testing.
 func (gs *gossipSenders) Flush() bool {
 	sent := false
@@ -270,3 +1090,12 @@ type gossipChannels map[string]*gossipChannel
 type gossipConnection interface {
 	gossipSenders() *gossipSenders
 }
+
+// connectionStop returns a channel closed when conn is, or nil if conn
+// is not ours to know.
+func connectionStop(conn Connection) <-chan struct{} {
+	if gc, ok := conn.(gossipConnection); ok {
+		return gc.gossipSenders().stop
+	}
+	return nil
+}
@@ -4,30 +4,75 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // gossipChannel is a logical communication channel within a physical mesh.
 type gossipChannel struct {
-	name     string
-	ourself  *localPeer
-	routes   *routes
-	gossiper Gossiper
-	logger   Logger
+	name      string
+	ourself   *localPeer
+	routes    *routes
+	gossiper  Gossiper
+	logger    Logger
+	coalescer *relayCoalescer   // nil if disabled
+	sequenced bool              // see Router.NewSequencedGossip
+	sequence  uint64            // atomic; last broadcast sequence we originated, if sequenced
+	interval  *adaptiveInterval // nil unless adaptive
+	noRelay   bool              // see Router.NewNeighbourGossip
+	surrogate bool              // created on receipt, not registered by us
+	received  int64             // atomic; UnixNano of last gossip received, for surrogates
+	tenant    *tenantAccount    // see Config.ChannelTenants; nil without a router
+	essential bool              // topology; exempt from Config.GossipSchedule and UnknownPeerGossip
+	reliable  *reliableUnicasts // nil unless created by Router.NewReliableGossip
+	budget    *regossipBudget   // nil unless Config.RegossipBudget is set
+
+	sequenceLock sync.Mutex
+	lastSequence map[PeerName]uint64 // highest broadcast sequence seen, by origin
+
+	heldLock      sync.Mutex
+	heldBroadcast GossipData // originated while paused; see hold
+	heldSubset    GossipData
+
+	shrunkLock sync.Mutex
+	shrunk     chan struct{} // closed when a backlog next shrinks; see awaitBackpressure
+
+	scheduledLock sync.Mutex
+	scheduled     map[*time.Timer]struct{} // broadcasts pending from SendAt
 }
 
 // newGossipChannel returns a named, usable channel.
 // It delegates receiving duties to the passed Gossiper.
 func newGossipChannel(channelName string, ourself *localPeer, r *routes, g Gossiper, logger Logger) *gossipChannel {
-	return &gossipChannel{
-		name:     channelName,
-		ourself:  ourself,
-		routes:   r,
-		gossiper: g,
-		logger:   logger,
+	c := &gossipChannel{
+		name:         channelName,
+		ourself:      ourself,
+		routes:       r,
+		gossiper:     g,
+		logger:       logger,
+		sequence:     newIncarnation(),
+		lastSequence: make(map[PeerName]uint64),
+	}
+	if ourself.router != nil && ourself.router.RelayCoalesceWindow > 0 {
+		c.coalescer = newRelayCoalescer(ourself.router.RelayCoalesceWindow, ourself.router.now)
+	}
+	if router := ourself.router; router != nil && router.adaptiveGossip() {
+		c.interval = newAdaptiveInterval(router.MinGossipInterval, router.MaxGossipInterval, router.gossipInterval(), router.now())
 	}
+	if ourself.router != nil {
+		c.tenant = ourself.router.channelTenant(channelName)
+	}
+	if ourself.router != nil && ourself.router.RegossipBudget > 0 {
+		c.budget = newRegossipBudget(ourself.router.RegossipBudget)
+	}
+	return c
 }
 
-func (c *gossipChannel) deliverUnicast(srcName PeerName, origPayload []byte, dec *gob.Decoder) error {
+func (c *gossipChannel) deliverUnicast(srcName, sender PeerName, origMsg protocolMsg, dec *gob.Decoder) error {
 	var destName PeerName
 	if err := dec.Decode(&destName); err != nil {
 		return err
@@ -37,56 +82,283 @@ func (c *gossipChannel) deliverUnicast(srcName PeerName, origPayload []byte, dec
 		if err := dec.Decode(&payload); err != nil {
 			return err
 		}
-		return c.gossiper.OnGossipUnicast(srcName, payload)
+		deliver := func(payload []byte) error {
+			c.tap(srcName, payload)
+			return c.trace(GossipDeliver, srcName, func() error {
+				if g, ok := c.gossiper.(GossiperWithSchemaVersion); ok {
+					version, err := decodeSchemaVersion(dec)
+					if err != nil {
+						return err
+					}
+					return g.OnGossipUnicastVersion(srcName, version, payload)
+				}
+				if g, ok := c.gossiper.(GossiperWithProvenance); ok {
+					return g.OnGossipUnicastFrom(srcName, sender, payload)
+				}
+				return c.gossiper.OnGossipUnicast(srcName, payload)
+			})
+		}
+		if c.reliable != nil {
+			return c.reliable.receive(c, srcName, payload, deliver)
+		}
+		return deliver(payload)
+	}
+	if c.ourself.NoTransit {
+		c.logf("not relaying unicast from %s to %s: we are NoTransit", srcName, destName)
+		return nil
 	}
-	if err := c.relayUnicast(destName, origPayload); err != nil {
+	if c.noRelay {
+		c.logf("not relaying unicast from %s to %s: channel is neighbour-only", srcName, destName)
+		return nil
+	}
+	if c.quarantined(srcName) {
+		c.logf("not relaying unicast from %s to %s: unknown peer", srcName, destName)
+		return nil
+	}
+	if err := c.trace(GossipRelay, srcName, func() error { return c.relayUnicast(destName, origMsg) }); err != nil {
 		c.logf("%v", err)
 	}
 	return nil
 }
 
-func (c *gossipChannel) deliverBroadcast(srcName PeerName, _ []byte, dec *gob.Decoder) error {
-	var payload []byte
-	if err := dec.Decode(&payload); err != nil {
+func (c *gossipChannel) deliverBroadcast(srcName, sender PeerName, origPayload []byte, dec *gob.Decoder, dict []byte) error {
+	if !c.coalescer.firstArrival(ProtocolGossipBroadcast, origPayload) {
+		c.noteDrop(GossipDropDuplicate, 1)
+		return nil
+	}
+	payload, err := decodePayload(dec, dict)
+	if err != nil {
+		return err
+	}
+	version, err := decodeSchemaVersion(dec)
+	if err != nil {
 		return err
 	}
-	data, err := c.gossiper.OnGossipBroadcast(srcName, payload)
-	if err != nil || data == nil {
+	seq, err := decodeSequence(dec)
+	if err != nil {
+		return err
+	}
+	if !c.admitSequence(srcName, seq) {
+		c.noteDrop(GossipDropStale, 1)
+		return nil
+	}
+	c.tap(srcName, payload)
+	var data GossipData
+	err = c.trace(GossipDeliver, srcName, func() (err error) {
+		if g, ok := c.gossiper.(GossiperWithSchemaVersion); ok {
+			data, err = g.OnGossipBroadcastVersion(srcName, version, payload)
+		} else if g, ok := c.gossiper.(GossiperWithProvenance); ok {
+			data, err = g.OnGossipBroadcastFrom(srcName, sender, payload)
+		} else {
+			data, err = c.gossiper.OnGossipBroadcast(srcName, payload)
+		}
+		return err
+	})
+	if err != nil || data == nil || c.noRelay || c.quarantined(srcName) {
 		return err
 	}
-	c.relayBroadcast(srcName, data)
+	c.interval.changed()
+	if !c.admitBroadcast(srcName, seq, data) {
+		return nil
+	}
+	c.trace(GossipRelay, srcName, func() error {
+		c.relayBroadcast(srcName, seq, data)
+		return nil
+	})
 	return nil
 }
 
-func (c *gossipChannel) deliver(srcName PeerName, _ []byte, dec *gob.Decoder) error {
-	var payload []byte
-	if err := dec.Decode(&payload); err != nil {
+// Broadcast sequence numbers hold the incarnation of their origin's
+// channel, chosen at random when it is made, above a count of the
+// broadcasts it has originated. A restarted peer has a new incarnation,
+// which resets the sequence expected from it, whatever its clock says.
+const sequenceCountBits = 40
+
+func newIncarnation() uint64 {
+	incarnation := randUint64() >> sequenceCountBits
+	if incarnation == 0 {
+		incarnation = 1
+	}
+	return incarnation << sequenceCountBits
+}
+
+func sameIncarnation(seq1, seq2 uint64) bool {
+	return seq1>>sequenceCountBits == seq2>>sequenceCountBits
+}
+
+// laterSequence returns the later of held and arriving, taking arriving
+// if it is from another incarnation, which is likely the newer.
+func laterSequence(held, arriving uint64) uint64 {
+	if sameIncarnation(held, arriving) && held > arriving {
+		return held
+	}
+	return arriving
+}
+
+// admitSequence reports whether a broadcast from srcName with sequence
+// seq is no older than the latest seen from the same incarnation of
+// srcName, and records it. Broadcasts without a sequence, and all
+// broadcasts on channels which are not sequenced, are admitted.
+func (c *gossipChannel) admitSequence(srcName PeerName, seq uint64) bool {
+	if seq == 0 || !c.sequenced {
+		return true
+	}
+	c.sequenceLock.Lock()
+	defer c.sequenceLock.Unlock()
+	if last, found := c.lastSequence[srcName]; found && sameIncarnation(seq, last) && seq < last {
+		return false
+	}
+	c.lastSequence[srcName] = seq
+	return true
+}
+
+// forgetSequence forgets the sequence seen from srcName, once it is
+// garbage collected.
+func (c *gossipChannel) forgetSequence(srcName PeerName) {
+	c.sequenceLock.Lock()
+	defer c.sequenceLock.Unlock()
+	delete(c.lastSequence, srcName)
+}
+
+func (c *gossipChannel) deliver(srcName PeerName, origPayload []byte, dec *gob.Decoder, dict []byte) error {
+	if !c.coalescer.firstArrival(ProtocolGossip, origPayload) {
+		c.noteDrop(GossipDropDuplicate, 1)
+		return nil
+	}
+	payload, err := decodePayload(dec, dict)
+	if err != nil {
 		return err
 	}
-	update, err := c.gossiper.OnGossip(payload)
-	if err != nil || update == nil {
+	c.tap(srcName, payload)
+	var update GossipData
+	err = c.trace(GossipDeliver, srcName, func() (err error) {
+		if g, ok := c.gossiper.(GossiperWithSchemaVersion); ok {
+			var version byte
+			if version, err = decodeSchemaVersion(dec); err != nil {
+				return err
+			}
+			update, err = g.OnGossipVersion(version, payload)
+		} else {
+			update, err = c.gossiper.OnGossip(payload)
+		}
 		return err
+	})
+	if err != nil || update == nil || c.noRelay || c.quarantined(srcName) {
+		return err
+	}
+	c.interval.changed()
+	if !c.admitGossip(srcName, update) {
+		return nil
 	}
-	c.relay(srcName, update)
+	c.trace(GossipRelay, srcName, func() error {
+		c.relay(srcName, update)
+		return nil
+	})
 	return nil
 }
 
 // GossipUnicast implements Gossip, relaying msg to dst, which must be a
 // member of the channel.
 func (c *gossipChannel) GossipUnicast(dstPeerName PeerName, msg []byte) error {
-	return c.relayUnicast(dstPeerName, gobEncode(c.name, c.ourself.Name, dstPeerName, msg))
+	return c.GossipUnicastVersion(dstPeerName, 0, msg)
+}
+
+// GossipUnicastVersion implements VersionedGossip, relaying msg to dst
+// along with its schema version.
+func (c *gossipChannel) GossipUnicastVersion(dstPeerName PeerName, version byte, msg []byte) error {
+	if c.seedSilenced() {
+		return errSeedNode
+	}
+	return c.trace(GossipOriginate, c.ourself.Name, func() error {
+		if _, found := c.ourself.ConnectionTo(dstPeerName); c.noRelay && !found {
+			return fmt.Errorf("%s is not a neighbour", dstPeerName)
+		}
+		if c.reliable != nil {
+			return c.reliable.send(c, dstPeerName, version, msg)
+		}
+		return c.relayUnicast(dstPeerName, protocolMsg{ProtocolGossipUnicast, gobEncodeVersioned(version, c.name, c.ourself.Name, dstPeerName, msg)})
+	})
 }
 
 // GossipBroadcast implements Gossip, relaying update to all members of the
 // channel.
 func (c *gossipChannel) GossipBroadcast(update GossipData) {
-	c.relayBroadcast(c.ourself.Name, update)
+	if c.seedSilenced() || c.hold(update, true) {
+		return
+	}
+	c.awaitBackpressure()
+	c.interval.changed()
+	var seq uint64
+	if c.sequenced {
+		seq = atomic.AddUint64(&c.sequence, 1)
+	}
+	c.trace(GossipOriginate, c.ourself.Name, func() error {
+		c.relayBroadcast(c.ourself.Name, seq, update)
+		return nil
+	})
 }
 
 // GossipNeighbourSubset implements Gossip, relaying update to subset of members of the
 // channel.
 func (c *gossipChannel) GossipNeighbourSubset(update GossipData) {
-	c.relay(c.ourself.Name, update)
+	if c.seedSilenced() || c.hold(update, false) {
+		return
+	}
+	c.awaitBackpressure()
+	c.interval.changed()
+	c.trace(GossipOriginate, c.ourself.Name, func() error {
+		c.relay(c.ourself.Name, update)
+		return nil
+	})
+}
+
+// touch notes that we have received gossip on the channel.
+func (c *gossipChannel) touch() {
+	atomic.StoreInt64(&c.received, c.ourself.router.now().UnixNano())
+}
+
+// lastReceived returns when we last received gossip on the channel, if
+// it is a surrogate.
+func (c *gossipChannel) lastReceived() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.received))
+}
+
+// SendAt implements ScheduledGossip, broadcasting update at t, by the
+// router's clock.
+func (c *gossipChannel) SendAt(t time.Time, update GossipData) {
+	c.scheduledLock.Lock()
+	defer c.scheduledLock.Unlock()
+	if c.scheduled == nil {
+		c.scheduled = make(map[*time.Timer]struct{})
+	}
+	var timer *time.Timer
+	// A delay which has passed fires at once; the timer is set before
+	// we unlock
+	timer = time.AfterFunc(t.Sub(c.ourself.router.now()), func() {
+		c.scheduledLock.Lock()
+		_, pending := c.scheduled[timer]
+		delete(c.scheduled, timer)
+		c.scheduledLock.Unlock()
+		if pending {
+			c.GossipBroadcast(update)
+		}
+	})
+	c.scheduled[timer] = struct{}{}
+}
+
+// cancelScheduled cancels the broadcasts pending from SendAt.
+func (c *gossipChannel) cancelScheduled() {
+	c.scheduledLock.Lock()
+	defer c.scheduledLock.Unlock()
+	for timer := range c.scheduled {
+		timer.Stop()
+	}
+	c.scheduled = nil
+}
+
+// CurrentState implements InspectableGossip.
+func (c *gossipChannel) CurrentState() GossipData {
+	return c.gossiper.Gossip()
 }
 
 // Send relays data into the channel topology via random neighbours.
@@ -99,18 +371,103 @@ func (c *gossipChannel) SendDown(conn Connection, data GossipData) {
 	c.senderFor(conn).Send(data)
 }
 
-func (c *gossipChannel) relayUnicast(dstPeerName PeerName, buf []byte) (err error) {
+// awaitBackpressure delays the origination of gossip while our
+// neighbours' backlogs on this channel are at the configured threshold,
+// as measured by the configured policy. The topology is exempt, lest
+// routes be slow to converge just when a neighbour lags.
+func (c *gossipChannel) awaitBackpressure() {
+	router := c.ourself.router
+	if router == nil || c.essential || router.GossipBackpressure == BackpressureNone || router.BackpressureThreshold <= 0 {
+		return
+	}
+	maxDelay := router.BackpressureMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultBackpressureMaxDelay
+	}
+	deadline := router.now().Add(maxDelay)
+	for {
+		// Taken before measuring, so that no shrinkage is missed
+		shrunk := c.backlogShrinking()
+		if c.backlog(router.GossipBackpressure) < router.BackpressureThreshold {
+			return
+		}
+		remaining := deadline.Sub(router.now())
+		if remaining <= 0 {
+			return
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-shrunk:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// backlogShrinking returns a channel which is closed when the backlog of
+// one of our senders next shrinks.
+func (c *gossipChannel) backlogShrinking() <-chan struct{} {
+	c.shrunkLock.Lock()
+	defer c.shrunkLock.Unlock()
+	if c.shrunk == nil {
+		c.shrunk = make(chan struct{})
+	}
+	return c.shrunk
+}
+
+// backlogShrank is called by our senders as they send or discard gossip.
+func (c *gossipChannel) backlogShrank() {
+	c.shrunkLock.Lock()
+	defer c.shrunkLock.Unlock()
+	if c.shrunk != nil {
+		close(c.shrunk)
+		c.shrunk = nil
+	}
+}
+
+// backlog returns the number of gossip items pending on this channel
+// for the slowest or median neighbour, according to policy.
+func (c *gossipChannel) backlog(policy BackpressurePolicy) int {
+	var depths []int
+	for conn := range c.ourself.getConnections() {
+		if gc, ok := conn.(gossipConnection); ok {
+			depths = append(depths, gc.gossipSenders().pending(c.name))
+		}
+	}
+	if len(depths) == 0 {
+		return 0
+	}
+	sort.Ints(depths)
+	if policy == BackpressureMedian {
+		return depths[len(depths)/2]
+	}
+	return depths[len(depths)-1]
+}
+
+func (c *gossipChannel) relayUnicast(dstPeerName PeerName, pm protocolMsg) error {
+	_, err := c.relayUnicastVia(dstPeerName, pm)
+	return err
+}
+
+// relayUnicastVia is relayUnicast, also returning the connection pm was
+// sent over.
+func (c *gossipChannel) relayUnicastVia(dstPeerName PeerName, pm protocolMsg) (conn Connection, err error) {
 	if relayPeerName, found := c.routes.UnicastAll(dstPeerName); !found {
 		err = fmt.Errorf("unknown relay destination: %s", dstPeerName)
-	} else if conn, found := c.ourself.ConnectionTo(relayPeerName); !found {
+	} else if conn, found = c.ourself.ConnectionTo(relayPeerName); !found {
 		err = fmt.Errorf("unable to find connection to relay peer %s", relayPeerName)
-	} else {
-		err = conn.(protocolSender).SendProtocolMsg(protocolMsg{ProtocolGossipUnicast, buf})
+	} else if !c.tenant.wait(connectionStop(conn), 1+len(pm.msg)) {
+		err = fmt.Errorf("connection to relay peer %s closed", relayPeerName)
+	} else if err = conn.(protocolSender).SendProtocolMsg(pm); err == nil {
+		c.tenant.countSent(1 + len(pm.msg))
 	}
-	return err
+	return conn, err
 }
 
-func (c *gossipChannel) relayBroadcast(srcName PeerName, update GossipData) {
+func (c *gossipChannel) relayBroadcast(srcName PeerName, seq uint64, update GossipData) {
+	if seq != 0 {
+		update = &sequencedGossipData{update, seq}
+	}
 	c.routes.ensureRecalculated()
 	for _, conn := range c.ourself.ConnectionsTo(c.routes.BroadcastAll(srcName)) {
 		c.senderFor(conn).Broadcast(srcName, update)
@@ -118,26 +475,88 @@ func (c *gossipChannel) relayBroadcast(srcName PeerName, update GossipData) {
 }
 
 func (c *gossipChannel) relay(srcName PeerName, data GossipData) {
+	if c.noRelay {
+		// what we send goes no further, so send it to everyone
+		for conn := range c.ourself.getConnections() {
+			c.senderFor(conn).Send(data)
+		}
+		return
+	}
 	c.routes.ensureRecalculated()
 	for _, conn := range c.ourself.ConnectionsTo(c.routes.randomNeighbours(srcName)) {
 		c.senderFor(conn).Send(data)
 	}
 }
 
+// sendDownFirst is SendDown, returning a channel which is closed once
+// the data has been sent. See Router.sendAllGossipDown.
+func (c *gossipChannel) sendDownFirst(conn Connection, data GossipData) <-chan struct{} {
+	return c.senderFor(conn).sendFirst(data)
+}
+
+// sendDownAfter is SendDown, holding back the data until after is
+// closed.
+func (c *gossipChannel) sendDownAfter(conn Connection, data GossipData, after <-chan struct{}) {
+	c.senderFor(conn).sendAfter(data, after)
+}
+
 func (c *gossipChannel) senderFor(conn Connection) *gossipSender {
 	return conn.(gossipConnection).gossipSenders().Sender(c.name, c.makeGossipSender)
 }
 
 func (c *gossipChannel) makeGossipSender(sender protocolSender, stop <-chan struct{}) *gossipSender {
-	return newGossipSender(c.makeMsg, c.makeBroadcastMsg, sender, stop)
+	makeMsg, makeBroadcastMsg := c.makeMsg, c.makeBroadcastMsg
+	if cs, ok := sender.(interface{ acceptsCompactGossip() bool }); ok && cs.acceptsCompactGossip() {
+		makeMsg, makeBroadcastMsg = c.makeCompactMsg, c.makeCompactBroadcastMsg
+	}
+	if ds, ok := sender.(interface{ gossipDictionary(string) []byte }); ok {
+		if dict := ds.gossipDictionary(c.name); dict != nil {
+			makeMsg, makeBroadcastMsg = withDictionary(dict, makeMsg, makeBroadcastMsg)
+		}
+	}
+	s := newGossipSender(makeMsg, makeBroadcastMsg, sender, stop, c.ourself.router.goroutineCount())
+	s.tenant = c.tenant
+	s.clock = c.ourself.router.now
+	s.shrank = c.backlogShrank
+	return s
+}
+
+func (c *gossipChannel) makeMsg(version byte, msg []byte) protocolMsg {
+	return protocolMsg{ProtocolGossip, gobEncodeVersioned(version, c.name, c.ourself.Name, msg)}
+}
+
+func (c *gossipChannel) makeBroadcastMsg(srcName PeerName, version byte, seq uint64, msg []byte) protocolMsg {
+	return protocolMsg{ProtocolGossipBroadcast, gobEncodeSequenced(version, seq, c.name, srcName, msg)}
 }
 
-func (c *gossipChannel) makeMsg(msg []byte) protocolMsg {
-	return protocolMsg{ProtocolGossip, gobEncode(c.name, c.ourself.Name, msg)}
+func (c *gossipChannel) makeCompactMsg(version byte, msg []byte) protocolMsg {
+	return protocolMsg{ProtocolGossipCompact, append(c.ourself.Name.bytes(), gobEncodeVersioned(version, c.name, msg)...)}
 }
 
-func (c *gossipChannel) makeBroadcastMsg(srcName PeerName, msg []byte) protocolMsg {
-	return protocolMsg{ProtocolGossipBroadcast, gobEncode(c.name, srcName, msg)}
+func (c *gossipChannel) makeCompactBroadcastMsg(srcName PeerName, version byte, seq uint64, msg []byte) protocolMsg {
+	return protocolMsg{ProtocolGossipBroadcastCompact, append(srcName.bytes(), gobEncodeSequenced(version, seq, c.name, msg)...)}
+}
+
+// tap reports the delivery of payload from srcName to the configured
+// GossipTap, if any.
+func (c *gossipChannel) tap(srcName PeerName, payload []byte) {
+	if c.ourself.router != nil && c.ourself.router.GossipTap != nil {
+		c.ourself.router.GossipTap(c.name, srcName, len(payload))
+	}
+}
+
+// trace runs f as the given stage of a message from origin, reporting
+// it to the configured GossipTracer, if any.
+func (c *gossipChannel) trace(stage GossipStage, origin PeerName, f func() error) error {
+	if c.ourself.router == nil || c.ourself.router.GossipTracer == nil {
+		return f()
+	}
+	end := c.ourself.router.GossipTracer.TraceGossip(stage, c.name, origin)
+	err := f()
+	if end != nil {
+		end(err)
+	}
+	return err
 }
 
 func (c *gossipChannel) logf(format string, args ...interface{}) {
@@ -145,6 +564,216 @@ func (c *gossipChannel) logf(format string, args ...interface{}) {
 	c.logger.Printf(format, args...)
 }
 
+// adaptiveInterval tunes how often a channel sends periodic gossip to
+// how often it changes. See Config.MinGossipInterval.
+type adaptiveInterval struct {
+	sync.Mutex
+	min, max time.Duration
+	current  time.Duration
+	changes  int
+	last     time.Time
+}
+
+func newAdaptiveInterval(min, max, initial time.Duration, start time.Time) *adaptiveInterval {
+	a := &adaptiveInterval{min: min, max: max, current: initial, last: start}
+	a.clamp()
+	return a
+}
+
+func (a *adaptiveInterval) clamp() {
+	if a.current < a.min {
+		a.current = a.min
+	} else if a.current > a.max {
+		a.current = a.max
+	}
+}
+
+// changed records a change to the channel. A nil adaptiveInterval
+// ignores changes.
+func (a *adaptiveInterval) changed() {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	a.changes++
+	a.Unlock()
+}
+
+// due reports whether the channel should gossip at t, and if so adjusts
+// the interval to the changes since it last did. A nil adaptiveInterval
+// is always due.
+func (a *adaptiveInterval) due(t time.Time) bool {
+	if a == nil {
+		return true
+	}
+	a.Lock()
+	defer a.Unlock()
+	// allow for ticks, which come every min, arriving a little early
+	if t.Sub(a.last) < a.current-a.min/2 {
+		return false
+	}
+	if a.changes > 0 {
+		a.current /= 2
+	} else {
+		a.current *= 2
+	}
+	a.clamp()
+	a.changes = 0
+	a.last = t
+	return true
+}
+
+func (a *adaptiveInterval) interval() time.Duration {
+	a.Lock()
+	defer a.Unlock()
+	return a.current
+}
+
+// maxCoalesced is how many recent arrivals a relayCoalescer remembers;
+// beyond it, the oldest are forgotten before the window is up.
+const maxCoalesced = 4096
+
+// relayCoalescer suppresses repeated arrivals of an identical message
+// within a short window, so that a burst of copies arriving from several
+// neighbours at once results in a single merge and relay.
+type relayCoalescer struct {
+	sync.Mutex
+	window time.Duration
+	max    int // see maxCoalesced
+	now    func() time.Time
+	byHash map[uint64][]prevUpdate // recent arrivals, by hash
+	order  []prevUpdate            // the same, oldest first
+}
+
+func newRelayCoalescer(window time.Duration, now func() time.Time) *relayCoalescer {
+	return &relayCoalescer{window: window, max: maxCoalesced, now: now, byHash: make(map[uint64][]prevUpdate)}
+}
+
+// firstArrival reports whether msg, received with tag, has not been seen
+// within the window, and records it. A nil relayCoalescer admits all
+// messages.
+func (rc *relayCoalescer) firstArrival(tag protocolTag, msg []byte) bool {
+	if rc == nil {
+		return true
+	}
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte{byte(tag)})
+	_, _ = hash.Write(msg)
+	msgHash := hash.Sum64()
+	arrival := rc.now()
+	rc.Lock()
+	defer rc.Unlock()
+	for len(rc.order) > 0 && arrival.Sub(rc.order[0].t) >= rc.window {
+		rc.forgetOldest()
+	}
+	for _, p := range rc.byHash[msgHash] {
+		if bytes.Equal(msg, p.update) {
+			return false
+		}
+	}
+	if len(rc.order) >= rc.max {
+		rc.forgetOldest()
+	}
+	p := prevUpdate{msg, msgHash, arrival}
+	rc.byHash[msgHash] = append(rc.byHash[msgHash], p)
+	rc.order = append(rc.order, p)
+	return true
+}
+
+// forgetOldest drops the oldest arrival remembered. Must hold rc.Lock.
+func (rc *relayCoalescer) forgetOldest() {
+	oldest := rc.order[0]
+	rc.order = rc.order[1:]
+	// Arrivals with the same hash are in order too, so it is the first
+	if same := rc.byHash[oldest.hash][1:]; len(same) > 0 {
+		rc.byHash[oldest.hash] = same
+	} else {
+		delete(rc.byHash, oldest.hash)
+	}
+}
+
+// compactGossipMsg converts a gossip message to its compact form.
+// Compact gossip messages carry the source name as its NameSize bytes,
+// ahead of the gob-encoded channel name and the rest of the message,
+// rather than gob-encoded after the channel name. This saves bytes and
+// decoding on every message. Peers announce that they accept them with
+// the "CompactGossip" feature.
+func compactGossipMsg(pm protocolMsg) (protocolMsg, error) {
+	r := bytes.NewReader(pm.msg)
+	dec := gob.NewDecoder(r)
+	var channelName string
+	if err := dec.Decode(&channelName); err != nil {
+		return pm, err
+	}
+	channelEnd := len(pm.msg) - r.Len()
+	var srcName PeerName
+	if err := dec.Decode(&srcName); err != nil {
+		return pm, err
+	}
+	srcEnd := len(pm.msg) - r.Len()
+	buf := make([]byte, 0, NameSize+len(pm.msg)-(srcEnd-channelEnd))
+	buf = append(buf, srcName.bytes()...)
+	buf = append(buf, pm.msg[:channelEnd]...)
+	buf = append(buf, pm.msg[srcEnd:]...)
+	return protocolMsg{compactTags[pm.tag], buf}, nil
+}
+
+// expandGossipMsg converts a compact gossip message back to the form
+// accepted by all peers.
+func expandGossipMsg(pm protocolMsg) (protocolMsg, error) {
+	tag, _ := expandedTag(pm.tag)
+	if len(pm.msg) < NameSize {
+		return pm, fmt.Errorf("compact gossip message too short (%d bytes)", len(pm.msg))
+	}
+	srcName, rest := PeerNameFromBin(pm.msg[:NameSize]), pm.msg[NameSize:]
+	r := bytes.NewReader(rest)
+	var channelName string
+	if err := gob.NewDecoder(r).Decode(&channelName); err != nil {
+		return pm, err
+	}
+	channelEnd := len(rest) - r.Len()
+	buf := append(append(append([]byte{}, rest[:channelEnd]...), gobEncode(srcName)...), rest[channelEnd:]...)
+	return protocolMsg{tag, buf}, nil
+}
+
+// gobEncodeVersioned encodes items followed by the schema version, which
+// is omitted when zero so that unversioned messages are unchanged on the
+// wire. Peers which predate schema versions ignore the trailing version.
+func gobEncodeVersioned(version byte, items ...interface{}) []byte {
+	if version != 0 {
+		items = append(items, version)
+	}
+	return gobEncode(items...)
+}
+
+// gobEncodeSequenced encodes items followed by the schema version and
+// broadcast sequence number. Both are omitted when the sequence is zero.
+func gobEncodeSequenced(version byte, seq uint64, items ...interface{}) []byte {
+	if seq == 0 {
+		return gobEncodeVersioned(version, items...)
+	}
+	return gobEncode(append(items, version, seq)...)
+}
+
+// decodeSequence decodes the optional trailing broadcast sequence number,
+// which follows the schema version.
+func decodeSequence(dec *gob.Decoder) (uint64, error) {
+	var seq uint64
+	if err := dec.Decode(&seq); err != nil && err != io.EOF {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// decodeSchemaVersion decodes the optional trailing schema version.
+func decodeSchemaVersion(dec *gob.Decoder) (byte, error) {
+	var version byte
+	if err := dec.Decode(&version); err != nil && err != io.EOF {
+		return 0, err
+	}
+	return version, nil
+}
+
 // GobEncode gob-encodes each item and returns the resulting byte slice.
 func gobEncode(items ...interface{}) []byte {
 	buf := new(bytes.Buffer)
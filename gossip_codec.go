@@ -0,0 +1,211 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// gossipCodecsFeature announces the gossip codecs a peer accepts, beyond
+// gob, which all peers accept.
+const gossipCodecsFeature = "GossipCodecs"
+
+// gossipCodec is the wire encoding of gossip over a connection. Later
+// codecs are preferred over earlier ones.
+type gossipCodec byte
+
+const (
+	// gossipCodecGob gob-encodes the fields of each gossip message.
+	gossipCodecGob gossipCodec = iota
+	// gossipCodecBinary length-prefixes the fields of each gossip
+	// message; see binaryGossipMsg.
+	gossipCodecBinary
+)
+
+var gossipCodecNames = []string{"gob", "binary"}
+
+func (c gossipCodec) String() string {
+	if int(c) < len(gossipCodecNames) {
+		return gossipCodecNames[c]
+	}
+	return fmt.Sprintf("codec%d", c)
+}
+
+// parseGossipCodecs checks that each of names is a known gossip codec.
+func parseGossipCodecs(names []string) error {
+	for _, name := range names {
+		found := false
+		for _, known := range gossipCodecNames {
+			found = found || name == known
+		}
+		if !found {
+			return fmt.Errorf("unknown gossip codec %q", name)
+		}
+	}
+	return nil
+}
+
+// negotiateGossipCodec returns the latest codec among ours which the
+// remote announced in theirs, falling back to gob.
+func negotiateGossipCodec(ours []string, theirs string) gossipCodec {
+	accepted := make(map[string]struct{})
+	for _, name := range strings.Split(theirs, ",") {
+		accepted[name] = struct{}{}
+	}
+	codec := gossipCodecGob
+	for _, name := range ours {
+		if _, found := accepted[name]; !found {
+			continue
+		}
+		for c, known := range gossipCodecNames {
+			if name == known && gossipCodec(c) > codec {
+				codec = gossipCodec(c)
+			}
+		}
+	}
+	return codec
+}
+
+// binaryTags maps compact gossip tags to their binary equivalents.
+var binaryTags = map[protocolTag]protocolTag{
+	ProtocolGossipCompact:          ProtocolGossipBinary,
+	ProtocolGossipUnicastCompact:   ProtocolGossipUnicastBinary,
+	ProtocolGossipBroadcastCompact: ProtocolGossipBroadcastBinary,
+}
+
+// unbinaryTag returns the compact gossip tag equivalent to a binary one,
+// and whether tag was binary.
+func unbinaryTag(tag protocolTag) (protocolTag, bool) {
+	for compact, bin := range binaryTags {
+		if tag == bin {
+			return compact, true
+		}
+	}
+	return tag, false
+}
+
+// binaryGossipMsg converts a gossip message to its binary form, which
+// holds the source name, the uvarint-prefixed channel name, the
+// destination name for unicasts, the uvarint-prefixed payload, the
+// schema version and, for broadcasts, the uvarint sequence number.
+// Other messages are returned unchanged.
+func binaryGossipMsg(pm protocolMsg) (protocolMsg, error) {
+	if _, found := compactTags[pm.tag]; found {
+		var err error
+		if pm, err = compactGossipMsg(pm); err != nil {
+			return pm, err
+		}
+	}
+	tag, found := binaryTags[pm.tag]
+	if !found {
+		return pm, nil
+	}
+	if len(pm.msg) < NameSize {
+		return pm, fmt.Errorf("compact gossip message too short (%d bytes)", len(pm.msg))
+	}
+	dec := gob.NewDecoder(bytes.NewReader(pm.msg[NameSize:]))
+	var channelName string
+	if err := dec.Decode(&channelName); err != nil {
+		return pm, err
+	}
+	var destName PeerName
+	if pm.tag == ProtocolGossipUnicastCompact {
+		if err := dec.Decode(&destName); err != nil {
+			return pm, err
+		}
+	}
+	var payload []byte
+	if err := dec.Decode(&payload); err != nil {
+		return pm, err
+	}
+	version, err := decodeSchemaVersion(dec)
+	if err != nil {
+		return pm, err
+	}
+	var seq uint64
+	if pm.tag == ProtocolGossipBroadcastCompact {
+		if seq, err = decodeSequence(dec); err != nil {
+			return pm, err
+		}
+	}
+	buf := make([]byte, 0, NameSize+2*binary.MaxVarintLen64+len(channelName)+NameSize+len(payload)+1+binary.MaxVarintLen64)
+	buf = append(buf, pm.msg[:NameSize]...)
+	buf = appendUvarintBytes(buf, []byte(channelName))
+	if pm.tag == ProtocolGossipUnicastCompact {
+		buf = append(buf, destName.bytes()...)
+	}
+	buf = appendUvarintBytes(buf, payload)
+	buf = append(buf, version)
+	if pm.tag == ProtocolGossipBroadcastCompact {
+		buf = appendUvarint(buf, seq)
+	}
+	return protocolMsg{tag, buf}, nil
+}
+
+// unbinaryGossipMsg converts a binary gossip message back to its compact
+// form, which is what we relay and deliver.
+func unbinaryGossipMsg(pm protocolMsg) (protocolMsg, error) {
+	tag, _ := unbinaryTag(pm.tag)
+	r := bytes.NewReader(pm.msg)
+	srcBytes := make([]byte, NameSize)
+	if _, err := io.ReadFull(r, srcBytes); err != nil {
+		return pm, fmt.Errorf("binary gossip message too short (%d bytes)", len(pm.msg))
+	}
+	channelName, err := readUvarintBytes(r)
+	if err != nil {
+		return pm, err
+	}
+	items := []interface{}{string(channelName)}
+	if tag == ProtocolGossipUnicastCompact {
+		destBytes := make([]byte, NameSize)
+		if _, err := io.ReadFull(r, destBytes); err != nil {
+			return pm, err
+		}
+		items = append(items, PeerNameFromBin(destBytes))
+	}
+	payload, err := readUvarintBytes(r)
+	if err != nil {
+		return pm, err
+	}
+	items = append(items, payload)
+	version, err := r.ReadByte()
+	if err != nil {
+		return pm, err
+	}
+	var msg []byte
+	if tag == ProtocolGossipBroadcastCompact {
+		seq, err := binary.ReadUvarint(r)
+		if err != nil {
+			return pm, err
+		}
+		msg = gobEncodeSequenced(version, seq, items...)
+	} else {
+		msg = gobEncodeVersioned(version, items...)
+	}
+	return protocolMsg{tag, append(srcBytes, msg...)}, nil
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], x)]...)
+}
+
+func appendUvarintBytes(buf, data []byte) []byte {
+	return append(appendUvarint(buf, uint64(len(data))), data...)
+}
+
+func readUvarintBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, fmt.Errorf("binary gossip field of %d bytes exceeds message", n)
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
@@ -0,0 +1,96 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinaryGossipMsgRoundTrip(t *testing.T) {
+	src, _ := PeerNameFromString("01:00:00:01:00:00")
+	dst, _ := PeerNameFromString("02:00:00:02:00:00")
+	for _, m := range []protocolMsg{
+		{ProtocolGossipCompact, append(src.bytes(), gobEncodeVersioned(0, "test", []byte("periodic"))...)},
+		{ProtocolGossipCompact, append(src.bytes(), gobEncodeVersioned(3, "test", []byte("versioned"))...)},
+		{ProtocolGossipUnicastCompact, append(src.bytes(), gobEncodeVersioned(0, "test", dst, []byte("unicast"))...)},
+		{ProtocolGossipBroadcastCompact, append(src.bytes(), gobEncodeSequenced(0, 0, "test", []byte("unsequenced"))...)},
+		{ProtocolGossipBroadcastCompact, append(src.bytes(), gobEncodeSequenced(2, 42, "test", []byte("sequenced"))...)},
+	} {
+		bin, err := binaryGossipMsg(m)
+		require.NoError(t, err)
+		require.Equal(t, binaryTags[m.tag], bin.tag)
+		back, err := unbinaryGossipMsg(bin)
+		require.NoError(t, err)
+		require.Equal(t, m, back)
+	}
+	// Expanded messages are made compact on the way
+	expanded := protocolMsg{ProtocolGossip, gobEncodeVersioned(0, "test", src, []byte("periodic"))}
+	bin, err := binaryGossipMsg(expanded)
+	require.NoError(t, err)
+	require.Equal(t, protocolTag(ProtocolGossipBinary), bin.tag)
+	_, err = unbinaryGossipMsg(protocolMsg{ProtocolGossipBinary, bin.msg[:len(bin.msg)-3]})
+	require.Error(t, err, "truncated message was accepted")
+}
+
+func TestNegotiateGossipCodec(t *testing.T) {
+	require.Equal(t, gossipCodecGob, negotiateGossipCodec(nil, ""))
+	require.Equal(t, gossipCodecGob, negotiateGossipCodec([]string{"binary"}, ""))
+	require.Equal(t, gossipCodecGob, negotiateGossipCodec(nil, "binary"))
+	require.Equal(t, gossipCodecBinary, negotiateGossipCodec([]string{"gob", "binary"}, "binary,gob"))
+	require.Error(t, parseGossipCodecs([]string{"binary", "protobuf"}))
+}
+
+type unicastRecorder struct {
+	testGossiper
+	received chan []byte
+}
+
+func (g *unicastRecorder) OnGossipUnicast(sender PeerName, msg []byte) error {
+	g.received <- msg
+	return nil
+}
+
+func TestGossipCodecNegotiation(t *testing.T) {
+	binary := Config{GossipCodecs: []string{"gob", "binary"}}
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", binary)
+	r3 := newTCPTestRouter(t, "03:00:00:03:00:00", binary)
+	defer stopTestRouters(t, r1, r2, r3)
+	g1 := &unicastRecorder{*newTestGossiper(), make(chan []byte, 1)}
+	s1, err := r1.NewGossip("test", g1)
+	require.NoError(t, err)
+	_, err = r2.NewGossip("test", newTestGossiper())
+	require.NoError(t, err)
+	g3 := newTestGossiper()
+	s3, err := r3.NewGossip("test", g3)
+	require.NoError(t, err)
+
+	connectTCPTestRouters(r2, r1)
+	connectTCPTestRouters(r3, r2)
+	require.Equal(t, gossipCodecGob, awaitEstablished(t, r2, r1).gossipCodec)
+	require.Equal(t, gossipCodecGob, awaitEstablished(t, r1, r2).gossipCodec)
+	require.Equal(t, gossipCodecBinary, awaitEstablished(t, r3, r2).gossipCodec)
+	require.Equal(t, gossipCodecBinary, awaitEstablished(t, r2, r3).gossipCodec)
+
+	// Gossip crosses from one codec to the other
+	broadcast(s1, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for !g3.has(1) {
+		require.True(t, time.Now().Before(deadline), "broadcast was not delivered")
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		if err = s3.GossipUnicast(r1.Ourself.Name, []byte("hello")); err == nil {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "no route for unicast: %v", err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case msg := <-g1.received:
+		require.Equal(t, []byte("hello"), msg)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "unicast was not delivered")
+	}
+}
@@ -0,0 +1,90 @@
+package mesh
+
+import "time"
+
+// GossipWithDeadline returns data which, while queued for a neighbour,
+// e.g. behind a congested link, is dropped rather than sent once deadline
+// has passed, since it would by then be stale. Pass the result to the
+// methods of Gossip. Merged with other data while queued, the result
+// keeps the later deadline, or none if the other data has none, so that
+// nothing fresh is dropped.
+func GossipWithDeadline(data GossipData, deadline time.Time) GossipData {
+	return &deadlineGossipData{data, deadline}
+}
+
+// deadlineGossipData is GossipData with a deadline. See
+// GossipWithDeadline.
+type deadlineGossipData struct {
+	GossipData
+	deadline time.Time
+}
+
+// Merge implements GossipData, keeping the later deadline.
+func (d *deadlineGossipData) Merge(other GossipData) GossipData {
+	return mergeDeadlines(d, other)
+}
+
+// splitDeadline returns data without any deadline given by
+// GossipWithDeadline, and the deadline, or zero if there is none.
+func splitDeadline(data GossipData) (GossipData, time.Time) {
+	switch d := data.(type) {
+	case *deadlineGossipData:
+		return d.GossipData, d.deadline
+	case *sequencedGossipData:
+		if dd, ok := d.GossipData.(*deadlineGossipData); ok {
+			return &sequencedGossipData{dd.GossipData, d.seq}, dd.deadline
+		}
+	}
+	return data, time.Time{}
+}
+
+// laterDeadline returns the later of two deadlines, or zero, meaning no
+// deadline, if either is.
+func laterDeadline(a, b time.Time) time.Time {
+	if a.IsZero() || b.IsZero() {
+		return time.Time{}
+	}
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// mergeDeadlines merges b into a, where either may have a deadline,
+// keeping the later one, so that Merge implementations never see the
+// deadline.
+func mergeDeadlines(a, b GossipData) GossipData {
+	a, da := splitDeadline(a)
+	b, db := splitDeadline(b)
+	merged := a.Merge(b)
+	if deadline := laterDeadline(da, db); !deadline.IsZero() {
+		return &deadlineGossipData{merged, deadline}
+	}
+	return merged
+}
+
+// expire drops what is queued past its deadline, as of t. Must hold
+// s.Lock.
+func (s *gossipSender) expire(t time.Time) {
+	if s.gossip != nil && !s.gossipDeadline.IsZero() && t.After(s.gossipDeadline) {
+		s.dropGossip(GossipDropDeadline)
+	}
+	for srcName, deadline := range s.broadcastDeadlines {
+		if t.After(deadline) {
+			s.dropBroadcasts(srcName, GossipDropDeadline)
+		}
+	}
+}
+
+// setBroadcastDeadline records the deadline of what is queued from
+// srcName. Must hold s.Lock.
+func (s *gossipSender) setBroadcastDeadline(srcName PeerName, deadline time.Time) {
+	if deadline.IsZero() {
+		delete(s.broadcastDeadlines, srcName)
+		return
+	}
+	if s.broadcastDeadlines == nil {
+		s.broadcastDeadlines = make(map[PeerName]time.Time)
+	}
+	s.broadcastDeadlines[srcName] = deadline
+}
@@ -0,0 +1,103 @@
+package mesh
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/url"
+)
+
+// Gossip dictionaries are advertised in the connection handshake under
+// this feature, as channel names and dictionary IDs in URL query form.
+const gossipDictionariesFeature = "GossipDictionaries"
+
+// dictionaryID identifies a dictionary, so that peers can tell whether
+// they have the same one.
+func dictionaryID(dict []byte) string {
+	h := fnv.New64a()
+	_, _ = h.Write(dict)
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+func encodeGossipDictionaries(dicts map[string][]byte) string {
+	values := url.Values{}
+	for channelName, dict := range dicts {
+		values.Set(channelName, dictionaryID(dict))
+	}
+	return values.Encode()
+}
+
+// sharedGossipDictionaries returns those of ours which the remote, from
+// its advertisement, has too.
+func sharedGossipDictionaries(ours map[string][]byte, theirs string) map[string][]byte {
+	if len(ours) == 0 || theirs == "" {
+		return nil
+	}
+	values, err := url.ParseQuery(theirs)
+	if err != nil {
+		return nil
+	}
+	shared := make(map[string][]byte)
+	for channelName, dict := range ours {
+		if values.Get(channelName) == dictionaryID(dict) {
+			shared[channelName] = dict
+		}
+	}
+	return shared
+}
+
+func compressWithDictionary(dict, msg []byte) []byte {
+	var buf bytes.Buffer
+	w, err := flate.NewWriterDict(&buf, flate.BestCompression, dict)
+	if err != nil {
+		panic(err) // only for an invalid level
+	}
+	_, _ = w.Write(msg)
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+// decompressWithDictionary decompresses data, refusing to expand it
+// beyond maxTCPMsgSize, which no payload sent uncompressed could exceed.
+func decompressWithDictionary(dict, data []byte) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(data), dict)
+	defer r.Close()
+	msg, err := ioutil.ReadAll(io.LimitReader(r, maxTCPMsgSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > maxTCPMsgSize {
+		return nil, fmt.Errorf("compressed gossip expands beyond maximum size: %d", maxTCPMsgSize)
+	}
+	return msg, nil
+}
+
+// decodePayload decodes a gossip payload, decompressing it with dict, if
+// set.
+func decodePayload(dec *gob.Decoder, dict []byte) ([]byte, error) {
+	var payload []byte
+	if err := dec.Decode(&payload); err != nil {
+		return nil, err
+	}
+	if dict == nil {
+		return payload, nil
+	}
+	return decompressWithDictionary(dict, payload)
+}
+
+// withDictionary wraps makeMsg and makeBroadcastMsg to compress each
+// payload with dict.
+func withDictionary(dict []byte,
+	makeMsg func(version byte, msg []byte) protocolMsg,
+	makeBroadcastMsg func(srcName PeerName, version byte, seq uint64, msg []byte) protocolMsg,
+) (func(version byte, msg []byte) protocolMsg, func(srcName PeerName, version byte, seq uint64, msg []byte) protocolMsg) {
+	return func(version byte, msg []byte) protocolMsg {
+			return makeMsg(version, compressWithDictionary(dict, msg))
+		}, func(srcName PeerName, version byte, seq uint64, msg []byte) protocolMsg {
+			return makeBroadcastMsg(srcName, version, seq, compressWithDictionary(dict, msg))
+		}
+}
@@ -0,0 +1,70 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGossipDictionary(t *testing.T) {
+	dicts := map[string][]byte{"kv": []byte(`{"key":"","value":"","version":}`)}
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{GossipDictionaries: dicts})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{GossipDictionaries: dicts})
+	r3 := newTCPTestRouter(t, "03:00:00:03:00:00", Config{})
+	defer r1.Stop()
+	defer r2.Stop()
+	defer r3.Stop()
+	s1, err := r1.NewGossip("kv", newTestGossiper())
+	require.NoError(t, err)
+	g2, g3 := newTestGossiper(), newTestGossiper()
+	_, err = r2.NewGossip("kv", g2)
+	require.NoError(t, err)
+	_, err = r3.NewGossip("kv", g3)
+	require.NoError(t, err)
+
+	connectTCPTestRouters(r1, r2)
+	connectTCPTestRouters(r1, r3)
+	require.NotNil(t, awaitEstablished(t, r1, r2).gossipDictionary("kv"))
+	require.Nil(t, awaitEstablished(t, r1, r3).gossipDictionary("kv"), "dictionary used with a peer without it")
+
+	broadcast(s1, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for !(g2.has(1) && g3.has(1)) {
+		require.True(t, time.Now().Before(deadline), "broadcast was not delivered")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGossipDictionaryRoundTrip(t *testing.T) {
+	dict := []byte(`{"key":"","value":""}`)
+	msg := []byte(`{"key":"a","value":"b"}`)
+	out, err := decompressWithDictionary(dict, compressWithDictionary(dict, msg))
+	require.NoError(t, err)
+	require.Equal(t, msg, out)
+	_, err = decompressWithDictionary(nil, compressWithDictionary(dict, msg))
+	require.Error(t, err, "decompressed without the dictionary")
+
+	// A few kilobytes must not become more than any message could hold
+	bomb := compressWithDictionary(dict, make([]byte, maxTCPMsgSize+1))
+	require.True(t, len(bomb) < maxTCPMsgSize/100)
+	_, err = decompressWithDictionary(dict, bomb)
+	require.Error(t, err, "decompressed beyond the maximum message size")
+}
+
+func BenchmarkGossipDictionary(b *testing.B) {
+	dict := []byte(`{"key":"","value":"","version":,"owner":"","expires":""}`)
+	msg := []byte(`{"key":"session/42","value":"ok","version":7,"owner":"01:00:00:01:00:00","expires":"2020-01-01"}`)
+	for _, test := range []struct {
+		name string
+		dict []byte
+	}{{"plain", nil}, {"dictionary", dict}} {
+		b.Run(test.name, func(b *testing.B) {
+			var compressed []byte
+			for i := 0; i < b.N; i++ {
+				compressed = compressWithDictionary(test.dict, msg)
+			}
+			b.ReportMetric(float64(len(msg))/float64(len(compressed)), "ratio")
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package mesh
+
+import "sync"
+
+// GossipDropReason is why gossip was dropped rather than delivered or
+// sent. See Router.GossipDrops.
+type GossipDropReason string
+
+const (
+	// GossipDropQueueFull is gossip pending for a neighbour beyond
+	// Config.MaxPendingGossip.
+	GossipDropQueueFull GossipDropReason = "queue-full"
+	// GossipDropDeadline is gossip still pending for a neighbour when
+	// its deadline passed. See GossipWithDeadline.
+	GossipDropDeadline GossipDropReason = "deadline"
+	// GossipDropRetention is broadcasts pending for a neighbour beyond
+	// Config.BroadcastRetention.
+	GossipDropRetention GossipDropReason = "retention"
+	// GossipDropDuplicate is gossip we received again, e.g. over
+	// another path, and had already handled.
+	GossipDropDuplicate GossipDropReason = "duplicate"
+	// GossipDropStale is a broadcast older than one we had already
+	// received from the same origin.
+	GossipDropStale GossipDropReason = "stale"
+	// GossipDropUnknownPeer is gossip from a peer not in our topology.
+	// See Config.UnknownPeerGossip.
+	GossipDropUnknownPeer GossipDropReason = "unknown-peer"
+)
+
+// gossipDrops counts dropped gossip messages by channel and reason.
+type gossipDrops struct {
+	sync.Mutex
+	counts map[string]map[GossipDropReason]uint64
+}
+
+// GossipDrops returns the number of gossip messages we have dropped, by
+// channel and reason. It is also in Status.
+func (router *Router) GossipDrops() map[string]map[GossipDropReason]uint64 {
+	router.drops.Lock()
+	defer router.drops.Unlock()
+	drops := make(map[string]map[GossipDropReason]uint64, len(router.drops.counts))
+	for channelName, counts := range router.drops.counts {
+		drops[channelName] = make(map[GossipDropReason]uint64, len(counts))
+		for reason, n := range counts {
+			drops[channelName][reason] = n
+		}
+	}
+	return drops
+}
+
+// noteGossipDrop counts n messages on the named channel dropped for
+// reason, and reports them to Config.OnGossipDropped.
+func (router *Router) noteGossipDrop(channelName string, reason GossipDropReason, n int) {
+	if n <= 0 {
+		return
+	}
+	router.drops.Lock()
+	if router.drops.counts == nil {
+		router.drops.counts = make(map[string]map[GossipDropReason]uint64)
+	}
+	counts, found := router.drops.counts[channelName]
+	if !found {
+		counts = make(map[GossipDropReason]uint64)
+		router.drops.counts[channelName] = counts
+	}
+	counts[reason] += uint64(n)
+	router.drops.Unlock()
+	if router.OnGossipDropped != nil {
+		router.OnGossipDropped(channelName, reason, n)
+	}
+}
+
+// noteDrop counts n messages on the channel dropped for reason.
+func (c *gossipChannel) noteDrop(reason GossipDropReason, n int) {
+	if router := c.ourself.router; router != nil {
+		router.noteGossipDrop(c.name, reason, n)
+	}
+}
+
+// noteDrop counts n messages dropped for reason, if we report drops.
+func (s *gossipSender) noteDrop(reason GossipDropReason, n int) {
+	if s.dropped != nil {
+		s.dropped(reason, n)
+	}
+}
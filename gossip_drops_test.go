@@ -0,0 +1,44 @@
+package mesh
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGossipDrops(t *testing.T) {
+	type drop struct {
+		channel string
+		reason  GossipDropReason
+	}
+	var lock sync.Mutex
+	reported := make(map[drop]int)
+	r := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{
+		OnGossipDropped: func(channel string, reason GossipDropReason, n int) {
+			lock.Lock()
+			defer lock.Unlock()
+			reported[drop{channel, reason}] += n
+		},
+	})
+	defer r.Stop()
+
+	stuck := &stuckSender{shutdowns: make(chan error, 1)}
+	senders := newGossipSenders(stuck, make(chan struct{}))
+	senders.limit(1, GossipOverflowDropOldest, nil, stuck.shutdown)
+	senders.reportDrops(r.noteGossipDrop)
+	channel := &gossipChannel{name: "Test", ourself: r.Ourself}
+	s := senders.Sender(channel.name, channel.makeGossipSender)
+	for i := 0; i < 5; i++ {
+		s.Send(newSurrogateGossipData([]byte{byte(i)}))
+	}
+
+	// One is in flight and one pending, so the queue filled at least once
+	drops := r.GossipDrops()["Test"][GossipDropQueueFull]
+	require.True(t, drops > 0, "no queue-full drops")
+	require.Equal(t, drops, senders.dropped())
+	require.Equal(t, r.GossipDrops(), NewStatus(r).GossipDrops)
+	lock.Lock()
+	require.Equal(t, map[drop]int{{"Test", GossipDropQueueFull}: int(drops)}, reported)
+	lock.Unlock()
+}
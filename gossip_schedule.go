@@ -0,0 +1,72 @@
+package mesh
+
+import "time"
+
+// GossipWindow is a period of each day during which application gossip is
+// paused. See Config.GossipSchedule.
+type GossipWindow struct {
+	// Start is the time of day, in UTC, at which the window opens, as
+	// the time since midnight.
+	Start time.Duration
+	// Duration is how long the window stays open. A window may run on
+	// past midnight.
+	Duration time.Duration
+}
+
+// contains reports whether t falls within the window.
+func (w GossipWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	since := (t.Sub(midnight) - w.Start) % (24 * time.Hour)
+	if since < 0 {
+		since += 24 * time.Hour
+	}
+	return since < w.Duration
+}
+
+// gossipPaused reports whether application gossip is paused at t by
+// Config.GossipSchedule.
+func (router *Router) gossipPaused(t time.Time) bool {
+	for _, window := range router.GossipSchedule {
+		if window.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// hold keeps update back, to be sent by release, if the channel's gossip
+// is paused, and reports whether it did.
+func (c *gossipChannel) hold(update GossipData, broadcast bool) bool {
+	router := c.ourself.router
+	if router == nil || c.essential || !router.gossipPaused(router.now()) {
+		return false
+	}
+	c.heldLock.Lock()
+	defer c.heldLock.Unlock()
+	held := &c.heldSubset
+	if broadcast {
+		held = &c.heldBroadcast
+	}
+	if *held == nil {
+		*held = update
+	} else {
+		*held = mergeDeadlines(*held, update)
+	}
+	return true
+}
+
+// release sends what hold kept back while the channel's gossip was
+// paused.
+func (c *gossipChannel) release() {
+	c.heldLock.Lock()
+	broadcast, subset := c.heldBroadcast, c.heldSubset
+	c.heldBroadcast, c.heldSubset = nil, nil
+	c.heldLock.Unlock()
+	if broadcast != nil {
+		c.GossipBroadcast(broadcast)
+	}
+	if subset != nil {
+		c.GossipNeighbourSubset(subset)
+	}
+}
@@ -0,0 +1,67 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGossipWindowContains(t *testing.T) {
+	day := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h, m int) time.Time { return day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute) }
+	w := GossipWindow{Start: 2 * time.Hour, Duration: 30 * time.Minute}
+	require.False(t, w.contains(at(1, 59)))
+	require.True(t, w.contains(at(2, 0)))
+	require.True(t, w.contains(at(2, 29)))
+	require.False(t, w.contains(at(2, 30)))
+	require.True(t, w.contains(at(2, 0).AddDate(0, 0, 1)))
+
+	// Across midnight, and in another time zone
+	w = GossipWindow{Start: 23 * time.Hour, Duration: 2 * time.Hour}
+	require.True(t, w.contains(at(23, 30)))
+	require.True(t, w.contains(at(0, 30)))
+	require.False(t, w.contains(at(1, 0)))
+	require.True(t, w.contains(at(0, 30).In(time.FixedZone("east", 5*3600))))
+}
+
+func TestGossipSchedule(t *testing.T) {
+	clock := newTestClock()
+	t0 := clock.now().UTC()
+	midnight := time.Date(t0.Year(), t0.Month(), t0.Day(), 0, 0, 0, 0, time.UTC)
+	window := GossipWindow{Start: t0.Sub(midnight) - time.Minute, Duration: 10 * time.Minute}
+
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{GossipSchedule: []GossipWindow{window}, Clock: clock.now})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	g1 := newTestGossiper()
+	s1, err := r1.NewGossip("Test", g1)
+	require.NoError(t, err)
+	g2 := newTestGossiper()
+	_, err = r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+
+	// During the window, topology gossip carries on
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r1, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2, r3), r2.tp(r1), r3.tp(r1))
+
+	// but neither our broadcasts nor periodic gossip go anywhere
+	broadcast(s1, 1)
+	_, err = g1.OnGossip([]byte{2})
+	require.NoError(t, err)
+	r1.sendAllGossip()
+	sendPendingGossip(routers...)
+	require.False(t, g2.has(1))
+	require.False(t, g2.has(2))
+
+	// After it, both resume
+	clock.advance(10 * time.Minute)
+	r1.sendAllGossip()
+	sendPendingGossip(routers...)
+	g2.checkHas(t, 1, 2)
+	for _, r := range routers {
+		r.Stop()
+	}
+}
@@ -1,12 +1,18 @@
 package mesh
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -24,8 +30,12 @@ type mockGossipConnection struct {
 var _ gossipConnection = &mockGossipConnection{}
 
 func newTestRouter(t *testing.T, name string) *Router {
+	return newTestRouterWithConfig(t, name, Config{})
+}
+
+func newTestRouterWithConfig(t *testing.T, name string, config Config) *Router {
 	peerName, _ := PeerNameFromString(name)
-	router, err := NewRouter(Config{}, peerName, "nick", nil, log.New(ioutil.Discard, "", 0))
+	router, err := NewRouter(config, peerName, "nick", nil, log.New(ioutil.Discard, "", 0))
 	require.NoError(t, err)
 	router.Start()
 	return router
@@ -48,7 +58,7 @@ func (conn *mockGossipConnection) logf(format string, args ...interface{}) {
 
 func (conn *mockGossipConnection) SendProtocolMsg(pm protocolMsg) error {
 	<-conn.start
-	return conn.dest.handleGossip(pm.tag, pm.msg)
+	return conn.dest.handleGossip(conn.local.Name, pm.tag, pm.msg)
 }
 
 func (conn *mockGossipConnection) gossipSenders() *gossipSenders {
@@ -310,6 +320,13 @@ func (g *testGossiper) OnGossip(update []byte) (GossipData, error) {
 	return newSurrogateGossipData(delta), nil
 }
 
+func (g *testGossiper) has(v byte) bool {
+	g.RLock()
+	defer g.RUnlock()
+	_, found := g.state[v]
+	return found
+}
+
 func (g *testGossiper) checkHas(t *testing.T, vs ...byte) {
 	g.RLock()
 	defer g.RUnlock()
@@ -324,6 +341,91 @@ func broadcast(s Gossip, v byte) {
 	s.GossipBroadcast(newSurrogateGossipData([]byte{v}))
 }
 
+func TestGossipCurrentState(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	g1 := newTestGossiper()
+	s1, err := r1.NewGossip("Test", g1)
+	require.NoError(t, err)
+	_, err = g1.OnGossip([]byte{1})
+	require.NoError(t, err)
+
+	state := s1.(InspectableGossip).CurrentState()
+	require.IsType(t, &surrogateGossipData{}, state)
+	require.Equal(t, g1.Gossip(), state)
+
+	// It is a snapshot, unaffected by later changes
+	_, err = g1.OnGossip([]byte{2})
+	require.NoError(t, err)
+	require.NotEqual(t, g1.Gossip(), state)
+	r1.Stop()
+}
+
+func TestGossipSendAt(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, []*Router{r1, r2}, r1.tp(r2), r2.tp(r1))
+	s1, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	g2 := newTestGossiper()
+	_, err = r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+	scheduled := s1.(ScheduledGossip)
+
+	awaitReceived := func(v byte) time.Time {
+		deadline := time.Now().Add(2 * time.Second)
+		for !g2.has(v) {
+			require.True(t, time.Now().Before(deadline), "%d was not received", v)
+			time.Sleep(5 * time.Millisecond)
+			sendPendingGossip(r1, r2)
+		}
+		return time.Now()
+	}
+
+	const delay = 300 * time.Millisecond
+	at := time.Now().Add(delay)
+	scheduled.SendAt(at, newSurrogateGossipData([]byte{1}))
+	received := awaitReceived(1)
+	require.False(t, received.Before(at), "received %v early", at.Sub(received))
+	require.True(t, received.Sub(at) < delay, "received %v late", received.Sub(at))
+
+	// A time which has passed sends straight away
+	start := time.Now()
+	scheduled.SendAt(start.Add(-time.Hour), newSurrogateGossipData([]byte{2}))
+	require.True(t, awaitReceived(2).Sub(start) < delay)
+
+	// Stop cancels what is still to be sent
+	scheduled.SendAt(time.Now().Add(time.Hour), newSurrogateGossipData([]byte{3}))
+	r1.Stop()
+	r2.Stop()
+	require.Empty(t, s1.(*gossipChannel).scheduled)
+}
+
+func TestGossipSendAtFollowsClock(t *testing.T) {
+	clock := newTestClock()
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{Clock: clock.now})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, []*Router{r1, r2}, r1.tp(r2), r2.tp(r1))
+	s1, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	g2 := newTestGossiper()
+	_, err = r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+
+	// An hour hence by the wall clock, but already past by the router's
+	clock.advance(2 * time.Hour)
+	s1.(ScheduledGossip).SendAt(time.Now().Add(time.Hour), newSurrogateGossipData([]byte{1}))
+	deadline := time.Now().Add(2 * time.Second)
+	for !g2.has(1) {
+		require.True(t, time.Now().Before(deadline), "broadcast was not sent by the router's clock")
+		time.Sleep(5 * time.Millisecond)
+		sendPendingGossip(r1, r2)
+	}
+	r1.Stop()
+	r2.Stop()
+}
+
 func TestRandomNeighbours(t *testing.T) {
 	const nTrials = 5000
 	ourself := PeerName(0) // aliased with UnknownPeerName, which is ok here
@@ -360,3 +462,1618 @@ func TestRandomNeighbours(t *testing.T) {
 		})
 	}
 }
+
+// stuckSender never completes a send, like a peer that stopped reading.
+type stuckSender struct {
+	shutdowns chan error
+}
+
+func (s *stuckSender) SendProtocolMsg(protocolMsg) error {
+	select {}
+}
+
+func (s *stuckSender) shutdown(err error) {
+	select {
+	case s.shutdowns <- err:
+	default:
+	}
+}
+
+func newLimitedTestSender(maxPending int, overflow GossipOverflowPolicy) (*gossipSenders, *gossipSender, *stuckSender) {
+	stuck := &stuckSender{shutdowns: make(chan error, 1)}
+	senders := newGossipSenders(stuck, make(chan struct{}))
+	senders.limit(maxPending, overflow, nil, stuck.shutdown)
+	channel := &gossipChannel{name: "test", ourself: &localPeer{Peer: &Peer{}}}
+	return senders, senders.Sender(channel.name, channel.makeGossipSender), stuck
+}
+
+func TestGossipSenderDropOldest(t *testing.T) {
+	senders, s, stuck := newLimitedTestSender(3, GossipOverflowDropOldest)
+	for i := 0; i < 20; i++ {
+		s.Send(newSurrogateGossipData([]byte{byte(i)}))
+		s.Broadcast(PeerName(i%2), newSurrogateGossipData([]byte{byte(i)}))
+		s.Lock()
+		require.True(t, s.pending <= 3, "pending %d exceeds limit", s.pending)
+		s.Unlock()
+	}
+	// At most one item is in flight; everything else is pending or dropped
+	require.True(t, senders.dropped() >= 40-1-3, "dropped %d", senders.dropped())
+	require.Len(t, stuck.shutdowns, 0)
+}
+
+func TestGossipSenderDropsOnlyOldest(t *testing.T) {
+	senders, s, _ := newLimitedTestSender(3, GossipOverflowDropOldest)
+	pending := func() int {
+		s.Lock()
+		defer s.Unlock()
+		return s.pending
+	}
+	// The first goes in flight, and sticks
+	s.Send(newSurrogateGossipData([]byte{0}))
+	require.Eventually(t, func() bool { return pending() == 0 }, time.Second, time.Millisecond)
+
+	s.Broadcast(PeerName(1), newSurrogateGossipData([]byte{1}))
+	s.Send(newSurrogateGossipData([]byte{2}))
+	s.Broadcast(PeerName(2), newSurrogateGossipData([]byte{3}))
+	s.Broadcast(PeerName(2), newSurrogateGossipData([]byte{4}))
+	require.Equal(t, uint64(1), senders.dropped())
+	s.Lock()
+	require.Equal(t, 3, s.pending)
+	require.NotContains(t, s.broadcasts, PeerName(1))
+	require.Contains(t, s.broadcasts, PeerName(2))
+	require.NotNil(t, s.gossip)
+	s.Unlock()
+
+	// Next oldest is the gossip
+	s.Broadcast(PeerName(3), newSurrogateGossipData([]byte{5}))
+	require.Equal(t, uint64(2), senders.dropped())
+	s.Lock()
+	require.Nil(t, s.gossip)
+	require.Len(t, s.broadcasts, 2)
+	s.Unlock()
+}
+
+func TestGossipOverflowPerChannel(t *testing.T) {
+	stuck := &stuckSender{shutdowns: make(chan error, 1)}
+	senders := newGossipSenders(stuck, make(chan struct{}))
+	senders.limit(1, GossipOverflowDropOldest, map[string]GossipOverflowPolicy{"reliable": GossipOverflowClose}, stuck.shutdown)
+	sender := func(name string) *gossipSender {
+		channel := &gossipChannel{name: name, ourself: &localPeer{Peer: &Peer{}}}
+		return senders.Sender(name, channel.makeGossipSender)
+	}
+	require.Equal(t, GossipOverflowDropOldest, sender("lossy").overflow)
+	require.Equal(t, GossipOverflowClose, sender("reliable").overflow)
+	require.Nil(t, sender(topologyChannel).limits)
+}
+
+func TestGossipSenderOverflowClose(t *testing.T) {
+	senders, s, stuck := newLimitedTestSender(3, GossipOverflowClose)
+	for i := 0; i < 10; i++ {
+		s.Send(newSurrogateGossipData([]byte{byte(i)}))
+	}
+	require.Error(t, <-stuck.shutdowns)
+	require.True(t, senders.dropped() > 0)
+	s.Lock()
+	require.True(t, s.pending <= 3, "pending %d exceeds limit", s.pending)
+	s.Unlock()
+}
+
+func TestPeerChannels(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, []*Router{r1, r2}, r1.tp(r2), r2.tp(r1))
+
+	for _, channelName := range []string{"alpha", "beta"} {
+		s, err := r1.NewGossip(channelName, newTestGossiper())
+		require.NoError(t, err)
+		broadcast(s, 1)
+	}
+	sendPendingGossip(r1, r2)
+
+	channels := r2.PeerChannels(r1.Ourself.Name)
+	require.Contains(t, channels, "alpha")
+	require.Contains(t, channels, "beta")
+	require.Empty(t, r1.PeerChannels(r1.Ourself.Name))
+}
+
+type countingGossiper struct {
+	testGossiper
+	broadcasts int32
+}
+
+func (g *countingGossiper) OnGossipBroadcast(src PeerName, update []byte) (GossipData, error) {
+	atomic.AddInt32(&g.broadcasts, 1)
+	return g.testGossiper.OnGossipBroadcast(src, update)
+}
+
+func TestRelayCoalescing(t *testing.T) {
+	clock := newTestClock()
+	peerName, _ := PeerNameFromString("01:00:00:01:00:00")
+	router, err := NewRouter(Config{RelayCoalesceWindow: time.Second, Clock: clock.now}, peerName, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	g := &countingGossiper{testGossiper: *newTestGossiper()}
+	_, err = router.NewGossip("test", g)
+	require.NoError(t, err)
+
+	origin, _ := PeerNameFromString("09:00:00:09:00:00")
+	payload := gobEncode("test", origin, []byte{42})
+	deliverFromNeighbours := func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.NoError(t, router.handleGossip(origin, ProtocolGossipBroadcast, payload))
+			}()
+		}
+		wg.Wait()
+	}
+
+	deliverFromNeighbours()
+	require.Equal(t, int32(1), atomic.LoadInt32(&g.broadcasts))
+
+	clock.advance(2 * time.Second)
+	deliverFromNeighbours()
+	require.Equal(t, int32(2), atomic.LoadInt32(&g.broadcasts))
+}
+
+func TestRelayCoalescerBounded(t *testing.T) {
+	clock := newTestClock()
+	rc := newRelayCoalescer(time.Minute, clock.now)
+	rc.max = 3
+	for i := byte(0); i < 10; i++ {
+		require.True(t, rc.firstArrival(ProtocolGossip, []byte{i}))
+		require.False(t, rc.firstArrival(ProtocolGossip, []byte{i}))
+	}
+	require.Len(t, rc.order, 3)
+	require.Len(t, rc.byHash, 3)
+	// The oldest were forgotten to make room, the newest were not
+	require.True(t, rc.firstArrival(ProtocolGossip, []byte{0}))
+	require.False(t, rc.firstArrival(ProtocolGossip, []byte{9}))
+
+	clock.advance(time.Minute)
+	require.True(t, rc.firstArrival(ProtocolGossip, []byte{9}))
+	require.Len(t, rc.order, 1)
+}
+
+type provenanceGossiper struct {
+	testGossiper
+	sync.Mutex
+	origins, senders []PeerName
+}
+
+func (g *provenanceGossiper) record(origin, sender PeerName) {
+	g.Lock()
+	defer g.Unlock()
+	g.origins = append(g.origins, origin)
+	g.senders = append(g.senders, sender)
+}
+
+func (g *provenanceGossiper) OnGossipUnicastFrom(origin, sender PeerName, msg []byte) error {
+	g.record(origin, sender)
+	return g.OnGossipUnicast(origin, msg)
+}
+
+func (g *provenanceGossiper) OnGossipBroadcastFrom(origin, sender PeerName, update []byte) (GossipData, error) {
+	g.record(origin, sender)
+	return g.OnGossipBroadcast(origin, update)
+}
+
+func TestGossipProvenance(t *testing.T) {
+	// create the topology r1 <-> r2 <-> r3
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r3, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	s1, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	g3 := &provenanceGossiper{testGossiper: *newTestGossiper()}
+	_, err = r3.NewGossip("Test", g3)
+	require.NoError(t, err)
+
+	broadcast(s1, 1)
+	sendPendingGossip(r1, r2, r3)
+	require.NoError(t, s1.GossipUnicast(r3.Ourself.Name, []byte{2}))
+	sendPendingGossip(r1, r2, r3)
+
+	g3.Lock()
+	defer g3.Unlock()
+	require.Equal(t, []PeerName{r1.Ourself.Name, r1.Ourself.Name}, g3.origins)
+	require.Equal(t, []PeerName{r2.Ourself.Name, r2.Ourself.Name}, g3.senders)
+}
+
+func TestFreezeMembershipTopology(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, routers[:2], r1.tp(r2), r2.tp(r1))
+
+	r1.FreezeMembership(true)
+	require.True(t, r1.MembershipFrozen())
+	addTestGossipConnection(t, r2, r3)
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	checkTopology(t, r1, r1.tp(r2), r2.tp(r1))
+	checkTopology(t, r2, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	// Gossip between existing peers carries on
+	g1, g2 := newTestGossiper(), newTestGossiper()
+	s1, err := r1.NewGossip("Test", g1)
+	require.NoError(t, err)
+	_, err = r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+	broadcast(s1, 1)
+	sendPendingGossip(routers...)
+	g2.checkHas(t, 1)
+
+	r1.FreezeMembership(false)
+	r2.sendAllGossip()
+	sendPendingGossip(routers...)
+	checkTopology(t, r1, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+}
+
+func TestNoTransit(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{NoTransit: true})
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	r4 := newTestRouter(t, "04:00:00:04:00:00")
+	r5 := newTestRouter(t, "05:00:00:05:00:00")
+	routers := []*Router{r1, r2, r3, r4, r5}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	addTestGossipConnection(t, r1, r4)
+	addTestGossipConnection(t, r4, r5)
+	addTestGossipConnection(t, r5, r3)
+	flushAndCheckTopology(t, routers,
+		r1.tp(r2, r4), r2.tp(r1, r3), r3.tp(r2, r5), r4.tp(r1, r5), r5.tp(r4, r3))
+	for _, r := range routers {
+		r.Routes.ensureRecalculated()
+	}
+
+	// r2 is still reachable directly, but the longer path is used to reach r3
+	hop, found := r1.Routes.Unicast(r2.Ourself.Name)
+	require.True(t, found)
+	require.Equal(t, r2.Ourself.Name, hop)
+	hop, found = r1.Routes.Unicast(r3.Ourself.Name)
+	require.True(t, found)
+	require.Equal(t, r4.Ourself.Name, hop)
+
+	// r2 relays nobody else's broadcasts, but still sends its own
+	require.Empty(t, r2.Routes.Broadcast(r1.Ourself.Name))
+	require.ElementsMatch(t, []PeerName{r1.Ourself.Name, r3.Ourself.Name}, r2.Routes.Broadcast(r2.Ourself.Name))
+}
+
+func TestRouteCost(t *testing.T) {
+	for _, cost := range []uint32{0, 3} {
+		r1 := newTestRouter(t, "01:00:00:01:00:00")
+		r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{RouteCost: cost})
+		r3 := newTestRouter(t, "03:00:00:03:00:00")
+		r4 := newTestRouter(t, "04:00:00:04:00:00")
+		r5 := newTestRouter(t, "05:00:00:05:00:00")
+		r6 := newTestRouter(t, "06:00:00:06:00:00")
+		routers := []*Router{r1, r2, r3, r4, r5, r6}
+		addTestGossipConnection(t, r1, r2)
+		addTestGossipConnection(t, r2, r3)
+		addTestGossipConnection(t, r2, r6)
+		addTestGossipConnection(t, r1, r4)
+		addTestGossipConnection(t, r4, r5)
+		addTestGossipConnection(t, r5, r3)
+		flushAndCheckTopology(t, routers,
+			r1.tp(r2, r4), r2.tp(r1, r3, r6), r3.tp(r2, r5), r4.tp(r1, r5), r5.tp(r4, r3), r6.tp(r2))
+		r1.Routes.ensureRecalculated()
+
+		// r3 is reached via r2 unless the longer path is cheaper
+		via := r2
+		if cost > 0 {
+			via = r4
+		}
+		hop, found := r1.Routes.Unicast(r3.Ourself.Name)
+		require.True(t, found)
+		require.Equal(t, via.Ourself.Name, hop, "cost %d", cost)
+		// r2 is the only way to r6, whatever it costs
+		hop, found = r1.Routes.Unicast(r6.Ourself.Name)
+		require.True(t, found)
+		require.Equal(t, r2.Ourself.Name, hop)
+		hop, found = r1.Routes.Unicast(r2.Ourself.Name)
+		require.True(t, found)
+		require.Equal(t, r2.Ourself.Name, hop)
+		for _, r := range routers {
+			r.Stop()
+		}
+	}
+}
+
+func TestConnectionCost(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	r4 := newTestRouter(t, "04:00:00:04:00:00")
+	r5 := newTestRouter(t, "05:00:00:05:00:00")
+	routers := []*Router{r1, r2, r3, r4, r5}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	addTestGossipConnection(t, r1, r4)
+	addTestGossipConnection(t, r4, r5)
+	addTestGossipConnection(t, r5, r3)
+	flushAndCheckTopology(t, routers,
+		r1.tp(r2, r4), r2.tp(r1, r3), r3.tp(r2, r5), r4.tp(r1, r5), r5.tp(r4, r3))
+	r1.Routes.ensureRecalculated()
+
+	requireRoute := func(dest, via *Router) {
+		hop, found := r1.Routes.Unicast(dest.Ourself.Name)
+		require.True(t, found)
+		require.Equal(t, via.Ourself.Name, hop)
+	}
+	requireRoute(r3, r2)
+
+	// Once the shortest path is costlier, the longer one is taken,
+	// though r2 itself is still reached directly
+	r1.SetConnectionCost(r2.Ourself.Name, 3)
+	r1.Routes.ensureRecalculated()
+	requireRoute(r3, r4)
+	requireRoute(r2, r2)
+
+	// Combined with a cost on the alternative, the shortest path wins
+	// again
+	r1.SetConnectionCost(r4.Ourself.Name, 4)
+	r1.Routes.ensureRecalculated()
+	requireRoute(r3, r2)
+
+	r1.SetConnectionCost(r2.Ourself.Name, 0)
+	r1.SetConnectionCost(r4.Ourself.Name, 0)
+	r1.Routes.ensureRecalculated()
+	requireRoute(r3, r2)
+	for _, r := range routers {
+		r.Stop()
+	}
+}
+
+func TestConnectionCostAdvertised(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	r4 := newTestRouter(t, "04:00:00:04:00:00")
+	routers := []*Router{r1, r2, r3, r4}
+	// A square, where r2 has two equal ways to r4, and prefers that via r1
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r1, r4)
+	addTestGossipConnection(t, r2, r3)
+	addTestGossipConnection(t, r3, r4)
+	flushAndCheckTopology(t, routers,
+		r1.tp(r2, r4), r2.tp(r1, r3), r3.tp(r2, r4), r4.tp(r1, r3))
+
+	// Were the cost known only to r1, r1 would send to r4 via r2, and
+	// r2 back via r1
+	r1.SetConnectionCost(r4.Ourself.Name, 10)
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	byName := make(map[PeerName]*Router)
+	for _, r := range routers {
+		r.Routes.ensureRecalculated()
+		byName[r.Ourself.Name] = r
+	}
+	path := []PeerName{r1.Ourself.Name}
+	for r := r1; r != r4; {
+		hop, found := r.Routes.Unicast(r4.Ourself.Name)
+		require.True(t, found)
+		require.NotContains(t, path, hop, "routing loop")
+		path = append(path, hop)
+		r = byName[hop]
+	}
+	require.Equal(t, []PeerName{r1.Ourself.Name, r2.Ourself.Name, r3.Ourself.Name, r4.Ourself.Name}, path)
+	for _, r := range routers {
+		r.Stop()
+	}
+}
+
+func TestWaitForPeers(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+
+	require.NoError(t, r1.WaitForPeers(context.Background(), 1))
+
+	done := make(chan error, 1)
+	go func() { done <- r1.WaitForPeers(context.Background(), 3) }()
+
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, routers[:2], r1.tp(r2), r2.tp(r1))
+	r1.Routes.ensureRecalculated()
+	select {
+	case err := <-done:
+		require.FailNow(t, "WaitForPeers returned early", "%v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+	r1.Routes.ensureRecalculated()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "WaitForPeers did not return")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, r1.WaitForPeers(ctx, 4))
+}
+
+type versionedGossipData struct {
+	GossipData
+	version byte
+}
+
+func (d versionedGossipData) SchemaVersion() byte { return d.version }
+
+type schemaGossiper struct {
+	testGossiper
+	sync.Mutex
+	unicasts, broadcasts map[byte][]byte // payloads by version
+}
+
+func newSchemaGossiper() *schemaGossiper {
+	return &schemaGossiper{
+		testGossiper: *newTestGossiper(),
+		unicasts:     make(map[byte][]byte),
+		broadcasts:   make(map[byte][]byte),
+	}
+}
+
+func (g *schemaGossiper) OnGossipUnicastVersion(src PeerName, version byte, msg []byte) error {
+	g.Lock()
+	defer g.Unlock()
+	g.unicasts[version] = append(g.unicasts[version], msg...)
+	return nil
+}
+
+func (g *schemaGossiper) OnGossipBroadcastVersion(src PeerName, version byte, update []byte) (GossipData, error) {
+	g.Lock()
+	g.broadcasts[version] = append(g.broadcasts[version], update...)
+	g.Unlock()
+	return g.OnGossipBroadcast(src, update)
+}
+
+func (g *schemaGossiper) OnGossipVersion(version byte, msg []byte) (GossipData, error) {
+	return g.OnGossip(msg)
+}
+
+func TestGossipSchemaVersion(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r1, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2, r3), r2.tp(r1), r3.tp(r1))
+
+	s1, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	g2 := newSchemaGossiper()
+	_, err = r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+	g3 := newTestGossiper() // unaware of schema versions
+	_, err = r3.NewGossip("Test", g3)
+	require.NoError(t, err)
+
+	vs := s1.(VersionedGossip)
+	require.NoError(t, vs.GossipUnicastVersion(r2.Ourself.Name, 1, []byte{10}))
+	require.NoError(t, vs.GossipUnicastVersion(r2.Ourself.Name, 2, []byte{20}))
+	require.NoError(t, s1.GossipUnicast(r2.Ourself.Name, []byte{30}))
+	sendPendingGossip(routers...)
+
+	s1.GossipBroadcast(versionedGossipData{newSurrogateGossipData([]byte{1}), 1})
+	sendPendingGossip(routers...)
+	s1.GossipBroadcast(versionedGossipData{newSurrogateGossipData([]byte{2}), 2})
+	sendPendingGossip(routers...)
+
+	g2.Lock()
+	require.Equal(t, map[byte][]byte{0: {30}, 1: {10}, 2: {20}}, g2.unicasts)
+	require.Equal(t, map[byte][]byte{1: {1}, 2: {2}}, g2.broadcasts)
+	g2.Unlock()
+	g3.checkHas(t, 1, 2)
+}
+
+func TestGossipBackpressure(t *testing.T) {
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{
+		GossipBackpressure:    BackpressureMedian,
+		BackpressureThreshold: 2,
+		BackpressureMaxDelay:  5 * time.Second,
+	})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	r4 := newTestRouter(t, "04:00:00:04:00:00")
+	// r2 is slow: nothing r1 sends to it is delivered until started
+	slow := r1.newTestGossipConnection(t, r2)
+	r2.newTestGossipConnection(t, r1).Start()
+	addTestGossipConnection(t, r1, r3)
+	addTestGossipConnection(t, r1, r4)
+
+	s1, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+
+	// The median neighbour keeps up, so r1 is not held back by r2
+	for i := 0; i < 10; i++ {
+		broadcast(s1, byte(i))
+	}
+	require.True(t, slow.senders.pending("Test") >= 2)
+
+	r1.GossipBackpressure = BackpressureSlowest
+	done := make(chan struct{})
+	go func() {
+		broadcast(s1, 10)
+		close(done)
+	}()
+	select {
+	case <-done:
+		require.FailNow(t, "origination was not throttled")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The topology is never held back, however far behind r2 is
+	essential, err := r1.NewGossip("Essential", newTestGossiper())
+	require.NoError(t, err)
+	essential.(*gossipChannel).essential = true
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		broadcast(essential, byte(i))
+	}
+	require.True(t, slow.senders.pending("Essential") >= 2)
+	require.True(t, time.Since(start) < time.Second, "essential channel was throttled")
+
+	slow.Start()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "origination did not resume")
+	}
+}
+
+func TestZoneRelayPolicy(t *testing.T) {
+	zoneA, zoneB := Config{Zone: "a"}, Config{Zone: "b"}
+	bridgeA, bridgeB := Config{Zone: "a", ZoneBridge: true}, Config{Zone: "b", ZoneBridge: true}
+	a1 := newTestRouterWithConfig(t, "01:00:00:0a:00:00", zoneA)
+	a2 := newTestRouterWithConfig(t, "02:00:00:0a:00:00", zoneA)
+	a3 := newTestRouterWithConfig(t, "03:00:00:0a:00:00", zoneA)
+	ab := newTestRouterWithConfig(t, "0b:00:00:0a:00:00", bridgeA)
+	b1 := newTestRouterWithConfig(t, "01:00:00:0b:00:00", zoneB)
+	bb := newTestRouterWithConfig(t, "0b:00:00:0b:00:00", bridgeB)
+	routers := []*Router{a1, a2, a3, ab, b1, bb}
+	addTestGossipConnection(t, a1, a3)
+	addTestGossipConnection(t, a3, a2)
+	addTestGossipConnection(t, a2, ab)
+	addTestGossipConnection(t, ab, bb)
+	addTestGossipConnection(t, bb, b1)
+	addTestGossipConnection(t, a1, b1) // crosses zones, but no bridge
+	addTestGossipConnection(t, a1, bb) // shortcut via another zone's bridge
+	addTestGossipConnection(t, bb, a2)
+	flushAndCheckTopology(t, routers,
+		a1.tp(a3, b1, bb), a2.tp(a3, ab, bb), a3.tp(a1, a2), ab.tp(a2, bb),
+		b1.tp(bb, a1), bb.tp(ab, b1, a1, a2))
+	for _, r := range routers {
+		r.Routes.ensureRecalculated()
+	}
+
+	requireHop := func(from, to, via *Router) {
+		hop, found := from.Routes.Unicast(to.Ourself.Name)
+		require.True(t, found)
+		require.Equal(t, via.Ourself.Name, hop)
+	}
+	requireHop(a1, a2, a3) // stays in zone, though via bb is shorter
+	requireHop(a1, b1, bb) // crosses via the bridge, not directly
+	requireHop(b1, a1, bb)
+	require.NotContains(t, a1.Routes.Broadcast(a1.Ourself.Name), b1.Ourself.Name)
+
+	s1, err := a1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	g2 := &provenanceGossiper{testGossiper: *newTestGossiper()}
+	_, err = a2.NewGossip("Test", g2)
+	require.NoError(t, err)
+	require.NoError(t, s1.GossipUnicast(a2.Ourself.Name, []byte{1}))
+	sendPendingGossip(routers...)
+	g2.Lock()
+	defer g2.Unlock()
+	require.Equal(t, []PeerName{a3.Ourself.Name}, g2.senders)
+}
+
+// gateSender passes the channel name of each message it is asked to send
+// down a channel, blocking until it is read.
+type gateSender struct {
+	sent chan string
+}
+
+func (s *gateSender) SendProtocolMsg(pm protocolMsg) error {
+	var channelName string
+	if err := gob.NewDecoder(bytes.NewReader(pm.msg)).Decode(&channelName); err != nil {
+		return err
+	}
+	s.sent <- channelName
+	return nil
+}
+
+func TestGossipFairScheduling(t *testing.T) {
+	gate := &gateSender{sent: make(chan string)}
+	senders := newGossipSenders(gate, make(chan struct{}))
+	senders.schedule(map[string]int{"high": 4})
+	ourself := &localPeer{Peer: &Peer{}}
+	high := &gossipChannel{name: "high", ourself: ourself}
+	low := &gossipChannel{name: "low", ourself: ourself}
+	highSender := senders.Sender(high.name, high.makeGossipSender)
+	lowSender := senders.Sender(low.name, low.makeGossipSender)
+
+	var backlog GossipData = newSurrogateGossipData([]byte{0})
+	for i := 1; i < 100; i++ {
+		backlog = backlog.Merge(newSurrogateGossipData([]byte{byte(i)}))
+	}
+	highSender.Send(backlog)
+	require.Equal(t, "high", <-gate.sent)
+
+	lowSender.Send(newSurrogateGossipData([]byte{1}))
+	for senders.sched.waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	var order []string
+	for i := 0; i < 8; i++ {
+		order = append(order, <-gate.sent)
+	}
+	require.Equal(t, []string{"high", "high", "high", "low", "high", "high", "high", "high"}, order)
+}
+
+// highestNeighbourRouter routes everything via our highest-named neighbour.
+type highestNeighbourRouter struct {
+	sync.Mutex
+	last RouteGraph
+}
+
+func (c *highestNeighbourRouter) ComputeRoutes(graph RouteGraph) map[PeerName]PeerName {
+	c.Lock()
+	c.last = graph
+	c.Unlock()
+	var via PeerName
+	for _, name := range graph.Neighbours[graph.Ourself] {
+		if name > via {
+			via = name
+		}
+	}
+	routes := make(map[PeerName]PeerName)
+	for name := range graph.Neighbours {
+		routes[name] = via
+	}
+	return routes
+}
+
+func TestRouteComputer(t *testing.T) {
+	computer := &highestNeighbourRouter{}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{RouteComputer: computer})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	r4 := newTestRouter(t, "04:00:00:04:00:00")
+	routers := []*Router{r1, r2, r3, r4}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r1, r3)
+	addTestGossipConnection(t, r2, r4)
+	addTestGossipConnection(t, r3, r4)
+	flushAndCheckTopology(t, routers, r1.tp(r2, r3), r2.tp(r1, r4), r3.tp(r1, r4), r4.tp(r2, r3))
+	r1.Routes.ensureRecalculated()
+
+	for _, r := range []*Router{r2, r3, r4} {
+		hop, found := r1.Routes.Unicast(r.Ourself.Name)
+		require.True(t, found)
+		require.Equal(t, r3.Ourself.Name, hop)
+	}
+	hop, found := r1.Routes.Unicast(r1.Ourself.Name)
+	require.True(t, found)
+	require.Equal(t, UnknownPeerName, hop)
+
+	// Connection costs are as advertised
+	r2.SetConnectionCost(r4.Ourself.Name, 5)
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	r1.Routes.ensureRecalculated()
+
+	computer.Lock()
+	defer computer.Unlock()
+	graph := computer.last
+	require.Equal(t, r1.Ourself.Name, graph.Ourself)
+	require.ElementsMatch(t, []PeerName{r1.Ourself.Name, r4.Ourself.Name}, graph.Neighbours[r3.Ourself.Name])
+	require.Equal(t, map[PeerName]map[PeerName]float64{r2.Ourself.Name: {r4.Ourself.Name: 5}}, graph.ConnectionCosts)
+}
+
+func TestGossipBroadcastSequence(t *testing.T) {
+	peerName, _ := PeerNameFromString("01:00:00:01:00:00")
+	router, err := NewRouter(Config{}, peerName, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	g := newTestGossiper()
+	s, err := router.NewSequencedGossip("test", g)
+	require.NoError(t, err)
+	unsequenced := newTestGossiper()
+	_, err = router.NewGossip("unsequenced", unsequenced)
+	require.NoError(t, err)
+
+	origin, _ := PeerNameFromString("09:00:00:09:00:00")
+	deliverOn := func(channelName string, seq uint64, v byte) {
+		payload := gobEncodeSequenced(0, seq, channelName, origin, []byte{v})
+		require.NoError(t, router.handleGossip(origin, ProtocolGossipBroadcast, payload))
+	}
+	deliver := func(seq uint64, v byte) { deliverOn("test", seq, v) }
+	first, second := newIncarnation(), newIncarnation()+1<<sequenceCountBits
+
+	deliver(first+10, 1)
+	deliver(first+5, 2) // stale re-delivery
+	require.True(t, g.has(1))
+	require.False(t, g.has(2), "stale broadcast was not ignored")
+
+	deliver(0, 3) // from a peer which predates sequence numbers
+	deliver(first+11, 4)
+	g.checkHas(t, 1, 3, 4)
+
+	// The origin restarts, its sequence starting afresh
+	deliver(second+1, 5)
+	deliver(second, 6)
+	g.checkHas(t, 1, 3, 4, 5)
+
+	// Other channels admit everything
+	deliverOn("unsequenced", first+10, 1)
+	deliverOn("unsequenced", first+5, 2)
+	unsequenced.checkHas(t, 1, 2)
+
+	// and the origin is forgotten when it goes
+	router.forgetPeerChannels(origin)
+	require.Empty(t, s.(*gossipChannel).lastSequence)
+}
+
+// listGossipData keeps the order of what it merges, so its Merge is not
+// commutative.
+type listGossipData []byte
+
+func (d listGossipData) Encode() [][]byte { return [][]byte{d} }
+
+func (d listGossipData) Merge(other GossipData) GossipData {
+	return append(append(listGossipData{}, d...), other.(listGossipData)...)
+}
+
+func (d listGossipData) Clone() GossipData { return append(listGossipData{}, d...) }
+
+// appendGossipData is listGossipData merging into its receiver, as
+// GossipData may.
+type appendGossipData struct{ list []byte }
+
+func (d *appendGossipData) Encode() [][]byte { return [][]byte{d.list} }
+
+func (d *appendGossipData) Merge(other GossipData) GossipData {
+	d.list = append(d.list, other.(*appendGossipData).list...)
+	return d
+}
+
+func (d *appendGossipData) Clone() GossipData {
+	return &appendGossipData{append([]byte{}, d.list...)}
+}
+
+// maxGossipData keeps the largest value it has seen.
+type maxGossipData byte
+
+func (d maxGossipData) Encode() [][]byte { return [][]byte{{byte(d)}} }
+
+func (d maxGossipData) Merge(other GossipData) GossipData {
+	if o := other.(maxGossipData); o > d {
+		return o
+	}
+	return d
+}
+
+func (d maxGossipData) Clone() GossipData { return d }
+
+func TestMergeValidation(t *testing.T) {
+	validator := &mergeValidator{logger: log.New(ioutil.Discard, "", 0)}
+	senders := newGossipSenders(&stuckSender{}, make(chan struct{}))
+	senders.validateMerges(validator)
+	channel := &gossipChannel{name: "test", ourself: &localPeer{Peer: &Peer{}}}
+	s := senders.Sender(channel.name, channel.makeGossipSender)
+
+	// The first item may be taken by the sender before anything merges
+	for i := 0; i < 4; i++ {
+		s.Send(maxGossipData(i))
+	}
+	require.Zero(t, atomic.LoadUint64(&validator.violations))
+
+	for i := 0; i < 4; i++ {
+		s.Broadcast(PeerName(1), listGossipData{byte(i)})
+	}
+	require.True(t, atomic.LoadUint64(&validator.violations) >= 2)
+
+	// Merging into the receiver disturbs neither operand
+	violations := atomic.LoadUint64(&validator.violations)
+	a, b := &appendGossipData{[]byte{1}}, &appendGossipData{[]byte{2}}
+	merged := validator.merge(a, b)
+	require.Equal(t, violations+1, atomic.LoadUint64(&validator.violations))
+	require.Equal(t, []byte{1, 2}, merged.(*appendGossipData).list)
+	require.Equal(t, []byte{2}, b.list)
+}
+
+func TestAdaptiveGossipInterval(t *testing.T) {
+	peerName, _ := PeerNameFromString("01:00:00:01:00:00")
+	config := Config{MinGossipInterval: 100 * time.Millisecond, MaxGossipInterval: 1600 * time.Millisecond}
+	router, err := NewRouter(config, peerName, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	require.Equal(t, config.MinGossipInterval, router.gossipTick())
+	s, err := router.NewGossip("test", newTestGossiper())
+	require.NoError(t, err)
+	interval := s.(*gossipChannel).interval
+	require.Equal(t, config.MaxGossipInterval, interval.interval())
+
+	tm := now()
+	gossipRound := func() {
+		require.False(t, interval.due(tm.Add(interval.interval()/4)))
+		tm = tm.Add(interval.interval())
+		require.True(t, interval.due(tm))
+	}
+
+	// Frequent updates shorten the interval
+	for i := 0; i < 5; i++ {
+		broadcast(s, byte(i))
+		broadcast(s, byte(i))
+		gossipRound()
+	}
+	require.Equal(t, config.MinGossipInterval, interval.interval())
+
+	// Idling lengthens it again
+	gossipRound()
+	require.Equal(t, 2*config.MinGossipInterval, interval.interval())
+	for i := 0; i < 5; i++ {
+		gossipRound()
+	}
+	require.Equal(t, config.MaxGossipInterval, interval.interval())
+}
+
+func TestCompactGossipMsg(t *testing.T) {
+	src, _ := PeerNameFromString("01:00:00:01:00:00")
+	dst, _ := PeerNameFromString("02:00:00:02:00:00")
+	pm := protocolMsg{ProtocolGossipUnicast, gobEncode("test", src, dst, []byte{42})}
+
+	compact, err := compactGossipMsg(pm)
+	require.NoError(t, err)
+	require.Equal(t, ProtocolGossipUnicastCompact, int(compact.tag))
+	require.True(t, len(compact.msg) < len(pm.msg), "compact %d bytes, gob %d", len(compact.msg), len(pm.msg))
+	require.Equal(t, src.bytes(), compact.msg[:NameSize])
+
+	expanded, err := expandGossipMsg(compact)
+	require.NoError(t, err)
+	require.Equal(t, pm, expanded)
+
+	// Both forms are delivered alike
+	router := newTestRouter(t, dst.String())
+	g := &provenanceGossiper{testGossiper: *newTestGossiper()}
+	_, err = router.NewGossip("test", g)
+	require.NoError(t, err)
+	for _, m := range []protocolMsg{pm, compact} {
+		require.NoError(t, router.handleGossip(src, m.tag, m.msg))
+	}
+	require.Equal(t, []PeerName{src, src}, g.origins)
+}
+
+func BenchmarkGossipSrcNameDecode(b *testing.B) {
+	src, _ := PeerNameFromString("01:00:00:01:00:00")
+	pm := protocolMsg{ProtocolGossipBroadcast, gobEncode("test", src, []byte{42})}
+	compact, err := compactGossipMsg(pm)
+	require.NoError(b, err)
+
+	b.Run("gob", func(b *testing.B) {
+		b.SetBytes(int64(len(pm.msg)))
+		for i := 0; i < b.N; i++ {
+			dec := gob.NewDecoder(bytes.NewReader(pm.msg))
+			var channelName string
+			var srcName PeerName
+			if dec.Decode(&channelName) != nil || dec.Decode(&srcName) != nil {
+				b.Fatal("decode failed")
+			}
+		}
+	})
+	b.Run("compact", func(b *testing.B) {
+		b.SetBytes(int64(len(compact.msg)))
+		for i := 0; i < b.N; i++ {
+			srcName := PeerNameFromBin(compact.msg[:NameSize])
+			dec := gob.NewDecoder(bytes.NewReader(compact.msg[NameSize:]))
+			var channelName string
+			if dec.Decode(&channelName) != nil || srcName != src {
+				b.Fatal("decode failed")
+			}
+		}
+	})
+}
+
+// countingSender counts the messages it is asked to send.
+type countingSender struct {
+	sent int
+}
+
+func (s *countingSender) SendProtocolMsg(protocolMsg) error {
+	s.sent++
+	return nil
+}
+
+func TestGossipBatchLimit(t *testing.T) {
+	counter := &countingSender{}
+	channel := &gossipChannel{name: "test", ourself: &localPeer{Peer: &Peer{}}}
+	// Without a run loop, so that the test does each flush
+	more := make(chan struct{}, 1)
+	s := &gossipSender{
+		makeMsg:          channel.makeMsg,
+		makeBroadcastMsg: channel.makeBroadcastMsg,
+		sender:           counter,
+		broadcasts:       make(map[PeerName]GossipData),
+		more:             more,
+		broadcastCounts:  make(map[PeerName]int),
+		turnUsed:         -1,
+		maxBatch:         10,
+	}
+	var backlog GossipData = newSurrogateGossipData([]byte{0})
+	for i := 1; i < 25; i++ {
+		backlog = backlog.Merge(newSurrogateGossipData([]byte{byte(i)}))
+	}
+	s.Send(backlog)
+	for i := 0; i < 5; i++ {
+		s.Broadcast(PeerName(i), newSurrogateGossipData([]byte{byte(i)}))
+	}
+
+	stop := make(chan struct{})
+	var batches []int
+	for len(more) > 0 {
+		<-more
+		before := counter.sent
+		_, err := s.deliver(stop)
+		require.NoError(t, err)
+		batches = append(batches, counter.sent-before)
+	}
+	require.Equal(t, []int{10, 10, 10}, batches)
+}
+
+// byteCountingSender counts the bytes it is asked to send, as
+// LocalConnection does.
+type byteCountingSender struct {
+	bytes int64 // atomic
+}
+
+func (s *byteCountingSender) SendProtocolMsg(pm protocolMsg) error {
+	atomic.AddInt64(&s.bytes, int64(1+len(pm.msg)))
+	return nil
+}
+
+func TestGossipTotalByteRate(t *testing.T) {
+	const rate = 50000
+	bucket := newByteBucket(rate)
+	stop := make(chan struct{})
+	defer close(stop)
+	channel := &gossipChannel{name: "test", ourself: &localPeer{Peer: &Peer{}}}
+	conns := make([]*byteCountingSender, 3)
+	start := time.Now()
+	for i := range conns {
+		conns[i] = &byteCountingSender{}
+		senders := newGossipSenders(conns[i], stop)
+		senders.throttle(bucket)
+		var backlog GossipData = newSurrogateGossipData(make([]byte, 1000))
+		for j := 1; j < 500; j++ {
+			backlog = backlog.Merge(newSurrogateGossipData(make([]byte, 1000)))
+		}
+		senders.Sender(channel.name, channel.makeGossipSender).Send(backlog)
+	}
+	sample := func() (total int64, counts []int64) {
+		for _, conn := range conns {
+			count := atomic.LoadInt64(&conn.bytes)
+			counts = append(counts, count)
+			total += count
+		}
+		return total, counts
+	}
+	// The first connection may well take the initial burst, before the
+	// others get going
+	time.Sleep(500 * time.Millisecond)
+	total0, counts0 := sample()
+	time.Sleep(time.Second)
+	total, counts := sample()
+	elapsed := time.Since(start)
+
+	// A second's burst, and then the rate, give or take a message
+	// per connection
+	limit := int64(rate*(elapsed+time.Second)/time.Second) + int64(len(conns))*1100
+	require.True(t, total <= limit, "sent %d bytes in %v; limit %d", total, elapsed, limit)
+	require.True(t, total-total0 >= rate/2, "sent only %d bytes in a second", total-total0)
+	for i := range counts {
+		share := counts[i] - counts0[i]
+		require.True(t, share >= (total-total0)/int64(2*len(conns)), "connection %d sent %d of %d bytes", i, share, total-total0)
+	}
+}
+
+func TestGetOrCreateGossip(t *testing.T) {
+	router := newTestRouter(t, "01:00:00:01:00:00")
+	g1, g2 := newTestGossiper(), newTestGossiper()
+	s1, created := router.GetOrCreateGossip("test", g1)
+	require.True(t, created)
+	s2, created := router.GetOrCreateGossip("test", g2)
+	require.False(t, created)
+	require.True(t, s1 == s2)
+	require.True(t, router.gossipChannel("test").gossiper == Gossiper(g1), "gossiper was swapped")
+
+	_, err := router.NewGossip("test", g2)
+	require.Error(t, err)
+
+	// Names of the router's own channels are reserved, even unused
+	_, err = router.NewGossip("mesh-test", g2)
+	require.Error(t, err)
+	s, created := router.GetOrCreateGossip(confirmChannel, g2)
+	require.False(t, created)
+	require.Nil(t, s)
+}
+
+func TestRouteRecalcThrottle(t *testing.T) {
+	const interval = 200 * time.Millisecond
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{MinRouteRecalcInterval: interval})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	addTestGossipConnection(t, r1, r2)
+
+	calculations := func() uint64 {
+		r1.Routes.RLock()
+		defer r1.Routes.RUnlock()
+		return r1.Routes.calculations
+	}
+	before := calculations()
+	start := time.Now()
+	for time.Since(start) < time.Second {
+		r1.Routes.recalculate()
+		time.Sleep(5 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	require.True(t, calculations()-before <= uint64(elapsed/interval)+1,
+		"%d recalculations in %v", calculations()-before, elapsed)
+
+	// The trailing recalculation reflects the final topology.
+	time.Sleep(interval + recalcDeferTime)
+	_, found := r1.Routes.Unicast(r2.Ourself.Name)
+	require.True(t, found)
+}
+
+type recordingTracer struct {
+	sync.Mutex
+	spans []string
+}
+
+func (rt *recordingTracer) TraceGossip(stage GossipStage, channel string, origin PeerName) func(error) {
+	return func(err error) {
+		rt.Lock()
+		defer rt.Unlock()
+		rt.spans = append(rt.spans, fmt.Sprintf("%s %s %s %v", stage, channel, origin, err != nil))
+	}
+}
+
+func (rt *recordingTracer) take() []string {
+	rt.Lock()
+	defer rt.Unlock()
+	spans := rt.spans
+	rt.spans = nil
+	return spans
+}
+
+func TestGossipTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	peerName, _ := PeerNameFromString("01:00:00:01:00:00")
+	router, err := NewRouter(Config{GossipTracer: tracer}, peerName, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	g, err := router.NewGossip("test", newTestGossiper())
+	require.NoError(t, err)
+	origin, _ := PeerNameFromString("09:00:00:09:00:00")
+
+	broadcast(g, 1)
+	require.Equal(t, []string{"originate test 01:00:00:01:00:00 false"}, tracer.take())
+
+	payload := gobEncodeSequenced(0, 1, "test", origin, []byte{2})
+	require.NoError(t, router.handleGossip(origin, ProtocolGossipBroadcast, payload))
+	require.Equal(t, []string{
+		"deliver test 09:00:00:09:00:00 false",
+		"relay test 09:00:00:09:00:00 false",
+	}, tracer.take())
+
+	payload = gobEncodeVersioned(0, "test", origin, peerName, []byte{3})
+	require.NoError(t, router.handleGossip(origin, ProtocolGossipUnicast, payload))
+	require.Equal(t, []string{"deliver test 09:00:00:09:00:00 false"}, tracer.take())
+
+	// We have no route to elsewhere, so relaying fails.
+	elsewhere, _ := PeerNameFromString("08:00:00:08:00:00")
+	payload = gobEncodeVersioned(0, "test", origin, elsewhere, []byte{4})
+	require.NoError(t, router.handleGossip(origin, ProtocolGossipUnicast, payload))
+	require.Equal(t, []string{"relay test 09:00:00:09:00:00 true"}, tracer.take())
+
+	require.Error(t, g.GossipUnicast(elsewhere, []byte{5}))
+	require.Equal(t, []string{"originate test 01:00:00:01:00:00 true"}, tracer.take())
+}
+
+func TestNeighbourGossip(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	g1, g2, g3 := newTestGossiper(), newTestGossiper(), newTestGossiper()
+	s1, err := r1.NewNeighbourGossip("link", g1)
+	require.NoError(t, err)
+	_, err = r2.NewNeighbourGossip("link", g2)
+	require.NoError(t, err)
+	_, err = r3.NewNeighbourGossip("link", g3)
+	require.NoError(t, err)
+
+	broadcast(s1, 1)
+	s1.GossipNeighbourSubset(newSurrogateGossipData([]byte{2}))
+	sendPendingGossip(routers...)
+	g2.checkHas(t, 1, 2)
+	require.False(t, g3.has(1) || g3.has(2), "neighbour-only gossip was relayed")
+
+	require.NoError(t, s1.GossipUnicast(r2.Ourself.Name, []byte{3}))
+	require.Error(t, s1.GossipUnicast(r3.Ourself.Name, []byte{4}))
+}
+
+func TestGossipTap(t *testing.T) {
+	var (
+		lock   sync.Mutex
+		tapped []string
+	)
+	tap := func(channel string, src PeerName, n int) {
+		lock.Lock()
+		defer lock.Unlock()
+		tapped = append(tapped, fmt.Sprintf("%s %s %d", channel, src, n))
+	}
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{GossipTap: tap})
+	routers := []*Router{r1, r2}
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1))
+	lock.Lock()
+	tapped = nil // forget the topology gossip
+	lock.Unlock()
+
+	a, err := r1.NewGossip("a", newTestGossiper())
+	require.NoError(t, err)
+	_, err = r2.NewGossip("a", newTestGossiper())
+	require.NoError(t, err)
+	b, err := r1.NewGossip("b", newTestGossiper()) // surrogate at r2
+	require.NoError(t, err)
+
+	broadcast(a, 1)
+	sendPendingGossip(routers...)
+	require.NoError(t, b.GossipUnicast(r2.Ourself.Name, []byte{2, 3}))
+	a.GossipNeighbourSubset(newSurrogateGossipData([]byte{4, 5, 6}))
+	sendPendingGossip(routers...)
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, []string{
+		"a 01:00:00:01:00:00 1",
+		"b 01:00:00:01:00:00 2",
+		"a 01:00:00:01:00:00 3",
+	}, tapped)
+}
+
+func TestBroadcastRetention(t *testing.T) {
+	channel := &gossipChannel{name: "test", ourself: &localPeer{Peer: &Peer{}}}
+	// Without a run loop, so that broadcasts are held until we deliver
+	s := &gossipSender{
+		makeMsg:          channel.makeMsg,
+		makeBroadcastMsg: channel.makeBroadcastMsg,
+		sender:           &countingSender{},
+		broadcasts:       make(map[PeerName]GossipData),
+		more:             make(chan struct{}, 1),
+		broadcastCounts:  make(map[PeerName]int),
+		turnUsed:         -1,
+		retention:        BroadcastRetention{MaxItems: 1},
+	}
+	origin := PeerName(1)
+	for i := 1; i <= 3; i++ {
+		s.Broadcast(origin, newSurrogateGossipData([]byte{byte(i)}))
+	}
+	// The oldest item is now the last
+	require.Equal(t, s.arrivals, s.broadcastSince[origin])
+	data, _ := s.pick()
+	require.Equal(t, [][]byte{{3}}, data.Encode(), "old values were retained")
+	require.Equal(t, 0, s.pending)
+
+	// Broadcasts older than MaxAge are discarded before sending
+	clock := newTestClock()
+	s.clock = clock.now
+	s.retention = BroadcastRetention{MaxAge: time.Second}
+	s.Broadcast(origin, newSurrogateGossipData([]byte{4}))
+	clock.advance(2 * time.Second)
+	s.Broadcast(origin, newSurrogateGossipData([]byte{5}))
+	data, _ = s.pick()
+	require.Equal(t, [][]byte{{5}}, data.Encode())
+
+	// Once everything from an origin is discarded, so is its arrival,
+	// lest it be picked to drop from with nothing to drop
+	s.Broadcast(origin, newSurrogateGossipData([]byte{6}))
+	clock.advance(2 * time.Second)
+	require.True(t, s.trim(origin, clock.now()))
+	require.NotContains(t, s.broadcastSince, origin)
+	require.Equal(t, 0, s.pending)
+}
+
+func TestOnGossipRound(t *testing.T) {
+	var rounds int32
+	interval := 50 * time.Millisecond
+	r := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{
+		GossipInterval: &interval,
+		OnGossipRound:  func() { atomic.AddInt32(&rounds, 1) },
+	})
+	defer r.Stop()
+	time.Sleep(10 * interval)
+	// Nothing was sent, since we have no neighbours, but each round counts
+	n := atomic.LoadInt32(&rounds)
+	require.True(t, n >= 5 && n <= 11, "%d rounds in %d intervals", n, 10)
+}
+
+func TestSetGossipInterval(t *testing.T) {
+	var rounds int32
+	interval := time.Hour
+	r := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{
+		GossipInterval: &interval,
+		OnGossipRound:  func() { atomic.AddInt32(&rounds, 1) },
+	})
+	defer r.Stop()
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(0), atomic.LoadInt32(&rounds))
+
+	r.SetGossipInterval(20 * time.Millisecond)
+	require.Equal(t, 20*time.Millisecond, r.gossipInterval())
+	time.Sleep(400 * time.Millisecond)
+	n := atomic.LoadInt32(&rounds)
+	require.True(t, n >= 10 && n <= 21, "%d rounds in %d intervals", n, 20)
+
+	r.SetGossipInterval(time.Hour)
+	time.Sleep(50 * time.Millisecond) // let the reset take effect
+	n = atomic.LoadInt32(&rounds)
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, n, atomic.LoadInt32(&rounds), "gossiped after the interval was lengthened")
+}
+
+type recordingLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, args ...interface{}) {
+	l.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+	l.Unlock()
+}
+
+func (l *recordingLogger) contains(s string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPruneSurrogateChannels(t *testing.T) {
+	clock := newTestClock()
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{SurrogateChannelIdle: time.Minute, Clock: clock.now})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, []*Router{r1, r2}, r1.tp(r2), r2.tp(r1))
+	_, err := r1.NewGossip("mine", newTestGossiper())
+	require.NoError(t, err)
+	sa, err := r2.NewGossip("a", newTestGossiper())
+	require.NoError(t, err)
+	sb, err := r2.NewGossip("b", newTestGossiper())
+	require.NoError(t, err)
+	broadcast(sa, 1)
+	broadcast(sb, 1)
+	sendPendingGossip(r1, r2)
+	require.Equal(t, []string{"a", "b"}, r1.SurrogateChannels())
+
+	// Our connection holds a sender for the channel until it is pruned
+	conn, _ := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+	senders := conn.(gossipConnection).gossipSenders()
+	r1.gossipChannel("a").senderFor(conn)
+
+	clock.advance(30 * time.Second)
+	require.Empty(t, r1.PruneSurrogateChannels())
+	broadcast(sb, 2)
+	sendPendingGossip(r1, r2)
+
+	clock.advance(45 * time.Second)
+	require.Equal(t, []string{"a"}, r1.PruneSurrogateChannels())
+	require.Equal(t, []string{"b"}, r1.SurrogateChannels())
+	senders.Lock()
+	_, found := senders.senders["a"]
+	senders.Unlock()
+	require.False(t, found)
+
+	// Channels we registered stay, however long they are idle
+	clock.advance(time.Hour)
+	require.Equal(t, []string{"b"}, r1.PruneSurrogateChannels())
+	require.Empty(t, r1.SurrogateChannels())
+	require.NotNil(t, r1.GetGossip("mine"))
+	r1.Stop()
+	r2.Stop()
+}
+
+func TestWarnOnSimilarChannels(t *testing.T) {
+	for _, warn := range []bool{false, true} {
+		logger := &recordingLogger{}
+		peerName, _ := PeerNameFromString("01:00:00:01:00:00")
+		r, err := NewRouter(Config{WarnOnSimilarChannels: warn}, peerName, "nick", nil, logger)
+		require.NoError(t, err)
+		_, err = r.NewGossip("metrics", newTestGossiper())
+		require.NoError(t, err)
+		r.gossipChannel("metric")
+		r.gossipChannel("metricz")
+		r.gossipChannel("topology")
+		require.Equal(t, warn, logger.contains(`[gossip metric]: WARNING: name is similar to registered channel "metrics"`))
+		require.Equal(t, warn, logger.contains(`[gossip metricz]: WARNING`))
+		require.False(t, logger.contains(`[gossip topology]: WARNING`))
+		r.Stop()
+	}
+}
+
+func TestSimilarChannelNames(t *testing.T) {
+	for _, test := range []struct {
+		a, b    string
+		similar bool
+	}{
+		{"metrics", "metric", true},
+		{"metric", "metrics", true},
+		{"topology", "topolgy", true},
+		{"topology", "topoloyg", false},
+		{"topology", "topology", false},
+		{"a", "", true},
+		{"ab", "", false},
+		{"counter", "county", false},
+	} {
+		require.Equal(t, test.similar, similarChannelNames(test.a, test.b), "%q %q", test.a, test.b)
+	}
+}
+
+func drainTopologyEvents(events <-chan TopologyEvent) []TopologyEvent {
+	var drained []TopologyEvent
+	for {
+		select {
+		case event := <-events:
+			drained = append(drained, event)
+		default:
+			return drained
+		}
+	}
+}
+
+func TestSubscribeTopology(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	routers := []*Router{r1, r2}
+	events, cancel := r1.SubscribeTopology()
+
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1))
+	name1, name2 := r1.Ourself.Name, r2.Ourself.Name
+	require.Equal(t, []TopologyEvent{
+		{Type: TopologyConnectionAdded, Peer: name1, Remote: name2},
+		{Type: TopologyPeerAdded, Peer: name2},
+		{Type: TopologyConnectionAdded, Peer: name2, Remote: name1},
+	}, drainTopologyEvents(events))
+
+	r1.DeleteTestGossipConnection(r2)
+	require.Equal(t, []TopologyEvent{
+		{Type: TopologyConnectionRemoved, Peer: name1, Remote: name2},
+		{Type: TopologyPeerRemoved, Peer: name2},
+	}, drainTopologyEvents(events))
+
+	cancel()
+	_, open := <-events
+	require.False(t, open)
+	cancel() // idempotent
+}
+
+func TestSubscribeTopologyDropsOldest(t *testing.T) {
+	r := newTestRouter(t, "01:00:00:01:00:00")
+	events, cancel := r.SubscribeTopology()
+	defer cancel()
+	sent := make([]TopologyEvent, topologyEventBuffer+10)
+	for i := range sent {
+		sent[i] = TopologyEvent{Type: TopologyPeerAdded, Peer: PeerName(i)}
+	}
+	r.topologyLock.Lock()
+	r.sendTopologyEvents(sent)
+	r.topologyLock.Unlock()
+	require.Equal(t, sent[10:], drainTopologyEvents(events))
+}
+
+func TestChannelInfo(t *testing.T) {
+	interval := time.Minute
+	r := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{
+		GossipInterval: &interval,
+		ChannelWeights: map[string]int{"app": 3},
+	})
+	defer r.Stop()
+	_, err := r.NewGossip("app", newTestGossiper())
+	require.NoError(t, err)
+	r.gossipChannel("other") // as on receipt of gossip
+
+	info, found := r.ChannelInfo("app")
+	require.True(t, found)
+	require.Equal(t, ChannelInfo{Name: "app", Gossiper: "*mesh.testGossiper", Interval: time.Minute, Weight: 3}, info)
+	info, found = r.ChannelInfo("other")
+	require.True(t, found)
+	require.Equal(t, ChannelInfo{Name: "other", Surrogate: true, Gossiper: "*mesh.surrogateGossiper", Interval: time.Minute, Weight: 1}, info)
+	_, found = r.ChannelInfo("missing")
+	require.False(t, found)
+}
+
+func TestDisabledProtocols(t *testing.T) {
+	peerName, _ := PeerNameFromString("01:00:00:01:00:00")
+	config := Config{DisabledProtocols: []byte{ProtocolGossipUnicast}}
+	router, err := NewRouter(config, peerName, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	g := &unicastRecorder{*newTestGossiper(), make(chan []byte, 1)}
+	_, err = router.NewGossip("test", g)
+	require.NoError(t, err)
+	origin, _ := PeerNameFromString("09:00:00:09:00:00")
+
+	err = router.handleGossip(origin, ProtocolGossipUnicast, gobEncodeVersioned(0, "test", origin, peerName, []byte("hello")))
+	require.EqualError(t, err, "rejected gossip from 09:00:00:09:00:00: protocol tag 5 is disabled")
+	err = router.handleGossip(origin, ProtocolGossipUnicastCompact, append(origin.bytes(), gobEncodeVersioned(0, "test", peerName, []byte("hello"))...))
+	require.Error(t, err, "compact unicast was not rejected")
+	require.Empty(t, g.received)
+	require.Equal(t, uint64(2), router.RejectedMessages())
+
+	require.NoError(t, router.handleGossip(origin, ProtocolGossipBroadcast, gobEncodeSequenced(0, 1, "test", origin, []byte{1})))
+	require.True(t, g.has(1))
+	require.Equal(t, uint64(2), router.RejectedMessages())
+}
+
+func TestTopologyGossipFirst(t *testing.T) {
+	var (
+		lock   sync.Mutex
+		tapped []string
+	)
+	tap := func(channel string, src PeerName, n int) {
+		lock.Lock()
+		defer lock.Unlock()
+		tapped = append(tapped, channel)
+	}
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{GossipTap: tap})
+	routers := []*Router{r1, r2}
+	for i := 0; i < 8; i++ {
+		g := newTestGossiper()
+		_, err := g.OnGossip([]byte{byte(i)})
+		require.NoError(t, err)
+		_, err = r1.NewGossip(fmt.Sprintf("bulk-%d", i), g)
+		require.NoError(t, err)
+	}
+
+	// The new connection gets all of r1's channels, topology first
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1))
+	sendPendingGossip(routers...)
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, "topology", tapped[0])
+	for i := 0; i < 8; i++ {
+		require.Contains(t, tapped, fmt.Sprintf("bulk-%d", i))
+	}
+}
+
+// slowMergeData takes a while to merge, keeping track of how many of its
+// merges run at once.
+type slowMergeData struct {
+	running, peak *int32
+}
+
+func (d *slowMergeData) Merge(other GossipData) GossipData {
+	n := atomic.AddInt32(d.running, 1)
+	for p := atomic.LoadInt32(d.peak); n > p && !atomic.CompareAndSwapInt32(d.peak, p, n); p = atomic.LoadInt32(d.peak) {
+	}
+	time.Sleep(10 * time.Millisecond)
+	atomic.AddInt32(d.running, -1)
+	return d
+}
+
+func (d *slowMergeData) Encode() [][]byte {
+	return [][]byte{nil}
+}
+
+// stalledSender never completes a send until stopped, so that gossip
+// piles up, and is merged, behind it.
+type stalledSender struct {
+	stop <-chan struct{}
+}
+
+func (s *stalledSender) SendProtocolMsg(pm protocolMsg) error {
+	<-s.stop
+	return nil
+}
+
+func TestMaxConcurrentMerges(t *testing.T) {
+	const max = 2
+	slots := make(mergeSlots, max)
+	stop := make(chan struct{})
+	defer close(stop)
+	channel := &gossipChannel{name: "test", ourself: &localPeer{Peer: &Peer{}}}
+	var running, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		senders := newGossipSenders(&stalledSender{stop}, stop)
+		senders.limitMerges(slots)
+		s := senders.Sender(channel.name, channel.makeGossipSender)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				s.Send(&slowMergeData{&running, &peak})
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(max), atomic.LoadInt32(&peak))
+}
+
+// gatedSender sends a message for each token put in its gate, recording
+// what it sent.
+type gatedSender struct {
+	sync.Mutex
+	gate chan struct{}
+	sent [][]byte
+}
+
+func (s *gatedSender) SendProtocolMsg(pm protocolMsg) error {
+	<-s.gate
+	s.Lock()
+	defer s.Unlock()
+	s.sent = append(s.sent, pm.msg)
+	return nil
+}
+
+func (s *gatedSender) sentMsgs() [][]byte {
+	s.Lock()
+	defer s.Unlock()
+	return append([][]byte(nil), s.sent...)
+}
+
+func TestGossipDeadline(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	sender := &gatedSender{gate: make(chan struct{})}
+	makeMsg := func(version byte, msg []byte) protocolMsg { return protocolMsg{ProtocolGossip, msg} }
+	s := newGossipSender(makeMsg, nil, sender, stop, nil)
+
+	// The first message is stuck on the link while the second, with a
+	// short deadline, waits behind it
+	empty := func() bool {
+		s.Lock()
+		defer s.Unlock()
+		return s.empty()
+	}
+	s.Send(newSurrogateGossipData([]byte{1}))
+	require.Eventually(t, empty, time.Second, time.Millisecond)
+	s.Send(GossipWithDeadline(newSurrogateGossipData([]byte{2}), time.Now().Add(50*time.Millisecond)))
+	time.Sleep(100 * time.Millisecond)
+	sender.gate <- struct{}{}
+	require.Eventually(t, empty, time.Second, time.Millisecond)
+
+	// so by the time the link clears, it is dropped, and the next
+	// message, whose deadline is far off, goes instead
+	s.Send(GossipWithDeadline(newSurrogateGossipData([]byte{3}), time.Now().Add(time.Hour)))
+	sender.gate <- struct{}{}
+	require.Eventually(t, func() bool { return len(sender.sentMsgs()) == 2 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, [][]byte{{1}, {3}}, sender.sentMsgs())
+}
@@ -0,0 +1,39 @@
+package mesh
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// GraphDOT renders the topology known to the router as a Graphviz DOT
+// document. Nodes are labelled with peer nicknames, and the local peer
+// is highlighted. Each peer's connections are drawn as edges from it,
+// dashed if not yet established.
+func (router *Router) GraphDOT() string {
+	peers := makePeerStatusSlice(router.Peers)
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "digraph mesh {")
+	for _, peer := range peers {
+		attrs := fmt.Sprintf("label=%q", peer.NickName)
+		if peer.Name == router.Ourself.Name.String() {
+			attrs += ", style=filled, fillcolor=lightblue"
+		}
+		fmt.Fprintf(&buf, "\t%q [%s];\n", peer.Name, attrs)
+	}
+	for _, peer := range peers {
+		conns := peer.Connections
+		sort.Slice(conns, func(i, j int) bool { return conns[i].Name < conns[j].Name })
+		for _, conn := range conns {
+			if conn.Established {
+				fmt.Fprintf(&buf, "\t%q -> %q;\n", peer.Name, conn.Name)
+			} else {
+				fmt.Fprintf(&buf, "\t%q -> %q [style=dashed];\n", peer.Name, conn.Name)
+			}
+		}
+	}
+	fmt.Fprintln(&buf, "}")
+	return buf.String()
+}
@@ -0,0 +1,29 @@
+package mesh
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphDOT(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	dot := r1.GraphDOT()
+	require.Contains(t, dot, "digraph mesh {")
+	for _, r := range routers {
+		require.Contains(t, dot, fmt.Sprintf("%q [label=%q", r.Ourself.Name.String(), r.Ourself.NickName))
+	}
+	require.Contains(t, dot, `"01:00:00:01:00:00" [label="nick", style=filled, fillcolor=lightblue];`)
+	for _, edge := range [][2]*Router{{r1, r2}, {r2, r1}, {r2, r3}, {r3, r2}} {
+		require.Contains(t, dot, fmt.Sprintf("%q -> %q;", edge[0].Ourself.Name.String(), edge[1].Ourself.Name.String()))
+	}
+	require.NotContains(t, dot, fmt.Sprintf("%q -> %q", r1.Ourself.Name.String(), r3.Ourself.Name.String()))
+}
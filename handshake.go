@@ -0,0 +1,106 @@
+package mesh
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HandshakePhase is a stage in setting up a connection. See
+// Config.OnHandshakePhase.
+type HandshakePhase int
+
+const (
+	// HandshakeConnect is making the TCP connection. Only outbound
+	// connections have it.
+	HandshakeConnect HandshakePhase = iota
+	// HandshakeVersion is the exchange of protocol headers, agreeing the
+	// protocol version.
+	HandshakeVersion
+	// HandshakeCrypto is the exchange of public keys, if the connection
+	// is encrypted, and of features.
+	HandshakeCrypto
+	// HandshakeSync is from then until the connection is established,
+	// including the registration of the remote peer and waiting for the
+	// overlay.
+	HandshakeSync
+)
+
+func (p HandshakePhase) String() string {
+	switch p {
+	case HandshakeConnect:
+		return "connect"
+	case HandshakeVersion:
+		return "version"
+	case HandshakeCrypto:
+		return "crypto"
+	case HandshakeSync:
+		return "sync"
+	}
+	return fmt.Sprintf("phase%d", int(p))
+}
+
+// HandshakeTimings is how long each phase of the handshake of a
+// connection took. Phases which are not over, or which the connection
+// did not have, are zero.
+type HandshakeTimings struct {
+	Connect time.Duration
+	Version time.Duration
+	Crypto  time.Duration
+	Sync    time.Duration
+}
+
+// handshakeTimer times the phases of the handshake of a connection.
+type handshakeTimer struct {
+	sync.Mutex
+	timings HandshakeTimings
+	last    time.Time // when the previous phase ended
+}
+
+// Handshake returns how long each phase of the connection's handshake
+// took.
+func (conn *LocalConnection) Handshake() HandshakeTimings {
+	conn.handshake.Lock()
+	defer conn.handshake.Unlock()
+	return conn.handshake.timings
+}
+
+// startHandshake starts timing the handshake, after a TCP connect which
+// took dialled, if we made it.
+func (conn *LocalConnection) startHandshake(dialled time.Duration) {
+	conn.handshake.Lock()
+	conn.handshake.last = now()
+	conn.handshake.Unlock()
+	if dialled > 0 {
+		conn.noteHandshakePhase(HandshakeConnect, dialled)
+	}
+}
+
+// handshakePhaseDone notes that phase has ended, and took the time since
+// the previous one did.
+func (conn *LocalConnection) handshakePhaseDone(phase HandshakePhase) {
+	t := now()
+	conn.handshake.Lock()
+	d := t.Sub(conn.handshake.last)
+	conn.handshake.last = t
+	conn.handshake.Unlock()
+	conn.noteHandshakePhase(phase, d)
+}
+
+func (conn *LocalConnection) noteHandshakePhase(phase HandshakePhase, d time.Duration) {
+	conn.handshake.Lock()
+	switch phase {
+	case HandshakeConnect:
+		conn.handshake.timings.Connect = d
+	case HandshakeVersion:
+		conn.handshake.timings.Version = d
+	case HandshakeCrypto:
+		conn.handshake.timings.Crypto = d
+	case HandshakeSync:
+		conn.handshake.timings.Sync = d
+	}
+	conn.handshake.Unlock()
+	if f := conn.router.OnHandshakePhase; f != nil {
+		f(conn.remoteTCPAddr, phase, d)
+	}
+}
@@ -0,0 +1,64 @@
+package mesh
+
+import "sync/atomic"
+
+// HealthStatus summarises whether a router is usefully part of a mesh,
+// e.g. for load balancer or orchestrator probes.
+type HealthStatus int
+
+const (
+	// HealthStarting means the router has not been started, or has been
+	// stopped, or has not yet completed its first connection and route
+	// calculation.
+	HealthStarting HealthStatus = iota
+	// HealthIsolated means the router has been connected to the mesh
+	// before, but currently has no established connections.
+	HealthIsolated
+	// HealthHealthy means the router has at least one established
+	// connection with a computed route, or is the sole peer in its mesh.
+	HealthHealthy
+)
+
+// String returns a human-readable name for the health status.
+func (h HealthStatus) String() string {
+	switch h {
+	case HealthStarting:
+		return "starting"
+	case HealthIsolated:
+		return "isolated"
+	case HealthHealthy:
+		return "healthy"
+	}
+	return "unknown"
+}
+
+// HealthCheck returns the health of the router. It is cheap enough to be
+// called from a liveness or readiness probe.
+func (router *Router) HealthCheck() HealthStatus {
+	if atomic.LoadInt32(&router.started) == 0 {
+		return HealthStarting
+	}
+	connected := false
+	for conn := range router.Ourself.getConnections() {
+		if !conn.isEstablished() {
+			continue
+		}
+		if _, found := router.Routes.Unicast(conn.Remote().Name); found {
+			return HealthHealthy
+		}
+		connected = true
+	}
+	switch {
+	case connected: // awaiting route calculation
+		return HealthStarting
+	case len(router.Peers.names()) == 1 && len(router.ConnectionMaker.Targets(false)) == 0:
+		return HealthHealthy // we are the sole peer
+	case atomic.LoadInt32(&router.everEstablished) == 0:
+		return HealthStarting
+	}
+	return HealthIsolated
+}
+
+func (router *Router) noteConnectionEstablished() {
+	atomic.StoreInt32(&router.everEstablished, 1)
+}
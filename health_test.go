@@ -0,0 +1,40 @@
+package mesh
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func awaitHealth(t *testing.T, router *Router, want HealthStatus) {
+	deadline := time.Now().Add(2 * time.Second)
+	for router.HealthCheck() != want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, want, router.HealthCheck())
+}
+
+func TestHealthCheck(t *testing.T) {
+	peerName, _ := PeerNameFromString("01:00:00:01:00:00")
+	r1, err := NewRouter(Config{}, peerName, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	require.Equal(t, HealthStarting, r1.HealthCheck())
+
+	// A peer on its own, not expecting to connect to others, is healthy
+	r1.Start()
+	require.Equal(t, HealthHealthy, r1.HealthCheck())
+
+	// Once it has somewhere to connect to, it is starting until it does
+	r1.ConnectionMaker.InitiateConnections([]string{"127.0.0.1:1"}, false)
+	require.Equal(t, HealthStarting, r1.HealthCheck())
+
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	addTestGossipConnection(t, r1, r2)
+	awaitHealth(t, r1, HealthHealthy)
+
+	r1.DeleteTestGossipConnection(r2)
+	awaitHealth(t, r1, HealthIsolated)
+}
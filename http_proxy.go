@@ -0,0 +1,78 @@
+package mesh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// parseHTTPProxy parses Config.HTTPProxy.
+func parseHTTPProxy(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme != "http" || proxyURL.Host == "" {
+		return nil, fmt.Errorf("HTTP proxy %q must be of the form http://host:port", proxy)
+	}
+	return proxyURL, nil
+}
+
+// dialHTTPProxy connects to peerAddr through a tunnel established with
+// CONNECT by the proxy.
+func dialHTTPProxy(proxyURL *url.URL, localAddr *net.TCPAddr, peerAddr string) (*net.TCPConn, error) {
+	proxyAddr, err := net.ResolveTCPAddr("tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	tcpConn, err := net.DialTCP("tcp", localAddr, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := connectHTTPProxy(tcpConn, proxyURL, peerAddr); err != nil {
+		tcpConn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", proxyURL.Host, err)
+	}
+	return tcpConn, nil
+}
+
+func connectHTTPProxy(conn net.Conn, proxyURL *url.URL, peerAddr string) error {
+	if err := conn.SetDeadline(time.Now().Add(tcpHeartbeat)); err != nil {
+		return err
+	}
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", peerAddr, peerAddr)
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		return err
+	}
+	// Read the response a byte at a time, since whatever follows it
+	// belongs to the mesh handshake.
+	var head []byte
+	buf := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) > 4096 {
+			return fmt.Errorf("response header too long")
+		}
+		if _, err := conn.Read(buf); err != nil {
+			return err
+		}
+		head = append(head, buf[0])
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT %s: %s", peerAddr, resp.Status)
+	}
+	return conn.SetDeadline(time.Time{})
+}
@@ -0,0 +1,79 @@
+package mesh
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHTTPProxy tunnels CONNECT requests, recording their targets.
+type fakeHTTPProxy struct {
+	sync.Mutex
+	ln      net.Listener
+	connect []string
+}
+
+func newFakeHTTPProxy(t *testing.T) *fakeHTTPProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := &fakeHTTPProxy{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakeHTTPProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	p.Lock()
+	p.connect = append(p.connect, req.Host)
+	p.Unlock()
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer target.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(target, r)
+	io.Copy(conn, target)
+}
+
+func (p *fakeHTTPProxy) connects() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string{}, p.connect...)
+}
+
+func TestHTTPProxy(t *testing.T) {
+	proxy := newFakeHTTPProxy(t)
+	defer proxy.ln.Close()
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{HTTPProxy: "http://" + proxy.ln.Addr().String()})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	defer r1.Stop()
+	defer r2.Stop()
+
+	connectTCPTestRouters(r1, r2)
+	awaitEstablished(t, r1, r2)
+	require.Equal(t, []string{fmt.Sprintf("127.0.0.1:%d", r2.Port)}, proxy.connects())
+
+	_, err := NewRouter(Config{HTTPProxy: "socks5://proxy:1080"}, r1.Ourself.Name, "nick", nil, r1.logger)
+	require.Error(t, err)
+}
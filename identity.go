@@ -0,0 +1,32 @@
+package mesh
+
+import "fmt"
+
+// peerIdentity returns the name by which we are known: name, or, if
+// Config.IdentityProvider is set, the name it provides. A provided name
+// must be the same each time the provider is asked, and must agree with
+// name, if that is given. Uniqueness across the mesh is not known until
+// we connect, where clashes are reported as name collisions.
+func (config Config) peerIdentity(name PeerName) (PeerName, error) {
+	if config.IdentityProvider == nil {
+		return name, nil
+	}
+	provided, err := config.IdentityProvider()
+	if err != nil {
+		return UnknownPeerName, fmt.Errorf("identity provider: %v", err)
+	}
+	if provided == UnknownPeerName {
+		return UnknownPeerName, fmt.Errorf("identity provider returned no name")
+	}
+	again, err := config.IdentityProvider()
+	if err != nil {
+		return UnknownPeerName, fmt.Errorf("identity provider: %v", err)
+	}
+	if again != provided {
+		return UnknownPeerName, fmt.Errorf("identity provider is unstable: it returned %s, then %s", provided, again)
+	}
+	if name != UnknownPeerName && name != provided {
+		return UnknownPeerName, fmt.Errorf("identity provider returned %s, but %s was given", provided, name)
+	}
+	return provided, nil
+}
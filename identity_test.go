@@ -0,0 +1,42 @@
+package mesh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentityProvider(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	other, _ := PeerNameFromString("02:00:00:02:00:00")
+	newRouter := func(name PeerName, provider func() (PeerName, error)) (*Router, error) {
+		return NewRouter(Config{IdentityProvider: provider}, name, "nick", nil, log.New(ioutil.Discard, "", 0))
+	}
+
+	router, err := newRouter(UnknownPeerName, func() (PeerName, error) { return name, nil })
+	require.NoError(t, err)
+	require.Equal(t, name, router.Ourself.Name)
+	// The caller may give the name too, as long as they agree
+	router, err = newRouter(name, func() (PeerName, error) { return name, nil })
+	require.NoError(t, err)
+	require.Equal(t, name, router.Ourself.Name)
+
+	_, err = newRouter(other, func() (PeerName, error) { return name, nil })
+	require.Error(t, err)
+	_, err = newRouter(UnknownPeerName, func() (PeerName, error) { return UnknownPeerName, nil })
+	require.Error(t, err)
+	_, err = newRouter(UnknownPeerName, func() (PeerName, error) { return UnknownPeerName, fmt.Errorf("no instance ID") })
+	require.EqualError(t, err, "identity provider: no instance ID")
+	calls := 0
+	_, err = newRouter(UnknownPeerName, func() (PeerName, error) {
+		calls++
+		if calls > 1 {
+			return other, nil
+		}
+		return name, nil
+	})
+	require.Error(t, err, "unstable identity was accepted")
+}
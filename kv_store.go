@@ -0,0 +1,185 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"sync"
+)
+
+// KVEntry is the value of a key in a KVStore, or the tombstone left by
+// its deletion.
+type KVEntry struct {
+	Value []byte
+	// Version orders the writes to the key; the highest wins, and ties
+	// go to the highest Origin.
+	Version uint64
+	// Origin is the peer which made the write.
+	Origin  PeerName
+	Deleted bool
+}
+
+// supersedes reports whether e is a later write than old.
+func (e KVEntry) supersedes(old KVEntry) bool {
+	if e.Version != old.Version {
+		return e.Version > old.Version
+	}
+	return e.Origin > old.Origin
+}
+
+// KVData is GossipData holding KVEntries by key. Merging keeps the later
+// entry for each key.
+type KVData struct {
+	Entries map[string]KVEntry
+}
+
+// Merge implements GossipData.
+func (d *KVData) Merge(other GossipData) GossipData {
+	entries := make(map[string]KVEntry, len(d.Entries))
+	for key, e := range d.Entries {
+		entries[key] = e
+	}
+	for key, e := range other.(*KVData).Entries {
+		if old, found := entries[key]; !found || e.supersedes(old) {
+			entries[key] = e
+		}
+	}
+	return &KVData{entries}
+}
+
+// Encode implements GossipData.
+func (d *KVData) Encode() [][]byte {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(d.Entries); err != nil {
+		panic(err)
+	}
+	return [][]byte{buf.Bytes()}
+}
+
+// KVStore is a key-value store shared over a gossip channel, where the
+// last write to each key wins. See Router.NewKVStore.
+type KVStore struct {
+	sync.Mutex
+	ourself PeerName
+	gossip  Gossip
+	version uint64 // the highest seen, so that our next write wins
+	entries map[string]KVEntry
+}
+
+// NewKVStore makes a KVStore shared with the peers which make one on the
+// same channel. A write to a key replaces any write to it that we have
+// seen, and whichever of two concurrent writes has the higher version
+// wins everywhere. Deleted keys leave tombstones, which are never
+// dropped, so that the deletion is not undone by a peer which has not
+// seen it.
+func (router *Router) NewKVStore(channelName string) (*KVStore, error) {
+	s := &KVStore{
+		ourself: router.Ourself.Name,
+		// Start from the clock, so that our writes after a restart
+		// replace those from before it
+		version: uint64(now().UnixNano()),
+		entries: make(map[string]KVEntry),
+	}
+	gossip, err := router.NewGossip(channelName, s)
+	if err != nil {
+		return nil, err
+	}
+	s.gossip = gossip
+	return s, nil
+}
+
+// Get returns the value of key, and whether it is set.
+func (s *KVStore) Get(key string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	e, found := s.entries[key]
+	if !found || e.Deleted {
+		return nil, false
+	}
+	return e.Value, true
+}
+
+// Keys returns the keys which are set, in order.
+func (s *KVStore) Keys() []string {
+	s.Lock()
+	defer s.Unlock()
+	var keys []string
+	for key, e := range s.entries {
+		if !e.Deleted {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Set sets key to value, and broadcasts it.
+func (s *KVStore) Set(key string, value []byte) {
+	s.write(key, KVEntry{Value: value})
+}
+
+// Delete deletes key, and broadcasts its tombstone.
+func (s *KVStore) Delete(key string) {
+	s.write(key, KVEntry{Deleted: true})
+}
+
+func (s *KVStore) write(key string, e KVEntry) {
+	s.Lock()
+	s.version++
+	e.Version, e.Origin = s.version, s.ourself
+	s.entries[key] = e
+	s.Unlock()
+	s.gossip.GossipBroadcast(&KVData{map[string]KVEntry{key: e}})
+}
+
+// merge keeps whichever entries in update are later than ours, returning
+// them, or nil if there are none.
+func (s *KVStore) merge(update []byte) (GossipData, error) {
+	var entries map[string]KVEntry
+	if err := gob.NewDecoder(bytes.NewReader(update)).Decode(&entries); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	delta := make(map[string]KVEntry)
+	for key, e := range entries {
+		if e.Version > s.version {
+			s.version = e.Version
+		}
+		if old, found := s.entries[key]; found && !e.supersedes(old) {
+			continue
+		}
+		s.entries[key] = e
+		delta[key] = e
+	}
+	if len(delta) == 0 {
+		return nil, nil
+	}
+	return &KVData{delta}, nil
+}
+
+// OnGossipUnicast implements Gossiper; writes are not unicast.
+func (s *KVStore) OnGossipUnicast(sender PeerName, msg []byte) error {
+	return nil
+}
+
+// OnGossipBroadcast implements Gossiper.
+func (s *KVStore) OnGossipBroadcast(_ PeerName, update []byte) (GossipData, error) {
+	return s.merge(update)
+}
+
+// Gossip implements Gossiper.
+func (s *KVStore) Gossip() GossipData {
+	s.Lock()
+	defer s.Unlock()
+	entries := make(map[string]KVEntry, len(s.entries))
+	for key, e := range s.entries {
+		entries[key] = e
+	}
+	return &KVData{entries}
+}
+
+// OnGossip implements Gossiper.
+func (s *KVStore) OnGossip(update []byte) (GossipData, error) {
+	return s.merge(update)
+}
@@ -0,0 +1,54 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStore(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	routers := []*Router{r1, r2}
+	defer func() {
+		for _, r := range routers {
+			r.Stop()
+		}
+	}()
+	kv1, err := r1.NewKVStore("kv")
+	require.NoError(t, err)
+	kv2, err := r2.NewKVStore("kv")
+	require.NoError(t, err)
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1))
+
+	kv1.Set("a", []byte("1"))
+	kv1.Set("b", []byte("2"))
+	sendPendingGossip(r1, r2)
+	v, found := kv2.Get("a")
+	require.True(t, found)
+	require.Equal(t, []byte("1"), v)
+	require.Equal(t, []string{"a", "b"}, kv2.Keys())
+
+	// The later write wins, wherever it is made
+	kv2.Set("a", []byte("3"))
+	sendPendingGossip(r1, r2)
+	v, _ = kv1.Get("a")
+	require.Equal(t, []byte("3"), v)
+
+	kv1.Delete("a")
+	sendPendingGossip(r1, r2)
+	_, found = kv2.Get("a")
+	require.False(t, found)
+	require.Equal(t, []string{"b"}, kv2.Keys())
+
+	// Nor does periodic gossip of the whole state bring it back
+	r2.sendAllGossip()
+	r1.sendAllGossip()
+	sendPendingGossip(r1, r2)
+	for _, kv := range []*KVStore{kv1, kv2} {
+		_, found = kv.Get("a")
+		require.False(t, found)
+		require.Equal(t, []string{"b"}, kv.Keys())
+	}
+}
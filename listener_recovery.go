@@ -0,0 +1,62 @@
+package mesh
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// The backoff between attempts to re-bind a failed listener. See
+// Config.RebindListeners.
+var (
+	listenerRebindInterval    = 100 * time.Millisecond
+	listenerRebindMaxInterval = 30 * time.Second
+)
+
+// listenerFailed stops accepting from ln, which has failed with err, and
+// reports it, re-binding its address if Config.RebindListeners is set.
+func (router *Router) listenerFailed(ln net.Listener, err error) {
+	router.listenerLock.Lock()
+	delete(router.listeners, ln)
+	router.listenerLock.Unlock()
+	router.logger.Printf("listener on %s failed: %v", ln.Addr(), err)
+	if router.OnListenerError != nil {
+		router.OnListenerError(ln.Addr(), err)
+	}
+	if router.RebindListeners {
+		router.goroutines.spawn(func() { router.rebindListener(ln.Addr()) })
+	}
+}
+
+// rebindListener listens on addr again, backing off between attempts,
+// until it succeeds or the router is stopped.
+func (router *Router) rebindListener(addr net.Addr) {
+	for interval := listenerRebindInterval; ; {
+		time.Sleep(interval)
+		if atomic.LoadInt32(&router.stopped) == 1 {
+			return
+		}
+		ln, err := router.relisten(addr)
+		if err == nil {
+			router.logger.Printf("listening on %s again", addr)
+			router.AddListener(ln)
+			// in case we were stopped meanwhile
+			if atomic.LoadInt32(&router.stopped) == 1 {
+				_ = router.RemoveListener(ln)
+			}
+			return
+		}
+		router.logger.Printf("re-binding listener on %s: %v", addr, err)
+		if interval *= 2; interval > listenerRebindMaxInterval {
+			interval = listenerRebindMaxInterval
+		}
+	}
+}
+
+// relisten listens on addr, the address of a failed listener, again.
+func (router *Router) relisten(addr net.Addr) (net.Listener, error) {
+	if addr.Network() == "tcp" || !router.usingTCP() {
+		return router.transport.Listen(addr.String())
+	}
+	return net.Listen(addr.Network(), addr.String())
+}
@@ -6,6 +6,8 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 const (
@@ -22,6 +24,7 @@ type localPeer struct {
 	topologyUpdates       peerNameSet
 	timer                 *time.Timer
 	pendingTopologyUpdate bool
+	gossipTicker          *time.Ticker // only touched by the actor
 }
 
 // The actor closure used by localPeer.
@@ -29,7 +32,11 @@ type localPeerAction func()
 
 // newLocalPeer returns a usable LocalPeer.
 func newLocalPeer(name PeerName, nickName string, router *Router) *localPeer {
-	actionChan := make(chan localPeerAction, ChannelSize)
+	channelSize := ChannelSize
+	if router != nil {
+		channelSize = router.channelSize()
+	}
+	actionChan := make(chan localPeerAction, channelSize)
 	topologyUpdates := make(peerNameSet)
 	peer := &localPeer{
 		Peer:            newPeer(name, nickName, randomPeerUID(), 0, randomPeerShortID()),
@@ -39,7 +46,7 @@ func newLocalPeer(name PeerName, nickName string, router *Router) *localPeer {
 		timer:           time.NewTimer(deferTopologyUpdateDuration),
 	}
 	peer.timer.Stop()
-	go peer.actorLoop(actionChan)
+	router.goroutineCount().spawn(func() { peer.actorLoop(actionChan) })
 	return peer
 }
 
@@ -93,23 +100,30 @@ func (peer *localPeer) createConnection(localAddr string, peerAddr string, accep
 	if err := peer.checkConnectionLimit(); err != nil {
 		return err
 	}
-	localTCPAddr, err := net.ResolveTCPAddr("tcp", localAddr)
-	if err != nil {
-		return err
-	}
-	remoteTCPAddr, err := net.ResolveTCPAddr("tcp", peerAddr)
-	if err != nil {
-		return err
-	}
-	tcpConn, err := net.DialTCP("tcp", localTCPAddr, remoteTCPAddr)
+	start := now()
+	tcpConn, err := peer.dial(localAddr, peerAddr)
 	if err != nil {
 		return err
 	}
 	connRemote := newRemoteConnection(peer.Peer, nil, peerAddr, true, false)
-	startLocalConnection(connRemote, tcpConn, peer.router, acceptNewPeer, logger)
+	startLocalConnection(connRemote, tcpConn, nil, now().Sub(start), peer.router, acceptNewPeer, logger)
 	return nil
 }
 
+// dial makes a connection from localAddr to peerAddr over
+// Config.Transport, or through Config.HTTPProxy if it is set.
+func (peer *localPeer) dial(localAddr string, peerAddr string) (net.Conn, error) {
+	if proxyURL := peer.router.httpProxy; proxyURL != nil {
+		localTCPAddr, err := net.ResolveTCPAddr("tcp", localAddr)
+		if err != nil {
+			return nil, err
+		}
+		// the proxy resolves peerAddr
+		return dialHTTPProxy(proxyURL, localTCPAddr, peerAddr)
+	}
+	return peer.router.transport.Dial(localAddr, peerAddr)
+}
+
 // ACTOR client API
 
 // Synchronous.
@@ -128,6 +142,13 @@ func (peer *localPeer) doConnectionEstablished(conn ourConnection) {
 	}
 }
 
+// Asynchronous.
+func (peer *localPeer) doConnectionQuiesced(conn ourConnection) {
+	peer.actionChan <- func() {
+		peer.handleConnectionQuiesced(conn)
+	}
+}
+
 // Synchronous.
 func (peer *localPeer) doDeleteConnection(conn ourConnection) {
 	resultChan := make(chan interface{})
@@ -138,10 +159,36 @@ func (peer *localPeer) doDeleteConnection(conn ourConnection) {
 	<-resultChan
 }
 
+// Synchronous.
+func (peer *localPeer) doConnectionCostChanged(name PeerName) {
+	resultChan := make(chan interface{})
+	peer.actionChan <- func() {
+		peer.handleConnectionCostChanged(name)
+		resultChan <- nil
+	}
+	<-resultChan
+}
+
+// Asynchronous.
+func (peer *localPeer) doResetGossipTicker() {
+	peer.actionChan <- func() {
+		peer.gossipTicker.Stop()
+		peer.gossipTicker = time.NewTicker(peer.router.gossipTick())
+	}
+}
+
 func (peer *localPeer) encode(enc *gob.Encoder) {
 	peer.RLock()
 	defer peer.RUnlock()
-	peer.Peer.encode(enc)
+	var cost func(*Peer) float64
+	if peer.router != nil {
+		cost = peer.router.connectionCost
+	}
+	ps, connSummaries := peer.peerSummary, peer.connectionSummaries(cost)
+	if peer.router != nil && peer.router.SigningKey != nil {
+		ps.Signature = ed25519.Sign(peer.router.SigningKey, signedBytes(ps, connSummaries))
+	}
+	encodePeer(enc, ps, connSummaries)
 }
 
 // ACTOR server
@@ -149,15 +196,17 @@ func (peer *localPeer) encode(enc *gob.Encoder) {
 func (peer *localPeer) actorLoop(actionChan <-chan localPeerAction) {
 	gossipInterval := defaultGossipInterval
 	if peer.router != nil {
-		gossipInterval = peer.router.gossipInterval()
+		gossipInterval = peer.router.gossipTick()
 	}
-	gossipTimer := time.Tick(gossipInterval)
+	peer.gossipTicker = time.NewTicker(gossipInterval)
 	for {
 		select {
 		case action := <-actionChan:
 			action()
-		case <-gossipTimer:
-			peer.router.sendAllGossip()
+		case <-peer.gossipTicker.C:
+			if peer.router != nil {
+				peer.router.sendAllGossip()
+			}
 		case <-peer.timer.C:
 			peer.broadcastPendingTopologyUpdates()
 		}
@@ -207,6 +256,7 @@ func (peer *localPeer) handleAddConnection(conn ourConnection, isRestartedPeer b
 	}
 	_, isConnectedPeer := peer.router.Routes.Unicast(toName)
 	peer.addConnection(conn)
+	peer.router.publishTopology(peerNameSet{peer.Name: struct{}{}})
 	switch {
 	case isRestartedPeer:
 		conn.logf("connection added (restarted peer)")
@@ -235,6 +285,7 @@ func (peer *localPeer) handleConnectionEstablished(conn ourConnection) {
 	}
 	peer.connectionEstablished(conn)
 	conn.logf("connection fully established")
+	peer.router.noteConnectionEstablished()
 
 	peer.router.Routes.recalculate()
 	//peer.broadcastPeerUpdate()
@@ -243,6 +294,34 @@ func (peer *localPeer) handleConnectionEstablished(conn ourConnection) {
 	}
 }
 
+// handleConnectionQuiesced reroutes around conn, or back over it, once it
+// has been quiesced or resumed.
+func (peer *localPeer) handleConnectionQuiesced(conn ourConnection) {
+	if dupConn, found := peer.connections[conn.Remote().Name]; !found || conn != dupConn {
+		return
+	}
+	peer.connectionEstablished(conn) // bumps our version
+	peer.router.Routes.recalculate()
+	if !peer.isFullyConnectedTopology() {
+		peer.broadcastPeerUpdate(conn.Remote())
+	}
+}
+
+// handleConnectionCostChanged reroutes once the cost of our connection to
+// the named peer has changed, and advertises the new cost, so that other
+// peers route consistently with us.
+func (peer *localPeer) handleConnectionCostChanged(name PeerName) {
+	peer.router.Routes.recalculate()
+	conn, found := peer.connections[name]
+	if !found {
+		return
+	}
+	peer.connectionEstablished(conn) // bumps our version
+	if !peer.isFullyConnectedTopology() {
+		peer.broadcastPeerUpdate()
+	}
+}
+
 func (peer *localPeer) handleDeleteConnection(conn ourConnection) {
 	if peer.Peer != conn.getLocal() {
 		panic("Attempt made to delete connection from peer where peer is not the source of connection")
@@ -255,6 +334,7 @@ func (peer *localPeer) handleDeleteConnection(conn ourConnection) {
 		return
 	}
 	peer.deleteConnection(conn)
+	peer.router.publishTopology(peerNameSet{peer.Name: struct{}{}})
 	conn.logf("connection deleted")
 	// Must do garbage collection first to ensure we don't send out an
 	// update with unreachable peers (can cause looping)
@@ -337,6 +417,13 @@ func (peer *localPeer) setVersionBeyond(version uint64) bool {
 	return false
 }
 
+func (peer *localPeer) isMembershipFrozen() bool {
+	if peer.router != nil {
+		return peer.router.MembershipFrozen()
+	}
+	return false
+}
+
 func (peer *localPeer) isFullyConnectedTopology() bool {
 	if peer.router != nil {
 		return peer.router.Config.SingleHopTopolgy
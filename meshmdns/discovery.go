@@ -0,0 +1,34 @@
+// Package meshmdns discovers mesh peers on the local network with
+// multicast DNS, and adds them as connection targets.
+package meshmdns
+
+import (
+	"github.com/csghh/mesh"
+)
+
+// Backend advertises a service and browses for other instances of it.
+type Backend interface {
+	// Advertise announces that we offer the service on port, until the
+	// backend is closed.
+	Advertise(port int) error
+
+	// Browse calls found with the address, as host:port, of each
+	// instance of the service that is discovered, until the backend is
+	// closed. found may be called more than once for an address.
+	Browse(found func(addr string)) error
+
+	// Close stops advertising and browsing.
+	Close() error
+}
+
+// Start advertises router's mesh port on backend, and adds each instance
+// discovered as a connection target of the router. Discovery continues
+// until backend is closed.
+func Start(router *mesh.Router, backend Backend) error {
+	if err := backend.Advertise(router.Port); err != nil {
+		return err
+	}
+	return backend.Browse(func(addr string) {
+		router.ConnectionMaker.InitiateConnections([]string{addr}, false)
+	})
+}
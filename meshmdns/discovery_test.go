@@ -0,0 +1,96 @@
+package meshmdns
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/csghh/mesh"
+)
+
+// fakeBackend lets a test play the part of the network.
+type fakeBackend struct {
+	sync.Mutex
+	port  int
+	found func(addr string)
+}
+
+func (b *fakeBackend) Advertise(port int) error {
+	b.Lock()
+	defer b.Unlock()
+	b.port = port
+	return nil
+}
+
+func (b *fakeBackend) Browse(found func(addr string)) error {
+	b.Lock()
+	defer b.Unlock()
+	b.found = found
+	return nil
+}
+
+func (b *fakeBackend) Close() error { return nil }
+
+func (b *fakeBackend) discover(addr string) {
+	b.Lock()
+	found := b.found
+	b.Unlock()
+	found(addr)
+}
+
+func TestStart(t *testing.T) {
+	name, err := mesh.PeerNameFromString("01:00:00:01:00:00")
+	require.NoError(t, err)
+	router, err := mesh.NewRouter(mesh.Config{Host: "127.0.0.1", Port: 6783}, name, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+
+	backend := &fakeBackend{}
+	require.NoError(t, Start(router, backend))
+	require.Equal(t, 6783, backend.port)
+
+	backend.discover("192.0.2.1:6783")
+	backend.discover("192.0.2.2:6783")
+	backend.discover("192.0.2.1:6783")
+	targets := router.ConnectionMaker.Targets(false)
+	sort.Strings(targets)
+	require.Equal(t, []string{"192.0.2.1:6783", "192.0.2.2:6783"}, targets)
+}
+
+func TestMessageEncoding(t *testing.T) {
+	b := NewMulticastBackend(DefaultService, "peer1", time.Second)
+	msg, err := parseMessage(b.query())
+	require.NoError(t, err)
+	require.True(t, msg.queries("_weavemesh._tcp.local."))
+
+	msg, err = parseMessage(b.answer(6783))
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"peer1._weavemesh._tcp.local.": 6783}, msg.services)
+}
+
+func TestMulticastBackend(t *testing.T) {
+	b1 := NewMulticastBackend(DefaultService, "peer1", 50*time.Millisecond)
+	b2 := NewMulticastBackend(DefaultService, "peer2", 50*time.Millisecond)
+	if err := b1.Advertise(6783); err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	defer b1.Close()
+	found := make(chan string, 16)
+	if err := b2.Browse(func(addr string) { found <- addr }); err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	defer b2.Close()
+	select {
+	case addr := <-found:
+		_, port, err := net.SplitHostPort(addr)
+		require.NoError(t, err)
+		require.Equal(t, "6783", port)
+	case <-time.After(2 * time.Second):
+		t.Skip("no multicast loopback on this host")
+	}
+}
@@ -0,0 +1,294 @@
+package meshmdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultService is the DNS-SD service type advertised by default.
+	DefaultService = "_weavemesh._tcp"
+
+	typePTR   = 12
+	typeSRV   = 33
+	classIN   = 1
+	recordTTL = 120
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// MulticastBackend is a minimal multicast DNS implementation of Backend.
+// It answers queries for the service with a PTR record naming our
+// instance and an SRV record giving our port, and takes the host of other
+// instances from the source address of their answers.
+type MulticastBackend struct {
+	service  string // fully qualified, e.g. "_weavemesh._tcp.local."
+	instance string // fully qualified instance name
+	interval time.Duration
+
+	mu    sync.Mutex
+	conn  *net.UDPConn
+	port  int               // zero unless advertising
+	found func(addr string) // nil unless browsing
+	stop  chan struct{}
+}
+
+// NewMulticastBackend returns a backend for service, e.g. DefaultService,
+// identifying us as instance, which should be unique on the network,
+// e.g. the peer name. Queries and announcements are repeated every
+// interval.
+func NewMulticastBackend(service, instance string, interval time.Duration) *MulticastBackend {
+	service = strings.TrimSuffix(service, ".") + ".local."
+	return &MulticastBackend{
+		service:  service,
+		instance: instance + "." + service,
+		interval: interval,
+	}
+}
+
+// Advertise implements Backend.
+func (b *MulticastBackend) Advertise(port int) error {
+	if err := b.start(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.port = port
+	b.mu.Unlock()
+	return b.send(b.answer(port))
+}
+
+// Browse implements Backend.
+func (b *MulticastBackend) Browse(found func(addr string)) error {
+	if err := b.start(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.found = found
+	b.mu.Unlock()
+	return b.send(b.query())
+}
+
+// Close implements Backend.
+func (b *MulticastBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	close(b.stop)
+	err := b.conn.Close()
+	b.conn = nil
+	return err
+}
+
+func (b *MulticastBackend) start() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		return nil
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	b.conn = conn
+	b.stop = make(chan struct{})
+	go b.receive(conn)
+	go b.repeat(b.stop)
+	return nil
+}
+
+func (b *MulticastBackend) send(msg []byte) error {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	if conn == nil {
+		return errors.New("mdns backend closed")
+	}
+	_, err := conn.WriteToUDP(msg, mdnsGroup)
+	return err
+}
+
+func (b *MulticastBackend) repeat(stop <-chan struct{}) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		b.mu.Lock()
+		port, browsing := b.port, b.found != nil
+		b.mu.Unlock()
+		if port != 0 {
+			b.send(b.answer(port))
+		}
+		if browsing {
+			b.send(b.query())
+		}
+	}
+}
+
+func (b *MulticastBackend) receive(conn *net.UDPConn) {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		msg, err := parseMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		b.mu.Lock()
+		port, found := b.port, b.found
+		b.mu.Unlock()
+		if port != 0 && msg.queries(b.service) {
+			b.send(b.answer(port))
+		}
+		if found != nil {
+			for instance, port := range msg.services {
+				if instance != b.instance && strings.HasSuffix(instance, "."+b.service) {
+					found(net.JoinHostPort(from.IP.String(), strconv.Itoa(port)))
+				}
+			}
+		}
+	}
+}
+
+func (b *MulticastBackend) query() []byte {
+	msg := header(0, 1, 0)
+	msg = appendName(msg, b.service)
+	return appendUint16s(msg, typePTR, classIN)
+}
+
+func (b *MulticastBackend) answer(port int) []byte {
+	msg := header(0x8400, 0, 2) // response, authoritative
+	msg = appendName(msg, b.service)
+	msg = appendUint16s(msg, typePTR, classIN)
+	msg = appendRData(msg, appendName(nil, b.instance))
+	msg = appendName(msg, b.instance)
+	msg = appendUint16s(msg, typeSRV, classIN)
+	srv := appendUint16s(nil, 0, 0, uint16(port)) // priority, weight, port
+	return appendRData(msg, appendName(srv, b.instance))
+}
+
+func header(flags uint16, questions, answers uint16) []byte {
+	return appendUint16s(nil, 0, flags, questions, answers, 0, 0)
+}
+
+func appendUint16s(b []byte, vs ...uint16) []byte {
+	for _, v := range vs {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return b
+}
+
+func appendRData(b []byte, rdata []byte) []byte {
+	b = append(b, 0, 0, recordTTL>>8, recordTTL&0xff)
+	b = appendUint16s(b, uint16(len(rdata)))
+	return append(b, rdata...)
+}
+
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// message holds the parts of a DNS message we are interested in.
+type message struct {
+	questions []string       // names queried for PTR records
+	services  map[string]int // SRV record names to ports
+}
+
+func (m *message) queries(service string) bool {
+	for _, q := range m.questions {
+		if q == service {
+			return true
+		}
+	}
+	return false
+}
+
+var errMalformed = errors.New("malformed mdns message")
+
+func parseMessage(b []byte) (*message, error) {
+	if len(b) < 12 {
+		return nil, errMalformed
+	}
+	msg := &message{services: make(map[string]int)}
+	qdCount := int(binary.BigEndian.Uint16(b[4:]))
+	rrCount := int(binary.BigEndian.Uint16(b[6:])) + int(binary.BigEndian.Uint16(b[8:])) + int(binary.BigEndian.Uint16(b[10:]))
+	off := 12
+	for i := 0; i < qdCount; i++ {
+		name, next, err := readName(b, off)
+		if err != nil || next+4 > len(b) {
+			return nil, errMalformed
+		}
+		if binary.BigEndian.Uint16(b[next:]) == typePTR {
+			msg.questions = append(msg.questions, name)
+		}
+		off = next + 4
+	}
+	for i := 0; i < rrCount; i++ {
+		name, next, err := readName(b, off)
+		if err != nil || next+10 > len(b) {
+			return nil, errMalformed
+		}
+		rrType := binary.BigEndian.Uint16(b[next:])
+		rdLen := int(binary.BigEndian.Uint16(b[next+8:]))
+		rdata := next + 10
+		if rdata+rdLen > len(b) {
+			return nil, errMalformed
+		}
+		if rrType == typeSRV && rdLen >= 6 {
+			msg.services[name] = int(binary.BigEndian.Uint16(b[rdata+4:]))
+		}
+		off = rdata + rdLen
+	}
+	return msg, nil
+}
+
+// readName reads a possibly compressed name at off, returning it and the
+// offset following it.
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for hops := 0; hops < 32; hops++ {
+		if off >= len(b) {
+			return "", 0, errMalformed
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+		default:
+			if off+1+l > len(b) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+	return "", 0, errMalformed
+}
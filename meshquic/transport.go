@@ -0,0 +1,272 @@
+// Package meshquic carries mesh connections over QUIC, whose loss
+// recovery copes better than TCP with lossy or high-latency links.
+// Importing it registers the transport as Config.Transport "quic".
+package meshquic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/csghh/mesh"
+)
+
+const (
+	// nextProto is our ALPN protocol name, which QUIC requires
+	nextProto = "mesh"
+	// handshakeTimeout bounds the QUIC handshake and the wait for the
+	// stream of a new connection
+	handshakeTimeout = 10 * time.Second
+	// keepAlivePeriod is well within QUIC's default idle timeout, as
+	// mesh heartbeats are not
+	keepAlivePeriod = 10 * time.Second
+)
+
+func init() {
+	mesh.RegisterTransport("quic", Transport{})
+}
+
+// Transport is a mesh.Transport carrying each mesh connection on a
+// single stream of its own QUIC connection.
+//
+// QUIC always encrypts, but peers are not authenticated by TLS: they
+// present throwaway certificates, which are not verified. As over TCP,
+// authentication is by the mesh handshake, so meshes crossing untrusted
+// networks should still set Config.Password.
+type Transport struct{}
+
+var quicConfig = &quic.Config{
+	HandshakeIdleTimeout: handshakeTimeout,
+	KeepAlivePeriod:      keepAlivePeriod,
+}
+
+// Listen implements mesh.Transport.
+func (Transport) Listen(addr string) (net.Listener, error) {
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{nextProto},
+	}
+	s, err := newSocket(addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := s.tr.Listen(tlsConfig, quicConfig)
+	if err != nil {
+		s.release()
+		return nil, err
+	}
+	l := &listener{
+		socket:   s,
+		ln:       ln,
+		accepted: make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+// Dial implements mesh.Transport.
+func (Transport) Dial(localAddr, addr string) (net.Conn, error) {
+	remoteAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSocket(localAddr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true, // see Transport
+		NextProtos:         []string{nextProto},
+	}
+	qc, err := s.tr.Dial(ctx, remoteAddr, tlsConfig, quicConfig)
+	if err != nil {
+		s.release()
+		return nil, err
+	}
+	stream, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		qc.CloseWithError(0, "")
+		s.release()
+		return nil, err
+	}
+	return &conn{Stream: stream, qc: qc, socket: s}, nil
+}
+
+// socket is a UDP socket and the QUIC transport over it, shared by a
+// listener and the connections it accepts, and closed when the last of
+// them is.
+type socket struct {
+	sync.Mutex
+	udpConn *net.UDPConn
+	tr      *quic.Transport
+	refs    int
+}
+
+func newSocket(addr string) (*socket, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &socket{udpConn: udpConn, tr: &quic.Transport{Conn: udpConn}, refs: 1}, nil
+}
+
+// acquire adds a user of s, unless s is already closed.
+func (s *socket) acquire() bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.refs == 0 {
+		return false
+	}
+	s.refs++
+	return true
+}
+
+func (s *socket) release() {
+	s.Lock()
+	s.refs--
+	last := s.refs == 0
+	s.Unlock()
+	if last {
+		s.tr.Close()
+		s.udpConn.Close()
+	}
+}
+
+// listener hands out the first stream of each QUIC connection accepted.
+type listener struct {
+	*socket
+	ln        *quic.Listener
+	accepted  chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *listener) acceptLoop() {
+	for {
+		qc, err := l.ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		// Await the stream separately, so that a slow peer does not
+		// hold up the others
+		go l.acceptStream(qc)
+	}
+}
+
+func (l *listener) acceptStream(qc *quic.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	stream, err := qc.AcceptStream(ctx)
+	if err != nil || !l.acquire() {
+		qc.CloseWithError(0, "")
+		return
+	}
+	c := &conn{Stream: stream, qc: qc, socket: l.socket}
+	select {
+	case l.accepted <- c:
+	case <-l.closed:
+		c.Close()
+	}
+}
+
+// Accept implements net.Listener.
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accepted:
+		return c, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+var errListenerClosed = errors.New("meshquic: listener closed")
+
+// Close implements net.Listener. Connections already accepted are
+// unaffected.
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.ln.Close()
+		l.release()
+	})
+	return nil
+}
+
+// Addr implements net.Listener.
+func (l *listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// conn is a mesh connection: a stream, and the QUIC connection and
+// socket it alone uses.
+type conn struct {
+	*quic.Stream
+	qc        *quic.Conn
+	socket    *socket
+	closeOnce sync.Once
+}
+
+// Close implements net.Conn, closing the QUIC connection, not just our
+// side of the stream.
+func (c *conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.qc.CloseWithError(0, "")
+		c.socket.release()
+	})
+	return err
+}
+
+// LocalAddr implements net.Conn.
+func (c *conn) LocalAddr() net.Addr {
+	return c.qc.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn.
+func (c *conn) RemoteAddr() net.Addr {
+	return c.qc.RemoteAddr()
+}
+
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: nextProto},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,134 @@
+package meshquic
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/csghh/mesh"
+	"github.com/csghh/mesh/meshtest"
+)
+
+// set is the GossipData of setGossiper: a set of strings.
+type set map[string]struct{}
+
+func (s set) Encode() [][]byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(map[string]struct{}(s)); err != nil {
+		panic(err)
+	}
+	return [][]byte{buf.Bytes()}
+}
+
+func (s set) Merge(other mesh.GossipData) mesh.GossipData {
+	for k := range other.(set) {
+		s[k] = struct{}{}
+	}
+	return s
+}
+
+func decodeSet(msg []byte) (set, error) {
+	var s set
+	err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&s)
+	return s, err
+}
+
+// setGossiper gossips the union of everything added to it.
+type setGossiper struct {
+	sync.Mutex
+	set set
+}
+
+func (g *setGossiper) add(k string) set {
+	g.Lock()
+	defer g.Unlock()
+	g.set[k] = struct{}{}
+	return set{k: {}}
+}
+
+func (g *setGossiper) has(k string) bool {
+	g.Lock()
+	defer g.Unlock()
+	_, found := g.set[k]
+	return found
+}
+
+func (g *setGossiper) merge(msg []byte) (mesh.GossipData, error) {
+	other, err := decodeSet(msg)
+	if err != nil {
+		return nil, err
+	}
+	g.Lock()
+	defer g.Unlock()
+	delta := set{}
+	for k := range other {
+		if _, found := g.set[k]; !found {
+			g.set[k] = struct{}{}
+			delta[k] = struct{}{}
+		}
+	}
+	if len(delta) == 0 {
+		return nil, nil
+	}
+	return delta, nil
+}
+
+func (g *setGossiper) Gossip() mesh.GossipData {
+	g.Lock()
+	defer g.Unlock()
+	return set{}.Merge(g.set)
+}
+
+func (g *setGossiper) OnGossipUnicast(mesh.PeerName, []byte) error { return nil }
+
+func (g *setGossiper) OnGossipBroadcast(_ mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	return g.merge(msg)
+}
+
+func (g *setGossiper) OnGossip(msg []byte) (mesh.GossipData, error) {
+	return g.merge(msg)
+}
+
+func newQUICRouter(t *testing.T, name string) (*mesh.Router, *setGossiper, mesh.Gossip) {
+	peerName, err := mesh.PeerNameFromString(name)
+	require.NoError(t, err)
+	config := mesh.Config{
+		Host:               "127.0.0.1",
+		ProtocolMinVersion: mesh.ProtocolMinVersion,
+		Password:           []byte("sekr1t"),
+		Transport:          "quic",
+	}
+	router, err := mesh.NewRouter(config, peerName, name, nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	g := &setGossiper{set: set{}}
+	gossip, err := router.NewGossip("test", g)
+	require.NoError(t, err)
+	router.Start()
+	return router, g, gossip
+}
+
+func TestGossipOverQUIC(t *testing.T) {
+	r1, g1, s1 := newQUICRouter(t, "01:00:00:01:00:00")
+	r2, g2, s2 := newQUICRouter(t, "02:00:00:02:00:00")
+	defer r1.Stop()
+	defer r2.Stop()
+	addr := r1.Listeners()[0].Addr()
+	require.Equal(t, "udp", addr.Network())
+
+	r2.ConnectionMaker.InitiateConnections([]string{addr.String()}, true)
+	meshtest.AwaitConverged(t, []*mesh.Router{r1, r2}, 10*time.Second)
+
+	s1.GossipBroadcast(g1.add("from 1"))
+	s2.GossipBroadcast(g2.add("from 2"))
+	deadline := time.Now().Add(10 * time.Second)
+	for !g1.has("from 2") || !g2.has("from 1") {
+		require.True(t, time.Now().Before(deadline), "gossip did not converge over QUIC")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,136 @@
+// Package meshtest provides helpers for testing code built on mesh.
+package meshtest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/csghh/mesh"
+)
+
+// TestingT is the subset of testing.TB used by meshtest.
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+	FailNow()
+}
+
+// DefaultPollInterval is how often AwaitConverged re-examines the
+// routers, unless Config.PollInterval says otherwise.
+const DefaultPollInterval = 50 * time.Millisecond
+
+// Config tunes the helpers in this package. The zero value gives the
+// defaults.
+type Config struct {
+	// PollInterval is how often AwaitConverged re-examines the routers.
+	// If zero, DefaultPollInterval is used.
+	PollInterval time.Duration
+}
+
+func (config Config) pollInterval() time.Duration {
+	if config.PollInterval > 0 {
+		return config.PollInterval
+	}
+	return DefaultPollInterval
+}
+
+// AwaitConverged waits until all routers know the same set of peers, and
+// each has an established route to every one of them. If that hasn't
+// happened within timeout, t is failed with a description of how each
+// router's view diverges.
+func AwaitConverged(t TestingT, routers []*mesh.Router, timeout time.Duration) {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+	Config{}.AwaitConverged(t, routers, timeout)
+}
+
+// AwaitConverged is the package's AwaitConverged, with the settings in
+// config.
+func (config Config) AwaitConverged(t TestingT, routers []*mesh.Router, timeout time.Duration) {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		views := make([]routerView, len(routers))
+		for i, router := range routers {
+			views[i] = viewOf(router)
+		}
+		union := unionOf(views)
+		if converged(views, union) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("routers did not converge within %v:\n%s", timeout, describe(views, union))
+			t.FailNow()
+			return
+		}
+		time.Sleep(config.pollInterval())
+	}
+}
+
+// routerView is a snapshot of what one router knows about the mesh.
+type routerView struct {
+	name        mesh.PeerName
+	nickName    string
+	peers       map[mesh.PeerName]struct{}
+	unreachable []string
+}
+
+func viewOf(router *mesh.Router) routerView {
+	view := routerView{
+		name:     router.Ourself.Name,
+		nickName: router.Ourself.NickName,
+		peers:    make(map[mesh.PeerName]struct{}),
+	}
+	for _, desc := range router.Peers.Descriptions() {
+		view.peers[desc.Name] = struct{}{}
+		if _, found := router.Routes.Unicast(desc.Name); !found {
+			view.unreachable = append(view.unreachable, desc.Name.String())
+		}
+	}
+	sort.Strings(view.unreachable)
+	return view
+}
+
+func unionOf(views []routerView) map[mesh.PeerName]struct{} {
+	union := make(map[mesh.PeerName]struct{})
+	for _, view := range views {
+		union[view.name] = struct{}{}
+		for name := range view.peers {
+			union[name] = struct{}{}
+		}
+	}
+	return union
+}
+
+func converged(views []routerView, union map[mesh.PeerName]struct{}) bool {
+	for _, view := range views {
+		if len(view.peers) != len(union) || len(view.unreachable) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func describe(views []routerView, union map[mesh.PeerName]struct{}) string {
+	buf := new(bytes.Buffer)
+	for _, view := range views {
+		var missing []string
+		for name := range union {
+			if _, found := view.peers[name]; !found {
+				missing = append(missing, name.String())
+			}
+		}
+		sort.Strings(missing)
+		status := "ok"
+		if len(missing) > 0 || len(view.unreachable) > 0 {
+			status = "DIVERGED"
+		}
+		fmt.Fprintf(buf, "  %s(%s): %s; knows %d/%d peers; missing %v; unreachable %v\n",
+			view.name, view.nickName, status, len(view.peers), len(union), missing, view.unreachable)
+	}
+	return buf.String()
+}
@@ -0,0 +1,72 @@
+package meshtest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/csghh/mesh"
+)
+
+type recordingT struct {
+	failed bool
+	msg    string
+}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.msg = fmt.Sprintf(format, args...)
+}
+
+func (t *recordingT) FailNow() { t.failed = true }
+
+// newRouter starts a router listening on a port of the system's
+// choosing; see addrOf.
+func newRouter(t *testing.T, name string) *mesh.Router {
+	peerName, err := mesh.PeerNameFromString(name)
+	require.NoError(t, err)
+	config := mesh.Config{
+		Host:               "127.0.0.1",
+		ProtocolMinVersion: mesh.ProtocolMinVersion,
+	}
+	router, err := mesh.NewRouter(config, peerName, name, nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	router.Start()
+	return router
+}
+
+// addrOf returns the address router is listening on.
+func addrOf(router *mesh.Router) string {
+	return router.Listeners()[0].Addr().String()
+}
+
+func TestAwaitConverged(t *testing.T) {
+	r1 := newRouter(t, "01:00:00:01:00:00")
+	r2 := newRouter(t, "02:00:00:02:00:00")
+	r3 := newRouter(t, "03:00:00:03:00:00")
+	defer r1.Stop()
+	defer r2.Stop()
+	defer r3.Stop()
+
+	r2.ConnectionMaker.InitiateConnections([]string{addrOf(r1)}, true)
+	r3.ConnectionMaker.InitiateConnections([]string{addrOf(r2)}, true)
+
+	Config{PollInterval: 10 * time.Millisecond}.AwaitConverged(t, []*mesh.Router{r1, r2, r3}, 10*time.Second)
+}
+
+func TestAwaitConvergedPartitioned(t *testing.T) {
+	r1 := newRouter(t, "01:00:00:01:00:00")
+	r2 := newRouter(t, "02:00:00:02:00:00")
+	defer r1.Stop()
+	defer r2.Stop()
+
+	rt := &recordingT{}
+	AwaitConverged(rt, []*mesh.Router{r1, r2}, 200*time.Millisecond)
+	require.True(t, rt.failed, "expected partitioned routers not to converge")
+	for _, want := range []string{"did not converge", "DIVERGED", "missing [02:00:00:02:00:00]", "missing [01:00:00:01:00:00]"} {
+		require.Contains(t, rt.msg, want)
+	}
+}
@@ -0,0 +1,55 @@
+package meshtest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/csghh/mesh"
+)
+
+// Split is a partition of routers made by Partition.
+type Split struct {
+	pairs [][2]*mesh.Router
+}
+
+// Partition cuts every connection between a router in groupA and one in
+// groupB, as if the network between them had failed, so that the groups
+// diverge. The connections are quiesced, at both ends, rather than
+// closed, so nothing is exchanged over them, nor routed via them, until
+// the returned Split is healed; the routers are not prompted to
+// reconnect. Connections made between the groups after the call are not
+// cut, so the routers should already be connected as desired.
+func Partition(groupA, groupB []*mesh.Router) *Split {
+	split := &Split{}
+	for _, a := range groupA {
+		for _, b := range groupB {
+			if _, found := a.Ourself.ConnectionTo(b.Ourself.Name); !found {
+				continue
+			}
+			split.pairs = append(split.pairs, [2]*mesh.Router{a, b})
+			for _, pair := range [][2]*mesh.Router{{a, b}, {b, a}} {
+				// A connection which has gone away is cut already
+				_ = pair[0].QuiesceConnection(pair[1].Ourself.Name)
+			}
+		}
+	}
+	return split
+}
+
+// Heal restores the connections cut by Partition. It returns an error
+// naming any which closed in the meantime, and so cannot be restored.
+func (split *Split) Heal() error {
+	var lost []string
+	for _, pair := range split.pairs {
+		for _, ends := range [][2]*mesh.Router{pair, {pair[1], pair[0]}} {
+			if err := ends[0].ResumeConnection(ends[1].Ourself.Name); err != nil {
+				lost = append(lost, fmt.Sprintf("%s: %v", ends[0].Ourself.Name, err))
+			}
+		}
+	}
+	split.pairs = nil
+	if len(lost) > 0 {
+		return fmt.Errorf("could not heal: %s", strings.Join(lost, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package meshtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/csghh/mesh"
+)
+
+func TestPartition(t *testing.T) {
+	r1 := newRouter(t, "01:00:00:01:00:00")
+	r2 := newRouter(t, "02:00:00:02:00:00")
+	r3 := newRouter(t, "03:00:00:03:00:00")
+	r4 := newRouter(t, "04:00:00:04:00:00")
+	routers := []*mesh.Router{r1, r2, r3, r4}
+	for _, r := range routers {
+		defer r.Stop()
+	}
+	// Fully connected, since discovery won't find peers on other ports
+	for i, r := range routers {
+		var peers []string
+		for _, other := range routers[:i] {
+			peers = append(peers, addrOf(other))
+		}
+		r.ConnectionMaker.InitiateConnections(peers, true)
+	}
+	names := []mesh.PeerName{r1.Ourself.Name, r2.Ourself.Name, r3.Ourself.Name, r4.Ourself.Name}
+	require.Eventually(t, func() bool {
+		for _, r := range routers {
+			if len(r.Ourself.ConnectionsTo(names)) != len(routers)-1 {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, DefaultPollInterval)
+	AwaitConverged(t, routers, 10*time.Second)
+
+	split := Partition(routers[:2], routers[2:])
+	require.Eventually(t, func() bool {
+		for _, a := range routers[:2] {
+			for _, b := range routers[2:] {
+				if _, found := a.Routes.Unicast(b.Ourself.Name); found {
+					return false
+				}
+				if _, found := b.Routes.Unicast(a.Ourself.Name); found {
+					return false
+				}
+			}
+		}
+		return true
+	}, 10*time.Second, DefaultPollInterval, "groups can still reach each other")
+	// Each group still works on its own
+	for _, group := range [][]*mesh.Router{routers[:2], routers[2:]} {
+		_, found := group[0].Routes.Unicast(group[1].Ourself.Name)
+		require.True(t, found)
+	}
+	rt := &recordingT{}
+	AwaitConverged(rt, routers, 200*time.Millisecond)
+	require.True(t, rt.failed, "expected partitioned routers not to converge")
+
+	require.NoError(t, split.Heal())
+	AwaitConverged(t, routers, 10*time.Second)
+}
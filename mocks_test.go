@@ -7,7 +7,9 @@ package mesh
 
 import (
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -113,3 +115,32 @@ func checkTopologyPeers(t *testing.T, checkConns bool, peers []*Peer, wantedPeer
 		require.FailNow(t, fmt.Sprintf("Expected peers not found: %v", check))
 	}
 }
+
+// testClock is a clock for Config.Clock which only moves when told to.
+type testClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{t: time.Now()}
+}
+
+func (c *testClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) time.Time {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+	return c.t
+}
+
+func (c *testClock) set(t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = t
+}
@@ -1,6 +1,7 @@
 package mesh
 
 import (
+	"container/heap"
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
@@ -24,6 +25,11 @@ type peerSummary struct {
 	Version    uint64
 	ShortID    PeerShortID
 	HasShortID bool
+	NoTransit  bool   // never route others' traffic via this peer
+	Zone       string // see Config.Zone
+	ZoneBridge bool   // see Config.ZoneBridge
+	Signature  []byte // see Config.SigningKey
+	RouteCost  uint32 // see Config.RouteCost
 }
 
 // PeerDescription collects information about peers that is useful to clients.
@@ -84,26 +90,38 @@ func (peer *Peer) String() string {
 // When a non-nil stopAt peer is supplied, the widening stops when it reaches
 // that peer. The boolean return indicates whether that has happened.
 //
+// When the 'relayPolicy' flag is set, the widening does not continue
+// through peers which have declared themselves NoTransit, other than the
+// starting peer, so they are only ever the final hop of a route. Nor does
+// it cross between zones except via a bridge, and it only does so once the
+// peers reachable without crossing have been exhausted. Nor does it use
+// our own connections which have been quiesced.
+//
+// If radius is positive, only peers within that many hops are reached.
+//
 // NB: This function should generally be invoked while holding a read lock on
 // Peers and LocalPeer.
 // func (peer *Peer) routes(stopAt *Peer, establishedAndSymmetric bool) (bool, map[PeerName]PeerName) {
-func (peer *Peer) routes(stopAt *Peer, establishedAndSymmetric, fullyConnectedTopology bool) (bool, map[PeerName]PeerName) {
+func (peer *Peer) routes(stopAt *Peer, establishedAndSymmetric, fullyConnectedTopology, relayPolicy bool, radius int) (bool, map[PeerName]PeerName) {
 	if fullyConnectedTopology {
-		return peer.routesForFullyConnectedTopology(stopAt, establishedAndSymmetric)
+		return peer.routesForFullyConnectedTopology(stopAt, establishedAndSymmetric, relayPolicy)
 	} else {
-		return peer.routesForGenericTopology(stopAt, establishedAndSymmetric)
+		return peer.routesForGenericTopology(stopAt, establishedAndSymmetric, relayPolicy, radius)
 	}
 }
 
 // routesForFullyConnectedTopology calculates routes for a special case of network topology where each peer in the
 // mesh is fully connected to rest of the peers. So each peer is single hop and directly reachable from the peer.
-func (peer *Peer) routesForFullyConnectedTopology(stopAt *Peer, establishedAndSymmetric bool) (bool, map[PeerName]PeerName) {
+func (peer *Peer) routesForFullyConnectedTopology(stopAt *Peer, establishedAndSymmetric, relayPolicy bool) (bool, map[PeerName]PeerName) {
 	routes := make(unicastRoutes)
 
 	for remoteName, conn := range peer.connections {
 		if establishedAndSymmetric && !conn.isEstablished() {
 			continue
 		}
+		if relayPolicy && isQuiesced(conn) {
+			continue
+		}
 		remotePeer := conn.Remote()
 		if remotePeer == stopAt {
 			return true, routes
@@ -115,11 +133,37 @@ func (peer *Peer) routesForFullyConnectedTopology(stopAt *Peer, establishedAndSy
 	return false, routes
 }
 
-func (peer *Peer) routesForGenericTopology(stopAt *Peer, establishedAndSymmetric bool) (bool, map[PeerName]PeerName) {
+func (peer *Peer) routesForGenericTopology(stopAt *Peer, establishedAndSymmetric, relayPolicy bool, radius int) (bool, map[PeerName]PeerName) {
 	routes := make(unicastRoutes)
 	routes[peer.Name] = UnknownPeerName
 	nextWorklist := []*Peer{peer}
-	for len(nextWorklist) > 0 {
+	// Hops to each peer reached, when limited to a radius
+	var hops map[PeerName]int
+	if radius > 0 {
+		hops = map[PeerName]int{peer.Name: 0}
+	}
+	// Peers in other zones, with the route to them, which are only
+	// visited once nothing more can be reached within the zone.
+	type crossing struct {
+		peer  *Peer
+		route PeerName
+		hops  int
+	}
+	var crossings []crossing
+	for len(nextWorklist) > 0 || len(crossings) > 0 {
+		if len(nextWorklist) == 0 {
+			for _, c := range crossings {
+				if _, found := routes[c.peer.Name]; !found {
+					routes[c.peer.Name] = c.route
+					if hops != nil {
+						hops[c.peer.Name] = c.hops
+					}
+					nextWorklist = append(nextWorklist, c.peer)
+				}
+			}
+			crossings = nil
+			continue
+		}
 		worklist := nextWorklist
 		sort.Sort(listOfPeers(worklist))
 		nextWorklist = []*Peer{}
@@ -127,22 +171,36 @@ func (peer *Peer) routesForGenericTopology(stopAt *Peer, establishedAndSymmetric
 			if curPeer == stopAt {
 				return true, routes
 			}
+			if relayPolicy && curPeer.NoTransit && curPeer != peer {
+				continue
+			}
+			if hops != nil && hops[curPeer.Name] >= radius {
+				continue
+			}
 			curPeer.forEachConnectedPeer(establishedAndSymmetric, routes,
 				func(remotePeer *Peer) {
-					//nextWorklist = append(nextWorklist, remotePeer)
-					//if !SingleHopTopolgy {
-					//	nextWorklist = append(nextWorklist, remotePeer)
-					//}
-					nextWorklist = append(nextWorklist, remotePeer)
 					remoteName := remotePeer.Name
+					if relayPolicy && curPeer == peer && isQuiesced(peer.connections[remoteName]) {
+						return
+					}
 					// We now know how to get to remoteName: the same
 					// way we get to curPeer. Except, if curPeer is
 					// the starting peer in which case we know we can
 					// reach remoteName directly.
-					if curPeer == peer {
-						routes[remoteName] = remoteName
-					} else {
-						routes[remoteName] = routes[curPeer.Name]
+					route := remoteName
+					if curPeer != peer {
+						route = routes[curPeer.Name]
+					}
+					if relayPolicy && curPeer.crossesZone(remotePeer) {
+						if curPeer.mayBridgeTo(remotePeer) {
+							crossings = append(crossings, crossing{remotePeer, route, hops[curPeer.Name] + 1})
+						}
+						return
+					}
+					nextWorklist = append(nextWorklist, remotePeer)
+					routes[remoteName] = route
+					if hops != nil {
+						hops[remoteName] = hops[curPeer.Name] + 1
 					}
 				})
 		}
@@ -150,6 +208,132 @@ func (peer *Peer) routesForGenericTopology(stopAt *Peer, establishedAndSymmetric
 	return false, routes
 }
 
+// weightedRoutes is routesForGenericTopology, calculating unicast routes
+// with the relay policy, where hops differ in cost: each of our own
+// connections costs edgeCost of the peer at its other end, and those of
+// other peers cost as they advertise, so that all peers agree on routes.
+// Relaying via a peer which advertises a RouteCost greater than one costs
+// as much as that many hops. Routes take the cheapest path, with ties
+// broken as by routesForGenericTopology, which this matches when all
+// hops cost one. If radius is positive, peers whose cheapest route is
+// more than that many hops long are not reached.
+//
+// NB: This function should generally be invoked while holding a read lock on
+// Peers and LocalPeer.
+func (peer *Peer) weightedRoutes(establishedAndSymmetric bool, edgeCost func(*Peer) float64, radius int) unicastRoutes {
+	routes := unicastRoutes{peer.Name: UnknownPeerName}
+	costs := map[PeerName]float64{peer.Name: 0}
+	hops := map[PeerName]int{peer.Name: 0}
+	done := make(peerNameSet)
+	queue := &peerQueue{{peer, 0}}
+	// Peers in other zones, as in routesForGenericTopology
+	type crossing struct {
+		peer  *Peer
+		route PeerName
+		cost  float64
+		hops  int
+	}
+	var crossings []crossing
+	reach := func(remotePeer *Peer, route PeerName, cost float64, n int) {
+		if _, found := done[remotePeer.Name]; found {
+			return
+		}
+		if old, found := costs[remotePeer.Name]; found && old <= cost {
+			return
+		}
+		costs[remotePeer.Name] = cost
+		hops[remotePeer.Name] = n
+		routes[remotePeer.Name] = route
+		heap.Push(queue, queuedPeer{remotePeer, cost})
+	}
+	for queue.Len() > 0 || len(crossings) > 0 {
+		if queue.Len() == 0 {
+			for _, c := range crossings {
+				reach(c.peer, c.route, c.cost, c.hops)
+			}
+			crossings = nil
+			continue
+		}
+		cur := heap.Pop(queue).(queuedPeer)
+		curPeer := cur.peer
+		if _, found := done[curPeer.Name]; found || cur.cost > costs[curPeer.Name] {
+			continue // superseded by a cheaper route
+		}
+		done[curPeer.Name] = struct{}{}
+		if curPeer.NoTransit && curPeer != peer {
+			continue
+		}
+		if radius > 0 && hops[curPeer.Name] >= radius {
+			continue
+		}
+		relayCost := 0.0
+		if curPeer != peer && curPeer.RouteCost > 1 {
+			relayCost = float64(curPeer.RouteCost - 1)
+		}
+		curPeer.forEachConnectedPeer(establishedAndSymmetric, nil, func(remotePeer *Peer) {
+			remoteName := remotePeer.Name
+			route, cost := remoteName, cur.cost+relayCost+curPeer.connections[remoteName].routeCost()
+			if curPeer == peer {
+				if isQuiesced(peer.connections[remoteName]) {
+					return
+				}
+				cost = edgeCost(remotePeer)
+			} else {
+				route = routes[curPeer.Name]
+			}
+			if curPeer.crossesZone(remotePeer) {
+				if curPeer.mayBridgeTo(remotePeer) {
+					crossings = append(crossings, crossing{remotePeer, route, cost, hops[curPeer.Name] + 1})
+				}
+				return
+			}
+			reach(remotePeer, route, cost, hops[curPeer.Name]+1)
+		})
+	}
+	return routes
+}
+
+// queuedPeer is a peer awaiting widening in weightedRoutes, with the
+// cost of reaching it.
+type queuedPeer struct {
+	peer *Peer
+	cost float64
+}
+
+// peerQueue is a heap of queuedPeers, cheapest first, and then in order
+// of name.
+type peerQueue []queuedPeer
+
+func (q peerQueue) Len() int      { return len(q) }
+func (q peerQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q peerQueue) Less(i, j int) bool {
+	if q[i].cost != q[j].cost {
+		return q[i].cost < q[j].cost
+	}
+	return q[i].peer.Name < q[j].peer.Name
+}
+
+func (q *peerQueue) Push(x interface{}) { *q = append(*q, x.(queuedPeer)) }
+
+func (q *peerQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+// crossesZone reports whether a connection from peer to remote leaves
+// peer's zone. A peer without a zone is regarded as being in every zone.
+func (peer *Peer) crossesZone(remote *Peer) bool {
+	return peer.Zone != "" && remote.Zone != "" && peer.Zone != remote.Zone
+}
+
+// mayBridgeTo reports whether traffic may be relayed over a connection
+// from peer to remote, which are in different zones.
+func (peer *Peer) mayBridgeTo(remote *Peer) bool {
+	return peer.ZoneBridge || remote.ZoneBridge
+}
+
 // Apply f to all peers reachable by peer. If establishedAndSymmetric is true,
 // only peers with established bidirectional connections will be selected. The
 // exclude maps is treated as a set of remote peers to blacklist.
@@ -168,6 +352,13 @@ func (peer *Peer) forEachConnectedPeer(establishedAndSymmetric bool, exclude map
 	}
 }
 
+// isQuiesced reports whether conn is one of our own connections which
+// has been quiesced, and so must not be routed over.
+func isQuiesced(conn Connection) bool {
+	q, ok := conn.(interface{ isQuiesced() bool })
+	return ok && q.isQuiesced()
+}
+
 // PeerUID uniquely identifies a peer in a mesh.
 type PeerUID uint64
 
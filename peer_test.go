@@ -1,6 +1,10 @@
 package mesh
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
 
 func newPeerFrom(peer *Peer) *Peer {
 	return newPeerFromSummary(peer.peerSummary)
@@ -26,3 +30,56 @@ func forcePendingGC(routers ...*Router) {
 		}
 	}
 }
+
+func TestPeerRoutesRadius(t *testing.T) {
+	// A 30x30 grid, in which the peer at (x, y) is x+y hops from the
+	// corner
+	const side, radius = 30, 3
+	grid := make([][]*Peer, side)
+	for x := range grid {
+		grid[x] = make([]*Peer, side)
+		for y := range grid[x] {
+			grid[x][y] = newPeer(PeerName(1+x*side+y), "", 0, 0, 0)
+		}
+	}
+	connect := func(a, b *Peer) {
+		a.connections[b.Name] = newRemoteConnection(a, b, "", false, true)
+		b.connections[a.Name] = newRemoteConnection(b, a, "", false, true)
+	}
+	for x := range grid {
+		for y := range grid[x] {
+			if x > 0 {
+				connect(grid[x-1][y], grid[x][y])
+			}
+			if y > 0 {
+				connect(grid[x][y-1], grid[x][y])
+			}
+		}
+	}
+	corner := grid[0][0]
+
+	_, all := corner.routes(nil, true, false, true, 0)
+	require.Len(t, all, side*side)
+	_, near := corner.routes(nil, true, false, true, radius)
+	weighted := corner.weightedRoutes(true, func(*Peer) float64 { return 1 }, radius)
+	for x := range grid {
+		for y := range grid[x] {
+			name := grid[x][y].Name
+			if x+y > radius {
+				require.NotContains(t, near, name)
+				require.NotContains(t, weighted, name)
+				continue
+			}
+			// Within the radius, routes are as without it
+			require.Equal(t, all[name], near[name])
+			require.Contains(t, weighted, name)
+		}
+	}
+	// 1+2+3+4 peers are within 3 hops of the corner
+	require.Len(t, near, 10)
+	require.Len(t, weighted, 10)
+
+	fullCost := testing.AllocsPerRun(10, func() { corner.routes(nil, true, false, true, 0) })
+	nearCost := testing.AllocsPerRun(10, func() { corner.routes(nil, true, false, true, radius) })
+	require.True(t, nearCost*10 < fullCost, "%v allocations within radius, %v without", nearCost, fullCost)
+}
@@ -5,8 +5,11 @@ import (
 	"encoding/gob"
 	"io"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 const (
@@ -25,6 +28,19 @@ type Peers struct {
 	onInvalidateShortIDs []func()
 	timer                *time.Timer
 	pendingGC            bool
+
+	// When peers retained due to Config.PeerGCTimeout became unreachable
+	unreachableSince map[PeerName]time.Time
+
+	// Rate limits on updates about each peer; see Config.MaxTopologyUpdateRate
+	updateLimits     map[PeerName]*tokenBucket
+	throttledUpdates uint64
+
+	// Versions seen of other incarnations of our name, by UID
+	otherSelves map[PeerUID]uint64
+
+	// Entries rejected for want of a valid signature; see Config.PeerSigningKey
+	unverifiedUpdates uint64
 }
 
 type shortIDPeers struct {
@@ -44,6 +60,7 @@ type connectionSummary struct {
 	RemoteTCPAddr string
 	Outbound      bool
 	Established   bool
+	Cost          float64 // for unicast routing, if not 1; see Router.SetConnectionCost
 }
 
 // Due to changes to Peers that need to be sent out
@@ -60,6 +77,9 @@ type peersPendingNotifications struct {
 
 	// The local peer was modified
 	localPeerModified bool
+
+	// UIDs of other live peers with our name
+	nameCollisions []PeerUID
 }
 
 func newPeers(ourself *localPeer) *Peers {
@@ -68,10 +88,14 @@ func newPeers(ourself *localPeer) *Peers {
 		byName:    make(map[PeerName]*Peer),
 		byShortID: make(map[PeerShortID]shortIDPeers),
 		timer:     time.NewTimer(gcInterval),
+
+		unreachableSince: make(map[PeerName]time.Time),
+		updateLimits:     make(map[PeerName]*tokenBucket),
+		otherSelves:      make(map[PeerUID]uint64),
 	}
 	peers.fetchWithDefault(ourself.Peer)
 	peers.timer.Stop()
-	go peers.actorLoop()
+	ourself.router.goroutineCount().spawn(peers.actorLoop)
 	return peers
 }
 
@@ -81,12 +105,19 @@ func (peers *Peers) Descriptions() []PeerDescription {
 	defer peers.RUnlock()
 	descriptions := make([]PeerDescription, 0, len(peers.byName))
 	for _, peer := range peers.byName {
+		var numConnections int
+		if peer == peers.ourself.Peer {
+			// ours change under the local peer's lock, not ours
+			numConnections = peers.ourself.connectionCount()
+		} else {
+			numConnections = len(peer.connections)
+		}
 		descriptions = append(descriptions, PeerDescription{
 			Name:           peer.Name,
 			NickName:       peer.peerSummary.NickName,
 			UID:            peer.UID,
 			Self:           peer.Name == peers.ourself.Name,
-			NumConnections: len(peer.connections),
+			NumConnections: numConnections,
 		})
 	}
 	return descriptions
@@ -139,6 +170,12 @@ func (peers *Peers) unlockAndNotify(pending *peersPendingNotifications) {
 	if broadcastLocalPeer {
 		peers.ourself.broadcastPeerUpdate()
 	}
+
+	if router := peers.ourself.router; router != nil {
+		for _, uid := range pending.nameCollisions {
+			router.noteNameCollision(uid, "in topology update")
+		}
+	}
 }
 
 func (peers *Peers) addByShortID(peer *Peer, pending *peersPendingNotifications) {
@@ -351,10 +388,11 @@ func (peers *Peers) forEach(fun func(*Peer)) {
 
 func (peers *Peers) actorLoop() {
 	for range peers.timer.C {
-		peers.GarbageCollect()
+		// Clear the flag first, so that GC may schedule a follow-up
 		peers.Lock()
 		peers.pendingGC = false
 		peers.Unlock()
+		peers.GarbageCollect()
 	}
 }
 
@@ -373,6 +411,10 @@ func (peers *Peers) applyUpdate(update []byte) (peerNameSet, peerNameSet, error)
 	if err != nil {
 		return nil, nil, err
 	}
+	if peers.ourself.isMembershipFrozen() {
+		decodedUpdate, decodedConns = excludeUnknownPeers(newPeers, decodedUpdate, decodedConns)
+		newPeers = nil
+	}
 
 	// Add new peers
 	for name, newPeer := range newPeers {
@@ -443,18 +485,51 @@ func (peers *Peers) garbageCollect(pending *peersPendingNotifications) {
 	peers.ourself.RLock()
 	//_, reached := peers.ourself.routes(nil, false)
 	singleHopTopology := false
+	var gcTimeout time.Duration
+	gcTime := now()
 	if peers.ourself.router != nil {
 		singleHopTopology = peers.ourself.router.Config.SingleHopTopolgy
+		gcTimeout = peers.ourself.router.Config.PeerGCTimeout
+		gcTime = peers.ourself.router.now()
+		if peers.ourself.router.SeedNode {
+			// transient peers are not worth holding on to
+			gcTimeout = 0
+		}
 	}
-	_, reached := peers.ourself.routes(nil, false, singleHopTopology)
+	// The relay policy is ignored here: peers beyond a NoTransit peer,
+	// or in another zone, are still part of the mesh, even if we cannot
+	// route to them.
+	_, reached := peers.ourself.routes(nil, false, singleHopTopology, false, 0)
 	peers.ourself.RUnlock()
 
+	var nextGC time.Duration
 	for name, peer := range peers.byName {
-		if _, found := reached[peer.Name]; !found && peer.localRefCount == 0 {
-			delete(peers.byName, name)
-			peers.deleteByShortID(peer, pending)
-			pending.removed = append(pending.removed, peer)
+		if _, found := reached[peer.Name]; found || peer.localRefCount != 0 {
+			delete(peers.unreachableSince, name)
+			continue
+		}
+		if gcTimeout > 0 {
+			since, found := peers.unreachableSince[name]
+			if !found {
+				since = gcTime
+				peers.unreachableSince[name] = since
+			}
+			if remaining := since.Add(gcTimeout).Sub(gcTime); remaining > 0 {
+				if nextGC == 0 || remaining < nextGC {
+					nextGC = remaining
+				}
+				continue
+			}
 		}
+		peers.remove(peer, pending)
+	}
+	if peers.ourself.router != nil && peers.ourself.router.PeersMemoryLimit > 0 {
+		peers.evictUnreachable(peers.ourself.router.PeersMemoryLimit, pending)
+	}
+
+	if nextGC > 0 && !peers.pendingGC {
+		peers.timer.Reset(nextGC)
+		peers.pendingGC = true
 	}
 
 	if len(pending.removed) > 0 && peers.byShortID[peers.ourself.ShortID].peer != peers.ourself.Peer {
@@ -465,6 +540,71 @@ func (peers *Peers) garbageCollect(pending *peersPendingNotifications) {
 	}
 }
 
+func (peers *Peers) remove(peer *Peer, pending *peersPendingNotifications) {
+	delete(peers.byName, peer.Name)
+	delete(peers.unreachableSince, peer.Name)
+	delete(peers.updateLimits, peer.Name)
+	peers.deleteByShortID(peer, pending)
+	pending.removed = append(pending.removed, peer)
+}
+
+// Rough estimates of the memory used by each peer we know of, and by
+// each of its connections.
+const (
+	peerMemoryEstimate       = 512
+	connectionMemoryEstimate = 128
+)
+
+func peerMemory(peer *Peer) int64 {
+	return peerMemoryEstimate + int64(len(peer.NickName)) + connectionMemoryEstimate*int64(len(peer.connections))
+}
+
+func (peers *Peers) estimatedMemory() int64 {
+	var n int64
+	for _, peer := range peers.byName {
+		n += peerMemory(peer)
+	}
+	return n
+}
+
+// EstimatedMemory returns a rough estimate, in bytes, of the memory used
+// by the peers we know of. See Config.PeersMemoryLimit.
+func (peers *Peers) EstimatedMemory() int64 {
+	peers.RLock()
+	defer peers.RUnlock()
+	return peers.estimatedMemory()
+}
+
+// evictUnreachable removes unreachable peers retained due to
+// Config.PeerGCTimeout, those unreachable longest first, until our
+// estimated memory use is within limit, or none are left.
+func (peers *Peers) evictUnreachable(limit int64, pending *peersPendingNotifications) {
+	used := peers.estimatedMemory()
+	if used <= limit {
+		return
+	}
+	var unreachable []*Peer
+	for name := range peers.unreachableSince {
+		if peer, found := peers.byName[name]; found {
+			unreachable = append(unreachable, peer)
+		}
+	}
+	sort.Slice(unreachable, func(i, j int) bool {
+		ti, tj := peers.unreachableSince[unreachable[i].Name], peers.unreachableSince[unreachable[j].Name]
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return unreachable[i].Name < unreachable[j].Name
+	})
+	for _, peer := range unreachable {
+		if used <= limit {
+			break
+		}
+		used -= peerMemory(peer)
+		peers.remove(peer, pending)
+	}
+}
+
 func (peers *Peers) decodeUpdate(update []byte) (newPeers map[PeerName]*Peer, decodedUpdate []*Peer, decodedConns [][]connectionSummary, err error) {
 	newPeers = make(map[PeerName]*Peer)
 	decodedUpdate = []*Peer{}
@@ -480,6 +620,10 @@ func (peers *Peers) decodeUpdate(update []byte) (newPeers map[PeerName]*Peer, de
 			err = decErr
 			return
 		}
+		if !peers.verifySignature(summary, connSummaries) {
+			peers.unverifiedUpdates++
+			continue
+		}
 		newPeer := newPeerFromSummary(summary)
 		decodedUpdate = append(decodedUpdate, newPeer)
 		decodedConns = append(decodedConns, connSummaries)
@@ -504,6 +648,89 @@ func (peers *Peers) decodeUpdate(update []byte) (newPeers map[PeerName]*Peer, de
 	return
 }
 
+// excludeUnknownPeers drops the entries of a decoded update which concern,
+// or have connections to, unknown peers. Entries for known peers are
+// dropped rather than trimmed so that, once membership is unfrozen, the
+// complete entry is applied when next received.
+func excludeUnknownPeers(unknown map[PeerName]*Peer, decodedUpdate []*Peer, decodedConns [][]connectionSummary) ([]*Peer, [][]connectionSummary) {
+	keptUpdate := []*Peer{}
+	keptConns := [][]connectionSummary{}
+	for idx, newPeer := range decodedUpdate {
+		if _, found := unknown[newPeer.Name]; found {
+			continue
+		}
+		refersToUnknown := false
+		for _, connSummary := range decodedConns[idx] {
+			if _, found := unknown[PeerNameFromBin(connSummary.NameByte)]; found {
+				refersToUnknown = true
+				break
+			}
+		}
+		if !refersToUnknown {
+			keptUpdate = append(keptUpdate, newPeer)
+			keptConns = append(keptConns, decodedConns[idx])
+		}
+	}
+	return keptUpdate, keptConns
+}
+
+// admitUpdate applies the rate limit on updates about the named peer,
+// returning false if the update must be dropped. A peer that floods the
+// mesh with updates then cannot force constant route recalculation;
+// periodic gossip delivers its latest state once it calms down. Must
+// hold peers.Lock.
+func (peers *Peers) admitUpdate(name PeerName) bool {
+	router := peers.ourself.router
+	if router == nil || router.MaxTopologyUpdateRate <= 0 {
+		return true
+	}
+	limit, found := peers.updateLimits[name]
+	if !found {
+		rate := router.MaxTopologyUpdateRate
+		limit = newTokenBucket(int64(rate), time.Second/time.Duration(rate))
+		peers.updateLimits[name] = limit
+	}
+	if limit.take() {
+		return true
+	}
+	peers.throttledUpdates++
+	return false
+}
+
+// verifySignature reports whether a peer's entry in a topology update is
+// signed by that peer, if Config.PeerSigningKey requires it. Entries at
+// version zero without connections, as relayed by neighbours who have
+// only heard of the peer or connected to it, are not signed; they carry
+// no routing information and give way to any signed entry. Must hold
+// peers.Lock.
+func (peers *Peers) verifySignature(ps peerSummary, connSummaries []connectionSummary) bool {
+	router := peers.ourself.router
+	if router == nil || router.PeerSigningKey == nil {
+		return true
+	}
+	if ps.Version == 0 && len(connSummaries) == 0 {
+		return true
+	}
+	key, found := router.PeerSigningKey(PeerNameFromBin(ps.NameByte))
+	return found && len(key) == ed25519.PublicKeySize && ed25519.Verify(key, signedBytes(ps, connSummaries), ps.Signature)
+}
+
+// UnverifiedUpdates returns the number of topology entries rejected
+// because they were not validly signed, when Config.PeerSigningKey is set.
+func (peers *Peers) UnverifiedUpdates() uint64 {
+	peers.RLock()
+	defer peers.RUnlock()
+	return peers.unverifiedUpdates
+}
+
+// ThrottledUpdates returns the number of topology updates dropped due to
+// Config.MaxTopologyUpdateRate.
+func (peers *Peers) ThrottledUpdates() uint64 {
+	peers.RLock()
+	defer peers.RUnlock()
+	return peers.throttledUpdates
+}
+
 func (peers *Peers) applyDecodedUpdate(decodedUpdate []*Peer, decodedConns [][]connectionSummary, pending *peersPendingNotifications) peerNameSet {
 	newUpdate := make(peerNameSet)
 	for idx, newPeer := range decodedUpdate {
@@ -513,6 +740,12 @@ func (peers *Peers) applyDecodedUpdate(decodedUpdate []*Peer, decodedConns [][]c
 		switch peer := peers.byName[name]; peer {
 		case peers.ourself.Peer:
 			if newPeer.UID != peer.UID {
+				// An old incarnation stays at the same version, but
+				// another live peer with our name keeps moving on.
+				if version, seen := peers.otherSelves[newPeer.UID]; seen && newPeer.Version > version {
+					pending.nameCollisions = append(pending.nameCollisions, newPeer.UID)
+				}
+				peers.otherSelves[newPeer.UID] = newPeer.Version
 				// The update contains information about an old
 				// incarnation of ourselves. We increase our version
 				// number beyond that which we received, so our
@@ -531,9 +764,17 @@ func (peers *Peers) applyDecodedUpdate(decodedUpdate []*Peer, decodedConns [][]c
 							(!newPeer.HasShortID || peer.HasShortID)))) {
 				continue
 			}
+			if !peers.admitUpdate(name) {
+				continue
+			}
 			peer.Version = newPeer.Version
 			peer.UID = newPeer.UID
 			peer.NickName = newPeer.NickName
+			peer.NoTransit = newPeer.NoTransit
+			peer.Zone = newPeer.Zone
+			peer.ZoneBridge = newPeer.ZoneBridge
+			peer.RouteCost = newPeer.RouteCost
+			peer.Signature = newPeer.Signature
 			peer.connections = makeConnsMap(peer, connSummaries, peers.byName)
 
 			if newPeer.ShortID != peer.ShortID || newPeer.HasShortID != peer.HasShortID {
@@ -549,25 +790,52 @@ func (peers *Peers) applyDecodedUpdate(decodedUpdate []*Peer, decodedConns [][]c
 }
 
 func (peer *Peer) encode(enc *gob.Encoder) {
-	if err := enc.Encode(peer.peerSummary); err != nil {
-		panic(err)
-	}
+	encodePeer(enc, peer.peerSummary, peer.connectionSummaries(nil))
+}
 
+// connectionSummaries summarises the connections of peer, each with the
+// cost given by cost, or as advertised if cost is nil.
+func (peer *Peer) connectionSummaries(cost func(*Peer) float64) []connectionSummary {
 	connSummaries := []connectionSummary{}
 	for _, conn := range peer.connections {
-		connSummaries = append(connSummaries, connectionSummary{
-			conn.Remote().NameByte,
-			conn.remoteTCPAddress(),
-			conn.isOutbound(),
-			conn.isEstablished(),
-		})
+		summary := connectionSummary{
+			NameByte:      conn.Remote().NameByte,
+			RemoteTCPAddr: conn.remoteTCPAddress(),
+			Outbound:      conn.isOutbound(),
+			Established:   conn.isEstablished(),
+		}
+		if cost != nil {
+			summary.Cost = cost(conn.Remote())
+		} else {
+			summary.Cost = conn.routeCost()
+		}
+		if summary.Cost == 1 {
+			summary.Cost = 0 // omitted, as by peers which predate costs
+		}
+		connSummaries = append(connSummaries, summary)
 	}
+	return connSummaries
+}
 
+func encodePeer(enc *gob.Encoder, ps peerSummary, connSummaries []connectionSummary) {
+	if err := enc.Encode(ps); err != nil {
+		panic(err)
+	}
 	if err := enc.Encode(connSummaries); err != nil {
 		panic(err)
 	}
 }
 
+// signedBytes returns the canonical form of a peer's entry in a topology
+// update, as covered by its signature. Peers relaying the entry encode
+// its connections in their own order, so they are sorted here.
+func signedBytes(ps peerSummary, connSummaries []connectionSummary) []byte {
+	ps.Signature = nil
+	sorted := append([]connectionSummary{}, connSummaries...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].NameByte, sorted[j].NameByte) < 0 })
+	return gobEncode(ps, sorted)
+}
+
 func decodePeer(dec *gob.Decoder) (ps peerSummary, connSummaries []connectionSummary, err error) {
 	if err = dec.Decode(&ps); err != nil {
 		return
@@ -584,6 +852,7 @@ func makeConnsMap(peer *Peer, connSummaries []connectionSummary, byName map[Peer
 		name := PeerNameFromBin(connSummary.NameByte)
 		remotePeer := byName[name]
 		conn := newRemoteConnection(peer, remotePeer, connSummary.RemoteTCPAddr, connSummary.Outbound, connSummary.Established)
+		conn.cost = connSummary.Cost
 		conns[name] = conn
 	}
 	return conns
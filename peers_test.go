@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
 )
 
 // TODO we should also test:
@@ -381,3 +382,176 @@ func TestDeferredShortIDReassignment(t *testing.T) {
 
 	require.Equal(t, us.ourself.Peer, us.byShortID[us.ourself.ShortID].peer)
 }
+
+func TestPeerGCTimeout(t *testing.T) {
+	for _, test := range []struct {
+		timeout   time.Duration
+		reconnect bool
+	}{{200 * time.Millisecond, false}, {time.Hour, true}} {
+		r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{PeerGCTimeout: test.timeout})
+		r2 := newTestRouter(t, "02:00:00:02:00:00")
+		r3 := newTestRouter(t, "03:00:00:03:00:00")
+		routers := []*Router{r1, r2, r3}
+		addTestGossipConnection(t, r1, r2)
+		addTestGossipConnection(t, r2, r3)
+		flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+		// r3 becomes unreachable from r1, but is retained for now
+		r2.DeleteTestGossipConnection(r3)
+		r3.DeleteTestGossipConnection(r2)
+		sendPendingTopologyUpdates(routers...)
+		sendPendingGossip(routers...)
+		forcePendingGC(r1)
+		require.NotNil(t, r1.Peers.Fetch(r3.Ourself.Name))
+
+		if test.reconnect {
+			addTestGossipConnection(t, r2, r3)
+			sendPendingTopologyUpdates(routers...)
+			sendPendingGossip(routers...)
+			forcePendingGC(r1)
+			require.NotNil(t, r1.Peers.Fetch(r3.Ourself.Name))
+			r1.Peers.RLock()
+			require.Empty(t, r1.Peers.unreachableSince)
+			r1.Peers.RUnlock()
+			continue
+		}
+
+		deadline := time.Now().Add(3 * time.Second)
+		for r1.Peers.Fetch(r3.Ourself.Name) != nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.Nil(t, r1.Peers.Fetch(r3.Ourself.Name))
+	}
+}
+
+func TestTopologyUpdateRateLimit(t *testing.T) {
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{MaxTopologyUpdateRate: 5})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r1, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2, r3), r2.tp(r1), r3.tp(r1))
+	throttled := r1.Peers.ThrottledUpdates()
+
+	// r2 floods us with updates about itself
+	applied := 0
+	for i := 0; i < 50; i++ {
+		r2.Ourself.setVersionBeyond(r2.Ourself.Version)
+		_, newUpdate, err := r1.Peers.applyUpdate(r2.Peers.encodePeers(peerNameSet{r2.Ourself.Name: struct{}{}}))
+		require.NoError(t, err)
+		if _, found := newUpdate[r2.Ourself.Name]; found {
+			applied++
+		}
+	}
+	require.True(t, applied <= 6, "applied %d updates", applied)
+	require.Equal(t, uint64(50-applied), r1.Peers.ThrottledUpdates()-throttled)
+
+	// Updates about other peers are unaffected
+	r3.Ourself.setVersionBeyond(r3.Ourself.Version)
+	_, newUpdate, err := r1.Peers.applyUpdate(r3.Peers.encodePeers(peerNameSet{r3.Ourself.Name: struct{}{}}))
+	require.NoError(t, err)
+	require.Contains(t, newUpdate, r3.Ourself.Name)
+}
+
+func TestNameCollision(t *testing.T) {
+	var collisions []PeerUID
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{
+		OnNameCollision: func(uid PeerUID, detail string) { collisions = append(collisions, uid) },
+	})
+	other := newTestRouter(t, "01:00:00:01:00:00")
+	require.NotEqual(t, r1.Ourself.UID, other.Ourself.UID)
+	update := func() {
+		_, _, err := r1.Peers.applyUpdate(other.Peers.encodePeers(peerNameSet{other.Ourself.Name: struct{}{}}))
+		require.NoError(t, err)
+	}
+
+	// A stale entry, as left behind by our previous incarnation, is not a collision
+	update()
+	update()
+	require.Empty(t, collisions)
+
+	// Another peer with our name moving on is, and is reported once
+	other.Ourself.setVersionBeyond(other.Ourself.Version)
+	update()
+	other.Ourself.setVersionBeyond(other.Ourself.Version)
+	update()
+	require.Equal(t, []PeerUID{other.Ourself.UID}, collisions)
+}
+
+func TestSignedTopologyUpdates(t *testing.T) {
+	names := []string{"01:00:00:01:00:00", "02:00:00:02:00:00", "03:00:00:03:00:00"}
+	keys := make(map[PeerName]ed25519.PublicKey)
+	var routers []*Router
+	for _, name := range names {
+		public, private, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+		peerName, _ := PeerNameFromString(name)
+		keys[peerName] = public
+		routers = append(routers, newTestRouterWithConfig(t, name, Config{
+			SigningKey: private,
+			PeerSigningKey: func(name PeerName) (ed25519.PublicKey, bool) {
+				key, found := keys[name]
+				return key, found
+			},
+		}))
+	}
+	r1, r2, r3 := routers[0], routers[1], routers[2]
+
+	// Signatures survive being relayed, by r2 between r1 and r3
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+	for _, r := range routers {
+		require.Zero(t, r.Peers.UnverifiedUpdates())
+	}
+
+	// An impostor claims r3 is connected to it, but cannot sign for r3
+	_, forgerKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	forger := newTestRouterWithConfig(t, names[2], Config{SigningKey: forgerKey})
+	forger.Ourself.setVersionBeyond(r3.Ourself.Version + 10)
+	_, newUpdate, err := r1.Peers.applyUpdate(forger.Peers.encodePeers(peerNameSet{forger.Ourself.Name: struct{}{}}))
+	require.NoError(t, err)
+	require.Empty(t, newUpdate)
+	require.Equal(t, uint64(1), r1.Peers.UnverifiedUpdates())
+	require.Equal(t, r3.Ourself.Version, r1.Peers.Fetch(r3.Ourself.Name).Version)
+}
+
+func TestPeersMemoryLimit(t *testing.T) {
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{PeerGCTimeout: time.Hour})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	r4 := newTestRouter(t, "04:00:00:04:00:00")
+	r5 := newTestRouter(t, "05:00:00:05:00:00")
+	routers := []*Router{r1, r2, r3, r4, r5}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	addTestGossipConnection(t, r2, r4)
+	flushAndCheckTopology(t, routers[:4], r1.tp(r2), r2.tp(r1, r3, r4), r3.tp(r2), r4.tp(r2))
+
+	// r3, then r4, become unreachable from r1, and are retained
+	for _, r := range []*Router{r3, r4} {
+		r2.DeleteTestGossipConnection(r)
+		r.DeleteTestGossipConnection(r2)
+		sendPendingTopologyUpdates(routers...)
+		sendPendingGossip(routers...)
+		forcePendingGC(r1)
+		require.NotNil(t, r1.Peers.Fetch(r.Ourself.Name))
+	}
+	r1.Peers.Lock()
+	r1.Peers.unreachableSince[r3.Ourself.Name] = time.Now().Add(-time.Minute)
+	r1.Peers.Unlock()
+
+	// Leave room for one more connection, but not for a new peer as well
+	r1.PeersMemoryLimit = r1.Peers.EstimatedMemory() + connectionMemoryEstimate
+	addTestGossipConnection(t, r2, r5)
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	forcePendingGC(r1)
+
+	require.Nil(t, r1.Peers.Fetch(r3.Ourself.Name), "least recently seen peer was not evicted")
+	require.NotNil(t, r1.Peers.Fetch(r4.Ourself.Name))
+	require.NotNil(t, r1.Peers.Fetch(r5.Ourself.Name))
+	require.True(t, NewStatus(r1).PeersMemory <= r1.PeersMemoryLimit)
+}
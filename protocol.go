@@ -41,6 +41,16 @@ var (
 	errExpectedNoCrypto = fmt.Errorf("no password specificed, but peer requested an encrypted connection")
 )
 
+// nonMeshError is returned when the remote's protocol header shows it is
+// not a mesh peer at all, e.g. a port scanner or an HTTP client.
+type nonMeshError struct {
+	header []byte // as far as it was read
+}
+
+func (err nonMeshError) Error() string {
+	return fmt.Sprintf("non-mesh connection rejected: header %q", err.header)
+}
+
 type protocolIntroConn interface {
 	io.ReadWriter
 
@@ -52,12 +62,15 @@ type protocolIntroConn interface {
 
 // The params necessary to negotiate a protocol intro with a remote peer.
 type protocolIntroParams struct {
-	MinVersion byte
-	MaxVersion byte
-	Outbound   bool
-	Features   map[string]string
-	Conn       protocolIntroConn
-	Password   []byte
+	MinVersion  byte
+	MaxVersion  byte
+	Outbound    bool
+	Features    map[string]string
+	Conn        protocolIntroConn
+	Password    []byte
+	CipherSuite CipherSuite
+	Framer      Framer // LengthPrefixFramer if nil
+	OnHeader    func() // if set, called once the protocol headers are exchanged
 }
 
 // The results from a successful protocol intro.
@@ -67,6 +80,7 @@ type protocolIntroResults struct {
 	Sender     tcpSender
 	SessionKey *[32]byte
 	Version    byte
+	Overhead   int // framing bytes added to each message, where known
 }
 
 // DoIntro executes the protocol introduction.
@@ -78,6 +92,9 @@ func (params protocolIntroParams) doIntro() (res protocolIntroResults, err error
 	if res.Version, err = params.exchangeProtocolHeader(); err != nil {
 		return
 	}
+	if params.OnHeader != nil {
+		params.OnHeader()
+	}
 
 	var pubKey, privKey *[32]byte
 	if params.Password != nil {
@@ -117,16 +134,25 @@ func (params protocolIntroParams) exchangeProtocolHeader() (byte, error) {
 		writeDone <- err
 	}()
 
+	// Check the magic as it arrives, so that we can give up on a
+	// non-mesh client straight away, rather than waiting for more.
 	header := make([]byte, len(protocolBytes)+2)
-	if n, err := io.ReadFull(params.Conn, header); err != nil && n == 0 {
-		return 0, fmt.Errorf("failed to receive remote protocol header: %s", err)
-	} else if err != nil {
-		return 0, fmt.Errorf("received incomplete remote protocol header (%d octets instead of %d): %v; error: %s",
-			n, len(header), header[:n], err)
-	}
-
-	if !bytes.Equal(protocolBytes, header[:len(protocolBytes)]) {
-		return 0, fmt.Errorf("remote protocol header not recognised: %v", header[:len(protocolBytes)])
+	for n := 0; n < len(header); {
+		m, err := params.Conn.Read(header[n:])
+		n += m
+		magic := n
+		if magic > len(protocolBytes) {
+			magic = len(protocolBytes)
+		}
+		if !bytes.Equal(protocolBytes[:magic], header[:magic]) {
+			return 0, nonMeshError{header[:magic]}
+		}
+		if err != nil && n == 0 {
+			return 0, fmt.Errorf("failed to receive remote protocol header: %s", err)
+		} else if err != nil && n < len(header) {
+			return 0, fmt.Errorf("received incomplete remote protocol header (%d octets instead of %d): %v; error: %s",
+				n, len(header), header[:n], err)
+		}
 	}
 
 	theirMinVersion := header[len(protocolBytes)]
@@ -161,6 +187,10 @@ func (params protocolIntroParams) exchangeProtocolHeader() (byte, error) {
 // encrypted connection).  For an encrypted connection, the public key
 // is passed in the "PublicKey" feature as a string of hex digits.
 func (res *protocolIntroResults) doIntroV1(params protocolIntroParams, pubKey, privKey *[32]byte) error {
+	if pubKey != nil && params.CipherSuite != CipherSuiteDefault {
+		return fmt.Errorf("cipher suite %v requires protocol version 2", params.CipherSuite)
+	}
+
 	features := filterV1Features(params.Features)
 	if pubKey != nil {
 		features["PublicKey"] = hex.EncodeToString(pubKey[:])
@@ -204,7 +234,9 @@ func (res *protocolIntroResults) doIntroV1(params protocolIntroParams, pubKey, p
 			return err
 		}
 
-		res.setupCrypto(params, remotePubKey, privKey)
+		if err := res.setupCrypto(params, remotePubKey, privKey); err != nil {
+			return err
+		}
 	}
 
 	res.Features = filterV1Features(res.Features)
@@ -228,8 +260,8 @@ func filterV1Features(intro map[string]string) map[string]string {
 // The V2 procotol consists of the protocol identification/version
 // header, followed by:
 //
-// - A single "encryption flag" byte: 0 for no encryption, 1 for
-// encryption.
+// - A single "encryption flag" byte: 0 for no encryption, otherwise
+// one more than the CipherSuite in use (so 1 for the default suite).
 //
 // - When the connection is encrypted, 32 bytes follow containing the
 // public key.
@@ -246,7 +278,7 @@ func (res *protocolIntroResults) doIntroV2(params protocolIntroParams, pubKey, p
 		wbuf = []byte{0}
 	} else {
 		wbuf = make([]byte, 1+len(*pubKey))
-		wbuf[0] = 1
+		wbuf[0] = encryptionFlag(params.CipherSuite)
 		copy(wbuf[1:], (*pubKey)[:])
 	}
 
@@ -265,28 +297,32 @@ func (res *protocolIntroResults) doIntroV2(params protocolIntroParams, pubKey, p
 		return err
 	}
 
-	switch rbuf[0] {
-	case 0:
+	switch flag := rbuf[0]; {
+	case flag == 0:
 		if pubKey != nil {
 			return errExpectedCrypto
 		}
 
-		res.Sender = newLengthPrefixTCPSender(params.Conn)
-		res.Receiver = newLengthPrefixTCPReceiver(params.Conn)
+		res.useFramer(params)
 
-	case 1:
+	case flag <= encryptionFlag(maxCipherSuite):
 		if pubKey == nil {
 			return errExpectedNoCrypto
 		}
 
+		if theirs := CipherSuite(flag - 1); theirs != params.CipherSuite {
+			return fmt.Errorf("cipher suite mismatch (ours: %v, theirs: %v)", params.CipherSuite, theirs)
+		}
+
 		rbuf = make([]byte, len(pubKey))
 		if _, err := io.ReadFull(params.Conn, rbuf); err != nil {
 			return err
 		}
 
-		res.Sender = newLengthPrefixTCPSender(params.Conn)
-		res.Receiver = newLengthPrefixTCPReceiver(params.Conn)
-		res.setupCrypto(params, rbuf, privKey)
+		res.useFramer(params)
+		if err := res.setupCrypto(params, rbuf, privKey); err != nil {
+			return err
+		}
 
 	default:
 		return fmt.Errorf("Bad encryption flag %d", rbuf[0])
@@ -323,12 +359,36 @@ func (res *protocolIntroResults) doIntroV2(params protocolIntroParams, pubKey, p
 	return nil
 }
 
-func (res *protocolIntroResults) setupCrypto(params protocolIntroParams, remotePubKey []byte, privKey *[32]byte) {
+// useFramer has messages framed by the Framer of params.
+func (res *protocolIntroResults) useFramer(params protocolIntroParams) {
+	framer := params.Framer
+	if framer == nil {
+		framer = LengthPrefixFramer{}
+	}
+	res.Sender = newFramedTCPSender(params.Conn, framer)
+	res.Receiver = newFramedTCPReceiver(params.Conn, framer)
+	if _, isDefault := framer.(LengthPrefixFramer); isDefault {
+		res.Overhead = lengthPrefixSize
+	}
+}
+
+func (res *protocolIntroResults) setupCrypto(params protocolIntroParams, remotePubKey []byte, privKey *[32]byte) error {
 	var remotePubKeyArr [32]byte
 	copy(remotePubKeyArr[:], remotePubKey)
 	res.SessionKey = formSessionKey(&remotePubKeyArr, privKey, params.Password)
-	res.Sender = newEncryptedTCPSender(res.Sender, res.SessionKey, params.Outbound)
-	res.Receiver = newEncryptedTCPReceiver(res.Receiver, res.SessionKey, params.Outbound)
+	aead, err := newAEAD(params.CipherSuite, res.SessionKey)
+	if err != nil {
+		return err
+	}
+	res.Overhead += aead.Overhead()
+	res.Sender = newEncryptedTCPSender(res.Sender, aead, params.Outbound)
+	res.Receiver = newEncryptedTCPReceiver(res.Receiver, aead, params.Outbound)
+	return nil
+}
+
+// encryptionFlag is the V2 encryption flag byte announcing suite.
+func encryptionFlag(suite CipherSuite) byte {
+	return byte(suite) + 1
 }
 
 // ProtocolTag identifies the type of msg encoded in a ProtocolMsg.
@@ -351,8 +411,49 @@ const (
 	ProtocolGossipBroadcast
 	// ProtocolOverlayControlMsg identifies a control msg.
 	ProtocolOverlayControlMsg
+	// ProtocolGossipCompact is ProtocolGossip with the source name in
+	// compact form; see compactGossipMsg.
+	ProtocolGossipCompact
+	// ProtocolGossipUnicastCompact is ProtocolGossipUnicast with the
+	// source name in compact form.
+	ProtocolGossipUnicastCompact
+	// ProtocolGossipBroadcastCompact is ProtocolGossipBroadcast with the
+	// source name in compact form.
+	ProtocolGossipBroadcastCompact
+	// ProtocolGossipBinary is ProtocolGossipCompact in the binary gossip
+	// codec; see binaryGossipMsg.
+	ProtocolGossipBinary
+	// ProtocolGossipUnicastBinary is ProtocolGossipUnicastCompact in the
+	// binary gossip codec.
+	ProtocolGossipUnicastBinary
+	// ProtocolGossipBroadcastBinary is ProtocolGossipBroadcastCompact in
+	// the binary gossip codec.
+	ProtocolGossipBroadcastBinary
+	// ProtocolPing asks the remote to echo its payload in a
+	// ProtocolPong, so that we can measure the round-trip time.
+	ProtocolPing
+	// ProtocolPong echoes the payload of a ProtocolPing.
+	ProtocolPong
 )
 
+// compactTags maps gossip tags to their compact equivalents.
+var compactTags = map[protocolTag]protocolTag{
+	ProtocolGossip:          ProtocolGossipCompact,
+	ProtocolGossipUnicast:   ProtocolGossipUnicastCompact,
+	ProtocolGossipBroadcast: ProtocolGossipBroadcastCompact,
+}
+
+// expandedTag returns the gossip tag equivalent to a compact one, and
+// whether tag was compact.
+func expandedTag(tag protocolTag) (protocolTag, bool) {
+	for expanded, compact := range compactTags {
+		if tag == compact {
+			return expanded, true
+		}
+	}
+	return tag, false
+}
+
 // ProtocolMsg combines a tag and encoded msg.
 type protocolMsg struct {
 	tag protocolTag
@@ -1,6 +1,8 @@
 package mesh
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
@@ -14,8 +16,8 @@ import (
 )
 
 // MaxTCPMsgSize is the hard limit on sends and receives. Larger messages will
-// result in errors. This applies to the LengthPrefixTCP{Sender,Receiver} i.e.
-// V2 of the protocol.
+// result in errors. This applies to the LengthPrefixFramer, used in V2 of the
+// protocol.
 const maxTCPMsgSize = 10 * 1024 * 1024
 
 // GenerateKeyPair is used during encrypted protocol introduction.
@@ -33,27 +35,100 @@ func formSessionKey(remotePublicKey, localPrivateKey *[32]byte, secretKey []byte
 	return &sessionKey
 }
 
+// CipherSuite selects the authenticated encryption algorithm used on
+// connections when a password is configured. Both ends of a connection
+// must select the same suite, otherwise the connection is refused.
+type CipherSuite byte
+
+const (
+	// CipherSuiteDefault is the NaCl secretbox construction (XSalsa20
+	// and Poly1305), which is what mesh has always used.
+	CipherSuiteDefault CipherSuite = iota
+	// CipherSuiteAES256GCM is AES-256 in Galois/Counter Mode.
+	CipherSuiteAES256GCM
+
+	maxCipherSuite = CipherSuiteAES256GCM
+)
+
+// String returns a human-readable name for the cipher suite.
+func (suite CipherSuite) String() string {
+	switch suite {
+	case CipherSuiteDefault:
+		return "nacl-secretbox"
+	case CipherSuiteAES256GCM:
+		return "aes-256-gcm"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(suite))
+}
+
+// newAEAD returns the cipher.AEAD implementing suite, keyed with sessionKey.
+func newAEAD(suite CipherSuite, sessionKey *[32]byte) (cipher.AEAD, error) {
+	switch suite {
+	case CipherSuiteDefault:
+		return secretboxAEAD{key: sessionKey}, nil
+	case CipherSuiteAES256GCM:
+		block, err := aes.NewCipher(sessionKey[:])
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return nil, fmt.Errorf("unsupported cipher suite %v", suite)
+}
+
+// secretboxAEAD adapts NaCl secretbox to cipher.AEAD. Additional data is
+// not supported by secretbox, and is ignored.
+type secretboxAEAD struct {
+	key *[32]byte
+}
+
+// NonceSize implements cipher.AEAD.
+func (secretboxAEAD) NonceSize() int { return 24 }
+
+// Overhead implements cipher.AEAD.
+func (secretboxAEAD) Overhead() int { return secretbox.Overhead }
+
+// Seal implements cipher.AEAD.
+func (a secretboxAEAD) Seal(dst, nonce, plaintext, _ []byte) []byte {
+	var n [24]byte
+	copy(n[:], nonce)
+	return secretbox.Seal(dst, plaintext, &n, a.key)
+}
+
+// Open implements cipher.AEAD.
+func (a secretboxAEAD) Open(dst, nonce, ciphertext, _ []byte) ([]byte, error) {
+	var n [24]byte
+	copy(n[:], nonce)
+	plaintext, ok := secretbox.Open(dst, ciphertext, &n, a.key)
+	if !ok {
+		return nil, errDecrypt
+	}
+	return plaintext, nil
+}
+
+var errDecrypt = fmt.Errorf("Unable to decrypt TCP msg")
+
 // TCP Senders/Receivers
 
-// TCPCryptoState stores session key, nonce, and sequence state.
+// TCPCryptoState stores the cipher, nonce, and sequence state.
 //
 // The lowest 64 bits of the nonce contain the message sequence number. The
 // top most bit indicates the connection polarity at the sender - '1' for
-// outbound; the next indicates protocol type - '1' for TCP. The remaining 126
+// outbound; the next indicates protocol type - '1' for TCP. The remaining
 // bits are zero. The polarity is needed so that the two ends of a connection
 // do not use the same nonces; the protocol type so that the TCP connection
 // nonces are distinct from nonces used by overlay connections, if they share
 // the session key. This is a requirement of the NaCl Security Model; see
 // http://nacl.cr.yp.to/box.html.
 type tcpCryptoState struct {
-	sessionKey *[32]byte
-	nonce      [24]byte
-	seqNo      uint64
+	aead  cipher.AEAD
+	nonce []byte
+	seqNo uint64
 }
 
 // NewTCPCryptoState returns a valid TCPCryptoState.
-func newTCPCryptoState(sessionKey *[32]byte, outbound bool) *tcpCryptoState {
-	s := &tcpCryptoState{sessionKey: sessionKey}
+func newTCPCryptoState(aead cipher.AEAD, outbound bool) *tcpCryptoState {
+	s := &tcpCryptoState{aead: aead, nonce: make([]byte, aead.NonceSize())}
 	if outbound {
 		s.nonce[0] |= (1 << 7)
 	}
@@ -63,7 +138,7 @@ func newTCPCryptoState(sessionKey *[32]byte, outbound bool) *tcpCryptoState {
 
 func (s *tcpCryptoState) advance() {
 	s.seqNo++
-	binary.BigEndian.PutUint64(s.nonce[16:24], s.seqNo)
+	binary.BigEndian.PutUint64(s.nonce[len(s.nonce)-8:], s.seqNo)
 }
 
 // TCPSender describes anything that can send byte buffers.
@@ -86,29 +161,23 @@ func (sender *gobTCPSender) Send(msg []byte) error {
 	return sender.encoder.Encode(msg)
 }
 
-// LengthPrefixTCPSender implements TCPSender and is used in the V2 protocol.
-type lengthPrefixTCPSender struct {
+// lengthPrefixSize is the size of the length prefix in the V2 protocol.
+const lengthPrefixSize = 4
+
+// framedTCPSender implements TCPSender with a Framer, and is used in the V2
+// protocol.
+type framedTCPSender struct {
 	writer io.Writer
+	framer Framer
 }
 
-func newLengthPrefixTCPSender(writer io.Writer) *lengthPrefixTCPSender {
-	return &lengthPrefixTCPSender{writer: writer}
+func newFramedTCPSender(writer io.Writer, framer Framer) *framedTCPSender {
+	return &framedTCPSender{writer: writer, framer: framer}
 }
 
-// Send implements TCPSender by writing the size of the msg as a big-endian
-// uint32 before the msg. msgs larger than MaxTCPMsgSize are rejected.
-func (sender *lengthPrefixTCPSender) Send(msg []byte) error {
-	l := len(msg)
-	if l > maxTCPMsgSize {
-		return fmt.Errorf("outgoing message exceeds maximum size: %d > %d", l, maxTCPMsgSize)
-	}
-	// We copy the message so we can send it in a single Write
-	// operation, thus making this thread-safe without locking.
-	prefixedMsg := make([]byte, 4+l)
-	binary.BigEndian.PutUint32(prefixedMsg, uint32(l))
-	copy(prefixedMsg[4:], msg)
-	_, err := sender.writer.Write(prefixedMsg)
-	return err
+// Send implements TCPSender by writing msg as a frame.
+func (sender *framedTCPSender) Send(msg []byte) error {
+	return sender.framer.WriteFrame(sender.writer, msg)
 }
 
 // Implement TCPSender by wrapping an existing TCPSender with tcpCryptoState.
@@ -118,15 +187,15 @@ type encryptedTCPSender struct {
 	state  *tcpCryptoState
 }
 
-func newEncryptedTCPSender(sender tcpSender, sessionKey *[32]byte, outbound bool) *encryptedTCPSender {
-	return &encryptedTCPSender{sender: sender, state: newTCPCryptoState(sessionKey, outbound)}
+func newEncryptedTCPSender(sender tcpSender, aead cipher.AEAD, outbound bool) *encryptedTCPSender {
+	return &encryptedTCPSender{sender: sender, state: newTCPCryptoState(aead, outbound)}
 }
 
 // Send implements TCPSender by sealing and sending the msg as-is.
 func (sender *encryptedTCPSender) Send(msg []byte) error {
 	sender.Lock()
 	defer sender.Unlock()
-	encodedMsg := secretbox.Seal(nil, msg, &sender.state.nonce, sender.state.sessionKey)
+	encodedMsg := sender.state.aead.Seal(nil, sender.state.nonce, msg, nil)
 	sender.state.advance()
 	return sender.sender.Send(encodedMsg)
 }
@@ -153,28 +222,20 @@ func (receiver *gobTCPReceiver) Receive() ([]byte, error) {
 	return msg, err
 }
 
-// lengthPrefixTCPReceiver implements TCPReceiver, used in the V2 protocol.
-type lengthPrefixTCPReceiver struct {
+// framedTCPReceiver implements TCPReceiver with a Framer, and is used in
+// the V2 protocol.
+type framedTCPReceiver struct {
 	reader io.Reader
+	framer Framer
 }
 
-func newLengthPrefixTCPReceiver(reader io.Reader) *lengthPrefixTCPReceiver {
-	return &lengthPrefixTCPReceiver{reader: reader}
+func newFramedTCPReceiver(reader io.Reader, framer Framer) *framedTCPReceiver {
+	return &framedTCPReceiver{reader: reader, framer: framer}
 }
 
-// Receive implements TCPReceiver by making a length-limited read into a byte buffer.
-func (receiver *lengthPrefixTCPReceiver) Receive() ([]byte, error) {
-	lenPrefix := make([]byte, 4)
-	if _, err := io.ReadFull(receiver.reader, lenPrefix); err != nil {
-		return nil, err
-	}
-	l := binary.BigEndian.Uint32(lenPrefix)
-	if l > maxTCPMsgSize {
-		return nil, fmt.Errorf("incoming message exceeds maximum size: %d > %d", l, maxTCPMsgSize)
-	}
-	msg := make([]byte, l)
-	_, err := io.ReadFull(receiver.reader, msg)
-	return msg, err
+// Receive implements TCPReceiver by reading a frame.
+func (receiver *framedTCPReceiver) Receive() ([]byte, error) {
+	return receiver.framer.ReadFrame(receiver.reader)
 }
 
 // encryptedTCPReceiver implements TCPReceiver by wrapping a TCPReceiver with TCPCryptoState.
@@ -183,8 +244,8 @@ type encryptedTCPReceiver struct {
 	state    *tcpCryptoState
 }
 
-func newEncryptedTCPReceiver(receiver tcpReceiver, sessionKey *[32]byte, outbound bool) *encryptedTCPReceiver {
-	return &encryptedTCPReceiver{receiver: receiver, state: newTCPCryptoState(sessionKey, !outbound)}
+func newEncryptedTCPReceiver(receiver tcpReceiver, aead cipher.AEAD, outbound bool) *encryptedTCPReceiver {
+	return &encryptedTCPReceiver{receiver: receiver, state: newTCPCryptoState(aead, !outbound)}
 }
 
 // Receive implements TCPReceiver by reading from the wrapped TCPReceiver and
@@ -195,9 +256,9 @@ func (receiver *encryptedTCPReceiver) Receive() ([]byte, error) {
 		return nil, err
 	}
 
-	decodedMsg, success := secretbox.Open(nil, msg, &receiver.state.nonce, receiver.state.sessionKey)
-	if !success {
-		return nil, fmt.Errorf("Unable to decrypt TCP msg")
+	decodedMsg, err := receiver.state.aead.Open(nil, receiver.state.nonce, msg, nil)
+	if err != nil {
+		return nil, errDecrypt
 	}
 
 	receiver.state.advance()
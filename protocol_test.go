@@ -44,22 +44,28 @@ func doIntro(t *testing.T, params protocolIntroParams) <-chan protocolIntroResul
 }
 
 func doProtocolIntro(t *testing.T, aver, bver byte, password []byte) byte {
+	return doProtocolIntroWithCipher(t, aver, bver, password, CipherSuiteDefault)
+}
+
+func doProtocolIntroWithCipher(t *testing.T, aver, bver byte, password []byte, suite CipherSuite) byte {
 	aconn, bconn := connPair()
 	aresch := doIntro(t, protocolIntroParams{
-		MinVersion: ProtocolMinVersion,
-		MaxVersion: aver,
-		Features:   map[string]string{"Name": "A"},
-		Conn:       aconn,
-		Outbound:   true,
-		Password:   password,
+		MinVersion:  ProtocolMinVersion,
+		MaxVersion:  aver,
+		Features:    map[string]string{"Name": "A"},
+		Conn:        aconn,
+		Outbound:    true,
+		Password:    password,
+		CipherSuite: suite,
 	})
 	bresch := doIntro(t, protocolIntroParams{
-		MinVersion: ProtocolMinVersion,
-		MaxVersion: bver,
-		Features:   map[string]string{"Name": "B"},
-		Conn:       bconn,
-		Outbound:   false,
-		Password:   password,
+		MinVersion:  ProtocolMinVersion,
+		MaxVersion:  bver,
+		Features:    map[string]string{"Name": "B"},
+		Conn:        bconn,
+		Outbound:    false,
+		Password:    password,
+		CipherSuite: suite,
 	})
 	ares := <-aresch
 	bres := <-bresch
@@ -94,3 +100,43 @@ func TestProtocolIntro(t *testing.T) {
 	require.Equal(t, 1, int(doProtocolIntro(t, 2, 1, nil)))
 	require.Equal(t, 1, int(doProtocolIntro(t, 2, 1, []byte("w0rd"))))
 }
+
+func TestProtocolIntroCipherSuite(t *testing.T) {
+	require.Equal(t, 2, int(doProtocolIntroWithCipher(t, 2, 2, []byte("sekr1t"), CipherSuiteAES256GCM)))
+	// Without a password, the suite is irrelevant
+	require.Equal(t, 1, int(doProtocolIntroWithCipher(t, 1, 2, nil, CipherSuiteAES256GCM)))
+
+	aconn, bconn := connPair()
+	params := protocolIntroParams{
+		MinVersion: ProtocolMinVersion,
+		MaxVersion: ProtocolMaxVersion,
+		Features:   map[string]string{"Name": "A"},
+		Password:   []byte("sekr1t"),
+	}
+	errs := make(chan error, 2)
+	go func(params protocolIntroParams) {
+		params.Conn, params.Outbound, params.CipherSuite = aconn, true, CipherSuiteAES256GCM
+		_, err := params.doIntro()
+		errs <- err
+	}(params)
+	go func(params protocolIntroParams) {
+		params.Conn, params.CipherSuite = bconn, CipherSuiteDefault
+		_, err := params.doIntro()
+		errs <- err
+	}(params)
+	require.Error(t, <-errs)
+	require.Error(t, <-errs)
+}
+
+func TestAEADNonceLayout(t *testing.T) {
+	key := new([32]byte)
+	for _, suite := range []CipherSuite{CipherSuiteDefault, CipherSuiteAES256GCM} {
+		aead, err := newAEAD(suite, key)
+		require.NoError(t, err)
+		state := newTCPCryptoState(aead, true)
+		state.advance()
+		require.Len(t, state.nonce, aead.NonceSize())
+		require.Equal(t, byte(1<<7|1<<6), state.nonce[0])
+		require.Equal(t, byte(1), state.nonce[len(state.nonce)-1])
+	}
+}
@@ -0,0 +1,150 @@
+package mesh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reachability classifies whether, and if not why not, a peer can be
+// reached from this router.
+type Reachability int
+
+const (
+	// PeerReachable means we have a route to the peer.
+	PeerReachable Reachability = iota
+	// PeerUnknown means the peer is not part of the topology known to
+	// us, either because we have never heard of it or because it was
+	// removed after becoming unreachable.
+	PeerUnknown
+	// PeerNoRoute means the peer is known, but there is no path of
+	// established connections to it.
+	PeerNoRoute
+	// PeerFiltered means a path to the peer exists, but is excluded by
+	// the relay policy, i.e. by NoTransit peers or zones.
+	PeerFiltered
+)
+
+func (r Reachability) String() string {
+	switch r {
+	case PeerReachable:
+		return "reachable"
+	case PeerUnknown:
+		return "unknown peer"
+	case PeerNoRoute:
+		return "no route"
+	case PeerFiltered:
+		return "filtered"
+	}
+	return "unknown"
+}
+
+// PeerReachability explains the reachability of a peer, as returned by
+// Router.PeerStatus.
+type PeerReachability struct {
+	State  Reachability
+	Detail string
+}
+
+func (r PeerReachability) String() string {
+	if r.Detail == "" {
+		return r.State.String()
+	}
+	return r.State.String() + ": " + r.Detail
+}
+
+// PeerStatus explains whether the named peer is reachable and, if not,
+// why not, drawing on our routes, the topology, and the errors from any
+// attempts to connect to the peer.
+func (router *Router) PeerStatus(name PeerName) PeerReachability {
+	if name == router.Ourself.Name {
+		return PeerReachability{PeerReachable, "ourself"}
+	}
+	router.Routes.ensureRecalculated()
+	if hop, found := router.Routes.Unicast(name); found {
+		if hop == name {
+			return PeerReachability{PeerReachable, "directly connected"}
+		}
+		return PeerReachability{PeerReachable, fmt.Sprintf("via %s", hop)}
+	}
+
+	peers := router.Peers
+	peers.RLock()
+	peer, found := peers.byName[name]
+	if !found {
+		peers.RUnlock()
+		if router.MembershipFrozen() {
+			return PeerReachability{PeerUnknown, "membership is frozen"}
+		}
+		return PeerReachability{PeerUnknown, ""}
+	}
+	router.Ourself.RLock()
+	_, unfiltered := router.Ourself.routes(nil, true, router.SingleHopTopolgy, false, 0)
+	_, near := router.Ourself.routes(nil, true, router.SingleHopTopolgy, false, router.RoutingRadius)
+	addresses := peerAddresses(peers, peer)
+	router.Ourself.RUnlock()
+	since, unreachable := peers.unreachableSince[name]
+	peers.RUnlock()
+
+	if _, found := near[name]; !found && router.RoutingRadius > 0 {
+		if _, found := unfiltered[name]; found {
+			return PeerReachability{PeerNoRoute, fmt.Sprintf("more than %d hops away; see Config.RoutingRadius", router.RoutingRadius)}
+		}
+	}
+	if _, found := unfiltered[name]; found {
+		return PeerReachability{PeerFiltered, "only reachable via NoTransit peers or zone crossings without a bridge"}
+	}
+	var details []string
+	if _, found := router.Routes.UnicastAll(name); found {
+		details = append(details, "connections to it are not yet established")
+	}
+	if unreachable {
+		details = append(details, fmt.Sprintf("unreachable for %v", time.Since(since).Round(time.Second)))
+	}
+	details = append(details, router.ConnectionMaker.targetErrors(addresses)...)
+	return PeerReachability{PeerNoRoute, strings.Join(details, "; ")}
+}
+
+// peerAddresses returns the addresses at which other peers have
+// connected to peer. Must hold a read lock on peers and ourself.
+func peerAddresses(peers *Peers, peer *Peer) []string {
+	var addresses []string
+	for _, other := range peers.byName {
+		if conn, found := other.connections[peer.Name]; found && conn.isOutbound() {
+			addresses = append(addresses, conn.remoteTCPAddress())
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// ViewDigest returns a digest of the membership of our partition of the
+// mesh: the peers we can reach, and their UIDs. Routers which can all
+// reach each other produce the same digest once the topology has
+// converged, and routers in different partitions produce different ones,
+// so comparing digests across the mesh detects split-brain.
+func (router *Router) ViewDigest() string {
+	router.Routes.ensureRecalculated()
+	router.Routes.RLock()
+	names := make([]PeerName, 0, len(router.Routes.unicast))
+	for name := range router.Routes.unicast {
+		names = append(names, name)
+	}
+	router.Routes.RUnlock()
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+
+	hash := sha256.New()
+	router.Peers.RLock()
+	for _, name := range names {
+		var uid PeerUID
+		if peer, found := router.Peers.byName[name]; found {
+			uid = peer.UID
+		}
+		fmt.Fprintf(hash, "%s/%d\n", name, uid)
+	}
+	router.Peers.RUnlock()
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,207 @@
+package mesh
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerStatus(t *testing.T) {
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{PeerGCTimeout: time.Hour})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	require.Equal(t, PeerReachable, r1.PeerStatus(r1.Ourself.Name).State)
+	require.Equal(t, PeerReachability{PeerReachable, "directly connected"}, r1.PeerStatus(r2.Ourself.Name))
+	require.Equal(t, PeerReachability{PeerReachable, "via " + r2.Ourself.Name.String()}, r1.PeerStatus(r3.Ourself.Name))
+
+	// Partition r3 from the rest of the mesh
+	r2.DeleteTestGossipConnection(r3)
+	r3.DeleteTestGossipConnection(r2)
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	forcePendingGC(r1)
+
+	status := r1.PeerStatus(r3.Ourself.Name)
+	require.Equal(t, PeerNoRoute, status.State)
+	require.Contains(t, status.Detail, "unreachable for")
+	require.Contains(t, status.String(), "no route: ")
+
+	unknown, _ := PeerNameFromString("04:00:00:04:00:00")
+	require.Equal(t, PeerReachability{PeerUnknown, ""}, r1.PeerStatus(unknown))
+}
+
+func TestViewDigest(t *testing.T) {
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	digest := r1.ViewDigest()
+	require.Equal(t, digest, r1.ViewDigest())
+	require.Equal(t, digest, r2.ViewDigest())
+	require.Equal(t, digest, r3.ViewDigest())
+
+	r2.DeleteTestGossipConnection(r3)
+	r3.DeleteTestGossipConnection(r2)
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+
+	require.Equal(t, r1.ViewDigest(), r2.ViewDigest())
+	require.NotEqual(t, r1.ViewDigest(), r3.ViewDigest())
+	require.NotEqual(t, digest, r1.ViewDigest())
+}
+
+func TestConfirmTopologyWith(t *testing.T) {
+	config := Config{EnableTopologyConfirm: true}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", config)
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", config)
+	r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", config)
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	confirm := func(from, with *Router, timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return from.ConfirmTopologyWith(ctx, with.Ourself.Name)
+	}
+	start := time.Now()
+	require.NoError(t, confirm(r1, r3, time.Second))
+	require.True(t, time.Since(start) < confirmRetryInterval, "took %v", time.Since(start))
+
+	// r2 knows at once that r3 is gone, but r1 does not until r2's
+	// deferred topology update reaches it
+	r2.DeleteTestGossipConnection(r3)
+	r3.DeleteTestGossipConnection(r2)
+	require.Equal(t, context.DeadlineExceeded, confirm(r1, r2, 300*time.Millisecond))
+
+	sendPendingTopologyUpdates(routers...)
+	sendPendingGossip(routers...)
+	require.NoError(t, confirm(r1, r2, time.Second))
+	require.NoError(t, confirm(r2, r1, time.Second))
+
+	// Without the feature, the channel is not registered
+	r4 := newTestRouter(t, "04:00:00:04:00:00")
+	require.Nil(t, r4.GetGossip(confirmChannel))
+	require.Error(t, confirm(r4, r1, time.Second))
+}
+
+func TestTracePath(t *testing.T) {
+	config := Config{EnablePathTrace: true}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", config)
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", config)
+	r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", config)
+	r4 := newTestRouterWithConfig(t, "04:00:00:04:00:00", config)
+	routers := []*Router{r1, r2, r3, r4}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	addTestGossipConnection(t, r3, r4)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2, r4), r4.tp(r3))
+
+	trace := func(from, to *Router) ([]PeerName, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return from.TracePath(ctx, to.Ourself.Name)
+	}
+	names := func(rs ...*Router) []PeerName {
+		var path []PeerName
+		for _, r := range rs {
+			path = append(path, r.Ourself.Name)
+		}
+		return path
+	}
+	path, err := trace(r1, r4)
+	require.NoError(t, err)
+	require.Equal(t, names(r1, r2, r3, r4), path)
+	path, err = trace(r4, r2)
+	require.NoError(t, err)
+	require.Equal(t, names(r4, r3, r2), path)
+	path, err = trace(r1, r1)
+	require.NoError(t, err)
+	require.Equal(t, names(r1), path)
+
+	// r3 knows at once that r4 is gone, before r1 does, so the probe
+	// gets no further
+	r3.DeleteTestGossipConnection(r4)
+	r4.DeleteTestGossipConnection(r3)
+	path, err = trace(r1, r4)
+	require.Error(t, err)
+	require.Equal(t, names(r1, r2, r3), path)
+
+	// Without the feature, the channel is not registered
+	r5 := newTestRouter(t, "05:00:00:05:00:00")
+	require.Nil(t, r5.GetGossip(traceChannel))
+	_, err = trace(r5, r1)
+	require.Error(t, err)
+}
+
+func TestRoutePair(t *testing.T) {
+	config := Config{EnablePathTrace: true}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", config)
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", config)
+	r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", config)
+	r4 := newTestRouterWithConfig(t, "04:00:00:04:00:00", config)
+	routers := []*Router{r1, r2, r3, r4}
+	defer func() {
+		for _, r := range routers {
+			r.Stop()
+		}
+	}()
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r1, r4)
+	addTestGossipConnection(t, r2, r3)
+	addTestGossipConnection(t, r4, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2, r4), r2.tp(r1, r3), r3.tp(r2, r4), r4.tp(r1, r3))
+
+	routePair := func(from, to *Router) (RoutePair, error) {
+		for _, r := range routers {
+			r.Routes.ensureRecalculated()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return from.RoutePair(ctx, to.Ourself.Name)
+	}
+	names := func(rs ...*Router) []PeerName {
+		var path []PeerName
+		for _, r := range rs {
+			path = append(path, r.Ourself.Name)
+		}
+		return path
+	}
+
+	// Both ends prefer the way via r2
+	r1.SetConnectionCost(r4.Ourself.Name, 5)
+	r3.SetConnectionCost(r4.Ourself.Name, 5)
+	pair, err := routePair(r1, r3)
+	require.NoError(t, err)
+	require.Equal(t, r2.Ourself.Name, pair.NextHop)
+	require.Equal(t, names(r1, r2, r3), pair.Out)
+	require.Equal(t, names(r3, r2, r1), pair.Return)
+	require.False(t, pair.Asymmetric())
+
+	// Once r3 weighs its links the other way, the reply comes back via r4
+	r3.SetConnectionCost(r4.Ourself.Name, 0)
+	r3.SetConnectionCost(r2.Ourself.Name, 5)
+	pair, err = routePair(r1, r3)
+	require.NoError(t, err)
+	require.Equal(t, r2.Ourself.Name, pair.NextHop)
+	require.Equal(t, names(r1, r2, r3), pair.Out)
+	require.Equal(t, names(r3, r4, r1), pair.Return)
+	require.True(t, pair.Asymmetric())
+
+	pair, err = routePair(r1, r1)
+	require.NoError(t, err)
+	require.Equal(t, names(r1), pair.Out)
+	require.False(t, pair.Asymmetric())
+}
@@ -0,0 +1,112 @@
+package mesh
+
+import "sync"
+
+// regossipBudget limits the relays of what a channel receives to
+// Config.RegossipBudget per gossip interval. What is received beyond it
+// is merged, by source, and relayed in the next interval instead.
+type regossipBudget struct {
+	sync.Mutex
+	limit      int
+	spent      int
+	broadcasts map[PeerName]*sequencedGossipData // deferred, by source
+	gossip     map[PeerName]GossipData           // deferred, by source
+}
+
+func newRegossipBudget(limit int) *regossipBudget {
+	return &regossipBudget{
+		limit:      limit,
+		broadcasts: make(map[PeerName]*sequencedGossipData),
+		gossip:     make(map[PeerName]GossipData),
+	}
+}
+
+// spend takes one relay from the budget, if it is not exhausted. Must
+// hold b.Lock.
+func (b *regossipBudget) spend() bool {
+	if b.spent >= b.limit {
+		return false
+	}
+	b.spent++
+	return true
+}
+
+// admitBroadcast reports whether a broadcast from srcName may be relayed
+// now, and if not, defers it.
+func (c *gossipChannel) admitBroadcast(srcName PeerName, seq uint64, data GossipData) bool {
+	b := c.budget
+	if b == nil || c.essential {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.spend() {
+		return true
+	}
+	if held, found := b.broadcasts[srcName]; found {
+		data = mergeDeadlines(held.GossipData, data)
+		seq = laterSequence(held.seq, seq)
+	}
+	b.broadcasts[srcName] = &sequencedGossipData{data, seq}
+	return false
+}
+
+// admitGossip is admitBroadcast for gossip.
+func (c *gossipChannel) admitGossip(srcName PeerName, data GossipData) bool {
+	b := c.budget
+	if b == nil || c.essential {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.spend() {
+		return true
+	}
+	if held, found := b.gossip[srcName]; found {
+		data = mergeDeadlines(held, data)
+	}
+	b.gossip[srcName] = data
+	return false
+}
+
+// renewBudget starts a new interval, relaying what was deferred in the
+// last, as far as the budget allows.
+func (c *gossipChannel) renewBudget() {
+	b := c.budget
+	if b == nil {
+		return
+	}
+	b.Lock()
+	b.spent = 0
+	broadcasts := make(map[PeerName]*sequencedGossipData)
+	for srcName, data := range b.broadcasts {
+		if !b.spend() {
+			break
+		}
+		broadcasts[srcName] = data
+		delete(b.broadcasts, srcName)
+	}
+	gossip := make(map[PeerName]GossipData)
+	for srcName, data := range b.gossip {
+		if !b.spend() {
+			break
+		}
+		gossip[srcName] = data
+		delete(b.gossip, srcName)
+	}
+	b.Unlock()
+	for srcName, data := range broadcasts {
+		srcName, data := srcName, data
+		c.trace(GossipRelay, srcName, func() error {
+			c.relayBroadcast(srcName, data.seq, data.GossipData)
+			return nil
+		})
+	}
+	for srcName, data := range gossip {
+		srcName, data := srcName, data
+		c.trace(GossipRelay, srcName, func() error {
+			c.relay(srcName, data)
+			return nil
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package mesh
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegossipBudget(t *testing.T) {
+	tracer := &recordingTracer{}
+	r1 := newTestRouter(t, "01:00:00:01:00:00")
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{RegossipBudget: 3, GossipTracer: tracer})
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	defer func() {
+		for _, r := range routers {
+			r.Stop()
+		}
+	}()
+	for _, r := range []*Router{r1, r2} {
+		_, err := r.NewGossip("test", newTestGossiper())
+		require.NoError(t, err)
+	}
+	g3 := newTestGossiper()
+	_, err := r3.NewGossip("test", g3)
+	require.NoError(t, err)
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+	r2.Routes.ensureRecalculated()
+	relays := func() int {
+		n := 0
+		for _, span := range tracer.take() {
+			if strings.HasPrefix(span, "relay test") {
+				n++
+			}
+		}
+		return n
+	}
+	relays()
+
+	// A burst of broadcasts from r1 in one interval
+	for v := byte(1); v <= 10; v++ {
+		payload := gobEncodeSequenced(0, uint64(v), "test", r1.Ourself.Name, []byte{v})
+		require.NoError(t, r2.handleGossip(r1.Ourself.Name, ProtocolGossipBroadcast, payload))
+	}
+	require.Equal(t, 3, relays())
+	r2.sendPendingGossip()
+	g3.checkHas(t, 1, 2, 3)
+	require.False(t, g3.has(4))
+
+	// The rest goes, merged, in the next interval
+	r2.gossipChannel("test").renewBudget()
+	require.Equal(t, 1, relays())
+	r2.sendPendingGossip()
+	g3.checkHas(t, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+}
@@ -0,0 +1,287 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// relayChannel is the gossip channel on which a peer asks another to
+// meet it at a relay. See Config.RelayPeers.
+const relayChannel = "mesh-relay"
+
+// relayMagic starts a request to a relay to be paired with whoever makes
+// the same request, in place of the protocol header. It is as long as
+// the header's magic, so that a relay need read no more than that to
+// tell the two apart.
+var relayMagic = []byte("relay")
+
+var (
+	// relayAfterFailures is how many times in a row we fail to dial a
+	// target before trying to reach it through a relay instead.
+	relayAfterFailures = 3
+
+	// relayWait is how long a relay holds a request open for the other
+	// end to turn up.
+	relayWait = headerTimeout
+)
+
+// relayInvite asks a peer to meet us at a relay, with a token by which
+// the relay pairs the two ends.
+type relayInvite struct {
+	Relay string
+	Token uint64
+}
+
+// relayFor returns the peer at address, and the relay through which to
+// reach it, if we have failed to dial it often enough to use one.
+// Must be called from the connection maker's actor.
+func (cm *connectionMaker) relayFor(address string, target *target) (PeerName, string, bool) {
+	router := cm.ourself.router
+	if router == nil || len(router.RelayPeers) == 0 || target.failures < relayAfterFailures {
+		return UnknownPeerName, "", false
+	}
+	name := target.remote
+	if name == UnknownPeerName {
+		name = cm.peerAt(address)
+	}
+	if name == UnknownPeerName {
+		return UnknownPeerName, "", false
+	}
+	// Move on to the next relay each time one fails
+	relay := router.RelayPeers[(target.failures-relayAfterFailures)%len(router.RelayPeers)]
+	return name, relay, true
+}
+
+// peerAt returns the peer which others reach at address, as targeted by
+// addPeerTargets, or UnknownPeerName if there is none.
+func (cm *connectionMaker) peerAt(address string) PeerName {
+	found := UnknownPeerName
+	cm.peers.forEach(func(peer *Peer) {
+		for otherPeer, conn := range peer.connections {
+			remote := conn.remoteTCPAddress()
+			if !conn.isOutbound() {
+				ip, _, err := net.SplitHostPort(remote)
+				if err != nil {
+					continue
+				}
+				remote = net.JoinHostPort(ip, fmt.Sprint(cm.port))
+			}
+			if remote == address && otherPeer != cm.ourself.Name {
+				found = otherPeer
+			}
+		}
+	})
+	return found
+}
+
+func (cm *connectionMaker) attemptRelayedConnection(address string, name PeerName, relay string, acceptNewPeer bool) {
+	cm.logger.Printf("->[%s] attempting connection to %s via relay %s", address, name, relay)
+	if err := cm.ourself.createRelayedConnection(cm.localAddr, relay, address, name, acceptNewPeer, cm.logger); err != nil {
+		cm.logger.Printf("->[%s] error during relayed connection attempt: %v", address, err)
+		cm.connectionAborted(address, err)
+	}
+}
+
+// createRelayedConnection connects to the named peer, which we know at
+// peerAddr, through relay, by inviting it to meet us there.
+func (peer *localPeer) createRelayedConnection(localAddr, relay, peerAddr string, name PeerName, acceptNewPeer bool, logger Logger) error {
+	if err := peer.checkConnectionLimit(); err != nil {
+		return err
+	}
+	token := randUint64()
+	start := now()
+	tcpConn, err := dialRelay(peer, localAddr, relay, token)
+	if err != nil {
+		return err
+	}
+	if err := peer.router.relays.invite(name, relayInvite{Relay: relay, Token: token}); err != nil {
+		tcpConn.Close()
+		return err
+	}
+	connRemote := newRemoteConnection(peer.Peer, nil, peerAddr, true, false)
+	startLocalConnection(connRemote, tcpConn, nil, now().Sub(start), peer.router, acceptNewPeer, logger)
+	return nil
+}
+
+// dialRelay connects to relay and asks to be paired with whoever gives
+// the same token.
+func dialRelay(peer *localPeer, localAddr, relay string, token uint64) (net.Conn, error) {
+	tcpConn, err := peer.dial(localAddr, relay)
+	if err != nil {
+		return nil, err
+	}
+	req := make([]byte, len(relayMagic)+8)
+	copy(req, relayMagic)
+	binary.BigEndian.PutUint64(req[len(relayMagic):], token)
+	if _, err := tcpConn.Write(req); err != nil {
+		tcpConn.Close()
+		return nil, fmt.Errorf("relay %s: %v", relay, err)
+	}
+	return tcpConn, nil
+}
+
+// relayInviter is the Gossiper of the relayChannel, sending invitations
+// to meet at a relay and answering those it receives.
+type relayInviter struct {
+	router *Router
+	gossip Gossip
+}
+
+func (r *relayInviter) invite(peer PeerName, invite relayInvite) error {
+	if r == nil {
+		return fmt.Errorf("no relays")
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(invite); err != nil {
+		return err
+	}
+	return r.gossip.GossipUnicast(peer, buf.Bytes())
+}
+
+// OnGossipUnicast implements Gossiper, dialling the relay we are invited
+// to, if it is one of ours, so that it connects us to the sender.
+func (r *relayInviter) OnGossipUnicast(sender PeerName, msg []byte) error {
+	var invite relayInvite
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&invite); err != nil {
+		return err
+	}
+	if !r.isRelay(invite.Relay) {
+		return fmt.Errorf("invited by %s to %s, which is not one of our relays", sender, invite.Relay)
+	}
+	r.router.goroutines.spawn(func() { r.accept(sender, invite) })
+	return nil
+}
+
+func (r *relayInviter) isRelay(addr string) bool {
+	for _, relay := range r.router.RelayPeers {
+		if relay == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// accept meets sender at the relay, taking the connection as inbound,
+// since it was sender who made it.
+func (r *relayInviter) accept(sender PeerName, invite relayInvite) {
+	router := r.router
+	if err := router.Ourself.checkConnectionLimit(); err != nil {
+		router.logger.Printf("->[%s] not meeting %s: %v", invite.Relay, sender, err)
+		return
+	}
+	start := now()
+	tcpConn, err := dialRelay(router.Ourself, router.ConnectionMaker.localAddr, invite.Relay, invite.Token)
+	if err != nil {
+		router.logger.Printf("->[%s] error meeting %s: %v", invite.Relay, sender, err)
+		return
+	}
+	router.logger.Printf("->[%s] meeting %s", invite.Relay, sender)
+	connRemote := newRemoteConnection(router.Ourself.Peer, nil, tcpConn.RemoteAddr().String(), false, false)
+	startLocalConnection(connRemote, tcpConn, nil, now().Sub(start), router, !router.MembershipFrozen(), router.logger)
+}
+
+// OnGossipBroadcast implements Gossiper; invitations are not broadcast.
+func (r *relayInviter) OnGossipBroadcast(_ PeerName, update []byte) (GossipData, error) {
+	return nil, nil
+}
+
+// Gossip implements Gossiper; invitations are not gossiped.
+func (r *relayInviter) Gossip() GossipData {
+	return nil
+}
+
+// OnGossip implements Gossiper; invitations are not gossiped.
+func (r *relayInviter) OnGossip(update []byte) (GossipData, error) {
+	return nil, nil
+}
+
+// relayRendezvous pairs the connections made to us as a relay. See
+// Config.Relay.
+type relayRendezvous struct {
+	sync.Mutex
+	waiting map[uint64]net.Conn // by token
+}
+
+// acceptRelayable reads enough of an inbound connection to tell whether
+// it is a request to relay, and if not, starts it as a mesh connection,
+// which reads again what was read here.
+func (router *Router) acceptRelayable(tcpConn net.Conn, connRemote *remoteConnection) {
+	peeked := make([]byte, len(relayMagic))
+	if err := tcpConn.SetReadDeadline(time.Now().Add(headerTimeout)); err == nil {
+		n, _ := io.ReadFull(tcpConn, peeked)
+		// Errors are met again, and reported, by the protocol intro
+		peeked = peeked[:n]
+	}
+	if !bytes.Equal(peeked, relayMagic) {
+		startLocalConnection(connRemote, tcpConn, peeked, 0, router, !router.MembershipFrozen(), router.logger)
+		return
+	}
+	token := make([]byte, 8)
+	if _, err := io.ReadFull(tcpConn, token); err != nil {
+		router.logger.Printf("->[%s] error reading relay request: %v", connRemote.remoteTCPAddr, err)
+		tcpConn.Close()
+		return
+	}
+	router.rendezvous.pair(binary.BigEndian.Uint64(token), tcpConn, &router.goroutines)
+}
+
+// pair joins tcpConn to the connection waiting with the same token, or,
+// if there is none, leaves it to wait for one.
+func (rv *relayRendezvous) pair(token uint64, tcpConn net.Conn, goroutines *goroutineCount) {
+	rv.Lock()
+	defer rv.Unlock()
+	other, found := rv.waiting[token]
+	if !found {
+		if rv.waiting == nil {
+			rv.waiting = make(map[uint64]net.Conn)
+		}
+		rv.waiting[token] = tcpConn
+		time.AfterFunc(relayWait, func() { rv.expire(token, tcpConn) })
+		return
+	}
+	delete(rv.waiting, token)
+	for _, c := range []net.Conn{tcpConn, other} {
+		c.SetDeadline(time.Time{})
+	}
+	goroutines.spawn(func() { splice(tcpConn, other) })
+	goroutines.spawn(func() { splice(other, tcpConn) })
+}
+
+// expire closes tcpConn if it is still waiting to be paired.
+func (rv *relayRendezvous) expire(token uint64, tcpConn net.Conn) {
+	rv.Lock()
+	defer rv.Unlock()
+	if rv.waiting[token] == tcpConn {
+		delete(rv.waiting, token)
+		tcpConn.Close()
+	}
+}
+
+// splice copies from src to dst until either fails, then closes both.
+func splice(dst, src net.Conn) {
+	io.Copy(dst, src)
+	dst.Close()
+	src.Close()
+}
+
+// peekedConn is a connection which returns what was read from it by
+// acceptRelayable before reading any more.
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.peeked) == 0 {
+		return c.Conn.Read(b)
+	}
+	n := copy(b, c.peeked)
+	c.peeked = c.peeked[n:]
+	return n, nil
+}
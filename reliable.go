@@ -0,0 +1,179 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// maxReliablePending is how many unicasts to each peer a reliable
+// channel holds unacknowledged before refusing more.
+var maxReliablePending = 1024
+
+// Kinds of message on a reliable channel.
+const (
+	reliableMsg byte = iota
+	reliableAck
+)
+
+// NewReliableGossip is NewGossip for channels whose unicasts must not be
+// lost, such as control channels. Each unicast is held until its
+// destination acknowledges it, and if the connection it went out on is
+// lost first, it is sent again once there is a route to the destination,
+// such as when the connection re-forms. Unicasts from each peer are
+// delivered in the order they were sent, but may be delivered more than
+// once if we restart. Broadcasts and gossip are as on any other channel.
+// Every peer must create the channel this way, or it will receive
+// unicasts wrapped in the acknowledgement protocol.
+func (router *Router) NewReliableGossip(channelName string, g Gossiper) (Gossip, error) {
+	gossip, err := router.NewGossip(channelName, g)
+	if err != nil {
+		return nil, err
+	}
+	channel := gossip.(*gossipChannel)
+	channel.reliable = newReliableUnicasts()
+	router.Routes.OnChange(func() {
+		router.goroutines.spawn(func() { channel.reliable.resend(channel) })
+	})
+	return gossip, nil
+}
+
+// reliableUnicasts holds the state of a reliable channel: the unicasts
+// we have sent and which are not yet acknowledged, and the next we
+// expect from each peer.
+type reliableUnicasts struct {
+	sendLock sync.Mutex
+	seq      uint64
+	pending  map[PeerName][]*reliableUnicast // by destination, in order
+
+	receiveLock sync.Mutex
+	expected    map[PeerName]uint64 // by source
+}
+
+// reliableUnicast is a unicast awaiting acknowledgement.
+type reliableUnicast struct {
+	seq     uint64
+	version byte
+	msg     []byte
+	conn    Connection // sent over; nil if it could not be
+}
+
+func newReliableUnicasts() *reliableUnicasts {
+	return &reliableUnicasts{
+		// Start from the clock, so that peers which remember our last
+		// sequence see a restart as a jump forward
+		seq:      uint64(now().UnixNano()),
+		pending:  make(map[PeerName][]*reliableUnicast),
+		expected: make(map[PeerName]uint64),
+	}
+}
+
+// send sends msg to dest, holding it until it is acknowledged. It is
+// not an error if msg cannot be sent at once.
+func (r *reliableUnicasts) send(c *gossipChannel, dest PeerName, version byte, msg []byte) error {
+	r.sendLock.Lock()
+	defer r.sendLock.Unlock()
+	pending := r.pending[dest]
+	if len(pending) >= maxReliablePending {
+		return fmt.Errorf("%d unicasts to %s are unacknowledged", len(pending), dest)
+	}
+	r.seq++
+	u := &reliableUnicast{seq: r.seq, version: version, msg: msg}
+	r.pending[dest] = append(pending, u)
+	r.transmit(c, dest, u)
+	return nil
+}
+
+// resend sends again, in order, the unicasts to each peer from the first
+// whose connection has gone; any after it which did arrive are out of
+// order, so were dropped. Must not be called with sendLock held.
+func (r *reliableUnicasts) resend(c *gossipChannel) {
+	connections := c.ourself.getConnections()
+	r.sendLock.Lock()
+	defer r.sendLock.Unlock()
+	for dest, pending := range r.pending {
+		stale := false
+		for _, u := range pending {
+			if _, live := connections[u.conn]; stale || !live {
+				stale = true
+				r.transmit(c, dest, u)
+			}
+		}
+	}
+}
+
+// transmit sends u to dest, noting the connection it went out on. Must
+// be called with sendLock held.
+func (r *reliableUnicasts) transmit(c *gossipChannel, dest PeerName, u *reliableUnicast) {
+	// The oldest pending, so that dest knows where to start
+	base := r.pending[dest][0].seq
+	buf := appendUvarint(appendUvarint([]byte{reliableMsg}, u.seq), base)
+	conn, err := c.relayUnicastVia(dest, protocolMsg{ProtocolGossipUnicast, gobEncodeVersioned(u.version, c.name, c.ourself.Name, dest, append(buf, u.msg...))})
+	if err != nil {
+		c.logf("unicast to %s held for resending: %v", dest, err)
+		conn = nil
+	}
+	u.conn = conn
+}
+
+// acked drops the unicasts to dest up to and including seq.
+func (r *reliableUnicasts) acked(dest PeerName, seq uint64) {
+	r.sendLock.Lock()
+	defer r.sendLock.Unlock()
+	pending := r.pending[dest]
+	for len(pending) > 0 && pending[0].seq <= seq {
+		pending = pending[1:]
+	}
+	if len(pending) == 0 {
+		delete(r.pending, dest)
+	} else {
+		r.pending[dest] = pending
+	}
+}
+
+// receive handles a message on a reliable channel from src, passing the
+// payload of the next unicast we expect from it to deliver, and
+// acknowledging all delivered so far. Others are dropped, to be sent
+// again.
+func (r *reliableUnicasts) receive(c *gossipChannel, src PeerName, msg []byte, deliver func([]byte) error) error {
+	rd := bytes.NewReader(msg)
+	kind, err := rd.ReadByte()
+	if err != nil {
+		return fmt.Errorf("blank reliable unicast")
+	}
+	seq, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return err
+	}
+	if kind == reliableAck {
+		r.acked(src, seq)
+		return nil
+	}
+	base, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return err
+	}
+	payload := msg[len(msg)-rd.Len():]
+	r.receiveLock.Lock()
+	defer r.receiveLock.Unlock()
+	expected, found := r.expected[src]
+	if !found || base > expected {
+		// First contact, or src has given up on, or forgotten, what we
+		// missed
+		expected = base
+	}
+	if seq == expected {
+		if err := deliver(payload); err != nil {
+			return err
+		}
+		expected++
+	}
+	r.expected[src] = expected
+	if expected > base {
+		ack := appendUvarint([]byte{reliableAck}, expected-1)
+		// A lost ack is made good by the next, or by resending
+		_ = c.relayUnicast(src, protocolMsg{ProtocolGossipUnicast, gobEncode(c.name, c.ourself.Name, src, ack)})
+	}
+	return nil
+}
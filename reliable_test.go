@@ -0,0 +1,57 @@
+package mesh
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReliableUnicastSurvivesReconnect(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	defer r1.Stop()
+	defer r2.Stop()
+	s1, err := r1.NewReliableGossip("test", newTestGossiper())
+	require.NoError(t, err)
+	g2 := &unicastRecorder{*newTestGossiper(), make(chan []byte, 10)}
+	_, err = r2.NewReliableGossip("test", g2)
+	require.NoError(t, err)
+	await := func(msg string) {
+		select {
+		case got := <-g2.received:
+			require.Equal(t, msg, string(got))
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "not delivered", msg)
+		}
+	}
+
+	connectTCPTestRouters(r1, r2)
+	conn := awaitEstablished(t, r1, r2)
+	awaitEstablished(t, r2, r1)
+	require.NoError(t, s1.GossipUnicast(r2.Ourself.Name, []byte("a")))
+	await("a")
+
+	// r2 stops reading, so that what r1 sends next is lost when r2 drops
+	// the connection
+	require.NoError(t, r2.QuiesceConnection(r1.Ourself.Name))
+	require.NoError(t, s1.GossipUnicast(r2.Ourself.Name, []byte("b")))
+	r2.localConnectionTo(r1.Ourself.Name).shutdown(fmt.Errorf("test"))
+	require.NoError(t, s1.GossipUnicast(r2.Ourself.Name, []byte("c")))
+
+	// Once r1 reconnects, both arrive, in order, and once only
+	await("b")
+	await("c")
+	require.NotEqual(t, conn, r1.localConnectionTo(r2.Ourself.Name))
+	require.Eventually(t, func() bool {
+		s1.(*gossipChannel).reliable.sendLock.Lock()
+		defer s1.(*gossipChannel).reliable.sendLock.Unlock()
+		return len(s1.(*gossipChannel).reliable.pending) == 0
+	}, 5*time.Second, 10*time.Millisecond, "unicasts were not acknowledged")
+	select {
+	case got := <-g2.received:
+		require.FailNow(t, "delivered twice", string(got))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
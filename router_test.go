@@ -0,0 +1,957 @@
+package mesh
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// newTCPTestRouter starts a router listening on an ephemeral loopback port.
+func newTCPTestRouter(t *testing.T, name string, config Config) *Router {
+	return newTCPTestRouterWithLogger(t, name, config, log.New(ioutil.Discard, "", 0))
+}
+
+func newTCPTestRouterWithLogger(t *testing.T, name string, config Config, logger Logger) *Router {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	config.Host = "127.0.0.1"
+	config.Port = ln.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ln.Close())
+
+	peerName, err := PeerNameFromString(name)
+	require.NoError(t, err)
+	router, err := NewRouter(config, peerName, "nick", nil, logger)
+	require.NoError(t, err)
+	router.Start()
+	return router
+}
+
+func connectTCPTestRouters(from, to *Router) {
+	from.ConnectionMaker.InitiateConnections([]string{fmt.Sprintf("127.0.0.1:%d", to.Port)}, false)
+}
+
+// stopTestRouters stops routers, and waits until each has seen all its
+// connections terminate, so that none is still shutting down once the
+// test returns.
+func stopTestRouters(t *testing.T, routers ...*Router) {
+	for _, router := range routers {
+		router.Stop()
+	}
+	for _, router := range routers {
+		cm := router.ConnectionMaker
+		require.Eventually(t, func() bool {
+			countChan := make(chan int)
+			cm.actionChan <- func() bool {
+				countChan <- len(cm.connections)
+				return false
+			}
+			return <-countChan == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+}
+
+// awaitEstablished waits until from has an established connection to to.
+func awaitEstablished(t *testing.T, from, to *Router) *LocalConnection {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn := from.localConnectionTo(to.Ourself.Name); conn != nil && conn.isEstablished() {
+			return conn
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.FailNow(t, fmt.Sprintf("no connection established from %s to %s", from.Ourself, to.Ourself))
+	return nil
+}
+
+func TestPasswordFunc(t *testing.T) {
+	var calls int32
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{Password: []byte("sekr1t")})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{PasswordFunc: func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return []byte("sekr1t"), nil
+	}})
+	require.True(t, r2.usingPassword())
+
+	connectTCPTestRouters(r2, r1)
+	conn := awaitEstablished(t, r2, r1)
+	awaitEstablished(t, r1, r2)
+	require.NotNil(t, conn.sessionKey)
+	require.True(t, atomic.LoadInt32(&calls) > 0)
+
+	// An empty password must not mean an unencrypted connection
+	empty := &Router{Config: Config{PasswordFunc: func() ([]byte, error) { return nil, nil }}}
+	_, err := empty.password()
+	require.Error(t, err)
+}
+
+func TestPasswordFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mesh")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "password")
+	require.NoError(t, ioutil.WriteFile(path, []byte("sekr1t\n"), 0600))
+
+	password, err := PasswordFromFile(path)()
+	require.NoError(t, err)
+	require.Equal(t, []byte("sekr1t"), password)
+
+	_, err = PasswordFromFile(filepath.Join(dir, "missing"))()
+	require.Error(t, err)
+}
+
+func TestNonMeshConnection(t *testing.T) {
+	logger := &recordingLogger{}
+	r := newTCPTestRouterWithLogger(t, "01:00:00:01:00:00", Config{}, logger)
+	defer r.Stop()
+
+	const attempts = nonMeshLogBurst + 5
+	for i := 0; i < attempts; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", r.Port))
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: mesh\r\n\r\n"))
+		require.NoError(t, err)
+		// We are closed on well before the header timeout
+		start := time.Now()
+		require.NoError(t, conn.SetReadDeadline(start.Add(headerTimeout/2)))
+		_, err = ioutil.ReadAll(conn)
+		if netErr, ok := err.(net.Error); ok {
+			require.False(t, netErr.Timeout(), "not closed after %v", time.Since(start))
+		}
+		conn.Close()
+	}
+	require.Eventually(t, func() bool { return r.NonMeshConnections() == attempts }, 2*time.Second, 10*time.Millisecond)
+
+	// Each is logged as such, up to a limit, and not as a failed handshake
+	logger.Lock()
+	defer logger.Unlock()
+	logged := 0
+	for _, line := range logger.lines {
+		require.NotContains(t, line, "during handshake")
+		if strings.Contains(line, `non-mesh connection rejected: header "GET /"`) {
+			logged++
+		}
+	}
+	require.True(t, logged >= nonMeshLogBurst && logged < attempts, "logged %d of %d", logged, attempts)
+}
+
+func TestEncryptionMismatch(t *testing.T) {
+	flagged := make(chan error, 10)
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{
+		Password:             []byte("sekr1t"),
+		OnEncryptionMismatch: func(addr string, err error) { flagged <- err },
+	})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{
+		OnEncryptionMismatch: func(addr string, err error) { flagged <- err },
+	})
+	defer r1.Stop()
+	defer r2.Stop()
+
+	// The mismatch is flagged by whichever end spots it first, as the
+	// other may only see the connection reset, and neither connects
+	connectTCPTestRouters(r2, r1)
+	select {
+	case err := <-flagged:
+		require.Contains(t, []error{errExpectedCrypto, errExpectedNoCrypto}, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "encryption mismatch was not flagged")
+	}
+	require.True(t, r1.EncryptionMismatches()+r2.EncryptionMismatches() > 0)
+	require.Nil(t, r1.localConnectionTo(r2.Ourself.Name))
+	require.Nil(t, r2.localConnectionTo(r1.Ourself.Name))
+}
+
+func TestListenerMigration(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	require.Len(t, r1.Listeners(), 1)
+	original := r1.Listeners()[0]
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	r1.AddListener(ln)
+	require.Len(t, r1.Listeners(), 2)
+
+	r2.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+	conn := awaitEstablished(t, r2, r1)
+
+	require.NoError(t, r1.RemoveListener(original))
+	require.Error(t, r1.RemoveListener(original))
+	require.Equal(t, []net.Listener{ln}, r1.Listeners())
+	_, err = net.Dial("tcp", original.Addr().String())
+	require.Error(t, err)
+
+	// The connection made via the new listener is unaffected
+	time.Sleep(100 * time.Millisecond)
+	current, found := r2.Ourself.ConnectionTo(r1.Ourself.Name)
+	require.True(t, found)
+	require.Equal(t, Connection(conn), current)
+}
+
+func TestFreezeMembershipRejectsNewPeers(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	r1.FreezeMembership(true)
+
+	connectTCPTestRouters(r2, r1)
+	time.Sleep(500 * time.Millisecond)
+	_, found := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+	require.False(t, found)
+	require.Nil(t, r1.Peers.Fetch(r2.Ourself.Name))
+}
+
+func TestIndependentMeshes(t *testing.T) {
+	a1 := newTCPTestRouter(t, "01:00:00:0a:00:00", Config{Password: []byte("alpha"), ChannelSize: 4})
+	a2 := newTCPTestRouter(t, "02:00:00:0a:00:00", Config{Password: []byte("alpha"), ChannelSize: 4})
+	b1 := newTCPTestRouter(t, "01:00:00:0b:00:00", Config{Password: []byte("beta"), ChannelSize: 32})
+	b2 := newTCPTestRouter(t, "02:00:00:0b:00:00", Config{Password: []byte("beta"), ChannelSize: 32})
+	require.NotEqual(t, a1.Port, b1.Port)
+
+	connectTCPTestRouters(a2, a1)
+	connectTCPTestRouters(b2, b1)
+	awaitEstablished(t, a2, a1)
+	awaitEstablished(t, b2, b1)
+
+	for _, r := range []*Router{a1, a2} {
+		require.Equal(t, 4, cap(r.Ourself.actionChan))
+		require.Equal(t, 4, cap(r.ConnectionMaker.actionChan))
+		require.Nil(t, r.Peers.Fetch(b1.Ourself.Name))
+		require.Nil(t, r.Peers.Fetch(b2.Ourself.Name))
+	}
+	for _, r := range []*Router{b1, b2} {
+		require.Equal(t, 32, cap(r.Ourself.actionChan))
+		require.Equal(t, 32, cap(r.ConnectionMaker.actionChan))
+		require.Nil(t, r.Peers.Fetch(a1.Ourself.Name))
+		require.Nil(t, r.Peers.Fetch(a2.Ourself.Name))
+	}
+}
+
+type byteCounter struct {
+	sync.Mutex
+	bytes map[protocolTag]int
+	min   int
+}
+
+func (c *byteCounter) count(peer PeerName, tag protocolTag, n int) {
+	c.Lock()
+	defer c.Unlock()
+	c.bytes[tag] += n
+	if c.min == 0 || n < c.min {
+		c.min = n
+	}
+}
+
+func (c *byteCounter) get(tag protocolTag) (int, int) {
+	c.Lock()
+	defer c.Unlock()
+	return c.bytes[tag], c.min
+}
+
+func TestByteCallbacks(t *testing.T) {
+	sent := &byteCounter{bytes: make(map[protocolTag]int)}
+	received := &byteCounter{bytes: make(map[protocolTag]int)}
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{Password: []byte("sekr1t"), OnBytesSent: sent.count})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{Password: []byte("sekr1t"), OnBytesReceived: received.count})
+
+	connectTCPTestRouters(r1, r2)
+	awaitEstablished(t, r1, r2)
+	awaitEstablished(t, r2, r1)
+	r1.sendAllGossip()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if n, _ := received.get(ProtocolGossip); n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The smallest possible message is a tag byte with framing
+	frame := 1 + lengthPrefixSize + secretbox.Overhead
+	n, min := received.get(ProtocolGossip)
+	require.True(t, n > frame, "received %d gossip bytes", n)
+	require.True(t, min >= frame, "received a message of %d bytes", min)
+	n, min = sent.get(ProtocolGossip)
+	require.True(t, n >= frame, "sent %d gossip bytes", n)
+	require.True(t, min >= frame, "sent a message of %d bytes", min)
+}
+
+func TestLocalConnectionTo(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	defer r1.Stop()
+	defer r2.Stop()
+	require.Nil(t, r1.localConnectionTo(r2.Ourself.Name))
+
+	connectTCPTestRouters(r1, r2)
+	awaitEstablished(t, r1, r2)
+	awaitEstablished(t, r2, r1)
+
+	out := r1.localConnectionTo(r2.Ourself.Name)
+	require.True(t, out.isOutbound())
+	require.Equal(t, fmt.Sprintf("127.0.0.1:%d", r2.Port), out.remoteTCPAddress())
+
+	in := r2.localConnectionTo(r1.Ourself.Name)
+	require.False(t, in.isOutbound())
+	host, _, err := net.SplitHostPort(in.remoteTCPAddress())
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", host)
+}
+
+func TestOnPeerConnecting(t *testing.T) {
+	revoked, _ := PeerNameFromString("01:00:00:01:00:00")
+	var lock sync.Mutex
+	var seen []PeerName
+	r1 := newTCPTestRouter(t, revoked.String(), Config{})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{OnPeerConnecting: func(name PeerName, addr string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		seen = append(seen, name)
+		if name == revoked {
+			return fmt.Errorf("revoked")
+		}
+		return nil
+	}})
+	r3 := newTCPTestRouter(t, "03:00:00:03:00:00", Config{})
+	defer r1.Stop()
+	defer r2.Stop()
+	defer r3.Stop()
+
+	connectTCPTestRouters(r3, r2)
+	awaitEstablished(t, r2, r3)
+
+	connectTCPTestRouters(r1, r2)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		n := len(seen)
+		lock.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	require.Contains(t, seen, revoked)
+	lock.Unlock()
+	require.Nil(t, r2.localConnectionTo(r1.Ourself.Name))
+}
+
+func TestQuiesceConnection(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	defer r1.Stop()
+	defer r2.Stop()
+	g1, g2 := newTestGossiper(), newTestGossiper()
+	s1, err := r1.NewGossip("test", g1)
+	require.NoError(t, err)
+	s2, err := r2.NewGossip("test", g2)
+	require.NoError(t, err)
+
+	require.Error(t, r1.QuiesceConnection(r2.Ourself.Name))
+	connectTCPTestRouters(r1, r2)
+	awaitEstablished(t, r1, r2)
+	awaitEstablished(t, r2, r1)
+
+	require.NoError(t, r1.QuiesceConnection(r2.Ourself.Name))
+	conn := r1.localConnectionTo(r2.Ourself.Name)
+	require.NotNil(t, conn, "quiesced connection was closed")
+	require.False(t, conn.isEstablished())
+	broadcast(s1, 1)
+	broadcast(s2, 2)
+	time.Sleep(500 * time.Millisecond)
+	require.False(t, g2.has(1), "gossip sent over quiesced connection")
+	require.False(t, g1.has(2), "gossip received over quiesced connection")
+
+	// What r2 sent meanwhile is received once resumed, and r1 routes
+	// over the connection again
+	require.NoError(t, r1.ResumeConnection(r2.Ourself.Name))
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, found := r1.Routes.UnicastAll(r2.Ourself.Name); found {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	broadcast(s1, 3)
+	for !(g1.has(2) && g2.has(3)) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	g1.checkHas(t, 2)
+	g2.checkHas(t, 3)
+	require.Equal(t, conn, r1.localConnectionTo(r2.Ourself.Name))
+}
+
+func TestSequentialBootstrap(t *testing.T) {
+	var (
+		lock   sync.Mutex
+		dialed []string
+		seeds  []string
+	)
+	for i := 0; i < 3; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+		seed := ln.Addr().String()
+		seeds = append(seeds, seed)
+		go func() {
+			for first := true; ; first = false {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				if first {
+					lock.Lock()
+					dialed = append(dialed, seed)
+					lock.Unlock()
+				}
+				conn.Close() // fail the handshake
+			}
+		}()
+	}
+
+	r := newTCPTestRouter(t, "01:00:00:01:00:00", Config{SequentialBootstrap: true})
+	defer r.Stop()
+	r.ConnectionMaker.InitiateConnections([]string{seeds[2], seeds[0], seeds[1]}, false)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		lock.Lock()
+		sofar := append([]string{}, dialed...)
+		lock.Unlock()
+		if len(sofar) == len(seeds) {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "only %d seeds dialed: %v %v", len(sofar), sofar, seeds)
+		time.Sleep(10 * time.Millisecond)
+	}
+	sort.Strings(seeds)
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, seeds, dialed)
+}
+
+func TestPeerDiscovery(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{PeerDiscovery: true})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	r3 := newTCPTestRouter(t, "03:00:00:03:00:00", Config{})
+	defer r1.Stop()
+	defer r2.Stop()
+	defer r3.Stop()
+
+	// r1 is only told of r2; it learns of r3 from r2's topology
+	connectTCPTestRouters(r1, r2)
+	connectTCPTestRouters(r2, r3)
+	awaitEstablished(t, r1, r2)
+	awaitEstablished(t, r2, r3)
+	conn := awaitEstablished(t, r1, r3)
+	require.True(t, conn.isOutbound(), "r1 did not dial r3")
+}
+
+func TestConnectionsByTag(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	r3 := newTCPTestRouter(t, "03:00:00:03:00:00", Config{})
+	defer r1.Stop()
+	defer r2.Stop()
+	defer r3.Stop()
+
+	addr2 := fmt.Sprintf("127.0.0.1:%d", r2.Port)
+	require.Empty(t, r1.ConnectionMaker.TagConnections([]string{addr2}, "zone-a", "db"))
+	connectTCPTestRouters(r1, r2)
+	connectTCPTestRouters(r1, r3)
+	awaitEstablished(t, r1, r2)
+	awaitEstablished(t, r1, r3)
+
+	addresses := func(statuses []LocalConnectionStatus) []string {
+		var addrs []string
+		for _, status := range statuses {
+			addrs = append(addrs, status.Address)
+		}
+		return addrs
+	}
+	require.Equal(t, []string{addr2}, addresses(r1.ConnectionsByTag("db")))
+	require.Len(t, r1.ConnectionsByTag(TagConfigured), 2)
+	require.Empty(t, r1.ConnectionsByTag("zone-b"))
+	require.Len(t, r2.ConnectionsByTag(TagInbound), 1)
+}
+
+func TestHeartbeatMissThreshold(t *testing.T) {
+	const heartbeat = 100 * time.Millisecond
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{HeartbeatInterval: heartbeat, HeartbeatMissThreshold: 3})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{HeartbeatInterval: heartbeat})
+	defer r1.Stop()
+	defer r2.Stop()
+	connectTCPTestRouters(r1, r2)
+	awaitEstablished(t, r1, r2)
+	conn := awaitEstablished(t, r2, r1)
+
+	// r2 misses two heartbeats; r1 tolerates that
+	conn.heartbeatTCP.Stop()
+	time.Sleep(heartbeat * 5 / 2)
+	conn.heartbeatTCP.Reset(heartbeat)
+	time.Sleep(heartbeat * 2)
+	require.Equal(t, conn, r2.localConnectionTo(r1.Ourself.Name), "connection did not survive")
+
+	// r2 stops sending heartbeats altogether, so r1 closes the connection
+	conn.heartbeatTCP.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for r1.localConnectionTo(r2.Ourself.Name) != nil {
+		require.True(t, time.Now().Before(deadline), "connection was not closed")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestExportImportTargets(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{PeerDiscovery: true})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	r3 := newTCPTestRouter(t, "03:00:00:03:00:00", Config{})
+	defer r2.Stop()
+	defer r3.Stop()
+
+	// r1 is told of r2, and discovers r3
+	addr2 := fmt.Sprintf("127.0.0.1:%d", r2.Port)
+	addr3 := fmt.Sprintf("127.0.0.1:%d", r3.Port)
+	r1.ConnectionMaker.TagConnections([]string{addr2}, "db")
+	connectTCPTestRouters(r1, r2)
+	connectTCPTestRouters(r2, r3)
+	awaitEstablished(t, r1, r3)
+	targets := r1.ConnectionMaker.ExportTargets()
+	expected := []ConnectionTarget{{addr2, true, []string{"db"}}, {addr3, false, nil}}
+	if addr3 < addr2 {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+	require.Equal(t, expected, targets)
+	require.NoError(t, r1.Stop())
+
+	// A fresh router, without discovery, redials both
+	r4 := newTCPTestRouter(t, "04:00:00:04:00:00", Config{})
+	defer r4.Stop()
+	require.Empty(t, r4.ConnectionMaker.ImportTargets(targets))
+	awaitEstablished(t, r4, r2)
+	conn := awaitEstablished(t, r4, r3)
+	require.True(t, conn.isOutbound())
+	require.Len(t, r4.ConnectionsByTag("db"), 1)
+}
+
+func TestManualConnections(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{PeerDiscovery: true, ManualConnections: true})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	r3 := newTCPTestRouter(t, "03:00:00:03:00:00", Config{})
+	defer r1.Stop()
+	defer r2.Stop()
+	defer r3.Stop()
+
+	connectTCPTestRouters(r1, r2)
+	connectTCPTestRouters(r2, r3)
+	awaitEstablished(t, r1, r2)
+	awaitEstablished(t, r2, r3)
+	deadline := time.Now().Add(5 * time.Second)
+	for r1.Peers.Fetch(r3.Ourself.Name) == nil {
+		require.True(t, time.Now().Before(deadline), "r1 did not learn of r3")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Long enough for discovery to have dialled r3, as in TestPeerDiscovery
+	time.Sleep(2 * initialInterval)
+	require.Nil(t, r1.localConnectionTo(r3.Ourself.Name))
+}
+
+func TestRouterRestart(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	defer r1.Stop()
+	defer r2.Stop()
+	g1, g2 := newTestGossiper(), newTestGossiper()
+	s1, err := r1.NewGossip("test", g1)
+	require.NoError(t, err)
+	_, err = r2.NewGossip("test", g2)
+	require.NoError(t, err)
+	await := func(g *testGossiper, v byte) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !g.has(v) {
+			require.True(t, time.Now().Before(deadline), "%d was not delivered", v)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	connectTCPTestRouters(r1, r2)
+	awaitEstablished(t, r1, r2)
+	broadcast(s1, 1)
+	await(g2, 1)
+
+	require.NoError(t, r1.Stop())
+	require.NoError(t, r1.Stop()) // idempotent
+	require.Equal(t, HealthStarting, r1.HealthCheck())
+	require.Empty(t, r1.Listeners())
+	deadline := time.Now().Add(5 * time.Second)
+	for r2.localConnectionTo(r1.Ourself.Name) != nil {
+		require.True(t, time.Now().Before(deadline), "connection outlived Stop")
+		time.Sleep(10 * time.Millisecond)
+	}
+	// r2's state moves on while r1 is stopped
+	_, err = g2.OnGossip([]byte{2})
+	require.NoError(t, err)
+
+	r1.Start()
+	r1.Start() // idempotent
+	require.Len(t, r1.Listeners(), 1)
+	awaitEstablished(t, r1, r2)
+	await(g1, 2)
+	broadcast(s1, 3)
+	await(g2, 3)
+	require.Eventually(t, func() bool { return r1.HealthCheck() == HealthHealthy }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConnectionCountByState(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	defer r1.Stop()
+	defer r2.Stop()
+
+	// A slow route to r2, which holds each connection for a while before
+	// passing it on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				time.Sleep(500 * time.Millisecond)
+				target, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", r2.Port))
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	r1.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+	require.Eventually(t, func() bool { return r1.ConnectionCountByState()["connecting"] == 1 }, time.Second, 10*time.Millisecond)
+	require.Zero(t, r1.ConnectionCountByState()["established"])
+	awaitEstablished(t, r1, r2)
+	require.Eventually(t, func() bool {
+		counts := r1.ConnectionCountByState()
+		return counts["established"] == 1 && counts["connecting"] == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, map[string]int{"established": 1}, NewStatus(r1).ConnectionCounts)
+}
+
+// delayedCopy copies from src to dst, holding back each chunk for delay,
+// as a long link would.
+func delayedCopy(dst io.Writer, src io.Reader, delay time.Duration) {
+	type chunk struct {
+		due  time.Time
+		data []byte
+	}
+	chunks := make(chan chunk, 1024)
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, 4096)
+			n, err := src.Read(buf)
+			if n > 0 {
+				chunks <- chunk{time.Now().Add(delay), buf[:n]}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for c := range chunks {
+		time.Sleep(time.Until(c.due))
+		if _, err := dst.Write(c.data); err != nil {
+			return
+		}
+	}
+}
+
+func TestConnectionRTT(t *testing.T) {
+	const heartbeat = 100 * time.Millisecond
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{HeartbeatInterval: heartbeat})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{HeartbeatInterval: heartbeat})
+	defer r1.Stop()
+	defer r2.Stop()
+
+	// A route to r2 which delays traffic by 40ms each way
+	const delay = 40 * time.Millisecond
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				target, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", r2.Port))
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go delayedCopy(target, conn, delay)
+				delayedCopy(conn, target, delay)
+			}()
+		}
+	}()
+
+	r1.ConnectionMaker.InitiateConnections([]string{ln.Addr().String()}, false)
+	conn := awaitEstablished(t, r1, r2)
+	time.Sleep(10 * heartbeat)
+	rtt := conn.RTT()
+	require.InDelta(t, float64(2*delay), float64(rtt), float64(delay), "rtt %v", rtt)
+	statuses := r1.ConnectionsByTag(TagConfigured)
+	require.Len(t, statuses, 1)
+	require.NotZero(t, statuses[0].RTT)
+}
+
+func TestListenerFailure(t *testing.T) {
+	failures := make(chan net.Addr, 1)
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{
+		OnListenerError: func(addr net.Addr, err error) { failures <- addr },
+		RebindListeners: true,
+	})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	defer r1.Stop()
+	defer r2.Stop()
+
+	// The listener is closed out from under r1
+	listeners := r1.Listeners()
+	require.Len(t, listeners, 1)
+	addr := listeners[0].Addr()
+	require.NoError(t, listeners[0].Close())
+	select {
+	case failed := <-failures:
+		require.Equal(t, addr.String(), failed.String())
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "OnListenerError was not called")
+	}
+
+	// r1 listens again on the same address, so r2 can connect to it
+	require.Eventually(t, func() bool {
+		listeners := r1.Listeners()
+		return len(listeners) == 1 && listeners[0].Addr().String() == addr.String()
+	}, 5*time.Second, 10*time.Millisecond)
+	connectTCPTestRouters(r2, r1)
+	awaitEstablished(t, r2, r1)
+}
+
+func TestRelayedConnection(t *testing.T) {
+	defer func(n int) { relayAfterFailures = n }(relayAfterFailures)
+	relayAfterFailures = 1
+	relay := newTCPTestRouter(t, "03:00:00:03:00:00", Config{Relay: true})
+	relayAddr := fmt.Sprintf("127.0.0.1:%d", relay.Port)
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{RelayPeers: []string{relayAddr}})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{RelayPeers: []string{relayAddr}})
+	defer relay.Stop()
+	defer r1.Stop()
+	defer r2.Stop()
+	connectTCPTestRouters(r2, relay)
+	r1.ConnectionMaker.InitiateConnections([]string{relayAddr, fmt.Sprintf("127.0.0.1:%d", r2.Port)}, false)
+	awaitEstablished(t, r1, relay)
+	awaitEstablished(t, r2, relay)
+	direct := awaitEstablished(t, r1, r2)
+
+	// r2 can no longer be dialled, as if it were behind NAT
+	for _, ln := range r2.Listeners() {
+		require.NoError(t, r2.RemoveListener(ln))
+	}
+	direct.shutdown(fmt.Errorf("test"))
+
+	// so r1 meets it at the relay instead
+	require.Eventually(t, func() bool {
+		conn := r1.localConnectionTo(r2.Ourself.Name)
+		return conn != nil && conn != direct && conn.isEstablished()
+	}, 10*time.Second, 10*time.Millisecond)
+	relayed := r1.localConnectionTo(r2.Ourself.Name)
+	require.Equal(t, relayAddr, relayed.tcpConn.RemoteAddr().String())
+	require.Equal(t, fmt.Sprintf("127.0.0.1:%d", r2.Port), relayed.remoteTCPAddress())
+	require.True(t, relayed.isOutbound())
+}
+
+func TestRouterGoroutines(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{})
+	defer r1.Stop()
+	s, err := r1.NewGossip("Test", newTestGossiper())
+	require.NoError(t, err)
+	baseline := r1.Goroutines()
+	require.True(t, baseline > 0)
+
+	// Each connection adds its actor, its receiver, and a sender per
+	// channel gossiped on
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	connectTCPTestRouters(r2, r1)
+	awaitEstablished(t, r1, r2)
+	broadcast(s, 1)
+	require.Eventually(t, func() bool { return r1.Goroutines() >= baseline+3 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, r1.Goroutines(), NewStatus(r1).Goroutines)
+
+	// and they all go with it
+	r2.Stop()
+	require.Eventually(t, func() bool { return r1.Goroutines() == baseline }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestResetBackoff(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	defer r1.Stop()
+	defer r2.Stop()
+	connectTCPTestRouters(r1, r2)
+	direct := awaitEstablished(t, r1, r2)
+	require.Error(t, r1.ResetBackoff(r2.Ourself.Name))
+
+	// r2 goes away for a while, and r1 backs off from it for an hour
+	listeners := r2.Listeners()
+	require.Len(t, listeners, 1)
+	addr := listeners[0].Addr().String()
+	require.NoError(t, r2.RemoveListener(listeners[0]))
+	direct.shutdown(fmt.Errorf("test"))
+	require.Eventually(t, func() bool {
+		_, found := r1.ConnectionBackoffs()[addr]
+		return found && r2.localConnectionTo(r1.Ourself.Name) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	later := time.Now().Add(time.Hour)
+	done := make(chan struct{})
+	r1.ConnectionMaker.actionChan <- func() bool {
+		r1.ConnectionMaker.targets[addr].tryAfter = later
+		close(done)
+		return false
+	}
+	<-done
+	require.Equal(t, later, r1.ConnectionBackoffs()[addr])
+
+	// When r2 is back, resetting the backoff has r1 dial it at once
+	ln, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	r2.AddListener(ln)
+	require.NoError(t, r1.ResetBackoff(r2.Ourself.Name))
+	require.Eventually(t, func() bool {
+		conn := r1.localConnectionTo(r2.Ourself.Name)
+		return conn != nil && conn != direct && conn.isEstablished()
+	}, initialInterval/2, 10*time.Millisecond)
+}
+
+func TestConnectionRetriesFollowClock(t *testing.T) {
+	clock := newTestClock()
+	r := newTCPTestRouter(t, "01:00:00:01:00:00", Config{Clock: clock.now})
+	defer r.Stop()
+	cm := r.ConnectionMaker
+	// Nobody listens at addr, so each attempt fails at once
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	// inActor runs f in the connection maker's actor, where targets may
+	// be touched.
+	inActor := func(f func(*target)) {
+		done := make(chan struct{})
+		cm.actionChan <- func() bool {
+			f(cm.targets[addr])
+			close(done)
+			return false
+		}
+		<-done
+	}
+	awaitFailure := func(attempts int) (tryAfter time.Time) {
+		require.Eventually(t, func() bool {
+			var failed bool
+			inActor(func(target *target) {
+				failed = target != nil && target.attempts == attempts && target.state == targetWaiting
+				tryAfter = target.tryAfter
+			})
+			return failed
+		}, 5*time.Second, 10*time.Millisecond)
+		return tryAfter
+	}
+
+	// attemptNow has the connection maker attempt whatever is due, and
+	// returns how many attempts it has made at addr.
+	attemptNow := func() (attempts int) {
+		inActor(func(target *target) {
+			cm.checkStateAndAttemptConnections()
+			attempts = target.attempts
+		})
+		return attempts
+	}
+
+	require.Empty(t, cm.InitiateConnections([]string{addr}, false))
+	tryAfter := awaitFailure(1)
+	for interval, attempts := initialInterval, 1; attempts < 5; attempts++ {
+		// the retry is due between half and one and a half intervals on
+		delay := tryAfter.Sub(clock.now())
+		require.True(t, delay >= interval/2 && delay < interval*3/2, "attempt %d after %v", attempts+1, delay)
+
+		clock.set(tryAfter.Add(-time.Millisecond))
+		require.Equal(t, attempts, attemptNow())
+
+		clock.set(tryAfter)
+		require.Equal(t, attempts+1, attemptNow())
+
+		tryAfter = awaitFailure(attempts + 1)
+		interval = interval * 3 / 2
+	}
+}
+
+func TestHandshakeTimings(t *testing.T) {
+	// r2 is slow to accept r1, which shows in the sync phase
+	const delay = 300 * time.Millisecond
+	var lock sync.Mutex
+	phases := make(map[HandshakePhase]time.Duration)
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{
+		OnPeerConnecting: func(PeerName, string) error {
+			time.Sleep(delay)
+			return nil
+		},
+		OnHandshakePhase: func(_ string, phase HandshakePhase, d time.Duration) {
+			lock.Lock()
+			defer lock.Unlock()
+			phases[phase] = d
+		},
+	})
+	defer r1.Stop()
+	defer r2.Stop()
+
+	connectTCPTestRouters(r1, r2)
+	outbound := awaitEstablished(t, r1, r2).Handshake()
+	inbound := awaitEstablished(t, r2, r1).Handshake()
+	require.True(t, outbound.Connect > 0)
+	require.Zero(t, inbound.Connect, "inbound connections are not dialled")
+	require.True(t, inbound.Sync >= delay, "sync took %v", inbound.Sync)
+	require.True(t, inbound.Version < delay, "version exchange took %v", inbound.Version)
+	require.True(t, inbound.Crypto < delay, "crypto took %v", inbound.Crypto)
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, map[HandshakePhase]time.Duration{
+		HandshakeVersion: inbound.Version,
+		HandshakeCrypto:  inbound.Crypto,
+		HandshakeSync:    inbound.Sync,
+	}, phases)
+	status := NewStatus(r2)
+	require.Len(t, status.Connections, 1)
+	require.Equal(t, inbound, status.Connections[0].Handshake)
+}
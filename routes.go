@@ -22,6 +22,9 @@ type routes struct {
 	broadcastAll  broadcastRoutes // [1]
 	recalcTimer   *time.Timer
 	pendingRecalc bool
+	minInterval   time.Duration // see Config.MinRouteRecalcInterval
+	lastCalc      time.Time
+	calculations  uint64
 	wait          chan chan struct{}
 	action        chan<- func()
 	// [1] based on *all* connections, not just established &
@@ -50,7 +53,10 @@ func newRoutes(ourself *localPeer, peers *Peers) *routes {
 		action:       action,
 	}
 	r.recalcTimer.Stop()
-	go r.run(wait, action)
+	if ourself.router != nil {
+		r.minInterval = ourself.router.MinRouteRecalcInterval
+	}
+	ourself.router.goroutineCount().spawn(func() { r.run(wait, action) })
 	return r
 }
 
@@ -76,6 +82,14 @@ func (r *routes) Unicast(name PeerName) (PeerName, bool) {
 	return hop, found
 }
 
+// reachableCount returns the number of peers, including ourself, to
+// which we have a unicast route over established and symmetric connections.
+func (r *routes) reachableCount() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.unicast)
+}
+
 // UnicastAll returns the next hop on the unicast route to the named peer,
 // based on all connections.
 func (r *routes) UnicastAll(name PeerName) (PeerName, bool) {
@@ -177,7 +191,11 @@ func (r *routes) randomNeighbours(except PeerName) []PeerName {
 func (r *routes) recalculate() {
 	r.Lock()
 	if !r.pendingRecalc {
-		r.recalcTimer.Reset(recalcDeferTime)
+		delay := recalcDeferTime
+		if wait := time.Until(r.lastCalc.Add(r.minInterval)); wait > delay {
+			delay = wait
+		}
+		r.recalcTimer.Reset(delay)
 		r.pendingRecalc = true
 	}
 	r.Unlock()
@@ -190,7 +208,12 @@ func (r *routes) clearPendingRecalcFlag() {
 }
 
 // EnsureRecalculated waits for any preceding Recalculate requests to finish.
+// When recalculation is throttled, it does not wait, and the current
+// routes are used until the throttled recalculation.
 func (r *routes) ensureRecalculated() {
+	if r.minInterval > 0 {
+		return
+	}
 	var done chan struct{}
 	// If another call is already waiting, wait on the same chan, otherwise make a new one
 	select {
@@ -245,6 +268,8 @@ func (r *routes) calculate() {
 	r.unicastAll = unicastAll
 	r.broadcast = broadcast
 	r.broadcastAll = broadcastAll
+	r.lastCalc = time.Now()
+	r.calculations++
 	onChange := r.onChange
 	r.Unlock()
 
@@ -267,8 +292,110 @@ func (r *routes) calculateUnicast(establishedAndSymmetric bool) unicastRoutes {
 	singleHopTopology := false
 	if r.ourself.router != nil {
 		singleHopTopology = r.ourself.router.Config.SingleHopTopolgy
+		if computer := r.ourself.router.Config.RouteComputer; computer != nil {
+			return r.computeUnicast(computer, establishedAndSymmetric)
+		}
+	}
+	if !singleHopTopology && r.weighted() {
+		return r.ourself.weightedRoutes(establishedAndSymmetric, r.ourself.router.connectionCost, r.radius())
+	}
+	_, unicast := r.ourself.routes(nil, establishedAndSymmetric, singleHopTopology, true, r.radius())
+	return unicast
+}
+
+// radius returns Config.RoutingRadius, or zero, for no limit, without a
+// router.
+func (r *routes) radius() int {
+	if r.ourself.router == nil {
+		return 0
+	}
+	return r.ourself.router.RoutingRadius
+}
+
+// weighted reports whether any hops have other than unit cost, so routes
+// must be calculated with Peer.weightedRoutes. Must hold a read lock on
+// r.peers.
+func (r *routes) weighted() bool {
+	if r.ourself.router == nil {
+		return false
+	}
+	if r.ourself.router.hasConnectionCosts() {
+		return true
+	}
+	for _, peer := range r.peers.byName {
+		if peer.RouteCost > 1 {
+			return true
+		}
+		for _, conn := range peer.connections {
+			if conn.routeCost() != 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RouteComputer computes unicast routes, in place of the built-in
+// shortest path algorithm. See Config.RouteComputer.
+type RouteComputer interface {
+	// ComputeRoutes returns, for each peer that should be reachable,
+	// the neighbour of graph.Ourself via which to send to it. Hops which
+	// are not neighbours of graph.Ourself are ignored.
+	ComputeRoutes(graph RouteGraph) map[PeerName]PeerName
+}
+
+// RouteGraph is a snapshot of the topology given to a RouteComputer.
+type RouteGraph struct {
+	// Ourself is the peer for which routes are computed.
+	Ourself PeerName
+	// Neighbours lists the peers to which each known peer is connected.
+	// When computing routes based on established and symmetric
+	// connections, only those are included.
+	Neighbours map[PeerName][]PeerName
+	// Costs has the RouteCost advertised by each peer which has one.
+	// See Config.RouteCost.
+	Costs map[PeerName]uint32
+	// ConnectionCosts has, for each peer, the cost of each of its
+	// connections which has other than the default of 1, by the name of
+	// the peer at the other end. See Router.SetConnectionCost.
+	ConnectionCosts map[PeerName]map[PeerName]float64
+}
+
+// computeUnicast calculates unicast routes with a RouteComputer. Must
+// hold read locks on r.peers and r.ourself.
+func (r *routes) computeUnicast(computer RouteComputer, establishedAndSymmetric bool) unicastRoutes {
+	graph := RouteGraph{Ourself: r.ourself.Name, Neighbours: make(map[PeerName][]PeerName), Costs: make(map[PeerName]uint32),
+		ConnectionCosts: make(map[PeerName]map[PeerName]float64)}
+	for name, peer := range r.peers.byName {
+		if peer.RouteCost > 1 {
+			graph.Costs[name] = peer.RouteCost
+		}
+		neighbours := []PeerName{}
+		peer.forEachConnectedPeer(establishedAndSymmetric, nil, func(remotePeer *Peer) {
+			neighbours = append(neighbours, remotePeer.Name)
+			cost := peer.connections[remotePeer.Name].routeCost()
+			if peer == r.ourself.Peer {
+				cost = r.ourself.router.connectionCost(remotePeer)
+			}
+			if cost != 1 {
+				if graph.ConnectionCosts[name] == nil {
+					graph.ConnectionCosts[name] = make(map[PeerName]float64)
+				}
+				graph.ConnectionCosts[name][remotePeer.Name] = cost
+			}
+		})
+		graph.Neighbours[name] = neighbours
+	}
+	neighbours := make(peerNameSet)
+	for _, name := range graph.Neighbours[r.ourself.Name] {
+		neighbours[name] = struct{}{}
+	}
+	unicast := unicastRoutes{r.ourself.Name: UnknownPeerName}
+	for dest, hop := range computer.ComputeRoutes(graph) {
+		if _, found := neighbours[hop]; found && dest != r.ourself.Name {
+			unicast[dest] = hop
+		}
 	}
-	_, unicast := r.ourself.routes(nil, establishedAndSymmetric, singleHopTopology)
 	return unicast
 }
 
@@ -300,14 +427,25 @@ func (r *routes) calculateBroadcast(name PeerName, establishedAndSymmetric bool)
 	if !found {
 		return hops
 	}
+	if r.ourself.NoTransit && name != r.ourself.Name {
+		// We never relay others' broadcasts
+		return hops
+	}
 	//if found, reached := peer.routes(r.ourself.Peer, establishedAndSymmetric); found {
 	singleHopTopology := false
 	if r.ourself.router != nil {
 		singleHopTopology = r.ourself.router.Config.SingleHopTopolgy
 	}
-	if found, reached := peer.routes(r.ourself.Peer, establishedAndSymmetric, singleHopTopology); found {
+	if found, reached := peer.routes(r.ourself.Peer, establishedAndSymmetric, singleHopTopology, true, r.radius()); found {
 		r.ourself.forEachConnectedPeer(establishedAndSymmetric, reached,
-			func(remotePeer *Peer) { hops = append(hops, remotePeer.Name) })
+			func(remotePeer *Peer) {
+				if isQuiesced(r.ourself.connections[remotePeer.Name]) {
+					return
+				}
+				if !r.ourself.crossesZone(remotePeer) || r.ourself.mayBridgeTo(remotePeer) {
+					hops = append(hops, remotePeer.Name)
+				}
+			})
 	}
 	return hops
 }
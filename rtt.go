@@ -0,0 +1,53 @@
+package mesh
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// pingFeature announces that we answer ProtocolPing.
+const pingFeature = "Ping"
+
+// rttSmoothing is the weight given to each new round-trip sample, as a
+// shift: the smoothed time moves 1/8 of the way towards it, as in TCP.
+const rttSmoothing = 3
+
+// RTT returns the smoothed round-trip time of the connection, measured by
+// pinging the remote peer with each heartbeat, or zero if it is not yet
+// known or the remote peer does not answer pings.
+func (conn *LocalConnection) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&conn.rtt))
+}
+
+// sendPing sends a ProtocolPing carrying the time, if the remote answers
+// them.
+func (conn *LocalConnection) sendPing() error {
+	if !conn.pings {
+		return nil
+	}
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+	return conn.sendProtocolMsg(protocolMsg{ProtocolPing, payload})
+}
+
+// handlePong folds the round-trip time of the ProtocolPing echoed in
+// payload into the smoothed time. Only actorLoop sends pings and only
+// receiveTCP handles pongs, so there is a single writer.
+func (conn *LocalConnection) handlePong(payload []byte) {
+	if len(payload) != 8 {
+		conn.logf("ignoring malformed pong")
+		return
+	}
+	sample := time.Now().UnixNano() - int64(binary.BigEndian.Uint64(payload))
+	if sample < 0 {
+		return
+	}
+	rtt := atomic.LoadInt64(&conn.rtt)
+	if rtt == 0 {
+		rtt = sample
+	} else {
+		rtt += (sample - rtt) >> rttSmoothing
+	}
+	atomic.StoreInt64(&conn.rtt, rtt)
+}
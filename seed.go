@@ -0,0 +1,23 @@
+package mesh
+
+import "fmt"
+
+// errSeedNode is returned for gossip a Config.SeedNode will not send.
+var errSeedNode = fmt.Errorf("seed nodes do not originate application gossip")
+
+// seedSilenced reports whether we keep our own gossip on the channel to
+// ourselves, as a Config.SeedNode does on all but the internal channels.
+// Gossip from others is still relayed.
+func (c *gossipChannel) seedSilenced() bool {
+	router := c.ourself.router
+	if router == nil || !router.SeedNode {
+		return false
+	}
+	_, internal := internalChannels[c.name]
+	return !internal
+}
+
+// seed reports whether we never dial out. See Config.SeedNode.
+func (cm *connectionMaker) seed() bool {
+	return cm.ourself.router != nil && cm.ourself.router.SeedNode
+}
@@ -0,0 +1,46 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeedNode(t *testing.T) {
+	seed := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{SeedNode: true})
+	r2 := newTestRouter(t, "02:00:00:02:00:00")
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{seed, r2, r3}
+	gs, g2, g3 := newTestGossiper(), newTestGossiper(), newTestGossiper()
+	s1, err := seed.NewGossip("Test", gs)
+	require.NoError(t, err)
+	s2, err := r2.NewGossip("Test", g2)
+	require.NoError(t, err)
+	_, err = r3.NewGossip("Test", g3)
+	require.NoError(t, err)
+
+	// Peers bootstrap through the seed, learning of each other
+	addTestGossipConnection(t, r2, seed)
+	addTestGossipConnection(t, r3, seed)
+	flushAndCheckTopology(t, routers, seed.tp(r2, r3), r2.tp(seed), r3.tp(seed))
+
+	// The seed's own application gossip goes nowhere
+	broadcast(s1, 1)
+	_, err = gs.OnGossip([]byte{2})
+	require.NoError(t, err)
+	require.Equal(t, errSeedNode, s1.GossipUnicast(r2.Ourself.Name, []byte{3}))
+	seed.sendAllGossip()
+	sendPendingGossip(routers...)
+	for _, g := range []*testGossiper{g2, g3} {
+		require.False(t, g.has(1))
+		require.False(t, g.has(2))
+	}
+
+	// but that of others is relayed through it
+	broadcast(s2, 4)
+	sendPendingGossip(routers...)
+	g3.checkHas(t, 4)
+	for _, r := range routers {
+		r.Stop()
+	}
+}
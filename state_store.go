@@ -0,0 +1,118 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// StateStore persists the state of a router across restarts, so that it
+// need not learn it all afresh. See Config.StateStore.
+type StateStore interface {
+	// Save replaces the stored state.
+	Save(state []byte) error
+	// Load returns the stored state, or nil if there is none.
+	Load() ([]byte, error)
+}
+
+// savedState is what a router keeps in its StateStore.
+type savedState struct {
+	// Peers other than ourself, encoded as for topology gossip
+	Peers []byte
+	// Targets, as by ConnectionMaker.ExportTargets
+	Targets []ConnectionTarget
+	// Channels holds the encoded state of each application gossip
+	// channel, as returned by its Gossiper's Gossip
+	Channels map[string][][]byte
+}
+
+// internalChannels are the gossip channels made by the router itself,
+// whose state is not saved.
+var internalChannels = map[string]struct{}{
+	topologyChannel: {},
+	confirmChannel:  {},
+	traceChannel:    {},
+	statsChannel:    {},
+	relayChannel:    {},
+}
+
+// saveState writes our state to Config.StateStore, if set.
+func (router *Router) saveState() {
+	if router.StateStore == nil {
+		return
+	}
+	names := router.Peers.names()
+	delete(names, router.Ourself.Name)
+	state := savedState{
+		Peers:    router.Peers.encodePeers(names),
+		Targets:  router.ConnectionMaker.ExportTargets(),
+		Channels: make(map[string][][]byte),
+	}
+	for channel := range router.gossipChannelSet() {
+		if _, internal := internalChannels[channel.name]; internal || channel.surrogate {
+			continue
+		}
+		if data := channel.gossiper.Gossip(); data != nil {
+			state.Channels[channel.name] = data.Encode()
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(state); err != nil {
+		router.logger.Printf("Unable to encode state: %v", err)
+		return
+	}
+	if err := router.StateStore.Save(buf.Bytes()); err != nil {
+		router.logger.Printf("Unable to save state: %v", err)
+	}
+}
+
+// loadState restores what saveState saved, if anything. Whatever cannot
+// be loaded is ignored, with a log message, so that we start afresh.
+// The state of gossip channels is passed to their Gossiper once
+// registered.
+func (router *Router) loadState() {
+	if router.StateStore == nil {
+		return
+	}
+	saved, err := router.StateStore.Load()
+	if err != nil {
+		router.logger.Printf("Unable to load state: %v", err)
+		return
+	}
+	if len(saved) == 0 {
+		return
+	}
+	var state savedState
+	if err := gob.NewDecoder(bytes.NewReader(saved)).Decode(&state); err != nil {
+		router.logger.Printf("Ignoring saved state: %v", err)
+		return
+	}
+	if len(state.Peers) > 0 {
+		if _, _, err := router.Peers.applyUpdate(state.Peers); err != nil {
+			router.logger.Printf("Ignoring saved peers: %v", err)
+		}
+	}
+	for _, err := range router.ConnectionMaker.ImportTargets(state.Targets) {
+		router.logger.Printf("Ignoring saved target: %v", err)
+	}
+	router.gossipLock.Lock()
+	router.savedChannels = state.Channels
+	router.gossipLock.Unlock()
+}
+
+// restoreChannel passes the saved state of the named channel, if any, to
+// g.
+func (router *Router) restoreChannel(channelName string, g Gossiper) {
+	router.gossipLock.Lock()
+	parts, found := router.savedChannels[channelName]
+	delete(router.savedChannels, channelName)
+	router.gossipLock.Unlock()
+	if !found {
+		return
+	}
+	for _, part := range parts {
+		if _, err := g.OnGossip(part); err != nil {
+			router.logger.Printf("Ignoring saved state of channel %s: %v", channelName, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package mesh
+
+import (
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memoryStateStore is a StateStore which keeps the state in memory.
+type memoryStateStore struct {
+	sync.Mutex
+	state []byte
+}
+
+func (s *memoryStateStore) Save(state []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.state = state
+	return nil
+}
+
+func (s *memoryStateStore) Load() ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.state, nil
+}
+
+func TestStateStore(t *testing.T) {
+	store := &memoryStateStore{}
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{StateStore: store})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	defer r2.Stop()
+	g1 := newTestGossiper()
+	_, err := r1.NewGossip("Test", g1)
+	require.NoError(t, err)
+	_, err = g1.OnGossip([]byte{1})
+	require.NoError(t, err)
+	g2 := newTestGossiper()
+	_, err = r1.NewGossip("Other", g2)
+	require.NoError(t, err)
+	_, err = g2.OnGossip([]byte{2})
+	require.NoError(t, err)
+	connectTCPTestRouters(r1, r2)
+	awaitEstablished(t, r1, r2)
+	targets := r1.ConnectionMaker.ExportTargets()
+	require.NoError(t, r1.Stop())
+	require.NotEmpty(t, store.state)
+
+	// A new router, with the same store, knows r2 and redials it at
+	// once, and its channel picks up where the old one left off
+	peerName, err := PeerNameFromString("01:00:00:01:00:00")
+	require.NoError(t, err)
+	r1, err = NewRouter(Config{Host: "127.0.0.1", Port: r1.Port, StateStore: store}, peerName, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	require.NotNil(t, r1.Peers.Fetch(r2.Ourself.Name))
+	require.Equal(t, targets, r1.ConnectionMaker.ExportTargets())
+	g1 = newTestGossiper()
+	_, err = r1.NewGossip("Test", g1)
+	require.NoError(t, err)
+	require.True(t, g1.has(1))
+	g2 = newTestGossiper()
+	_, created := r1.GetOrCreateGossip("Other", g2)
+	require.True(t, created)
+	require.True(t, g2.has(2))
+	r1.Start()
+	awaitEstablished(t, r1, r2)
+	require.NoError(t, r1.Stop())
+
+	// Corrupt state is ignored
+	store.state = []byte("garbage")
+	r3, err := NewRouter(Config{StateStore: store}, peerName, "nick", nil, log.New(ioutil.Discard, "", 0))
+	require.NoError(t, err)
+	require.Nil(t, r3.Peers.Fetch(r2.Ourself.Name))
+	require.Empty(t, r3.ConnectionMaker.ExportTargets())
+}
@@ -0,0 +1,178 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+	"time"
+)
+
+// statsChannel is the gossip channel on which peers share their
+// PeerStats. See Config.EnableStatsGossip.
+const statsChannel = "mesh-stats"
+
+// PeerStats is the summary of its own state that each peer gossips when
+// Config.EnableStatsGossip is set. See Router.ClusterStats.
+type PeerStats struct {
+	// Seq orders the summaries from a peer; later ones replace earlier.
+	Seq uint64
+	// Time is when the peer made the summary, by its own clock.
+	Time time.Time
+	// Connections is the number of the peer's established connections.
+	Connections int
+	// Peers is the number of peers the peer knows of, including itself.
+	Peers int
+	// SendRate and ReceiveRate are the bytes per second the peer sent
+	// and received over all connections, averaged over ten seconds.
+	SendRate    float64
+	ReceiveRate float64
+}
+
+// ClusterStats returns the latest PeerStats gossiped by each peer, and
+// our own, by peer name. It returns nil unless Config.EnableStatsGossip
+// is set. Peers which do not set it are absent, as are those which have
+// not yet been heard from.
+func (router *Router) ClusterStats() map[PeerName]PeerStats {
+	if router.stats == nil {
+		return nil
+	}
+	router.stats.refresh()
+	router.stats.Lock()
+	defer router.stats.Unlock()
+	stats := make(map[PeerName]PeerStats, len(router.stats.state))
+	for name, s := range router.stats.state {
+		stats[name] = s
+	}
+	return stats
+}
+
+// statsGossiper is the Gossiper of the statsChannel, holding the latest
+// PeerStats from each peer.
+type statsGossiper struct {
+	sync.Mutex
+	router *Router
+	seq    uint64
+	state  map[PeerName]PeerStats
+}
+
+func newStatsGossiper(router *Router) *statsGossiper {
+	return &statsGossiper{
+		router: router,
+		// Start from the clock, so that our summaries keep replacing
+		// those from before a restart
+		seq:   uint64(time.Now().UnixNano()),
+		state: make(map[PeerName]PeerStats),
+	}
+}
+
+// refresh replaces our own entry with a new summary.
+func (g *statsGossiper) refresh() {
+	router := g.router
+	t := now()
+	s := PeerStats{Time: t, Peers: len(router.Peers.names())}
+	for conn := range router.Ourself.getConnections() {
+		if conn.isEstablished() {
+			s.Connections++
+		}
+		if lc, ok := conn.(*LocalConnection); ok {
+			_, sendRate := lc.bytesSent.read(t)
+			_, receiveRate := lc.bytesReceived.read(t)
+			s.SendRate += sendRate
+			s.ReceiveRate += receiveRate
+		}
+	}
+	g.Lock()
+	defer g.Unlock()
+	g.seq++
+	s.Seq = g.seq
+	g.state[router.Ourself.Name] = s
+}
+
+// forget drops the entry for a peer which has gone away.
+func (g *statsGossiper) forget(name PeerName) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.state, name)
+}
+
+// merge keeps whichever entries in update are later than ours, returning
+// them, or nil if there are none.
+func (g *statsGossiper) merge(update []byte) (GossipData, error) {
+	var stats map[PeerName]PeerStats
+	if err := gob.NewDecoder(bytes.NewReader(update)).Decode(&stats); err != nil {
+		return nil, err
+	}
+	g.Lock()
+	defer g.Unlock()
+	delta := make(map[PeerName]PeerStats)
+	for name, s := range stats {
+		if name == g.router.Ourself.Name {
+			continue
+		}
+		if old, found := g.state[name]; found && old.Seq >= s.Seq {
+			continue
+		}
+		g.state[name] = s
+		delta[name] = s
+	}
+	if len(delta) == 0 {
+		return nil, nil
+	}
+	return &statsGossipData{delta}, nil
+}
+
+// OnGossipUnicast implements Gossiper; stats are not unicast.
+func (g *statsGossiper) OnGossipUnicast(sender PeerName, msg []byte) error {
+	return nil
+}
+
+// OnGossipBroadcast implements Gossiper.
+func (g *statsGossiper) OnGossipBroadcast(_ PeerName, update []byte) (GossipData, error) {
+	return g.merge(update)
+}
+
+// Gossip implements Gossiper, refreshing our own summary first, so that
+// each round of periodic gossip carries a new one.
+func (g *statsGossiper) Gossip() GossipData {
+	g.refresh()
+	g.Lock()
+	defer g.Unlock()
+	stats := make(map[PeerName]PeerStats, len(g.state))
+	for name, s := range g.state {
+		stats[name] = s
+	}
+	return &statsGossipData{stats}
+}
+
+// OnGossip implements Gossiper.
+func (g *statsGossiper) OnGossip(update []byte) (GossipData, error) {
+	return g.merge(update)
+}
+
+// statsGossipData is a set of PeerStats, by peer name.
+type statsGossipData struct {
+	stats map[PeerName]PeerStats
+}
+
+// Merge implements GossipData, keeping the later of each peer's entries.
+func (d *statsGossipData) Merge(other GossipData) GossipData {
+	stats := make(map[PeerName]PeerStats, len(d.stats))
+	for name, s := range d.stats {
+		stats[name] = s
+	}
+	for name, s := range other.(*statsGossipData).stats {
+		if old, found := stats[name]; !found || s.Seq > old.Seq {
+			stats[name] = s
+		}
+	}
+	return &statsGossipData{stats}
+}
+
+// Encode implements GossipData.
+func (d *statsGossipData) Encode() [][]byte {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(d.stats); err != nil {
+		panic(err)
+	}
+	return [][]byte{buf.Bytes()}
+}
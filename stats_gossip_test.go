@@ -0,0 +1,49 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterStats(t *testing.T) {
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{EnableStatsGossip: true})
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{EnableStatsGossip: true})
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+	require.Nil(t, r3.ClusterStats())
+
+	for _, r := range routers {
+		r.sendAllGossip()
+	}
+	sendPendingGossip(routers...)
+
+	// Each sees the other's summary, and its own, but not that of r3,
+	// which does not gossip one
+	for _, test := range []struct {
+		r           *Router
+		connections map[PeerName]int
+	}{
+		{r1, map[PeerName]int{r1.Ourself.Name: 1, r2.Ourself.Name: 2}},
+		{r2, map[PeerName]int{r1.Ourself.Name: 1, r2.Ourself.Name: 2}},
+	} {
+		stats := test.r.ClusterStats()
+		require.Len(t, stats, 2)
+		for name, connections := range test.connections {
+			require.Equal(t, connections, stats[name].Connections, "%s as seen by %s", name, test.r.Ourself.Name)
+			require.Equal(t, 3, stats[name].Peers)
+		}
+	}
+
+	// Later summaries replace earlier ones
+	before := r2.ClusterStats()[r1.Ourself.Name].Seq
+	r1.sendAllGossip()
+	sendPendingGossip(routers...)
+	require.True(t, r2.ClusterStats()[r1.Ourself.Name].Seq > before)
+	for _, r := range routers {
+		r.Stop()
+	}
+}
@@ -3,6 +3,7 @@ package mesh
 import (
 	"fmt"
 	"net"
+	"time"
 )
 
 // Status is our current state as a peer, as taken from a router.
@@ -24,10 +25,15 @@ type Status struct {
 	Targets            []string
 	OverlayDiagnostics interface{}
 	TrustedSubnets     []string
+	PeersMemory        int64                                  // estimated bytes; see Config.PeersMemoryLimit
+	ConnectionCounts   map[string]int                         // by state; see Router.ConnectionCountByState
+	GossipDrops        map[string]map[GossipDropReason]uint64 // by channel and reason; see Router.GossipDrops
+	Goroutines         int                                    // see Router.Goroutines
 }
 
 // NewStatus returns a Status object, taken as a snapshot from the router.
 func NewStatus(router *Router) *Status {
+	connections := makeLocalConnectionStatusSlice(router.ConnectionMaker)
 	return &Status{
 		Protocol:           Protocol,
 		ProtocolMinVersion: int(router.ProtocolMinVersion),
@@ -40,11 +46,15 @@ func NewStatus(router *Router) *Status {
 		Peers:              makePeerStatusSlice(router.Peers),
 		UnicastRoutes:      makeUnicastRouteStatusSlice(router.Routes),
 		BroadcastRoutes:    makeBroadcastRouteStatusSlice(router.Routes),
-		Connections:        makeLocalConnectionStatusSlice(router.ConnectionMaker),
-		TerminationCount:   router.ConnectionMaker.terminationCount,
+		Connections:        connections,
+		TerminationCount:   router.ConnectionMaker.terminations(),
 		Targets:            router.ConnectionMaker.Targets(false),
 		OverlayDiagnostics: router.Overlay.Diagnostics(),
 		TrustedSubnets:     makeTrustedSubnetsSlice(router.TrustedSubnets),
+		PeersMemory:        router.Peers.EstimatedMemory(),
+		ConnectionCounts:   countConnectionStates(connections),
+		GossipDrops:        router.GossipDrops(),
+		Goroutines:         router.Goroutines(),
 	}
 }
 
@@ -148,11 +158,37 @@ func makeBroadcastRouteStatusSlice(r *routes) []broadcastRouteStatus {
 
 // LocalConnectionStatus is the current state of a physical connection to a peer.
 type LocalConnectionStatus struct {
-	Address  string
-	Outbound bool
-	State    string
-	Info     string
-	Attrs    map[string]interface{}
+	Address       string
+	Outbound      bool
+	State         string
+	Info          string
+	Attrs         map[string]interface{}
+	DroppedGossip uint64
+	// Bytes sent and received, including framing, in total and per
+	// second over the last ten seconds
+	BytesSent     uint64
+	BytesReceived uint64
+	SendRate      float64
+	ReceiveRate   float64
+	// Tags set by ConnectionMaker.TagConnections, and one of TagConfigured,
+	// TagDiscovered or TagInbound
+	Tags []string
+	// Tenant of the remote peer, if it has one. See Config.Tenant.
+	Tenant string
+	// RTT is the smoothed round-trip time, or zero if not known. See
+	// LocalConnection.RTT.
+	RTT time.Duration
+	// Handshake is how long each phase of the handshake took.
+	Handshake HandshakeTimings
+}
+
+// countConnectionStates returns the number of connections in each state.
+func countConnectionStates(connections []LocalConnectionStatus) map[string]int {
+	counts := make(map[string]int)
+	for _, conn := range connections {
+		counts[conn.State]++
+	}
+	return counts
 }
 
 // makeLocalConnectionStatusSlice takes a snapshot of the active local
@@ -161,12 +197,15 @@ func makeLocalConnectionStatusSlice(cm *connectionMaker) []LocalConnectionStatus
 	resultChan := make(chan []LocalConnectionStatus)
 	cm.actionChan <- func() bool {
 		var slice []LocalConnectionStatus
+		direct := cm.directAddresses()
 		for conn := range cm.connections {
+			lc, _ := conn.(*LocalConnection)
 			state := "pending"
-			if conn.isEstablished() {
+			if lc.isQuiesced() {
+				state = "quiesced"
+			} else if conn.isEstablished() {
 				state = "established"
 			}
-			lc, _ := conn.(*LocalConnection)
 			attrs := lc.OverlayConn.Attrs()
 			name, ok := attrs["name"]
 			if !ok {
@@ -183,11 +222,15 @@ func makeLocalConnectionStatusSlice(cm *connectionMaker) []LocalConnectionStatus
 					info = fmt.Sprintf("%-11v %v", "unencrypted", info)
 				}
 			}
-			slice = append(slice, LocalConnectionStatus{conn.remoteTCPAddress(), conn.isOutbound(), state, info, attrs})
+			t := now()
+			sent, sendRate := lc.bytesSent.read(t)
+			received, receiveRate := lc.bytesReceived.read(t)
+			slice = append(slice, LocalConnectionStatus{conn.remoteTCPAddress(), conn.isOutbound(), state, info, attrs, lc.senders.dropped(),
+				sent, received, sendRate, receiveRate, cm.connectionTags(conn.remoteTCPAddress(), conn.isOutbound(), direct), lc.remoteTenant, lc.RTT(), lc.Handshake()})
 		}
 		for address, target := range cm.targets {
 			add := func(state, info string) {
-				slice = append(slice, LocalConnectionStatus{address, true, state, info, nil})
+				slice = append(slice, LocalConnectionStatus{address, true, state, info, nil, 0, 0, 0, 0, 0, cm.connectionTags(address, true, direct), "", 0, HandshakeTimings{}})
 			}
 			switch target.state {
 			case targetWaiting:
@@ -56,7 +56,7 @@ func (s *surrogateGossiper) OnGossip(update []byte) (GossipData, error) {
 	// Delete anything that's older than the gossip interval, so we don't grow forever
 	// (this time limit is arbitrary; surrogateGossiper should pass on new gossip immediately
 	// so there should be no reason for a duplicate to show up after a long time)
-	updateTime := now()
+	updateTime := s.router.now()
 	gossipInterval := defaultGossipInterval
 	if s.router != nil {
 		gossipInterval = s.router.gossipInterval()
@@ -30,8 +30,7 @@ func checkOnGossip(t *testing.T, s Gossiper, input, expected []byte) {
 
 func TestSurrogateGossiperOnGossip(t *testing.T) {
 	myTime := time.Now()
-	now = func() time.Time { return myTime }
-	s := &surrogateGossiper{}
+	s := &surrogateGossiper{router: &Router{Config: Config{Clock: func() time.Time { return myTime }}}}
 	msg := [][]byte{[]byte("test 1"), []byte("test 2"), []byte("test 3"), []byte("test 4")}
 	checkOnGossip(t, s, msg[0], msg[0])
 	checkOnGossip(t, s, msg[1], msg[1])
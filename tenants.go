@@ -0,0 +1,91 @@
+package mesh
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// tenantFeature announces our Config.Tenant to peers.
+const tenantFeature = "Tenant"
+
+// TenantStats is the gossip traffic of one tenant. See Router.TenantStats.
+type TenantStats struct {
+	// Bytes of gossip for the tenant's channels which we sent, including
+	// relayed gossip, and received, excluding framing.
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// tenantAccount counts the gossip traffic of a tenant, and limits it if
+// Config.TenantByteRates says so.
+type tenantAccount struct {
+	sent     uint64      // atomic
+	received uint64      // atomic
+	limit    *byteBucket // nil means unlimited
+}
+
+// tenantAccounts holds the tenantAccount of each tenant.
+type tenantAccounts struct {
+	sync.Mutex
+	byTenant map[string]*tenantAccount
+}
+
+// TenantStats returns the gossip traffic of each tenant whose channels we
+// have, as labelled by Config.ChannelTenants and Config.Tenant. The
+// tenant of the peer at the other end of each connection is in its
+// LocalConnectionStatus.
+func (router *Router) TenantStats() map[string]TenantStats {
+	router.tenants.Lock()
+	defer router.tenants.Unlock()
+	stats := make(map[string]TenantStats, len(router.tenants.byTenant))
+	for tenant, account := range router.tenants.byTenant {
+		stats[tenant] = TenantStats{
+			BytesSent:     atomic.LoadUint64(&account.sent),
+			BytesReceived: atomic.LoadUint64(&account.received),
+		}
+	}
+	return stats
+}
+
+// channelTenant returns the account of the tenant of the named channel.
+func (router *Router) channelTenant(channelName string) *tenantAccount {
+	tenant, found := router.ChannelTenants[channelName]
+	if !found {
+		tenant = router.Tenant
+	}
+	router.tenants.Lock()
+	defer router.tenants.Unlock()
+	if router.tenants.byTenant == nil {
+		router.tenants.byTenant = make(map[string]*tenantAccount)
+	}
+	account, found := router.tenants.byTenant[tenant]
+	if !found {
+		account = &tenantAccount{}
+		if rate := router.TenantByteRates[tenant]; rate > 0 {
+			account.limit = newByteBucket(rate)
+		}
+		router.tenants.byTenant[tenant] = account
+	}
+	return account
+}
+
+// wait blocks until n bytes of the tenant's gossip may be sent, returning
+// false if stopped first.
+func (account *tenantAccount) wait(stop <-chan struct{}, n int) bool {
+	if account == nil || account.limit == nil {
+		return true
+	}
+	return account.limit.wait(stop, n)
+}
+
+func (account *tenantAccount) countSent(n int) {
+	if account != nil {
+		atomic.AddUint64(&account.sent, uint64(n))
+	}
+}
+
+func (account *tenantAccount) countReceived(n int) {
+	if account != nil {
+		atomic.AddUint64(&account.received, uint64(n))
+	}
+}
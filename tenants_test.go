@@ -0,0 +1,105 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantStats(t *testing.T) {
+	tenants := map[string]string{"red-a": "red", "red-b": "red", "blue": "blue"}
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{ChannelTenants: tenants})
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{ChannelTenants: tenants})
+	routers := []*Router{r1, r2}
+	addTestGossipConnection(t, r1, r2)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1))
+	channels := make(map[string]Gossip)
+	for name := range tenants {
+		for _, r := range routers {
+			s, err := r.NewGossip(name, newTestGossiper())
+			require.NoError(t, err)
+			if r == r1 {
+				channels[name] = s
+			}
+		}
+	}
+	before1, before2 := r1.TenantStats(), r2.TenantStats()
+
+	channels["red-a"].GossipBroadcast(newSurrogateGossipData(make([]byte, 1000)))
+	channels["red-b"].GossipBroadcast(newSurrogateGossipData(make([]byte, 1000)))
+	channels["blue"].GossipBroadcast(newSurrogateGossipData(make([]byte, 100)))
+	sendPendingGossip(routers...)
+
+	after1, after2 := r1.TenantStats(), r2.TenantStats()
+	sent := func(tenant string) uint64 { return after1[tenant].BytesSent - before1[tenant].BytesSent }
+	received := func(tenant string) uint64 { return after2[tenant].BytesReceived - before2[tenant].BytesReceived }
+	require.True(t, sent("red") > 2000, "red sent %d", sent("red"))
+	require.True(t, sent("blue") > 100 && sent("blue") < 1000, "blue sent %d", sent("blue"))
+	require.Equal(t, sent("red"), received("red"))
+	require.Equal(t, sent("blue"), received("blue"))
+	// Topology gossip belongs to our own, unnamed, tenant
+	require.Contains(t, after1, "")
+	for _, r := range routers {
+		r.Stop()
+	}
+}
+
+func TestConnectionTenant(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{Tenant: "red"})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{Tenant: "blue"})
+	defer r1.Stop()
+	defer r2.Stop()
+	connectTCPTestRouters(r1, r2)
+	awaitEstablished(t, r1, r2)
+	awaitEstablished(t, r2, r1)
+
+	for _, test := range []struct {
+		r      *Router
+		remote string
+	}{{r1, "blue"}, {r2, "red"}} {
+		var tenants []string
+		for _, status := range NewStatus(test.r).Connections {
+			if status.State == "established" {
+				tenants = append(tenants, status.Tenant)
+			}
+		}
+		require.Equal(t, []string{test.remote}, tenants)
+	}
+}
+
+func TestRelayedUnicastReleasedByStop(t *testing.T) {
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", Config{
+		ChannelTenants:  map[string]string{"slow": "slow"},
+		TenantByteRates: map[string]int64{"slow": 1},
+	})
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", Config{})
+	defer r2.Stop()
+	s, err := r1.NewGossip("slow", newTestGossiper())
+	require.NoError(t, err)
+	connectTCPTestRouters(r1, r2)
+	awaitEstablished(t, r1, r2)
+	c := s.(*gossipChannel)
+	require.Eventually(t, func() bool {
+		_, found := c.routes.UnicastAll(r2.Ourself.Name)
+		return found
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// At a byte per second, relaying this would take minutes
+	done := make(chan error, 1)
+	go func() {
+		done <- c.relayUnicast(r2.Ourself.Name, protocolMsg{ProtocolGossipUnicast, make([]byte, 100)})
+	}()
+	select {
+	case <-done:
+		require.FailNow(t, "relay was not throttled")
+	case <-time.After(100 * time.Millisecond):
+	}
+	r1.Stop()
+	select {
+	case err := <-done:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "relay was not released by Stop")
+	}
+}
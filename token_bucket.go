@@ -1,6 +1,7 @@
 package mesh
 
 import (
+	"sync"
 	"time"
 )
 
@@ -42,7 +43,69 @@ func (tb *tokenBucket) wait() {
 	tb.earliestUnspentToken = tb.earliestUnspentToken.Add(tb.tokenInterval)
 }
 
+// take removes a token if one is available, without blocking, and
+// reports whether it did.
+// Not safe for concurrent use by multiple goroutines.
+func (tb *tokenBucket) take() bool {
+	if time.Now().Before(tb.earliestUnspentToken) {
+		return false
+	}
+	capacityToken := tb.capacityToken()
+	if tb.earliestUnspentToken.Before(capacityToken) {
+		tb.earliestUnspentToken = capacityToken
+	}
+	tb.earliestUnspentToken = tb.earliestUnspentToken.Add(tb.tokenInterval)
+	return true
+}
+
 // Determine the historic token timestamp representing a full bucket
 func (tb *tokenBucket) capacityToken() time.Time {
 	return time.Now().Add(-tb.refillDuration).Truncate(tb.tokenInterval)
 }
+
+// byteBucket limits the rate of bytes sent by any number of goroutines
+// between them. Bytes are reserved in the order they are asked for, so a
+// goroutine with a lot to send, which must ask again for each message,
+// cannot monopolise the rate while others wait.
+type byteBucket struct {
+	sync.Mutex
+	byteInterval time.Duration // time to send one byte
+	burst        time.Duration // credit accumulated while idle
+	free         time.Time     // when the bytes reserved so far have been sent
+}
+
+// newByteBucket returns a bucket allowing rate bytes per second, in
+// bursts of up to one second's worth.
+func newByteBucket(rate int64) *byteBucket {
+	return &byteBucket{byteInterval: time.Second / time.Duration(rate), burst: time.Second}
+}
+
+// reserve reserves n bytes, returning how long to wait before sending
+// them.
+func (b *byteBucket) reserve(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	if earliest := now.Add(-b.burst); b.free.Before(earliest) {
+		b.free = earliest
+	}
+	b.free = b.free.Add(time.Duration(n) * b.byteInterval)
+	return b.free.Sub(now)
+}
+
+// wait blocks until n bytes may be sent, returning false if stopped
+// first.
+func (b *byteBucket) wait(stop <-chan struct{}, n int) bool {
+	delay := b.reserve(n)
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
@@ -0,0 +1,155 @@
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"sync"
+	"time"
+)
+
+// confirmChannel is the gossip channel on which peers exchange their
+// ViewDigest. See Router.ConfirmTopologyWith.
+const confirmChannel = "mesh-confirm"
+
+// confirmRetryInterval is how often ConfirmTopologyWith asks again while
+// neither view changes, in case the other peer's has.
+var confirmRetryInterval = 100 * time.Millisecond
+
+// ConfirmTopologyWith blocks until the named peer reports the same
+// ViewDigest as ours, so that both agree on the membership of the mesh,
+// or ctx is done, in which case ctx.Err() is returned. While the views
+// differ, e.g. because a change is still propagating, it keeps asking.
+// Both we and the peer must set Config.EnableTopologyConfirm.
+func (router *Router) ConfirmTopologyWith(ctx context.Context, peer PeerName) error {
+	c := router.confirmer
+	if c == nil {
+		return errors.New("topology confirmation is not enabled; see Config.EnableTopologyConfirm")
+	}
+	if peer == router.Ourself.Name {
+		return nil
+	}
+	replies := make(chan string, 1)
+	id := c.expect(peer, replies)
+	defer c.forget(id)
+	for {
+		router.routesLock.Lock()
+		changed := router.routesChanged
+		router.routesLock.Unlock()
+		// Failures, e.g. for want of a route to the peer, are retried
+		_ = c.ask(peer, id)
+		retry := time.After(confirmRetryInterval)
+	wait:
+		for {
+			select {
+			case digest := <-replies:
+				if digest == router.ViewDigest() {
+					return nil
+				}
+			case <-changed:
+				break wait
+			case <-retry:
+				break wait
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// confirmMsg is a request for, or a reply with, a peer's ViewDigest.
+type confirmMsg struct {
+	ID     uint64
+	Reply  bool
+	Digest string
+}
+
+// confirmation is a ConfirmTopologyWith awaiting replies.
+type confirmation struct {
+	peer    PeerName
+	replies chan string
+}
+
+// topologyConfirmer is the Gossiper of the confirmChannel, answering
+// requests for our ViewDigest and passing on replies to ours.
+type topologyConfirmer struct {
+	sync.Mutex
+	router  *Router
+	gossip  Gossip
+	nextID  uint64
+	waiting map[uint64]confirmation
+}
+
+func newTopologyConfirmer(router *Router) *topologyConfirmer {
+	return &topologyConfirmer{router: router, waiting: make(map[uint64]confirmation)}
+}
+
+// expect registers for replies from peer, returning the ID with which to
+// ask it.
+func (c *topologyConfirmer) expect(peer PeerName, replies chan string) uint64 {
+	c.Lock()
+	defer c.Unlock()
+	c.nextID++
+	c.waiting[c.nextID] = confirmation{peer, replies}
+	return c.nextID
+}
+
+func (c *topologyConfirmer) forget(id uint64) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.waiting, id)
+}
+
+// ask requests the ViewDigest of peer.
+func (c *topologyConfirmer) ask(peer PeerName, id uint64) error {
+	return c.send(peer, confirmMsg{ID: id})
+}
+
+func (c *topologyConfirmer) send(peer PeerName, msg confirmMsg) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+	return c.gossip.GossipUnicast(peer, buf.Bytes())
+}
+
+// OnGossipUnicast implements Gossiper, answering requests and passing on
+// replies.
+func (c *topologyConfirmer) OnGossipUnicast(sender PeerName, msg []byte) error {
+	var m confirmMsg
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&m); err != nil {
+		return err
+	}
+	if !m.Reply {
+		return c.send(sender, confirmMsg{ID: m.ID, Reply: true, Digest: c.router.ViewDigest()})
+	}
+	c.Lock()
+	defer c.Unlock()
+	waiting, found := c.waiting[m.ID]
+	if !found || waiting.peer != sender {
+		return nil // too late, or not for us
+	}
+	// Only the latest reply matters
+	select {
+	case <-waiting.replies:
+	default:
+	}
+	waiting.replies <- m.Digest
+	return nil
+}
+
+// OnGossipBroadcast implements Gossiper; digests are not broadcast.
+func (c *topologyConfirmer) OnGossipBroadcast(_ PeerName, update []byte) (GossipData, error) {
+	return nil, nil
+}
+
+// Gossip implements Gossiper; digests are not gossiped.
+func (c *topologyConfirmer) Gossip() GossipData {
+	return nil
+}
+
+// OnGossip implements Gossiper; digests are not gossiped.
+func (c *topologyConfirmer) OnGossip(update []byte) (GossipData, error) {
+	return nil, nil
+}
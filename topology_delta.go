@@ -0,0 +1,88 @@
+package mesh
+
+import (
+	"sync"
+	"time"
+)
+
+// topologyDeltas tracks the versions of the peers last sent down each
+// connection in periodic topology gossip, so that only those which have
+// changed since need be sent again. See Config.TopologyFullSyncInterval.
+type topologyDeltas struct {
+	sync.Mutex
+	sent map[Connection]*topologySent
+}
+
+// topologySent is what was last sent down a connection.
+type topologySent struct {
+	versions map[PeerName]uint64 // not modified once recorded
+	fullSync time.Time
+}
+
+// delta returns the peers whose versions differ from those last sent
+// down conn, or all of them if it is time for a full sync, and records
+// versions as sent.
+func (d *topologyDeltas) delta(conn Connection, versions map[PeerName]uint64, t time.Time, fullSync time.Duration) peerNameSet {
+	d.Lock()
+	defer d.Unlock()
+	if d.sent == nil {
+		d.sent = make(map[Connection]*topologySent)
+	}
+	sent, found := d.sent[conn]
+	if !found || t.Sub(sent.fullSync) >= fullSync {
+		sent = &topologySent{fullSync: t}
+		d.sent[conn] = sent
+	}
+	update := make(peerNameSet)
+	for name, version := range versions {
+		if last, found := sent.versions[name]; !found || last != version {
+			update[name] = struct{}{}
+		}
+	}
+	sent.versions = versions
+	return update
+}
+
+// retain forgets what was sent down connections other than conns.
+func (d *topologyDeltas) retain(conns connectionSet) {
+	d.Lock()
+	defer d.Unlock()
+	for conn := range d.sent {
+		if _, found := conns[conn]; !found {
+			delete(d.sent, conn)
+		}
+	}
+}
+
+// sendTopologyDeltas sends the periodic topology gossip on channel, to
+// each neighbour it picks only the peers which have changed since the
+// last it was sent, and nothing if none have.
+func (router *Router) sendTopologyDeltas(channel *gossipChannel) {
+	connections := router.Ourself.getConnections()
+	router.topologyDeltas.retain(connections)
+	versions := router.Peers.versions()
+	t := router.now()
+	channel.routes.ensureRecalculated()
+	for _, conn := range router.Ourself.ConnectionsTo(channel.routes.randomNeighbours(router.Ourself.Name)) {
+		if update := router.topologyDeltas.delta(conn, versions, t, router.TopologyFullSyncInterval); len(update) > 0 {
+			channel.SendDown(conn, &topologyGossipData{peers: router.Peers, update: update})
+		}
+	}
+}
+
+// versions returns the version of each peer we know of.
+func (peers *Peers) versions() map[PeerName]uint64 {
+	peers.RLock()
+	defer peers.RUnlock()
+	versions := make(map[PeerName]uint64, len(peers.byName))
+	for name, peer := range peers.byName {
+		if peer == peers.ourself.Peer {
+			peers.ourself.RLock()
+			versions[name] = peer.Version
+			peers.ourself.RUnlock()
+			continue
+		}
+		versions[name] = peer.Version
+	}
+	return versions
+}
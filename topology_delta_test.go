@@ -0,0 +1,69 @@
+package mesh
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopologyDeltas(t *testing.T) {
+	clock := newTestClock()
+	var (
+		lock   sync.Mutex
+		tapped []int
+	)
+	r1 := newTestRouterWithConfig(t, "01:00:00:01:00:00", Config{TopologyFullSyncInterval: time.Hour, Clock: clock.now})
+	tap := func(channel string, src PeerName, n int) {
+		lock.Lock()
+		defer lock.Unlock()
+		if channel == "topology" && src == r1.Ourself.Name {
+			tapped = append(tapped, n)
+		}
+	}
+	r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{GossipTap: tap})
+	r3 := newTestRouter(t, "03:00:00:03:00:00")
+	routers := []*Router{r1, r2, r3}
+	addTestGossipConnection(t, r1, r2)
+	addTestGossipConnection(t, r2, r3)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+
+	// round returns the sizes of the periodic topology gossip r2 gets
+	// from r1
+	round := func() []int {
+		lock.Lock()
+		tapped = nil
+		lock.Unlock()
+		r1.sendAllGossip()
+		sendPendingGossip(routers...)
+		lock.Lock()
+		defer lock.Unlock()
+		return tapped
+	}
+
+	// The first round carries the full set, and the next nothing, as
+	// nothing has changed
+	full := round()
+	require.Len(t, full, 1)
+	require.Empty(t, round())
+
+	// When peers change, only they are sent
+	r4 := newTestRouter(t, "04:00:00:04:00:00")
+	routers = append(routers, r4)
+	addTestGossipConnection(t, r3, r4)
+	flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2, r4), r4.tp(r3))
+	delta := round()
+	require.Len(t, delta, 1)
+	require.Empty(t, round())
+
+	// until it is time for a full sync, which carries them all
+	clock.advance(time.Hour)
+	refresh := round()
+	require.Len(t, refresh, 1)
+	require.True(t, delta[0] < refresh[0], "delta of %d bytes, full sync of %d", delta[0], refresh[0])
+	require.True(t, full[0] < refresh[0])
+	for _, r := range routers {
+		r.Stop()
+	}
+}
@@ -0,0 +1,169 @@
+package mesh
+
+import (
+	"sort"
+	"time"
+)
+
+// topologyEventBuffer is how many events a topology subscription holds
+// for its consumer before dropping the oldest.
+const topologyEventBuffer = 256
+
+// recentTopologyEvents is how many of the latest events we keep for
+// Router.Diagnostics.
+const recentTopologyEvents = 64
+
+// TopologyEventType says what changed in a TopologyEvent.
+type TopologyEventType int
+
+const (
+	// TopologyPeerAdded means we learnt of Peer.
+	TopologyPeerAdded TopologyEventType = iota
+	// TopologyPeerRemoved means Peer was garbage collected, along with
+	// its connections.
+	TopologyPeerRemoved
+	// TopologyConnectionAdded means Peer reported a connection to Remote.
+	TopologyConnectionAdded
+	// TopologyConnectionRemoved means Peer no longer reports a
+	// connection to Remote.
+	TopologyConnectionRemoved
+)
+
+// String returns a human-readable name for the event type.
+func (t TopologyEventType) String() string {
+	switch t {
+	case TopologyPeerAdded:
+		return "peer added"
+	case TopologyPeerRemoved:
+		return "peer removed"
+	case TopologyConnectionAdded:
+		return "connection added"
+	case TopologyConnectionRemoved:
+		return "connection removed"
+	}
+	return "unknown"
+}
+
+// TopologyEvent is an incremental change to the topology. See
+// Router.SubscribeTopology.
+type TopologyEvent struct {
+	Type   TopologyEventType
+	Peer   PeerName
+	Remote PeerName // for connection events
+}
+
+// SubscribeTopology returns a channel of changes to the topology from
+// now on, and a function to end the subscription, which closes the
+// channel. Call Peers.Descriptions, or the like, after subscribing for
+// the state to which the changes apply. The channel is buffered; if the
+// consumer falls behind, the oldest events are dropped rather than
+// holding up topology gossip.
+func (router *Router) SubscribeTopology() (<-chan TopologyEvent, func()) {
+	ch := make(chan TopologyEvent, topologyEventBuffer)
+	router.topologyLock.Lock()
+	router.topologySubs[ch] = struct{}{}
+	router.topologyLock.Unlock()
+	cancel := func() {
+		router.topologyLock.Lock()
+		defer router.topologyLock.Unlock()
+		if _, found := router.topologySubs[ch]; !found {
+			return
+		}
+		delete(router.topologySubs, ch)
+		close(ch)
+	}
+	return ch, cancel
+}
+
+// topologySnapshot returns the connections of the named peers, or of all
+// peers if names is nil.
+func (router *Router) topologySnapshot(names peerNameSet) map[PeerName]peerNameSet {
+	router.Peers.RLock()
+	router.Ourself.RLock()
+	defer router.Peers.RUnlock()
+	defer router.Ourself.RUnlock()
+	snapshot := make(map[PeerName]peerNameSet)
+	for name, peer := range router.Peers.byName {
+		if _, found := names[name]; names != nil && !found {
+			continue
+		}
+		remotes := make(peerNameSet)
+		for remoteName := range peer.connections {
+			remotes[remoteName] = struct{}{}
+		}
+		snapshot[name] = remotes
+	}
+	return snapshot
+}
+
+// publishTopology sends subscribers the changes to the connections of
+// the named peers since we last did so.
+func (router *Router) publishTopology(names peerNameSet) {
+	router.topologyLock.Lock()
+	defer router.topologyLock.Unlock()
+	var events []TopologyEvent
+	for name, remotes := range router.topologySnapshot(names) {
+		old, known := router.topologyView[name]
+		if !known {
+			events = append(events, TopologyEvent{Type: TopologyPeerAdded, Peer: name})
+		}
+		for remote := range remotes {
+			if _, found := old[remote]; !found {
+				events = append(events, TopologyEvent{Type: TopologyConnectionAdded, Peer: name, Remote: remote})
+			}
+		}
+		for remote := range old {
+			if _, found := remotes[remote]; !found {
+				events = append(events, TopologyEvent{Type: TopologyConnectionRemoved, Peer: name, Remote: remote})
+			}
+		}
+		router.topologyView[name] = remotes
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Peer != events[j].Peer {
+			return events[i].Peer < events[j].Peer
+		}
+		return events[i].Type < events[j].Type
+	})
+	router.sendTopologyEvents(events)
+}
+
+// publishPeerRemoved tells subscribers that peer has been garbage
+// collected.
+func (router *Router) publishPeerRemoved(peer *Peer) {
+	router.topologyLock.Lock()
+	defer router.topologyLock.Unlock()
+	if _, known := router.topologyView[peer.Name]; !known {
+		return
+	}
+	delete(router.topologyView, peer.Name)
+	router.sendTopologyEvents([]TopologyEvent{{Type: TopologyPeerRemoved, Peer: peer.Name}})
+}
+
+// sendTopologyEvents queues events for each subscriber, dropping the
+// oldest queued if it is full, and records them as recent. Must hold
+// topologyLock.
+func (router *Router) sendTopologyEvents(events []TopologyEvent) {
+	now := time.Now()
+	for _, event := range events {
+		router.topologyRecent = append(router.topologyRecent, DiagnosticEvent{now, event})
+	}
+	if excess := len(router.topologyRecent) - recentTopologyEvents; excess > 0 {
+		router.topologyRecent = append(router.topologyRecent[:0], router.topologyRecent[excess:]...)
+	}
+	for ch := range router.topologySubs {
+		for _, event := range events {
+			for sent := false; !sent; {
+				select {
+				case ch <- event:
+					sent = true
+				default:
+					select {
+					case <-ch:
+					default:
+					}
+				}
+			}
+		}
+	}
+}
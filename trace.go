@@ -0,0 +1,250 @@
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// traceChannel is the gossip channel along which TracePath probes are
+// passed, hop by hop.
+const traceChannel = "mesh-trace"
+
+var errPathTraceDisabled = errors.New("path tracing is not enabled; see Config.EnablePathTrace")
+
+// TracePath returns the path which unicast gossip from us to dest takes,
+// starting with us, and ending with dest, by passing a probe along it
+// which each peer on the way adds itself to, like traceroute. If the
+// probe meets a peer with no route to dest, or one it has passed
+// already, the path as far as it got is returned, with an error. If ctx
+// is done first, ctx.Err() is returned. We and the peers on the path
+// must set Config.EnablePathTrace.
+func (router *Router) TracePath(ctx context.Context, dest PeerName) ([]PeerName, error) {
+	if router.tracer == nil {
+		return nil, errPathTraceDisabled
+	}
+	if dest == router.Ourself.Name {
+		return []PeerName{dest}, nil
+	}
+	reply, err := router.tracer.probe(ctx, dest, false)
+	return reply.Path, err
+}
+
+// RoutePair is the path from us to a peer, and the path back, which
+// differ when the peers along them weigh their connections differently.
+// See Router.RoutePair.
+type RoutePair struct {
+	// NextHop is our next hop to the peer, according to our routes.
+	NextHop PeerName
+	// Out is the path from us to the peer, as from TracePath.
+	Out []PeerName
+	// Return is the path from the peer back to us, starting with the
+	// peer.
+	Return []PeerName
+}
+
+// Asymmetric reports whether the path back is other than the path out,
+// reversed.
+func (p RoutePair) Asymmetric() bool {
+	if len(p.Out) != len(p.Return) {
+		return true
+	}
+	for i, name := range p.Out {
+		if p.Return[len(p.Return)-1-i] != name {
+			return true
+		}
+	}
+	return false
+}
+
+// RoutePair returns the path which unicast gossip from us to dest takes,
+// and the path back from dest, by passing a probe along each, as
+// TracePath does. If the probe meets a peer with no route on, the paths
+// as far as they got are returned, with an error.
+func (router *Router) RoutePair(ctx context.Context, dest PeerName) (RoutePair, error) {
+	if router.tracer == nil {
+		return RoutePair{NextHop: UnknownPeerName}, errPathTraceDisabled
+	}
+	if dest == router.Ourself.Name {
+		return RoutePair{NextHop: UnknownPeerName, Out: []PeerName{dest}, Return: []PeerName{dest}}, nil
+	}
+	pair := RoutePair{NextHop: UnknownPeerName}
+	if hop, found := router.Routes.Unicast(dest); found {
+		pair.NextHop = hop
+	}
+	reply, err := router.tracer.probe(ctx, dest, true)
+	pair.Out, pair.Return = reply.Path, reply.ReturnPath
+	return pair, err
+}
+
+// traceMsg is a TracePath probe, or the reply to its origin.
+type traceMsg struct {
+	ID         uint64
+	Origin     PeerName
+	Dest       PeerName
+	Path       []PeerName
+	Return     bool       // is the path back from Dest wanted too?
+	ReturnPath []PeerName // from Dest, once the probe is on its way back
+	Reply      bool
+	Err        string // in a reply, why the probe did not get through
+}
+
+// target returns the peer the probe is on its way to.
+func (m traceMsg) target() PeerName {
+	if len(m.ReturnPath) > 0 {
+		return m.Origin
+	}
+	return m.Dest
+}
+
+// pathTracer is the Gossiper of the traceChannel, passing on probes
+// and their replies.
+type pathTracer struct {
+	sync.Mutex
+	router  *Router
+	gossip  Gossip
+	nextID  uint64
+	waiting map[uint64]chan<- traceMsg
+}
+
+func newPathTracer(router *Router) *pathTracer {
+	return &pathTracer{router: router, waiting: make(map[uint64]chan<- traceMsg)}
+}
+
+// probe sends a probe to dest, and waits for the reply.
+func (t *pathTracer) probe(ctx context.Context, dest PeerName, wantReturn bool) (traceMsg, error) {
+	replies := make(chan traceMsg, 1)
+	id := t.expect(replies)
+	defer t.forget(id)
+	ourself := t.router.Ourself.Name
+	t.forward(traceMsg{ID: id, Origin: ourself, Dest: dest, Path: []PeerName{ourself}, Return: wantReturn})
+	select {
+	case reply := <-replies:
+		if reply.Err != "" {
+			return reply, errors.New(reply.Err)
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return traceMsg{}, ctx.Err()
+	}
+}
+
+// expect registers for the reply to a probe, returning its ID.
+func (t *pathTracer) expect(replies chan<- traceMsg) uint64 {
+	t.Lock()
+	defer t.Unlock()
+	t.nextID++
+	t.waiting[t.nextID] = replies
+	return t.nextID
+}
+
+func (t *pathTracer) forget(id uint64) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.waiting, id)
+}
+
+// forward passes probe m on to our next hop towards its target, or
+// replies with why it cannot.
+func (t *pathTracer) forward(m traceMsg) {
+	target := m.target()
+	next, found := t.router.Routes.Unicast(target)
+	if !found || next == UnknownPeerName {
+		t.reply(m, fmt.Errorf("no route from %s to %s", t.router.Ourself.Name, target))
+		return
+	}
+	if err := t.send(next, m); err != nil {
+		t.reply(m, fmt.Errorf("passing probe from %s to %s: %v", t.router.Ourself.Name, next, err))
+	}
+}
+
+// reply tells the origin of probe m where it got to, and, if it did not
+// reach its destination, why.
+func (t *pathTracer) reply(m traceMsg, err error) {
+	m.Reply = true
+	if err != nil {
+		m.Err = err.Error()
+	}
+	if m.Origin == t.router.Ourself.Name {
+		t.deliver(m)
+		return
+	}
+	// If the reply cannot be sent, the origin gives up in time
+	_ = t.send(m.Origin, m)
+}
+
+func (t *pathTracer) deliver(m traceMsg) {
+	t.Lock()
+	defer t.Unlock()
+	if replies, found := t.waiting[m.ID]; found {
+		select {
+		case replies <- m:
+		default:
+		}
+	}
+}
+
+func (t *pathTracer) send(peer PeerName, m traceMsg) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(m); err != nil {
+		return err
+	}
+	return t.gossip.GossipUnicast(peer, buf.Bytes())
+}
+
+// OnGossipUnicast implements Gossiper, adding ourself to probes and
+// passing them on, and passing on replies to ours.
+func (t *pathTracer) OnGossipUnicast(_ PeerName, msg []byte) error {
+	var m traceMsg
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&m); err != nil {
+		return err
+	}
+	if m.Reply {
+		t.deliver(m)
+		return nil
+	}
+	ourself := t.router.Ourself.Name
+	path := &m.Path
+	if len(m.ReturnPath) > 0 {
+		path = &m.ReturnPath
+	}
+	for _, name := range *path {
+		if name == ourself {
+			*path = append(*path, ourself)
+			t.reply(m, fmt.Errorf("routing loop at %s", ourself))
+			return nil
+		}
+	}
+	*path = append(*path, ourself)
+	switch {
+	case len(m.ReturnPath) > 0 && m.Origin == ourself:
+		t.reply(m, nil)
+	case len(m.ReturnPath) == 0 && m.Dest == ourself && m.Return:
+		// Back the way our routes go, which may not be the way it came
+		m.ReturnPath = []PeerName{ourself}
+		t.forward(m)
+	case len(m.ReturnPath) == 0 && m.Dest == ourself:
+		t.reply(m, nil)
+	default:
+		t.forward(m)
+	}
+	return nil
+}
+
+// OnGossipBroadcast implements Gossiper; probes are not broadcast.
+func (t *pathTracer) OnGossipBroadcast(_ PeerName, update []byte) (GossipData, error) {
+	return nil, nil
+}
+
+// Gossip implements Gossiper; probes are not gossiped.
+func (t *pathTracer) Gossip() GossipData {
+	return nil
+}
+
+// OnGossip implements Gossiper; probes are not gossiped.
+func (t *pathTracer) OnGossip(update []byte) (GossipData, error) {
+	return nil, nil
+}
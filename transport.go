@@ -0,0 +1,100 @@
+package mesh
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Transport carries the connections between peers. The default, "tcp",
+// is plain TCP; others, such as "quic" from the meshquic package, are
+// provided by packages which register them with RegisterTransport, to be
+// selected with Config.Transport. The mesh protocol, including its
+// handshake and encryption, runs unchanged over the connections, so they
+// must be reliable, ordered streams.
+type Transport interface {
+	// Listen listens for connections on addr, a host and port.
+	Listen(addr string) (net.Listener, error)
+	// Dial connects from localAddr to addr, each a host and port.
+	Dial(localAddr, addr string) (net.Conn, error)
+}
+
+var (
+	transportsLock sync.Mutex
+	transports     = map[string]Transport{"tcp": tcpTransport{}}
+)
+
+// RegisterTransport makes t available as Config.Transport name. It is
+// intended to be called from the init function of the package providing
+// t, and panics if name is taken.
+func RegisterTransport(name string, t Transport) {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	if _, found := transports[name]; found {
+		panic(fmt.Sprintf("transport %q registered twice", name))
+	}
+	transports[name] = t
+}
+
+// transport returns the Transport named by Config.Transport.
+func (config *Config) transport() (Transport, error) {
+	name := config.Transport
+	if name == "" {
+		name = "tcp"
+	}
+	transportsLock.Lock()
+	t, found := transports[name]
+	transportsLock.Unlock()
+	if !found {
+		return nil, fmt.Errorf("unknown transport %q; is the package providing it imported?", name)
+	}
+	if _, tcp := t.(tcpTransport); !tcp && config.HTTPProxy != "" {
+		return nil, fmt.Errorf("HTTPProxy requires the tcp transport, not %q", name)
+	}
+	return t, nil
+}
+
+// tcpTransport is the default Transport.
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	localAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP("tcp", localAddr)
+}
+
+func (tcpTransport) Dial(localAddr, addr string) (net.Conn, error) {
+	localTCPAddr, err := net.ResolveTCPAddr("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	remoteTCPAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTCP("tcp", localTCPAddr, remoteTCPAddr)
+}
+
+// tcpAddrOf returns addr as a TCP address, for the overlay, which deals
+// in them. Addresses of other transports with the same form, a host and
+// port, are converted; others give nil.
+func tcpAddrOf(addr net.Addr) *net.TCPAddr {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		return nil
+	}
+	return tcpAddr
+}
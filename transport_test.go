@@ -0,0 +1,111 @@
+// +build linux
+
+package mesh
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// unixTransport carries connections over Unix sockets in the abstract
+// namespace, named after the host and port, to show that nothing needs
+// TCP.
+type unixTransport struct{}
+
+var registerUnixTransport sync.Once
+
+// unixAddr is the address of a connection over unixTransport, in the
+// form of a TCP address, as the rest of the mesh expects.
+type unixAddr string
+
+func (a unixAddr) Network() string { return "test-unix" }
+func (a unixAddr) String() string  { return string(a) }
+
+func unixPath(addr string) string {
+	return fmt.Sprintf("@mesh-test-%d-%s", os.Getpid(), addr)
+}
+
+func (unixTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("unix", unixPath(addr))
+	if err != nil {
+		return nil, err
+	}
+	return &unixListener{ln, unixAddr(addr)}, nil
+}
+
+func (unixTransport) Dial(localAddr, addr string) (net.Conn, error) {
+	conn, err := net.Dial("unix", unixPath(addr))
+	if err != nil {
+		return nil, err
+	}
+	// The port is made up, being unknown to the listener
+	return &unixConn{conn, unixAddr("127.0.0.1:1"), unixAddr(addr)}, nil
+}
+
+type unixListener struct {
+	net.Listener
+	addr unixAddr
+}
+
+func (ln *unixListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &unixConn{conn, ln.addr, unixAddr("127.0.0.1:1")}, nil
+}
+
+func (ln *unixListener) Addr() net.Addr { return ln.addr }
+
+type unixConn struct {
+	net.Conn
+	local, remote unixAddr
+}
+
+func (c *unixConn) LocalAddr() net.Addr  { return c.local }
+func (c *unixConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestTransport(t *testing.T) {
+	registerUnixTransport.Do(func() { RegisterTransport("test-unix", unixTransport{}) })
+	config := Config{Transport: "test-unix", Password: []byte("sekr1t")}
+	r1 := newTCPTestRouter(t, "01:00:00:01:00:00", config)
+	r2 := newTCPTestRouter(t, "02:00:00:02:00:00", config)
+	defer r1.Stop()
+	defer r2.Stop()
+	s1, err := r1.NewGossip("test", newTestGossiper())
+	require.NoError(t, err)
+	g2 := &unicastRecorder{*newTestGossiper(), make(chan []byte, 1)}
+	_, err = r2.NewGossip("test", g2)
+	require.NoError(t, err)
+
+	connectTCPTestRouters(r1, r2)
+	conn := awaitEstablished(t, r1, r2)
+	awaitEstablished(t, r2, r1)
+	require.IsType(t, &unixConn{}, conn.tcpConn)
+	require.NotNil(t, conn.sessionKey)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err = s1.GossipUnicast(r2.Ourself.Name, []byte("hello")); err == nil {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "no route for unicast: %v", err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case got := <-g2.received:
+		require.Equal(t, "hello", string(got))
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "unicast not delivered")
+	}
+
+	_, err = NewRouter(Config{Transport: "carrier-pigeon"}, r1.Ourself.Name, "nick", nil, nil)
+	require.Error(t, err)
+	_, err = NewRouter(Config{Transport: "test-unix", HTTPProxy: "http://proxy:3128"}, r1.Ourself.Name, "nick", nil, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,55 @@
+package mesh
+
+import "sync/atomic"
+
+// UnknownPeerPolicy determines what happens to application gossip which
+// originates from a peer not yet in our topology, e.g. because its
+// topology gossip has yet to reach us. See Config.UnknownPeerGossip.
+type UnknownPeerPolicy int
+
+const (
+	// UnknownPeerAccept delivers the gossip, and relays it as far as our
+	// routes allow, as for known peers.
+	UnknownPeerAccept UnknownPeerPolicy = iota
+	// UnknownPeerReject drops the gossip, neither delivering nor
+	// relaying it. Drops are counted by Router.UnknownPeerRejections.
+	UnknownPeerReject
+	// UnknownPeerQuarantine delivers the gossip, but does not relay it,
+	// so that a peer cannot influence the rest of the mesh through us
+	// until it has appeared in our topology.
+	UnknownPeerQuarantine
+)
+
+// UnknownPeerRejections returns the number of gossip messages we have
+// dropped because they came from a peer not in our topology. See
+// Config.UnknownPeerGossip.
+func (router *Router) UnknownPeerRejections() uint64 {
+	return atomic.LoadUint64(&router.unknownRejected)
+}
+
+// unknownSource reports whether gossip on the channel from srcName is
+// subject to policy because srcName is not in our topology. Topology
+// gossip never is, since it is how we learn of peers.
+func (c *gossipChannel) unknownSource(srcName PeerName, policy UnknownPeerPolicy) bool {
+	router := c.ourself.router
+	if router == nil || router.UnknownPeerGossip != policy || c.essential {
+		return false
+	}
+	return router.Peers.Fetch(srcName) == nil
+}
+
+// rejectUnknown reports whether gossip from srcName must be dropped, and
+// counts it if so.
+func (c *gossipChannel) rejectUnknown(srcName PeerName) bool {
+	if !c.unknownSource(srcName, UnknownPeerReject) {
+		return false
+	}
+	atomic.AddUint64(&c.ourself.router.unknownRejected, 1)
+	c.noteDrop(GossipDropUnknownPeer, 1)
+	return true
+}
+
+// quarantined reports whether gossip from srcName must not be relayed.
+func (c *gossipChannel) quarantined(srcName PeerName) bool {
+	return c.unknownSource(srcName, UnknownPeerQuarantine)
+}
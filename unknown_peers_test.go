@@ -0,0 +1,76 @@
+package mesh
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnknownPeerGossip(t *testing.T) {
+	unknown, err := PeerNameFromString("0f:00:00:0f:00:00")
+	require.NoError(t, err)
+	for _, test := range []struct {
+		policy    UnknownPeerPolicy
+		delivered bool
+		relayed   bool
+		rejected  uint64
+	}{
+		{UnknownPeerAccept, true, true, 0},
+		{UnknownPeerReject, false, false, 2},
+		{UnknownPeerQuarantine, true, false, 0},
+	} {
+		var (
+			lock    sync.Mutex
+			tapped3 []PeerName
+		)
+		tap := func(channel string, src PeerName, n int) {
+			lock.Lock()
+			defer lock.Unlock()
+			tapped3 = append(tapped3, src)
+		}
+		r1 := newTestRouter(t, "01:00:00:01:00:00")
+		r2 := newTestRouterWithConfig(t, "02:00:00:02:00:00", Config{UnknownPeerGossip: test.policy})
+		r3 := newTestRouterWithConfig(t, "03:00:00:03:00:00", Config{GossipTap: tap})
+		routers := []*Router{r1, r2, r3}
+		addTestGossipConnection(t, r1, r2)
+		addTestGossipConnection(t, r2, r3)
+		flushAndCheckTopology(t, routers, r1.tp(r2), r2.tp(r1, r3), r3.tp(r2))
+		g2 := newTestGossiper()
+		_, err := r2.NewGossip("Test", g2)
+		require.NoError(t, err)
+		_, err = r3.NewGossip("Test", newTestGossiper())
+		require.NoError(t, err)
+
+		// r1 relays to r2 a broadcast, and a unicast for r3, from a peer
+		// r2 has never heard of, and then the same from itself
+		channel := r2.gossipChannel("Test")
+		unicast := func(src PeerName) protocolMsg {
+			return protocolMsg{ProtocolGossipUnicast, gobEncodeVersioned(0, channel.name, src, r3.Ourself.Name, []byte{9})}
+		}
+		for _, m := range []protocolMsg{
+			channel.makeBroadcastMsg(unknown, 0, 0, []byte{1}),
+			unicast(unknown),
+			channel.makeBroadcastMsg(r1.Ourself.Name, 0, 0, []byte{2}),
+			unicast(r1.Ourself.Name),
+		} {
+			require.NoError(t, r2.handleGossip(r1.Ourself.Name, m.tag, m.msg))
+		}
+		sendPendingGossip(routers...)
+
+		require.Equal(t, test.delivered, g2.has(1), "policy %d", test.policy)
+		g2.checkHas(t, 2)
+		lock.Lock()
+		relayed := false
+		for _, src := range tapped3 {
+			relayed = relayed || src == unknown
+		}
+		require.Equal(t, test.relayed, relayed, "policy %d", test.policy)
+		require.Contains(t, tapped3, r1.Ourself.Name)
+		lock.Unlock()
+		require.Equal(t, test.rejected, r2.UnknownPeerRejections(), "policy %d", test.policy)
+		for _, r := range routers {
+			r.Stop()
+		}
+	}
+}